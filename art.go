@@ -2,12 +2,18 @@ package art
 
 import (
 	"bytes"
+	"crypto"
 	"crypto/ecdh"
 	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"math"
+	"runtime"
 
 	"github.com/syslab-wm/mu"
 	"golang.org/x/crypto/hkdf"
@@ -15,17 +21,57 @@ import (
 
 const StageKeySize = 32
 
+// maxWorkers caps RecommendWorkers on machines with many CPUs.
+const maxWorkers = 64
+
+// RecommendWorkers returns the number of goroutines to use for independent
+// DHs, such as deriving the members' leaf keys at setup: one per CPU the Go
+// scheduler may use (GOMAXPROCS), between 1 and 64.  The DHs are X25519
+// (see BenchmarkX25519DH for the cost of one); X448 is not offered.
+func RecommendWorkers() int {
+	return max(1, min(runtime.GOMAXPROCS(0), maxWorkers))
+}
+
 func DHKeyGen() (*ecdh.PrivateKey, error) {
 	curve := ecdh.X25519() // multiple invocations of this function return the same value
 	return curve.GenerateKey(rand.Reader)
 }
 
+// DHKeyGenFrom generates an X25519 key from the bytes of r.  Unlike
+// ecdh.Curve.GenerateKey, which may read a variable number of bytes, the
+// result depends only on the next 32 bytes of r, so a deterministic r
+// yields a deterministic key.
+func DHKeyGenFrom(r io.Reader) (*ecdh.PrivateKey, error) {
+	raw := make([]byte, 32)
+	_, err := io.ReadFull(r, raw)
+	if err != nil {
+		return nil, err
+	}
+	return UnmarshalPrivateX25519FromRaw(raw)
+}
+
+// IKKeyGenFrom generates an Ed25519 identity key from the next 32 bytes of r,
+// which are the key's seed; as with DHKeyGenFrom, a deterministic r yields a
+// deterministic key.  If r is nil, crypto/rand is used.
+func IKKeyGenFrom(r io.Reader) (ed25519.PrivateKey, error) {
+	if r == nil {
+		r = rand.Reader
+	}
+	seed := make([]byte, ed25519.SeedSize)
+	_, err := io.ReadFull(r, seed)
+	if err != nil {
+		return nil, err
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
 func KeyExchangeKeyGen() (*ecdh.PrivateKey, error) {
 	return DHKeyGen()
 }
 
 /* the unauthenticated KeyExchange is just SUK^ek or EK^suk */
 func KeyExchange(sk *ecdh.PrivateKey, pk *ecdh.PublicKey) ([]byte, error) {
+	count(dhOperations)
 	return sk.ECDH(pk)
 }
 
@@ -66,6 +112,94 @@ func DeriveStageKey(skInfo *StageKeyInfo) ([]byte, error) {
 	return stageKey, nil
 }
 
+// epochSecretInfo prefixes the HKDF info of the epoch secret.
+const epochSecretInfo = "art epoch secret"
+
+// DeriveEpochSecret derives from skInfo the epoch secret, the secret from
+// which the next stage key is derived in a group whose KDF is
+// KDFHKDFSHA256Epoch.  It is derived from the same input as the stage key,
+// but unlike the stage key it is never given to the application.
+func DeriveEpochSecret(skInfo *StageKeyInfo) ([]byte, error) {
+	info := append([]byte(epochSecretInfo), skInfo.GetInfo()...)
+
+	epochSecret := make([]byte, StageKeySize)
+	_, err := io.ReadFull(hkdf.New(sha256.New, skInfo.GetIKM(), nil, info), epochSecret)
+	if err != nil {
+		return nil, err
+	}
+
+	return epochSecret, nil
+}
+
+// memberKeyInfo prefixes the HKDF info of the keys DeriveMemberKey derives.
+const memberKeyInfo = "art member key"
+
+// DeriveMemberKey derives from the stage key a subkey for the member at
+// position memberIndex, for the purpose named by label: HKDF-SHA256 with
+// the stage key as the secret, and "art member key", the index (a 4-byte
+// big-endian integer) and the label as the info.  Every member can derive
+// the subkey of any member, and the subkeys of different members, or for
+// different labels, are independent.  stageKey is the stage key's seed
+// (StageKeySize bytes) or the expanded key (as in TreeState.Sk); both give
+// the same subkey.
+func DeriveMemberKey(stageKey []byte, memberIndex int, label string) ([]byte, error) {
+	switch len(stageKey) {
+	case StageKeySize:
+	case ed25519.PrivateKeySize:
+		stageKey = ed25519.PrivateKey(stageKey).Seed()
+	default:
+		return nil, fmt.Errorf("stage key is %d bytes; expected %d or %d", len(stageKey),
+			StageKeySize, ed25519.PrivateKeySize)
+	}
+	if memberIndex < 1 || uint64(memberIndex) > math.MaxUint32 {
+		return nil, fmt.Errorf("invalid member index %d", memberIndex)
+	}
+	if label == "" {
+		return nil, errors.New("the label is empty")
+	}
+
+	info := []byte(memberKeyInfo)
+	info = binary.BigEndian.AppendUint32(info, uint32(memberIndex))
+	info = append(info, label...)
+
+	key := make([]byte, StageKeySize)
+	_, err := io.ReadFull(hkdf.New(sha256.New, stageKey, nil, info), key)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// StageKeyEqual reports whether the stage keys a and b are equal, in time
+// that does not depend on their contents.  Keys of different lengths are
+// unequal; the length of a stage key is not secret.
+func StageKeyEqual(a, b []byte) bool {
+	return subtle.ConstantTimeCompare(a, b) == 1
+}
+
+// CombineKeys derives the private key of a node from the private key sk of
+// one of its children and the public key pk of the other, as the suite's
+// CombineDH does: the node's key is the raw X25519 shared secret of sk and
+// pk, with no hashing.  Since X25519 is commutative, it does not matter which
+// child's private key is known: DH(left, right) and DH(right, left) are the
+// same key, so there is no left-first or right-first order to agree on.
+// Implementations that hash the shared secret, or the children's keys in
+// some order, into the node's key derive different trees; their messages
+// name a different combination in the suite, which Suite.Check rejects.
+func CombineKeys(sk *ecdh.PrivateKey, pk *ecdh.PublicKey) (*ecdh.PrivateKey, error) {
+	raw, err := KeyExchange(sk, pk)
+	if err != nil {
+		return nil, fmt.Errorf("ECDH for node failed: %v", err)
+	}
+
+	key, err := UnmarshalPrivateX25519FromRaw(raw)
+	if err != nil {
+		return nil, fmt.Errorf("can't unmarshal private x25519 key for node: %v", err)
+	}
+
+	return key, nil
+}
+
 func PathNodeKeys(leafKey *ecdh.PrivateKey, copathKeys []*ecdh.PublicKey) (
 	[]*ecdh.PrivateKey, error) {
 	pathKeys := make([]*ecdh.PrivateKey, 0)
@@ -73,14 +207,9 @@ func PathNodeKeys(leafKey *ecdh.PrivateKey, copathKeys []*ecdh.PublicKey) (
 
 	// starting at the "bottom" of the copath and working up
 	for i := 0; i < len(copathKeys); i++ {
-		raw, err := pathKeys[i].ECDH(copathKeys[len(copathKeys)-i-1])
+		key, err := CombineKeys(pathKeys[i], copathKeys[len(copathKeys)-i-1])
 		if err != nil {
-			return nil, fmt.Errorf("ECDH for node failed: %v", err)
-		}
-
-		key, err := UnmarshalPrivateX25519FromRaw(raw)
-		if err != nil {
-			return nil, fmt.Errorf("can't unmarshal private x25519 key for node: %v", err)
+			return nil, err
 		}
 
 		pathKeys = append(pathKeys, key)
@@ -93,7 +222,7 @@ func marshallPublicKeys(pathKeys []*ecdh.PrivateKey) [][]byte {
 	marshalledPathKeys := make([][]byte, 0, len(pathKeys))
 
 	for _, key := range pathKeys {
-		marshalledKey, err := MarshalPublicEKToPEM(key.PublicKey())
+		marshalledKey, err := MarshalPublicEKToPEM(PublicOf(key))
 		if err != nil {
 			mu.Fatalf("failed to marshal public EK: %v", err)
 		}
@@ -115,7 +244,7 @@ func CreateUpdateMessage(index int, pathKeys []*ecdh.PrivateKey) UpdateMessage {
 func GetPublicKeys(pathKeys []*ecdh.PrivateKey) []*ecdh.PublicKey {
 	publicPathKeys := make([]*ecdh.PublicKey, 0, len(pathKeys))
 	for _, key := range pathKeys {
-		publicPathKeys = append(publicPathKeys, key.PublicKey())
+		publicPathKeys = append(publicPathKeys, PublicOf(key))
 	}
 	return publicPathKeys
 }
@@ -132,25 +261,262 @@ func UnmarshallPublicKeys(pathKeys [][]byte) []*ecdh.PublicKey {
 	return updatedPathKeys
 }
 
-func SetupGroup(configFile, initiator string) (*TreeState, *SetupMessage) {
+// SetupOptions holds the optional parameters of SetupGroup.  A nil
+// *SetupOptions is the same as the zero value.
+type SetupOptions struct {
+	// Rand is the source of randomness for the initiator's leaf key and
+	// the SUK.  If nil, crypto/rand is used.
+	Rand io.Reader
+
+	// SetupKey, if non-nil, is used as the SUK instead of generating one.
+	SetupKey *ecdh.PrivateKey
+
+	// SignatureScheme is the scheme the initiator will sign the setup
+	// message with (see SignatureScheme and SignatureSchemeOfKeyFile).  If
+	// empty, it is Ed25519.
+	SignatureScheme string
+
+	// Workers is the number of goroutines that derive the members' leaf
+	// keys.  If zero, it is RecommendWorkers().
+	Workers int
+
+	// VerifyAll checks, before SetupGroup returns, that every member derives
+	// the initiator's stage key from the setup message.
+	VerifyAll bool
+
+	// SignedPrekeys requires each member's EK to be signed by the member's
+	// IK (see VerifyPrekeySignature).
+	SignedPrekeys bool
+
+	// LeafMetadata maps member names to the metadata of their leaves (see
+	// SetupMessage.LeafMetadata).  Members that are not in the map get an
+	// empty string; if the map is empty, the setup message has no metadata.
+	LeafMetadata map[string]string
+
+	// TreeOrder is the order of the tree's keys in the setup message (see
+	// PublicNode.MarshalKeysOrder).  If empty, it is OrderLevel, and the
+	// message's suite does not name an order, so that older builds can read
+	// it.
+	TreeOrder string
+
+	// EpochSecret derives, along with each stage key, an epoch secret that
+	// seeds the next stage key in its place (see KDFHKDFSHA256Epoch).  It is
+	// recorded in the message's suite, which older builds reject, rather
+	// than derive stage keys that diverge from the other members'.
+	EpochSecret bool
+
+	// LeafKeys maps member names to leaf keys that the caller supplies
+	// instead of the ones derived as DH(SUK, EK), e.g., keys that the
+	// initiator and the members agreed on in a different key-agreement
+	// step.  Each such member must process the setup message with the same
+	// leaf key; its public key is the member's leaf in the setup message's
+	// tree.
+	LeafKeys map[string]*ecdh.PrivateKey
+
+	// Compact drops the blank leaves of a sparse assignment of INDEXes (see
+	// CompactMembers), placing the members at consecutive positions in
+	// INDEX order.  Setting up a group anew with Compact rebalances a tree
+	// whose blank leaves lengthen its paths.
+	Compact bool
+}
+
+// SetupGroup creates the group described by configFile, with initiator as the
+// initiator (the first member if empty).  It returns the setup message for
+// the other members, along with the initiator's complete tree state: its own
+// leaf key, the public tree, the IKeys, and the stage key.  The initiator
+// therefore does not process its own setup message.  On error, SetupGroup
+// exits; CreateGroup returns the error instead.
+func SetupGroup(configFile, initiator string, opts *SetupOptions) (*TreeState,
+	*SetupMessage) {
+
+	state, setupMsg, err := CreateGroup(configFile, initiator, opts)
+	if err != nil {
+		mu.Fatalf("error: %v", err)
+	}
+	return state, setupMsg
+}
+
+// SetupGroupFromMembers is like SetupGroup, but takes the members (see
+// NewMember), in order, instead of a config file.
+func SetupGroupFromMembers(members []*Member, initiator string,
+	opts *SetupOptions) (*TreeState, *SetupMessage) {
+
+	state, setupMsg, err := CreateGroupFromMembers(members, initiator, opts)
+	if err != nil {
+		mu.Fatalf("error: %v", err)
+	}
+	return state, setupMsg
+}
+
+// CreateGroup is like SetupGroup, but returns an error rather than exiting.
+func CreateGroup(configFile, initiator string, opts *SetupOptions) (*TreeState,
+	*SetupMessage, error) {
+
+	members, err := ReadMembersFromFile(configFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	return CreateGroupFromMembers(members, initiator, opts)
+}
+
+// CreateGroupFromMembers is like SetupGroupFromMembers, but returns an error
+// rather than exiting.
+func CreateGroupFromMembers(members []*Member, initiator string,
+	opts *SetupOptions) (*TreeState, *SetupMessage, error) {
+
+	if opts == nil {
+		opts = &SetupOptions{}
+	}
+	if opts.Compact {
+		members = CompactMembers(members)
+	}
+	if len(members) == 0 {
+		return nil, nil, errors.New("no members in the group")
+	}
 
 	g := &Group{}
-	members := getMembersFromFile(configFile)
+	if opts.SignedPrekeys {
+		if err := verifyPrekeys(members); err != nil {
+			return nil, nil, err
+		}
+	}
 	g.addMembers(members)
 
-	suk := g.generateInitiatorKeys(initiator)
-	leafKeys := g.generateLeafKeys(suk)
+	suk, err := g.generateInitiatorKeys(initiator, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := g.checkSetupKey(suk); err != nil {
+		return nil, nil, err
+	}
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = RecommendWorkers()
+	}
+	leafKeys, err := g.generateLeafKeys(suk, workers)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(opts.LeafKeys) != 0 {
+		if err := g.applyLeafKeys(leafKeys, opts.LeafKeys); err != nil {
+			return nil, nil, err
+		}
+	}
 
-	treeSecret, treePublic := generateTree(leafKeys)
-	setupMsg := g.createSetupMessage(suk.PublicKey(), treePublic)
+	treeSecret, treePublic, err := generateTree(leafKeys)
+	if err != nil {
+		return nil, nil, err
+	}
+	setupMsg, err := g.createSetupMessage(PublicOf(suk), treePublic)
+	if err != nil {
+		return nil, nil, err
+	}
+	if opts.SignatureScheme != "" {
+		setupMsg.Suite.Signature = opts.SignatureScheme
+	}
+	if len(opts.LeafMetadata) != 0 {
+		setupMsg.LeafMetadata, err = g.leafMetadata(opts.LeafMetadata)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if opts.TreeOrder != "" {
+		treeKeys, err := treePublic.MarshalKeysOrder(opts.TreeOrder)
+		if err != nil {
+			return nil, nil, err
+		}
+		setupMsg.TreeKeys = treeKeys
+		setupMsg.Suite.Order = opts.TreeOrder
+	}
+	if opts.EpochSecret {
+		setupMsg.Suite.KDF = KDFHKDFSHA256Epoch
+	}
 
 	var state TreeState
 	state.Lk = g.initiator.leafKey
 	state.PublicTree = treePublic
 	state.IKeys = setupMsg.IKeys
+	state.LeafMetadata = setupMsg.LeafMetadata
 	state.Sk = setupMsg.DeriveStageKey(treeSecret)
+	state.EpochSecret = setupMsg.DeriveEpochSecret(treeSecret)
+	state.extendTranscript(setupMsg.transcriptBytes())
+	state.SetupMessageHash = setupMsg.Hash()
+
+	if opts.VerifyAll {
+		if err := setupMsg.verifyMembers(leafKeys, state.Sk); err != nil {
+			return nil, nil, fmt.Errorf("setup message failed verification: %v", err)
+		}
+	}
 
-	return &state, setupMsg
+	return &state, setupMsg, nil
+}
+
+// verifyMembers checks that each member, whose leaf key is in leafKeys,
+// derives stageKey from the setup message, as ProcessSetupMessage would.  The
+// public tree is rebuilt from the message's TreeKeys, so the check covers the
+// encoding of the tree's shape and order, and not just the initiator's
+// in-memory tree.
+func (sm *SetupMessage) verifyMembers(leafKeys []*ecdh.PrivateKey, stageKey []byte) error {
+	tree := sm.GetPublicTree()
+	for i, leafKey := range leafKeys {
+		state := TreeState{PublicTree: tree, Lk: leafKey, IKeys: sm.IKeys}
+		sk := sm.DeriveStageKey(state.DeriveTreeKey(i + 1))
+		if !StageKeyEqual(sk, stageKey) {
+			return fmt.Errorf("member %d would derive a different stage key", i+1)
+		}
+	}
+	return nil
+}
+
+// OracleStageKey computes the group's stage key directly from every member's
+// private leaf key (leafKeys, in member order), by combining the keys up the
+// tree as the initiator does at setup, rather than from one member's leaf key
+// and copath.  It is an independent reference for the keys that the members
+// derive, for testers and key escrows that hold all the leaf keys.
+//
+// If prevStageKey is nil, the result is the stage key of the setup message
+// sm, and the tree of leafKeys must be sm's tree.  Otherwise, it is the
+// stage key that follows prevStageKey once the members' leaf keys are
+// leafKeys, e.g., after one of them updated; in a group with epoch secrets
+// (see KDFHKDFSHA256Epoch), prevStageKey is the previous epoch secret.
+func OracleStageKey(sm *SetupMessage, leafKeys []*ecdh.PrivateKey,
+	prevStageKey ed25519.PrivateKey) (ed25519.PrivateKey, error) {
+
+	if len(leafKeys) != len(sm.IKeys) {
+		return nil, fmt.Errorf("%d leaf keys for a group of %d members", len(leafKeys),
+			len(sm.IKeys))
+	}
+
+	root, err := CreateTree(leafKeys)
+	if err != nil {
+		return nil, err
+	}
+	tree := root.PublicKeys()
+
+	if prevStageKey == nil {
+		for i, leaf := range sm.GetPublicTree().Leaves() {
+			if !leaf.GetPk().Equal(PublicOf(leafKeys[i])) {
+				return nil, fmt.Errorf("leaf key %d is not member %d's leaf in the "+
+					"setup message's tree", i+1, i+1)
+			}
+		}
+		return sm.DeriveStageKey(root.GetSk()), nil
+	}
+
+	treeKeys, err := tree.MarshalKeys()
+	if err != nil {
+		return nil, err
+	}
+	seed, err := DeriveStageKey(&StageKeyInfo{
+		PrevStageKey:  prevStageKey,
+		TreeSecretKey: root.GetSk().Bytes(),
+		IKeys:         sm.IKeys,
+		TreeKeys:      treeKeys,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
 }
 
 func ProcessSetupMessage(index int, privEKFile, setupMsgFile, initiatorPubIKFile,
@@ -158,49 +524,37 @@ func ProcessSetupMessage(index int, privEKFile, setupMsgFile, initiatorPubIKFile
 
 	VerifyMessageSignature(initiatorPubIKFile, setupMsgFile, sigFile)
 
-	var state TreeState
 	var setupMsg SetupMessage
 	setupMsg.Read(setupMsgFile)
+	if err := setupMsg.Validate(); err != nil {
+		mu.Fatalf("error: invalid setup message:\n%v", err)
+	}
+	if err := setupMsg.CheckPrivateEK(index, privEKFile); err != nil {
+		mu.Fatalf("error: %v", err)
+	}
 	suk := setupMsg.GetSetupKey()
-	state.PublicTree = setupMsg.GetPublicTree()
-	state.Lk = DeriveLeafKeyOrFail(privEKFile, suk)
-	state.IKeys = setupMsg.IKeys
-
-	treeSecret := state.DeriveTreeKey(index)
-	state.Sk = setupMsg.DeriveStageKey(treeSecret)
+	leafKey := DeriveLeafKeyOrFail(privEKFile, suk)
 
-	return &state
+	return setupMsg.NewTreeState(index, leafKey)
 }
 
 func UpdateKey(index int, treeStateFile string) (*UpdateMessage,
 	*TreeState, *ed25519.PrivateKey) {
 
-	var err error
-	var state TreeState
-
-	state.Read(treeStateFile)
-
-	// create a new leaf key
-	state.Lk, err = DHKeyGen()
-	if err != nil {
-		mu.Fatalf("error creating the new leaf key: %v", err)
-	}
-
-	pathKeys := UpdateCoPathNodes(index, &state)
-	treeSecret := pathKeys[len(pathKeys)-1]
-
-	publicPathKeys := GetPublicKeys(pathKeys)
+	return UpdateKeyFrom(index, treeStateFile, nil)
+}
 
-	updateMsg := CreateUpdateMessage(index, pathKeys)
+// UpdateKeyFrom is like UpdateKey, but generates the new leaf key from the
+// bytes of r (see TreeState.UpdateKeyFrom).
+func UpdateKeyFrom(index int, treeStateFile string, r io.Reader) (*UpdateMessage,
+	*TreeState, *ed25519.PrivateKey) {
 
-	// replace the updated nodes in the full tree representation
-	state.PublicTree = UpdatePublicTree(publicPathKeys, state.PublicTree,
-		index)
+	var state TreeState
+	state.Read(treeStateFile)
 
-	prevStageKey := state.Sk
-	state.DeriveStageKey(treeSecret)
+	updateMsg, prevStageKey := state.UpdateKeyFrom(index, r)
 
-	return &updateMsg, &state, &prevStageKey
+	return updateMsg, &state, &prevStageKey
 }
 
 func ProcessUpdateMessage(index int, treeStateFile, updateMsgFile, macFile string) *TreeState {
@@ -213,16 +567,116 @@ func ProcessUpdateMessage(index int, treeStateFile, updateMsgFile, macFile strin
 
 	updateMsg.VerifyUpdateMessage(state.Sk, macFile)
 
-	updatedPathKeys := UnmarshallPublicKeys(updateMsg.PathPublicKeys)
+	state.ProcessUpdateMessage(index, &updateMsg)
 
-	// replace the updated nodes in the full tree representation
-	state.PublicTree = UpdatePublicTree(updatedPathKeys, state.PublicTree,
-		updateMsg.Idx)
+	return &state
+}
 
-	pathKeys := UpdateCoPathNodes(index, &state)
-	treeSecret := pathKeys[len(pathKeys)-1]
+// ProcessSetupMessageBytes is the in-memory counterpart of
+// ProcessSetupMessage: it verifies the encoded setup message msg against the
+// initiator's signature sig with initiatorIK, and derives the tree state of
+// the member at position index, whose private EK is ek.  Unlike
+// ProcessSetupMessage, it returns an error rather than exiting.
+func ProcessSetupMessageBytes(index int, ek *ecdh.PrivateKey, msg, sig []byte,
+	initiatorIK crypto.PublicKey) (*TreeState, error) {
 
-	state.DeriveStageKey(treeSecret)
+	if err := CheckSignatureFormat(initiatorIK, sig); err != nil {
+		return nil, err
+	}
+	count(signatureVerifications)
+	if !Verify(initiatorIK, msg, sig) {
+		count(signatureFailures)
+		return nil, errors.New("message signature verification failed")
+	}
 
-	return &state
+	setupMsg, err := DecodeSetupMessage(msg)
+	if err != nil {
+		return nil, fmt.Errorf("can't decode setup message: %v", err)
+	}
+	setupMsg.raw = msg
+	if err := setupMsg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid setup message:\n%v", err)
+	}
+	if err := setupMsg.checkEK(index, ek); err != nil {
+		return nil, err
+	}
+
+	leafKey, err := DeriveLeafKeyFromEK(ek, setupMsg.GetSetupKey())
+	if err != nil {
+		return nil, err
+	}
+
+	return setupMsg.NewTreeState(index, leafKey), nil
+}
+
+// ProcessUpdateMessageBytes is the in-memory counterpart of
+// ProcessUpdateMessage: it verifies the encoded update message msg against
+// its MAC mac with the state's stage key, and applies it to the state of the
+// member at position index.  On error, the state is unchanged.
+func ProcessUpdateMessageBytes(state *TreeState, index int, msg, mac []byte) error {
+	updateMsg, err := DecodeUpdateMessage(msg)
+	if err != nil {
+		return fmt.Errorf("can't decode update message: %v", err)
+	}
+	if !updateMsg.macValid(state.Sk, mac) {
+		return errors.New("update message failed to pass signature verification")
+	}
+	if err := updateMsg.check(state.PublicTree); err != nil {
+		return fmt.Errorf("invalid update message: %v", err)
+	}
+
+	state.ProcessUpdateMessage(index, updateMsg)
+	return nil
+}
+
+// A TranscriptUpdate is an encoded update message along with its MAC.
+type TranscriptUpdate struct {
+	Msg []byte
+	MAC []byte
+}
+
+// ValidateTranscript replays a group's history as the member at position
+// index, whose private EK is ek: it processes the setup message setupMsg,
+// with the initiator's signature setupSig by initiatorIK (see
+// ProcessSetupMessageBytes), and then each of the updates, in order,
+// verifying each update's MAC and that its epoch follows the one before.  It
+// returns the final stage key, or the first error.  The member must not be
+// the updater of any of the updates, since its new leaf keys are not part of
+// the transcript.
+//
+// Epoch continuity rests on the MACs, not on the updates' epochs: each
+// update is MAC'd under the stage key it replaces, so an update that is
+// missing or out of order fails its MAC check.  UpdateMessage.Epoch is not
+// MAC'd, and is 0 in messages from older builds, so it is not enforced on
+// its own; it only lets a missing or out-of-order update be reported as
+// such rather than as a bad MAC.
+func ValidateTranscript(index int, ek *ecdh.PrivateKey, setupMsg, setupSig []byte,
+	initiatorIK crypto.PublicKey, updates []TranscriptUpdate) (ed25519.PrivateKey, error) {
+
+	state, err := ProcessSetupMessageBytes(index, ek, setupMsg, setupSig, initiatorIK)
+	if err != nil {
+		return nil, fmt.Errorf("setup message: %v", err)
+	}
+
+	for i, update := range updates {
+		updateMsg, err := DecodeUpdateMessage(update.Msg)
+		if err != nil {
+			return nil, fmt.Errorf("update %d: can't decode update message: %v", i+1, err)
+		}
+		if updateMsg.Epoch != 0 && updateMsg.Epoch != state.Epoch+1 {
+			return nil, fmt.Errorf("update %d is for epoch %d, but follows epoch %d; "+
+				"an update is missing or out of order", i+1, updateMsg.Epoch, state.Epoch)
+		}
+		if updateMsg.Idx == index {
+			return nil, fmt.Errorf("update %d is by member %d, which is replaying the "+
+				"transcript", i+1, index)
+		}
+
+		err = ProcessUpdateMessageBytes(state, index, update.Msg, update.MAC)
+		if err != nil {
+			return nil, fmt.Errorf("update %d: %v", i+1, err)
+		}
+	}
+
+	return state.Sk, nil
 }
@@ -0,0 +1,314 @@
+package art
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"encoding/hex"
+	"fmt"
+	"runtime"
+	"testing"
+)
+
+// The X25519 test vector of RFC 7748, section 6.1: Alice's and Bob's key
+// pairs and their shared secret.
+const (
+	rfc7748AlicePriv = "77076d0a7318a57d3c16c17251b26645df4c2f87ebc0992ab177fba51db92c2a"
+	rfc7748AlicePub  = "8520f0098930a754748b7ddcb43ef75a0dbf3a0d26381af4eba4a98eaa9b4e6a"
+	rfc7748BobPriv   = "5dab087e624a8a4b79e17f8b83800ee66f3bb1292618b6fd1c2f8b27ff88e0eb"
+	rfc7748BobPub    = "de9edb7d7b7dc1b4d35b61c2ece435373f8343c85b78674dadfc7e146f882b4f"
+	rfc7748Shared    = "4a5d9d5ba4ce2de1728e3bf480350f25e07e21c947d19e3376f09b3c1e161742"
+)
+
+func hexPrivateKey(t *testing.T, s string) *ecdh.PrivateKey {
+	t.Helper()
+	raw, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ecdh.X25519().NewPrivateKey(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func hexPublicKey(t *testing.T, s string) *ecdh.PublicKey {
+	t.Helper()
+	raw, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ecdh.X25519().NewPublicKey(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// TestCombineKeysVector checks CombineDH against the RFC 7748 vector: a
+// node's private key is the children's raw shared secret, whichever child's
+// private key is known.
+func TestCombineKeysVector(t *testing.T) {
+	tests := []struct {
+		name string
+		sk   string
+		pk   string
+	}{
+		{"left private", rfc7748AlicePriv, rfc7748BobPub},
+		{"right private", rfc7748BobPriv, rfc7748AlicePub},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, err := CombineKeys(hexPrivateKey(t, tt.sk), hexPublicKey(t, tt.pk))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := hex.EncodeToString(key.Bytes()); got != rfc7748Shared {
+				t.Errorf("got node key %s, want %s", got, rfc7748Shared)
+			}
+		})
+	}
+}
+
+// TestPathNodeKeysVector checks the path keys of a leaf at depth 2: the
+// copath is given from the root's child down, and combined from the bottom
+// up.
+func TestPathNodeKeysVector(t *testing.T) {
+	leafKey := hexPrivateKey(t, rfc7748AlicePriv)
+	copath := []*ecdh.PublicKey{
+		hexPublicKey(t, rfc7748AlicePub), // the root's other child
+		hexPublicKey(t, rfc7748BobPub),   // the leaf's sibling
+	}
+
+	want := []string{
+		rfc7748AlicePriv,
+		// DH(leaf, sibling)
+		rfc7748Shared,
+		// DH(DH(leaf, sibling), the root's other child)
+		"eb3577b69a108d694ef3e4f9f636e7cb327916574dc3f4b7db2fdb4f9009f859",
+	}
+
+	pathKeys, err := PathNodeKeys(leafKey, copath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pathKeys) != len(want) {
+		t.Fatalf("got %d path keys, want %d", len(pathKeys), len(want))
+	}
+	for i, key := range pathKeys {
+		if got := hex.EncodeToString(key.Bytes()); got != want[i] {
+			t.Errorf("path key %d: got %s, want %s", i, got, want[i])
+		}
+	}
+}
+
+func TestKeyGenFromDeterministic(t *testing.T) {
+	seed := make([]byte, 64)
+	if _, err := testReader("key gen from").Read(seed); err != nil {
+		t.Fatal(err)
+	}
+
+	ek1, err := DHKeyGenFrom(bytes.NewReader(seed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ek2, err := DHKeyGenFrom(bytes.NewReader(seed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ek1.Equal(ek2) {
+		t.Error("DHKeyGenFrom gave different keys from the same bytes")
+	}
+	ek3, err := DHKeyGenFrom(bytes.NewReader(seed[32:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ek1.Equal(ek3) {
+		t.Error("DHKeyGenFrom gave the same key from different bytes")
+	}
+
+	ik1, err := IKKeyGenFrom(bytes.NewReader(seed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ik2, err := IKKeyGenFrom(bytes.NewReader(seed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ik1.Equal(ik2) {
+		t.Error("IKKeyGenFrom gave different keys from the same bytes")
+	}
+
+	if _, err := DHKeyGenFrom(bytes.NewReader(seed[:31])); err == nil {
+		t.Error("DHKeyGenFrom accepted 31 bytes")
+	}
+	if _, err := IKKeyGenFrom(bytes.NewReader(seed[:31])); err == nil {
+		t.Error("IKKeyGenFrom accepted 31 bytes")
+	}
+}
+
+// TestSetupRandDeterministic checks that two setups of the same group, with
+// SetupOptions.Rand reading the same bytes, give the same SUK, initiator leaf
+// key, and stage key.
+func TestSetupRandDeterministic(t *testing.T) {
+	members, _, _ := testMembers(t, 4, testReader("setup rand"))
+	seed := make([]byte, 64)
+	if _, err := testReader("setup rand seed").Read(seed); err != nil {
+		t.Fatal(err)
+	}
+
+	var states []*TreeState
+	var setupMsgs []*SetupMessage
+	for i := 0; i < 2; i++ {
+		state, setupMsg, err := CreateGroupFromMembers(members, "",
+			&SetupOptions{Rand: bytes.NewReader(seed)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		states = append(states, state)
+		setupMsgs = append(setupMsgs, setupMsg)
+	}
+
+	if !bytes.Equal(setupMsgs[0].Suk, setupMsgs[1].Suk) {
+		t.Error("the SUKs differ")
+	}
+	if !states[0].Lk.Equal(states[1].Lk) {
+		t.Error("the initiator's leaf keys differ")
+	}
+	if !StageKeyEqual(states[0].Sk, states[1].Sk) {
+		t.Error("the stage keys differ")
+	}
+
+	// the initiator's leaf key is drawn first, and then the SUK
+	other := bytes.Clone(seed)
+	other[40] ^= 1
+	_, setupMsg, err := CreateGroupFromMembers(members, "",
+		&SetupOptions{Rand: bytes.NewReader(other)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(setupMsg.Suk, setupMsgs[0].Suk) {
+		t.Error("the SUK does not depend on the reader's bytes")
+	}
+}
+
+func TestStageKeyEqual(t *testing.T) {
+	g := newTestGroup(t, "stage key equal", 2, nil)
+	sk := g.states[0].Sk
+	flipped := bytes.Clone(sk)
+	flipped[len(flipped)-1] ^= 1
+
+	tests := []struct {
+		name string
+		a, b []byte
+		want bool
+	}{
+		{"equal", sk, g.states[1].Sk, true},
+		{"same length", sk, flipped, false},
+		{"seed only", sk, sk.Seed(), false},
+		{"longer", sk, append(bytes.Clone(sk), 0), false},
+		{"empty", sk, nil, false},
+		{"both empty", nil, []byte{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := StageKeyEqual(tt.a, tt.b); got != tt.want {
+				t.Errorf("StageKeyEqual = %v, want %v", got, tt.want)
+			}
+			if got := StageKeyEqual(tt.b, tt.a); got != tt.want {
+				t.Errorf("StageKeyEqual, swapped = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestDeriveMemberKey checks that every member derives the same subkey for a
+// given member, that the subkeys of different members and labels differ, and
+// that the seed and the expanded stage key give the same subkeys.
+func TestDeriveMemberKey(t *testing.T) {
+	const n = 4
+	g := newTestGroup(t, "derive member key", n, nil)
+
+	seen := make(map[string]string)
+	for _, label := range []string{"sender", "receiver"} {
+		for index := 1; index <= n; index++ {
+			want, err := DeriveMemberKey(g.states[0].Sk, index, label)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, state := range g.states {
+				for _, sk := range [][]byte{state.Sk, state.Sk.Seed()} {
+					got, err := DeriveMemberKey(sk, index, label)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if !bytes.Equal(got, want) {
+						t.Errorf("member %d derived another %q key for member %d from a "+
+							"%d-byte stage key", i+1, label, index, len(sk))
+					}
+				}
+			}
+
+			name := fmt.Sprintf("%q key of member %d", label, index)
+			if other, ok := seen[string(want)]; ok {
+				t.Errorf("the %s is the %s", name, other)
+			}
+			seen[string(want)] = name
+		}
+	}
+
+	sk := g.states[0].Sk
+	for _, tt := range []struct {
+		name  string
+		sk    []byte
+		index int
+		label string
+	}{
+		{"index 0", sk, 0, "sender"},
+		{"negative index", sk, -1, "sender"},
+		{"empty label", sk, 1, ""},
+		{"short stage key", sk[:StageKeySize-1], 1, "sender"},
+	} {
+		if _, err := DeriveMemberKey(tt.sk, tt.index, tt.label); err == nil {
+			t.Errorf("%s: DeriveMemberKey succeeded", tt.name)
+		}
+	}
+}
+
+// TestRecommendWorkers checks that RecommendWorkers is between 1 and
+// maxWorkers, and follows GOMAXPROCS within those bounds.
+func TestRecommendWorkers(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(0))
+	for _, procs := range []int{1, 2, 7, maxWorkers, maxWorkers + 1, 4 * maxWorkers} {
+		runtime.GOMAXPROCS(procs)
+		n := RecommendWorkers()
+		if n < 1 || n > maxWorkers {
+			t.Errorf("GOMAXPROCS %d: got %d workers, want between 1 and %d", procs, n,
+				maxWorkers)
+		}
+		if want := min(procs, maxWorkers); n != want {
+			t.Errorf("GOMAXPROCS %d: got %d workers, want %d", procs, n, want)
+		}
+	}
+}
+
+// BenchmarkX25519DH measures a single X25519 DH, the unit of work of
+// RecommendWorkers' workers.
+func BenchmarkX25519DH(b *testing.B) {
+	r := testReader("x25519 dh")
+	sk, err := DHKeyGenFrom(r)
+	if err != nil {
+		b.Fatal(err)
+	}
+	pk, err := DHKeyGenFrom(r)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := KeyExchange(sk, pk.PublicKey()); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,350 @@
+package art
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// The binary encoding of a SetupMessage is:
+//
+//	magic    "ARTS"
+//	version  byte (1 to 5)
+//	iKeys    list of raw Ed25519 public keys
+//	eKeys    list of raw X25519 public keys
+//	suk      raw X25519 public key (empty if absent)
+//	treeKeys list of raw X25519 public keys
+//	suite    version 2 and later only: the curve, signature and KDF
+//	         names, as three byte strings, in version 3 and later, the
+//	         combination name as a fourth, and in version 5, the tree key
+//	         order as a fifth
+//	metadata version 4 and later only: the leaf metadata, a list
+//
+// A list is a uvarint count followed by that many byte strings, and a byte
+// string is a uvarint length followed by that many bytes.  A message without
+// a suite is encoded as version 1, and one whose suite does not name a
+// combination as version 2; only a message with leaf metadata is encoded as
+// version 4, which requires a suite, and only one whose suite names a tree
+// key order as version 5.  Keys are stored
+// raw rather than PEM-encoded; converting between the two encodings is
+// lossless because the PEM encoding of a key is canonical.
+
+var setupMessageMagic = []byte("ARTS")
+
+const (
+	setupMessageBinaryVersion        = 1
+	setupMessageBinaryVersionSuite   = 2
+	setupMessageBinaryVersionCombine = 3
+	setupMessageBinaryVersionMeta    = 4
+	setupMessageBinaryVersionOrder   = 5
+)
+
+type keyCodec struct {
+	toRaw   func(pem []byte) ([]byte, error)
+	fromRaw func(raw []byte) ([]byte, error)
+}
+
+var ikCodec = keyCodec{
+	toRaw: func(pem []byte) ([]byte, error) {
+		key, err := UnmarshalPublicIKFromPEM(pem)
+		if err != nil {
+			return nil, err
+		}
+		return MarshalPublicIKToRaw(key)
+	},
+	fromRaw: func(raw []byte) ([]byte, error) {
+		key, err := UnmarshalPublicIKFromRaw(raw)
+		if err != nil {
+			return nil, err
+		}
+		return MarshalPublicIKToPEM(key)
+	},
+}
+
+var ekCodec = keyCodec{
+	toRaw: func(pem []byte) ([]byte, error) {
+		key, err := UnmarshalPublicEKFromPEM(pem)
+		if err != nil {
+			return nil, err
+		}
+		return MarshalPublicEKToRaw(key)
+	},
+	fromRaw: func(raw []byte) ([]byte, error) {
+		key, err := UnmarshalPublicEKFromRaw(raw)
+		if err != nil {
+			return nil, err
+		}
+		return MarshalPublicEKToPEM(key)
+	},
+}
+
+func putBytes(buf *bytes.Buffer, data []byte) {
+	buf.Write(binary.AppendUvarint(nil, uint64(len(data))))
+	buf.Write(data)
+}
+
+func putKeys(buf *bytes.Buffer, keys [][]byte, codec keyCodec) error {
+	buf.Write(binary.AppendUvarint(nil, uint64(len(keys))))
+	for i, pem := range keys {
+		// the empty key of a blank leaf is encoded as is
+		if len(pem) == 0 {
+			putBytes(buf, nil)
+			continue
+		}
+		raw, err := codec.toRaw(pem)
+		if err != nil {
+			return fmt.Errorf("key #%d: %v", i+1, err)
+		}
+		putBytes(buf, raw)
+	}
+	return nil
+}
+
+func putStrings(buf *bytes.Buffer, list []string) {
+	buf.Write(binary.AppendUvarint(nil, uint64(len(list))))
+	for _, s := range list {
+		putBytes(buf, []byte(s))
+	}
+}
+
+func getBytes(r *bytes.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if n > uint64(r.Len()) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	data := make([]byte, n)
+	_, err = io.ReadFull(r, data)
+	return data, err
+}
+
+func getKeys(r *bytes.Reader, codec keyCodec) ([][]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if n > uint64(r.Len()) {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	keys := make([][]byte, 0, n)
+	for i := uint64(0); i < n; i++ {
+		raw, err := getBytes(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(raw) == 0 {
+			keys = append(keys, []byte{})
+			continue
+		}
+		pem, err := codec.fromRaw(raw)
+		if err != nil {
+			return nil, fmt.Errorf("key #%d: %v", i+1, err)
+		}
+		keys = append(keys, pem)
+	}
+	return keys, nil
+}
+
+func getStrings(r *bytes.Reader) ([]string, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if n > uint64(r.Len()) {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	list := make([]string, 0, n)
+	for i := uint64(0); i < n; i++ {
+		s, err := getBytes(r)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, string(s))
+	}
+	return list, nil
+}
+
+// MarshalBinary returns the binary encoding of the setup message.
+func (sm *SetupMessage) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+
+	var version byte
+	switch {
+	case sm.Suite != nil && sm.Suite.Order != "":
+		version = setupMessageBinaryVersionOrder
+	case len(sm.LeafMetadata) != 0:
+		if sm.Suite == nil {
+			return nil, errors.New("can't encode leaf metadata without a suite")
+		}
+		version = setupMessageBinaryVersionMeta
+	case sm.Suite == nil:
+		version = setupMessageBinaryVersion
+	case sm.Suite.Combine == "":
+		version = setupMessageBinaryVersionSuite
+	default:
+		version = setupMessageBinaryVersionCombine
+	}
+	buf.Write(setupMessageMagic)
+	buf.WriteByte(version)
+
+	if err := putKeys(&buf, sm.IKeys, ikCodec); err != nil {
+		return nil, fmt.Errorf("can't encode IKeys: %v", err)
+	}
+	if err := putKeys(&buf, sm.EKeys, ekCodec); err != nil {
+		return nil, fmt.Errorf("can't encode EKeys: %v", err)
+	}
+
+	var suk []byte
+	if len(sm.Suk) != 0 {
+		var err error
+		suk, err = ekCodec.toRaw(sm.Suk)
+		if err != nil {
+			return nil, fmt.Errorf("can't encode SUK: %v", err)
+		}
+	}
+	putBytes(&buf, suk)
+
+	if err := putKeys(&buf, sm.TreeKeys, ekCodec); err != nil {
+		return nil, fmt.Errorf("can't encode tree keys: %v", err)
+	}
+
+	if sm.Suite != nil {
+		putBytes(&buf, []byte(sm.Suite.Curve))
+		putBytes(&buf, []byte(sm.Suite.Signature))
+		putBytes(&buf, []byte(sm.Suite.KDF))
+		if version >= setupMessageBinaryVersionCombine {
+			putBytes(&buf, []byte(sm.Suite.Combine))
+		}
+		if version >= setupMessageBinaryVersionOrder {
+			putBytes(&buf, []byte(sm.Suite.Order))
+		}
+	}
+	if version >= setupMessageBinaryVersionMeta {
+		putStrings(&buf, sm.LeafMetadata)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary decodes a setup message produced by MarshalBinary.
+func (sm *SetupMessage) UnmarshalBinary(data []byte) error {
+	var msg SetupMessage
+	var err error
+
+	if !IsBinarySetupMessage(data) {
+		return errors.New("not a binary setup message")
+	}
+
+	r := bytes.NewReader(data[len(setupMessageMagic):])
+	version, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+	if version < setupMessageBinaryVersion || version > setupMessageBinaryVersionOrder {
+		return fmt.Errorf("unsupported binary setup message version %d", version)
+	}
+
+	if msg.IKeys, err = getKeys(r, ikCodec); err != nil {
+		return fmt.Errorf("can't decode IKeys: %v", err)
+	}
+	if msg.EKeys, err = getKeys(r, ekCodec); err != nil {
+		return fmt.Errorf("can't decode EKeys: %v", err)
+	}
+
+	suk, err := getBytes(r)
+	if err != nil {
+		return fmt.Errorf("can't decode SUK: %v", err)
+	}
+	if len(suk) != 0 {
+		if msg.Suk, err = ekCodec.fromRaw(suk); err != nil {
+			return fmt.Errorf("can't decode SUK: %v", err)
+		}
+	}
+
+	if msg.TreeKeys, err = getKeys(r, ekCodec); err != nil {
+		return fmt.Errorf("can't decode tree keys: %v", err)
+	}
+
+	if version >= setupMessageBinaryVersionSuite {
+		names := make([][]byte, 3, 5)
+		if version >= setupMessageBinaryVersionCombine {
+			names = names[:4]
+		}
+		if version >= setupMessageBinaryVersionOrder {
+			names = names[:5]
+		}
+		for i := range names {
+			if names[i], err = getBytes(r); err != nil {
+				return fmt.Errorf("can't decode suite: %v", err)
+			}
+		}
+		msg.Suite = &Suite{
+			Curve:     string(names[0]),
+			Signature: string(names[1]),
+			KDF:       string(names[2]),
+		}
+		if version >= setupMessageBinaryVersionCombine {
+			msg.Suite.Combine = string(names[3])
+		}
+		if version >= setupMessageBinaryVersionOrder {
+			msg.Suite.Order = string(names[4])
+		}
+	}
+
+	if version >= setupMessageBinaryVersionMeta {
+		if msg.LeafMetadata, err = getStrings(r); err != nil {
+			return fmt.Errorf("can't decode leaf metadata: %v", err)
+		}
+	}
+
+	// the signature covers the whole file, but reject bytes after the
+	// message all the same, so that a message has a single encoding
+	if r.Len() != 0 {
+		return fmt.Errorf("%d bytes of trailing data after the message", r.Len())
+	}
+
+	*sm = msg
+	return nil
+}
+
+// IsBinarySetupMessage reports whether data looks like a binary-encoded
+// setup message (as opposed to a JSON-encoded one).
+func IsBinarySetupMessage(data []byte) bool {
+	return bytes.HasPrefix(data, setupMessageMagic)
+}
+
+// BinarySetupMessageVersion returns the version of the binary encoding of
+// the binary-encoded setup message data.
+func BinarySetupMessageVersion(data []byte) (int, error) {
+	if !IsBinarySetupMessage(data) || len(data) == len(setupMessageMagic) {
+		return 0, errors.New("not a binary setup message")
+	}
+	return int(data[len(setupMessageMagic)]), nil
+}
+
+// DecodeSetupMessage decodes a setup message in either the JSON or the
+// binary encoding; the encoding is detected automatically.
+func DecodeSetupMessage(data []byte) (*SetupMessage, error) {
+	var sm SetupMessage
+
+	if IsBinarySetupMessage(data) {
+		err := sm.UnmarshalBinary(data)
+		if err != nil {
+			return nil, err
+		}
+		return &sm, nil
+	}
+
+	err := json.Unmarshal(data, &sm)
+	if err != nil {
+		return nil, err
+	}
+	return &sm, nil
+}
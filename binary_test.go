@@ -0,0 +1,155 @@
+package art
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/syslab-wm/art/internal/jsonutl"
+)
+
+// TestSetupMessageEncodings checks that the JSON and the binary encoding of
+// a setup message decode to the same message, for each version of the
+// binary encoding.
+func TestSetupMessageEncodings(t *testing.T) {
+	g := newTestGroup(t, "setup message encodings", 5, nil)
+
+	tests := []struct {
+		name    string
+		version int
+		change  func(sm *SetupMessage)
+	}{
+		{"no suite", setupMessageBinaryVersion, func(sm *SetupMessage) { sm.Suite = nil }},
+		{"suite without combination", setupMessageBinaryVersionSuite,
+			func(sm *SetupMessage) { sm.Suite.Combine = "" }},
+		{"default suite", setupMessageBinaryVersionCombine, func(sm *SetupMessage) {}},
+		{"leaf metadata", setupMessageBinaryVersionMeta, func(sm *SetupMessage) {
+			sm.LeafMetadata = []string{"a", "", "c", "d", "e"}
+		}},
+		{"tree key order", setupMessageBinaryVersionOrder, func(sm *SetupMessage) {
+			sm.Suite.Order = OrderIn
+			sm.LeafMetadata = []string{"a", "", "c", "d", "e"}
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm := *g.setupMsg
+			suite := *g.setupMsg.Suite
+			sm.Suite = &suite
+			tt.change(&sm)
+
+			jsonData, err := jsonutl.Marshal(&sm)
+			if err != nil {
+				t.Fatal(err)
+			}
+			binData, err := sm.MarshalBinary()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if version, err := BinarySetupMessageVersion(binData); err != nil ||
+				version != tt.version {
+				t.Errorf("got binary version %d (error %v), want %d", version, err,
+					tt.version)
+			}
+
+			fromJSON, err := DecodeSetupMessage(jsonData)
+			if err != nil {
+				t.Fatalf("decoding JSON: %v", err)
+			}
+			fromBinary, err := DecodeSetupMessage(binData)
+			if err != nil {
+				t.Fatalf("decoding binary: %v", err)
+			}
+			if !reflect.DeepEqual(fromJSON, fromBinary) {
+				t.Error("the JSON and binary encodings decode to different messages")
+			}
+			if !reflect.DeepEqual(fromBinary, &sm) {
+				t.Error("the binary encoding does not decode to the original message")
+			}
+		})
+	}
+}
+
+func TestUnmarshalBinaryRejects(t *testing.T) {
+	g := newTestGroup(t, "unmarshal binary rejects", 3, nil)
+	data, err := g.setupMsg.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"magic only", setupMessageMagic},
+		{"unknown version", append(append([]byte(nil), setupMessageMagic...), 99)},
+		{"truncated", data[:len(data)-1]},
+		{"trailing data", append(append([]byte(nil), data...), 0)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sm SetupMessage
+			if err := sm.UnmarshalBinary(tt.data); err == nil {
+				t.Error("UnmarshalBinary accepted the data")
+			}
+		})
+	}
+}
+
+// encodingBenchSizes are the group sizes of the encoding benchmarks.
+var encodingBenchSizes = []int{16, 256, 4096, 65536}
+
+// setupMessageCodecs are the encodings of a setup message, for the
+// benchmarks: the JSON is indented, as in the files that setup_group writes.
+var setupMessageCodecs = []struct {
+	name   string
+	encode func(sm *SetupMessage) ([]byte, error)
+}{
+	{"json", func(sm *SetupMessage) ([]byte, error) { return jsonutl.Marshal(sm) }},
+	{"binary", (*SetupMessage).MarshalBinary},
+}
+
+// BenchmarkSetupMessageEncode reports the time to encode a setup message of
+// each size in each encoding, and the size of the encoding.
+func BenchmarkSetupMessageEncode(b *testing.B) {
+	for _, n := range encodingBenchSizes {
+		sm := syntheticSetupMessage(b, n)
+		for _, codec := range setupMessageCodecs {
+			b.Run(fmt.Sprintf("%s/members=%d", codec.name, n), func(b *testing.B) {
+				var data []byte
+				for i := 0; i < b.N; i++ {
+					var err error
+					if data, err = codec.encode(sm); err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.ReportMetric(float64(len(data)), "bytes")
+			})
+		}
+	}
+}
+
+// BenchmarkSetupMessageDecode reports the time to decode a setup message of
+// each size from each encoding, and the size of the encoding.
+func BenchmarkSetupMessageDecode(b *testing.B) {
+	for _, n := range encodingBenchSizes {
+		sm := syntheticSetupMessage(b, n)
+		for _, codec := range setupMessageCodecs {
+			data, err := codec.encode(sm)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.Run(fmt.Sprintf("%s/members=%d", codec.name, n), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					if _, err := DecodeSetupMessage(data); err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.ReportMetric(float64(len(data)), "bytes")
+			})
+		}
+	}
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/syslab-wm/art"
+	"github.com/syslab-wm/mu"
+)
+
+const prompt = "art> "
+
+type shell struct {
+	setupMsg  *art.SetupMessage
+	initiator int
+	states    map[int]*art.TreeState // keyed by member index
+
+	maxDepth int // the default MAX_DEPTH of the tree command
+	levels   int // if nonzero, show trees level by level, to this many levels
+}
+
+func (sh *shell) requireSetup() error {
+	if sh.setupMsg == nil {
+		return fmt.Errorf("no group; run setup first")
+	}
+	return nil
+}
+
+func (sh *shell) numMembers() int {
+	return len(sh.setupMsg.IKeys)
+}
+
+func (sh *shell) parseIndex(arg string) (int, error) {
+	index, err := strconv.Atoi(arg)
+	if err != nil {
+		return 0, fmt.Errorf("invalid INDEX %q", arg)
+	}
+	if index < 1 || index > sh.numMembers() {
+		return 0, fmt.Errorf("INDEX must be between 1 and %d", sh.numMembers())
+	}
+	return index, nil
+}
+
+func (sh *shell) sortedIndices() []int {
+	indices := make([]int, 0, len(sh.states))
+	for index := range sh.states {
+		indices = append(indices, index)
+	}
+	sort.Ints(indices)
+	return indices
+}
+
+func (sh *shell) setup(args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return fmt.Errorf("usage: setup CONFIG_FILE [INITIATOR]")
+	}
+
+	initiator := ""
+	if len(args) == 2 {
+		initiator = args[1]
+	}
+
+	state, setupMsg, err := art.CreateGroup(args[0], initiator, nil)
+	if err != nil {
+		return err
+	}
+
+	sh.initiator = state.LeafIndex()
+	sh.setupMsg = setupMsg
+	sh.states = map[int]*art.TreeState{sh.initiator: state}
+
+	fmt.Printf("group of %d members created; initiator is at index %d\n",
+		sh.numMembers(), sh.initiator)
+	return nil
+}
+
+func (sh *shell) join(args []string) error {
+	if err := sh.requireSetup(); err != nil {
+		return err
+	}
+	if len(args) != 2 {
+		return fmt.Errorf("usage: join INDEX PRIV_EK_FILE")
+	}
+
+	index, err := sh.parseIndex(args[0])
+	if err != nil {
+		return err
+	}
+	if _, ok := sh.states[index]; ok {
+		return fmt.Errorf("member %d has already joined", index)
+	}
+
+	if err := sh.setupMsg.CheckPrivateEK(index, args[1]); err != nil {
+		return err
+	}
+
+	leafKey, err := art.DeriveLeafKey(args[1], sh.setupMsg.GetSetupKey())
+	if err != nil {
+		return err
+	}
+	sh.states[index] = sh.setupMsg.NewTreeState(index, leafKey)
+
+	fmt.Printf("member %d joined\n", index)
+	return nil
+}
+
+func (sh *shell) update(args []string) error {
+	if err := sh.requireSetup(); err != nil {
+		return err
+	}
+	if len(args) != 1 {
+		return fmt.Errorf("usage: update INDEX")
+	}
+
+	index, err := sh.parseIndex(args[0])
+	if err != nil {
+		return err
+	}
+	state, ok := sh.states[index]
+	if !ok {
+		return fmt.Errorf("member %d has not joined", index)
+	}
+
+	// process the update as the other members would receive it: encoded,
+	// and MAC'd with the stage key it replaces
+	updateMsg, prevStageKey := state.UpdateKey(index)
+	msg, err := json.Marshal(updateMsg)
+	if err != nil {
+		return fmt.Errorf("can't encode the update message: %v", err)
+	}
+	mac := updateMsg.MAC(prevStageKey)
+	for _, other := range sh.sortedIndices() {
+		if other == index {
+			continue
+		}
+		if err := art.ProcessUpdateMessageBytes(sh.states[other], other, msg, mac); err != nil {
+			return fmt.Errorf("member %d: %v", other, err)
+		}
+	}
+
+	fmt.Printf("member %d updated their leaf key\n", index)
+	return nil
+}
+
+func (sh *shell) key(args []string) error {
+	if err := sh.requireSetup(); err != nil {
+		return err
+	}
+	if len(args) > 1 {
+		return fmt.Errorf("usage: key [INDEX]")
+	}
+
+	indices := sh.sortedIndices()
+	if len(args) == 1 {
+		index, err := sh.parseIndex(args[0])
+		if err != nil {
+			return err
+		}
+		if _, ok := sh.states[index]; !ok {
+			return fmt.Errorf("member %d has not joined", index)
+		}
+		indices = []int{index}
+	}
+
+	for _, index := range indices {
+		fmt.Printf("%d: %x\n", index, sh.states[index].StageKey().Seed())
+	}
+	return nil
+}
+
+// printTree prints the subtree rooted at node, which is at the given depth.
+// Nodes deeper than maxDepth are not printed; instead, each subtree cut off
+// is summarized by its number of leaves.  A negative maxDepth means no limit.
+func printTree(node *art.PublicNode, depth, maxDepth int) {
+	if node == nil {
+		return
+	}
+	indent := strings.Repeat("  ", depth)
+	if maxDepth >= 0 && depth > maxDepth {
+		fmt.Printf("%s... (%d leaves)\n", indent, node.NumLeaves())
+		return
+	}
+	kind := "node"
+	if node.Height == 0 {
+		kind = "leaf"
+	}
+	fmt.Printf("%s%s %x\n", indent, kind, node.GetPk().Bytes()[:8])
+	printTree(node.Left, depth+1, maxDepth)
+	printTree(node.Right, depth+1, maxDepth)
+}
+
+// printLevels prints the levels of the tree rooted at root, from the root down
+// to maxDepth, one line per level.  The levels below maxDepth are summarized
+// by their number.  Unlike printTree, it walks the tree iteratively, one
+// level at a time.
+func printLevels(root *art.PublicNode, maxDepth int) {
+	level := []*art.PublicNode{root}
+	for depth := 0; len(level) != 0; depth++ {
+		if depth > maxDepth {
+			fmt.Printf("... (%d more levels)\n", root.Height-maxDepth)
+			return
+		}
+
+		var next []*art.PublicNode
+		fmt.Printf("%d:", depth)
+		for _, node := range level {
+			fmt.Printf(" %x", node.GetPk().Bytes()[:8])
+			if node.Left != nil {
+				next = append(next, node.Left)
+			}
+			if node.Right != nil {
+				next = append(next, node.Right)
+			}
+		}
+		fmt.Println()
+		level = next
+	}
+}
+
+func (sh *shell) tree(args []string) error {
+	if err := sh.requireSetup(); err != nil {
+		return err
+	}
+	if len(args) > 2 {
+		return fmt.Errorf("usage: tree [INDEX [MAX_DEPTH]]")
+	}
+
+	index := sh.initiator
+	if len(args) >= 1 {
+		var err error
+		index, err = sh.parseIndex(args[0])
+		if err != nil {
+			return err
+		}
+	}
+	state, ok := sh.states[index]
+	if !ok {
+		return fmt.Errorf("member %d has not joined", index)
+	}
+
+	maxDepth := sh.maxDepth
+	if sh.levels > 0 {
+		maxDepth = sh.levels - 1
+	}
+	if len(args) == 2 {
+		var err error
+		maxDepth, err = strconv.Atoi(args[1])
+		if err != nil || maxDepth < 0 {
+			return fmt.Errorf("invalid MAX_DEPTH %q", args[1])
+		}
+	}
+
+	if sh.levels > 0 {
+		printLevels(state.PublicTree, maxDepth)
+	} else {
+		printTree(state.PublicTree, 0, maxDepth)
+	}
+	return nil
+}
+
+func (sh *shell) members(args []string) error {
+	if err := sh.requireSetup(); err != nil {
+		return err
+	}
+	for _, index := range sh.sortedIndices() {
+		if index == sh.initiator {
+			fmt.Printf("%d (initiator)\n", index)
+		} else {
+			fmt.Printf("%d\n", index)
+		}
+	}
+	return nil
+}
+
+// errFixedMembership is the error of the add and remove commands: the
+// library has no operation that changes a group's members after setup.
+var errFixedMembership = errors.New("the members of a group are fixed at setup; " +
+	"to add or remove members, setup a new group")
+
+// run runs the command on line, and reports whether the shell should exit.
+func (sh *shell) run(line string) (bool, error) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return false, nil
+	}
+
+	cmd, args := fields[0], fields[1:]
+	switch cmd {
+	case "setup":
+		return false, sh.setup(args)
+	case "join":
+		return false, sh.join(args)
+	case "update":
+		return false, sh.update(args)
+	case "key":
+		return false, sh.key(args)
+	case "tree":
+		return false, sh.tree(args)
+	case "members":
+		return false, sh.members(args)
+	case "add", "remove":
+		return false, errFixedMembership
+	case "help":
+		fmt.Println(usage[strings.Index(usage, "commands:"):])
+		return false, nil
+	case "quit", "exit":
+		return true, nil
+	default:
+		return false, fmt.Errorf("unknown command %q (try help)", cmd)
+	}
+}
+
+func main() {
+	opts := parseOptions()
+
+	sh := &shell{maxDepth: opts.maxDepth, levels: opts.levels}
+	scanner := bufio.NewScanner(os.Stdin)
+
+	for {
+		fmt.Print(prompt)
+		if !scanner.Scan() {
+			break
+		}
+
+		line := strings.TrimSpace(scanner.Text())
+		done, err := sh.run(line)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		}
+		if done {
+			return
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		mu.Fatalf("error: failed to read input: %v", err)
+	}
+	fmt.Println()
+}
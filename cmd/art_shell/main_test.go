@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/syslab-wm/art"
+)
+
+// writeConfig writes the keys of n members, and a config file for them, to
+// dir, and returns the config file.  Member i's private EK is in
+// member<i>-ek.pem.
+func writeConfig(t *testing.T, dir string, n int) string {
+	t.Helper()
+	r := art.NewSeededReader([]byte("art test art_shell"))
+	var config strings.Builder
+	for i := 1; i <= n; i++ {
+		ik, err := art.IKKeyGenFrom(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ek, err := art.DHKeyGenFrom(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ikFile := filepath.Join(dir, fmt.Sprintf("member%d-ik-pub.pem", i))
+		ekFile := filepath.Join(dir, fmt.Sprintf("member%d-ek-pub.pem", i))
+		privEKFile := filepath.Join(dir, fmt.Sprintf("member%d-ek.pem", i))
+		err = art.WritePublicIKToFile(ik.Public().(ed25519.PublicKey), ikFile, art.EncodingPEM)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := art.WritePublicEKToFile(ek.PublicKey(), ekFile, art.EncodingPEM); err != nil {
+			t.Fatal(err)
+		}
+		if err := art.WritePrivateEKToFile(ek, privEKFile, art.EncodingPEM); err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(&config, "member%d %s %s\n", i, filepath.Base(ikFile),
+			filepath.Base(ekFile))
+	}
+
+	configFile := filepath.Join(dir, "config")
+	if err := os.WriteFile(configFile, []byte(config.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return configFile
+}
+
+// runLine runs line in sh, and returns what the command printed, whether the
+// shell should exit, and the command's error.
+func runLine(t *testing.T, sh *shell, line string) (string, bool, error) {
+	t.Helper()
+	out, err := os.CreateTemp(t.TempDir(), "stdout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+
+	stdout := os.Stdout
+	os.Stdout = out
+	done, runErr := sh.run(line)
+	os.Stdout = stdout
+
+	data, err := os.ReadFile(out.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data), done, runErr
+}
+
+// TestRun runs a session of commands through the shell's dispatcher, and
+// checks each command's output or error.
+func TestRun(t *testing.T) {
+	dir := t.TempDir()
+	configFile := writeConfig(t, dir, 3)
+	ekFile := func(i int) string { return filepath.Join(dir, fmt.Sprintf("member%d-ek.pem", i)) }
+
+	tests := []struct {
+		line string
+		want string // a substring of the output, or of the error if err
+		err  bool
+	}{
+		{"", "", false},
+		{"   ", "", false},
+		{"key", "no group; run setup first", true},
+		{"frobnicate", `unknown command "frobnicate"`, true},
+		{"setup", "usage: setup CONFIG_FILE [INITIATOR]", true},
+		{"setup " + configFile + " member2", "initiator is at index 2", false},
+		{"join 2 " + ekFile(2), "member 2 has already joined", true},
+		{"join 4 " + ekFile(1), "INDEX must be between 1 and 3", true},
+		{"join 1 " + ekFile(3), "", true},
+		{"join 1 " + ekFile(1), "member 1 joined", false},
+		{"update 3", "member 3 has not joined", true},
+		{"join 3 " + ekFile(3), "member 3 joined", false},
+		{"members", "2 (initiator)", false},
+		{"update 1", "member 1 updated their leaf key", false},
+		{"key 3", "3: ", false},
+		{"key x", `invalid INDEX "x"`, true},
+		{"tree 2 1", "... (", false},
+		{"tree 2 -1", `invalid MAX_DEPTH "-1"`, true},
+		{"add member4", "fixed at setup", true},
+		{"remove 3", "fixed at setup", true},
+		{"help", "commands:", false},
+	}
+
+	sh := &shell{maxDepth: -1}
+	for _, tt := range tests {
+		out, done, err := runLine(t, sh, tt.line)
+		if done {
+			t.Fatalf("%q: the shell exits", tt.line)
+		}
+		if (err != nil) != tt.err {
+			t.Fatalf("%q: got error %v, want error %v", tt.line, err, tt.err)
+		}
+		got := out
+		if err != nil {
+			got = err.Error()
+		}
+		if !strings.Contains(got, tt.want) {
+			t.Errorf("%q: got %q, want it to contain %q", tt.line, got, tt.want)
+		}
+	}
+
+	// every member that has joined agrees on the stage key
+	for index, state := range sh.states {
+		if !art.StageKeyEqual(state.Sk, sh.states[sh.initiator].Sk) {
+			t.Errorf("member %d's stage key differs from the initiator's", index)
+		}
+	}
+	if _, _, err := runLine(t, sh, "add"); !errors.Is(err, errFixedMembership) {
+		t.Errorf("add: got error %v, want errFixedMembership", err)
+	}
+
+	for _, line := range []string{"quit", "exit", " quit "} {
+		if _, done, err := runLine(t, sh, line); !done || err != nil {
+			t.Errorf("%q: got exit %v and error %v, want the shell to exit", line, done, err)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/syslab-wm/art/internal/defaults"
+	"github.com/syslab-wm/mu"
+)
+
+const shortUsage = "Usage: art_shell [options]"
+const usage = `Usage: art_shell [options]
+
+An interactive shell for experimenting with an ART group.  All group state
+is held in memory; nothing is written to disk.
+
+options:
+  -h, -help
+    Show this usage statement and exit.
+
+  -max-depth DEPTH
+    The tree command's default MAX_DEPTH.  A negative DEPTH (the default)
+    means no limit.
+
+  -levels LEVELS
+    Have the tree command show the top LEVELS levels of the tree level by
+    level, with one line per level, rather than as an indented tree.  A
+    MAX_DEPTH given to the tree command shows levels 0 through MAX_DEPTH
+    instead.
+
+commands:
+  setup CONFIG_FILE [INITIATOR]
+    Setup the group described by CONFIG_FILE (see setup_group).  If
+    INITIATOR is omitted, the first member in CONFIG_FILE is the initiator.
+
+  join INDEX PRIV_EK_FILE
+    Process the setup message as the member at position INDEX, whose
+    private ephemeral key is PRIV_EK_FILE.
+
+  update INDEX
+    The member at position INDEX updates their leaf key; every other
+    member that has joined processes the resulting update message.
+
+  key [INDEX]
+    Show the stage key of the member at position INDEX, or of every member
+    that has joined if INDEX is omitted.
+
+  tree [INDEX [MAX_DEPTH]]
+    Show the public tree as seen by the member at position INDEX (default:
+    the initiator).  If MAX_DEPTH is given, only the nodes at most MAX_DEPTH
+    levels below the root are shown, and each subtree below that is shown
+    as its number of leaves; this keeps the output of large trees readable.
+
+  members
+    List the members that have joined.
+
+  add, remove
+    Not supported: the members of a group are fixed at setup, since the
+    library has no operation that adds or removes a member.  To change the
+    members, setup a new group.
+
+  help
+    Show the list of commands.
+
+  quit
+    Exit the shell.
+
+example:
+  art> setup 4.conf alice
+  art> join 2 bob-ek.pem
+  art> update 2
+  art> key`
+
+func printUsage() {
+	fmt.Println(usage)
+}
+
+type options struct {
+	maxDepth int
+	levels   int
+}
+
+func parseOptions() *options {
+	opts := options{}
+
+	flag.Usage = printUsage
+	flag.IntVar(&opts.maxDepth, "max-depth", -1, "")
+	flag.IntVar(&opts.levels, "levels", 0, "")
+	if err := defaults.Load(flag.CommandLine, "art_shell"); err != nil {
+		mu.Fatalf("error: %v", err)
+	}
+	flag.Parse()
+
+	if flag.NArg() != 0 {
+		mu.Fatalf(shortUsage)
+	}
+
+	if opts.levels < 0 {
+		mu.Fatalf("error: -levels must be positive")
+	}
+
+	return &opts
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+	"time"
+
+	"github.com/syslab-wm/art"
+	"github.com/syslab-wm/art/internal/jsonutl"
+	"github.com/syslab-wm/mu"
+)
+
+// A phase is the measurement of one phase of the benchmark.
+type phase struct {
+	Name       string `json:"name"`
+	Ops        int    `json:"ops"`
+	ElapsedNs  int64  `json:"elapsedNs"`
+	PerOpNs    int64  `json:"perOpNs"`
+	Allocs     uint64 `json:"allocs"`
+	AllocBytes uint64 `json:"allocBytes"`
+}
+
+type report struct {
+	Members    int      `json:"members"`
+	Updaters   int      `json:"updaters"`
+	Workers    int      `json:"workers"`
+	GOMAXPROCS int      `json:"gomaxprocs"`
+	GoVersion  string   `json:"goVersion"`
+	Phases     []*phase `json:"phases"`
+}
+
+// newPhase adds the phase called name to the report.
+func (r *report) newPhase(name string) *phase {
+	p := &phase{Name: name}
+	r.Phases = append(r.Phases, p)
+	return p
+}
+
+// run runs f, which does ops operations, and adds its elapsed time and
+// allocations to the phase.
+func (p *phase) run(ops int, f func()) {
+	var before, after runtime.MemStats
+
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+	f()
+	elapsed := time.Since(start)
+	runtime.ReadMemStats(&after)
+
+	p.Ops += ops
+	p.ElapsedNs += elapsed.Nanoseconds()
+	p.Allocs += after.Mallocs - before.Mallocs
+	p.AllocBytes += after.TotalAlloc - before.TotalAlloc
+	if p.Ops > 0 {
+		p.PerOpNs = p.ElapsedNs / int64(p.Ops)
+	}
+}
+
+// group holds the members' keys and states.  Member i is at INDEX i+1, and
+// the initiator is member 0.
+type group struct {
+	members []*art.Member
+	iks     []ed25519.PrivateKey
+	eks     []*ecdh.PrivateKey
+	states  []*art.TreeState
+}
+
+func (g *group) generateKeys(n int) {
+	for i := 0; i < n; i++ {
+		pubIK, ik, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			mu.Fatalf("error: can't generate an IK: %v", err)
+		}
+		ek, err := art.DHKeyGen()
+		if err != nil {
+			mu.Fatalf("error: can't generate an EK: %v", err)
+		}
+
+		name := fmt.Sprintf("member-%d", i+1)
+		g.members = append(g.members, art.NewMemberFromKeys(name, pubIK, art.PublicOf(ek)))
+		g.iks = append(g.iks, ik)
+		g.eks = append(g.eks, ek)
+	}
+	g.states = make([]*art.TreeState, n)
+}
+
+// setup sets up the group, and returns the encoded setup message and its
+// signature.
+func (g *group) setup(workers int) ([]byte, []byte) {
+	opts := &art.SetupOptions{Workers: workers}
+	state, setupMsg := art.SetupGroupFromMembers(g.members, "", opts)
+	g.states[0] = state
+
+	msg, err := jsonutl.Marshal(setupMsg)
+	if err != nil {
+		mu.Fatalf("error encoding setup message: %v", err)
+	}
+	sig, err := art.Sign(g.iks[0], msg)
+	if err != nil {
+		mu.Fatalf("error: can't sign the setup message: %v", err)
+	}
+
+	return msg, sig
+}
+
+func (g *group) join(msg, sig []byte) {
+	initiatorIK := g.iks[0].Public()
+	for i := 1; i < len(g.members); i++ {
+		state, err := art.ProcessSetupMessageBytes(i+1, g.eks[i], msg, sig, initiatorIK)
+		if err != nil {
+			mu.Fatalf("error: member %d can't process the setup message: %v", i+1, err)
+		}
+		g.states[i] = state
+	}
+}
+
+// update has member i update its leaf key, and returns the encoded update
+// message and its MAC.
+func (g *group) update(i int) ([]byte, []byte) {
+	updateMsg, prevStageKey := g.states[i].UpdateKey(i + 1)
+
+	msg, err := jsonutl.Marshal(updateMsg)
+	if err != nil {
+		mu.Fatalf("error encoding update message: %v", err)
+	}
+	return msg, updateMsg.MAC(prevStageKey)
+}
+
+func (g *group) processUpdate(updater int, msg, mac []byte) {
+	for i := range g.members {
+		if i == updater {
+			continue
+		}
+		err := art.ProcessUpdateMessageBytes(g.states[i], i+1, msg, mac)
+		if err != nil {
+			mu.Fatalf("error: member %d can't process the update of member %d: %v",
+				i+1, updater+1, err)
+		}
+	}
+}
+
+// checkStageKeys fails unless every member has the initiator's stage key.
+func (g *group) checkStageKeys(after string) {
+	for i, state := range g.states {
+		if !art.StageKeyEqual(state.Sk, g.states[0].Sk) {
+			mu.Fatalf("error: after %s, member %d has a different stage key than "+
+				"the initiator", after, i+1)
+		}
+	}
+}
+
+func main() {
+	var g group
+	var msg, sig []byte
+
+	opts := parseOptions()
+	n := opts.numMembers
+
+	r := &report{
+		Members:    n,
+		Updaters:   opts.updaters,
+		Workers:    opts.workers,
+		GOMAXPROCS: runtime.GOMAXPROCS(0),
+		GoVersion:  runtime.Version(),
+	}
+
+	r.newPhase("keygen").run(n, func() { g.generateKeys(n) })
+	r.newPhase("setup").run(1, func() { msg, sig = g.setup(opts.workers) })
+	r.newPhase("join").run(n-1, func() { g.join(msg, sig) })
+	g.checkStageKeys("setup")
+
+	// every member must process an update before the next one is made,
+	// since an update is MAC'd with the stage key it replaces
+	update, process := r.newPhase("update"), r.newPhase("process_update")
+	for i := 0; i < opts.updaters; i++ {
+		var mac []byte
+		update.run(1, func() { msg, mac = g.update(i) })
+		process.run(n-1, func() { g.processUpdate(i, msg, mac) })
+	}
+	g.checkStageKeys("the updates")
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(r); err != nil {
+		mu.Fatalf("error: can't write the report: %v", err)
+	}
+}
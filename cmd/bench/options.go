@@ -0,0 +1,114 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+
+	"github.com/syslab-wm/art"
+	"github.com/syslab-wm/art/internal/defaults"
+	"github.com/syslab-wm/mu"
+)
+
+const shortUsage = "Usage: bench [options] NUM_MEMBERS"
+const usage = `Usage: bench [options] NUM_MEMBERS
+
+Benchmark a group of NUM_MEMBERS members end to end, in memory: generate the
+members' keys, set up the group, have every other member process the signed
+setup message, and run a round of updates that every other member
+processes.  The timings and allocations of each phase are printed as JSON,
+for tracking performance across builds or validating capacity on target
+hardware.  Unlike cost_estimate, which extrapolates from the time of one DH,
+bench runs the real protocol, including encoding, signatures and MACs.
+
+The phases are:
+  keygen
+    Generate each member's identity and ephemeral keys (not part of the
+    protocol; reported for reference).
+
+  setup
+    The initiator sets up the group, and encodes and signs the setup
+    message.
+
+  join
+    Each member other than the initiator processes the setup message.
+
+  update
+    Each updater updates its leaf key, and encodes and MACs the update
+    message.
+
+  process_update
+    Each member other than the updater processes each update message.
+
+For each phase, "ops" is the number of operations (e.g., members that
+joined), and "elapsedNs", "allocs" and "allocBytes" are the totals over the
+phase; "perOpNs" is the elapsed time per operation.  The program fails if
+any member derives a different stage key than the initiator.
+
+positional arguments:
+  NUM_MEMBERS
+    The number of members in the group.
+
+options:
+  -h, -help
+    Show this usage statement and exit.
+
+  -updaters N
+    The number of members that update in the round of updates, starting at
+    INDEX 1.  Each update is processed by every other member, so a round of
+    updates by all members does on the order of NUM_MEMBERS^2 DHs.  If not
+    provided, the default is 1.
+
+  -workers N
+    The number of goroutines that derive the leaf keys at setup (see
+    setup_group -workers).  If not provided, the default is setup_group's
+    default for this machine.
+
+examples:
+  ./bench -updaters 10 1000`
+
+func printUsage() {
+	fmt.Println(usage)
+}
+
+type options struct {
+	// positional arguments
+	numMembers int
+
+	// options
+	updaters int
+	workers  int
+}
+
+func parseOptions() *options {
+	var err error
+	opts := options{}
+
+	flag.Usage = printUsage
+	flag.IntVar(&opts.updaters, "updaters", 1, "")
+	flag.IntVar(&opts.workers, "workers", art.RecommendWorkers(), "")
+	if err := defaults.Load(flag.CommandLine, "bench"); err != nil {
+		mu.Fatalf("error: %v", err)
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		mu.Fatalf(shortUsage)
+	}
+
+	opts.numMembers, err = strconv.Atoi(flag.Arg(0))
+	if err != nil {
+		mu.Fatalf("error converting positional argument NUM_MEMBERS to int: %v", err)
+	}
+	if opts.numMembers < 1 {
+		mu.Fatalf("error: NUM_MEMBERS must be at least 1")
+	}
+	if opts.updaters < 0 || opts.updaters > opts.numMembers {
+		mu.Fatalf("error: -updaters must be between 0 and NUM_MEMBERS")
+	}
+	if opts.workers < 1 {
+		mu.Fatalf("error: -workers must be at least 1")
+	}
+
+	return &opts
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/syslab-wm/art"
+	"github.com/syslab-wm/mu"
+)
+
+// benchmarkDH returns the average time of one X25519 DH.
+func benchmarkDH(iterations int) time.Duration {
+	sk, err := art.DHKeyGen()
+	if err != nil {
+		mu.Fatalf("error: can't generate a key: %v", err)
+	}
+	peer, err := art.DHKeyGen()
+	if err != nil {
+		mu.Fatalf("error: can't generate a key: %v", err)
+	}
+	pk := art.PublicOf(peer)
+
+	start := time.Now()
+	for i := 0; i < iterations; i++ {
+		_, err = art.KeyExchange(sk, pk)
+		if err != nil {
+			mu.Fatalf("error: DH failed: %v", err)
+		}
+	}
+	return time.Since(start) / time.Duration(iterations)
+}
+
+func printCost(name string, numDH int, perDH time.Duration) {
+	fmt.Printf("%-24s %8d DH  %12v\n", name, numDH, time.Duration(numDH)*perDH)
+}
+
+func main() {
+	opts := parseOptions()
+	n := opts.numMembers
+
+	depths := art.LeafDepths(n)
+	minDepth, maxDepth, sumDepth := depths[0], depths[0], 0
+	for _, d := range depths {
+		minDepth = min(minDepth, d)
+		maxDepth = max(maxDepth, d)
+		sumDepth += d
+	}
+
+	perDH := benchmarkDH(opts.iterations)
+
+	fmt.Printf("members: %d\n", n)
+	fmt.Printf("tree depth: %d (shallowest leaf: %d)\n", maxDepth, minDepth)
+	fmt.Printf("DH benchmark: %v per DH (%d iterations)\n", perDH, opts.iterations)
+	fmt.Printf("setup workers: %d\n\n", opts.workers)
+
+	printCost("setup (initiator)", 2*(n-1), perDH)
+	leafRounds := (n - 1 + opts.workers - 1) / opts.workers
+	fmt.Printf("%-24s %8s     %12v\n", "setup (elapsed)", "",
+		time.Duration(leafRounds+n-1)*perDH)
+	printCost("join (per member, max)", 1+maxDepth, perDH)
+	printCost("update (updater, max)", maxDepth, perDH)
+	printCost("update (per member, max)", maxDepth, perDH)
+	printCost("update (whole group)", sumDepth, perDH)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+
+	"github.com/syslab-wm/art"
+	"github.com/syslab-wm/art/internal/defaults"
+	"github.com/syslab-wm/mu"
+)
+
+const shortUsage = "Usage: cost_estimate [options] NUM_MEMBERS"
+const usage = `Usage: cost_estimate [options] NUM_MEMBERS
+
+Print the number of X25519 Diffie-Hellman (DH) operations for a group of
+NUM_MEMBERS members, along with an estimate of the time they take based on
+a quick benchmark of DH on this machine.
+
+The counts are:
+  setup
+    The initiator does one DH per member (other than itself) to derive the
+    leaf keys, and one DH per internal node of the tree.  The leaf keys are
+    derived in parallel, so the elapsed time is also estimated.
+
+  join
+    A member processing the setup message does one DH to derive its leaf key
+    and one DH per node on its path to the root.
+
+  update
+    The updating member does one DH per node on its path to the root, and
+    each other member does one DH per node on its own path to the root.
+
+This implementation does not support adding or removing members; changing
+the membership requires a new setup.
+
+positional arguments:
+  NUM_MEMBERS
+    The number of members in the group.
+
+options:
+  -h, -help
+    Show this usage statement and exit.
+
+  -iterations N
+    The number of DHs to time for the benchmark.  If not provided, the
+    default is 1000.
+
+  -workers N
+    The number of goroutines setup_group uses to derive the leaf keys (see
+    setup_group -workers), for the estimate of the setup's elapsed time.
+    If not provided, the default is setup_group's default for this machine.
+
+examples:
+  ./cost_estimate 1000`
+
+func printUsage() {
+	fmt.Println(usage)
+}
+
+type options struct {
+	// positional arguments
+	numMembers int
+
+	// options
+	iterations int
+	workers    int
+}
+
+func parseOptions() *options {
+	var err error
+	opts := options{}
+
+	flag.Usage = printUsage
+	flag.IntVar(&opts.iterations, "iterations", 1000, "")
+	flag.IntVar(&opts.workers, "workers", art.RecommendWorkers(), "")
+	if err := defaults.Load(flag.CommandLine, "cost_estimate"); err != nil {
+		mu.Fatalf("error: %v", err)
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		mu.Fatalf(shortUsage)
+	}
+
+	opts.numMembers, err = strconv.Atoi(flag.Arg(0))
+	if err != nil {
+		mu.Fatalf("error converting positional argument NUM_MEMBERS to int: %v", err)
+	}
+	if opts.numMembers < 2 {
+		mu.Fatalf("error: NUM_MEMBERS must be at least 2")
+	}
+	if opts.iterations < 1 {
+		mu.Fatalf("error: -iterations must be at least 1")
+	}
+	if opts.workers < 1 {
+		mu.Fatalf("error: -workers must be at least 1")
+	}
+
+	return &opts
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"os"
+
+	"github.com/syslab-wm/art"
+	"github.com/syslab-wm/mu"
+)
+
+// readPublicTree reads the public tree from treeFile, which is a setup
+// message or a tree state, along with the state's stage key, if treeFile is
+// a state that has one.
+func readPublicTree(treeFile string) (*art.PublicNode, ed25519.PrivateKey) {
+	kind, err := art.SniffFile(treeFile)
+	if err != nil {
+		mu.Fatalf("error: can't read tree file: %v", err)
+	}
+
+	switch kind {
+	case art.FileSetupMessage:
+		var setupMsg art.SetupMessage
+		setupMsg.Read(treeFile)
+		return setupMsg.GetPublicTree(), nil
+	case art.FileTreeState:
+		state, err := art.LoadPartialTreeState(treeFile)
+		if err != nil {
+			mu.Fatalf("error reading tree state from %s: %v", treeFile, err)
+		}
+		return state.PublicTree, state.Sk
+	default:
+		mu.Fatalf("error: %s is neither a setup message nor a tree state", treeFile)
+		return nil, nil
+	}
+}
+
+func main() {
+	opts := parseOptions()
+
+	tree, stageKey := readPublicTree(opts.treeFile)
+	if opts.stageKeyFile != "" {
+		var err error
+		stageKey, err = art.ReadPrivateIKFromFile(opts.stageKeyFile, art.EncodingPEM)
+		if err != nil {
+			mu.Fatalf("error: can't read stage key file: %v", err)
+		}
+	}
+	if stageKey == nil {
+		mu.Fatalf("error: %s has no stage key to MAC the copath with; give one with "+
+			"-stage-key", opts.treeFile)
+	}
+
+	copath, err := art.NewCopathMessage(tree, opts.index)
+	if err != nil {
+		mu.Fatalf("error: can't extract the copath: %v", err)
+	}
+	copath.Save(opts.copathFile)
+	copath.SaveMac(stageKey, opts.macFile)
+
+	if opts.splitDir != "" {
+		if err := os.MkdirAll(opts.splitDir, 0750); err != nil {
+			mu.Fatalf("error: can't create split dir: %v", err)
+		}
+		copath.SaveNodes(opts.splitDir)
+	}
+
+	fmt.Printf("copath of member %d of %d: %d nodes\n", copath.Idx, copath.NumLeaves,
+		len(copath.Copath))
+}
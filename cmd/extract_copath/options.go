@@ -0,0 +1,105 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+
+	"github.com/syslab-wm/art/internal/defaults"
+	"github.com/syslab-wm/mu"
+)
+
+const shortUsage = "Usage: extract_copath [options] INDEX TREE_FILE"
+const usage = `Usage: extract_copath [options] INDEX TREE_FILE
+
+Extract the copath of the group member at position INDEX from a full tree,
+for the member to process with process_partial.  This is the server-side
+counterpart of process_partial: a server that holds the full tree sends a
+bandwidth-constrained member just the public keys it needs to derive the
+tree key.  The copath is MAC'd with the group's stage key, which the member
+must hold to verify it, as for update messages.
+
+positional arguments:
+  INDEX
+	The index position of the member whose copath to extract, this index is
+	based off the member's position in the group config file, where the
+	first entry is at index 1.
+
+  TREE_FILE
+	The file that holds the full public tree: either a setup message (the
+	tree as of setup) or a member's state file (the tree as of the updates
+	the member has applied).  Only the public tree is read.
+
+options:
+  -h, -help
+    Show this usage statement and exit.
+
+  -out-copath COPATH_FILE
+    The file to write the copath to.  If not provided, the default is
+    copath.json.
+
+  -stage-key STAGE_KEY_FILE
+    The stage key to MAC the copath with, as a PEM-encoded Ed25519 private
+    key (e.g., a stage-key file written by setup_group or
+    process_setup_message).  This is required if TREE_FILE is a setup
+    message; for a state, the default is the state's stage key.
+
+  -out-mac MAC_FILE
+    The file to write the copath's MAC to.  If not provided, the default is
+    COPATH_FILE.mac.  The MAC also authenticates the nodes written with
+    -split, once process_partial has assembled them.
+
+  -split DIR
+    Also write each copath node to its own file in DIR, named node-N.json
+    for node index N, for members that receive the nodes separately (see
+    process_partial -num-leaves).  DIR is created if it does not exist.
+
+examples:
+  ./extract_copath -stage-key stage-key.pem -out-copath bob.copath 2 setup.msg`
+
+func printUsage() {
+	fmt.Println(usage)
+}
+
+type options struct {
+	// positional arguments
+	index    int
+	treeFile string
+
+	// options
+	copathFile   string
+	stageKeyFile string
+	macFile      string
+	splitDir     string
+}
+
+func parseOptions() *options {
+	var err error
+	opts := options{}
+
+	flag.Usage = printUsage
+	flag.StringVar(&opts.copathFile, "out-copath", "copath.json", "")
+	flag.StringVar(&opts.stageKeyFile, "stage-key", "", "")
+	flag.StringVar(&opts.macFile, "out-mac", "", "")
+	flag.StringVar(&opts.splitDir, "split", "", "")
+	if err := defaults.Load(flag.CommandLine, "extract_copath"); err != nil {
+		mu.Fatalf("error: %v", err)
+	}
+	flag.Parse()
+
+	if flag.NArg() != 2 {
+		mu.Fatalf(shortUsage)
+	}
+
+	opts.index, err = strconv.Atoi(flag.Arg(0))
+	if err != nil {
+		mu.Fatalf("error converting positional argument INDEX to int: %v", err)
+	}
+	opts.treeFile = flag.Arg(1)
+
+	if opts.macFile == "" {
+		opts.macFile = opts.copathFile + ".mac"
+	}
+
+	return &opts
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/syslab-wm/art"
+	"github.com/syslab-wm/art/internal/fileutl"
+	"github.com/syslab-wm/mu"
+)
+
+const (
+	ikSuffix = "-ik-pub.pem"
+	ekSuffix = "-ek-pub.pem"
+)
+
+// memberNames returns the sorted names of the members with public keys in
+// keyDir, and fails if a member is missing either key.
+func memberNames(keyDir string) []string {
+	entries, err := os.ReadDir(keyDir)
+	if err != nil {
+		mu.Fatalf("error: can't read KEY_DIR: %v", err)
+	}
+
+	hasIK := make(map[string]bool)
+	hasEK := make(map[string]bool)
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasSuffix(name, ikSuffix) {
+			hasIK[strings.TrimSuffix(name, ikSuffix)] = true
+		} else if strings.HasSuffix(name, ekSuffix) {
+			hasEK[strings.TrimSuffix(name, ekSuffix)] = true
+		}
+	}
+
+	names := make([]string, 0, len(hasIK))
+	for name := range hasIK {
+		if !hasEK[name] {
+			mu.Fatalf("error: member %q has %s%s but no %s%s", name, name, ikSuffix,
+				name, ekSuffix)
+		}
+		names = append(names, name)
+	}
+	for name := range hasEK {
+		if !hasIK[name] {
+			mu.Fatalf("error: member %q has %s%s but no %s%s", name, name, ekSuffix,
+				name, ikSuffix)
+		}
+	}
+
+	if len(names) == 0 {
+		mu.Fatalf("error: no public keys in %s", keyDir)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// checkKeys fails unless the member's key files hold valid public keys.
+func checkKeys(ikFile, ekFile string) {
+	if _, err := art.ReadPublicIKFromFile(ikFile, art.EncodingPEM); err != nil {
+		mu.Fatalf("error: invalid IK in %s: %v", ikFile, err)
+	}
+	if _, err := art.ReadPublicEKFromFile(ekFile, art.EncodingPEM); err != nil {
+		mu.Fatalf("error: invalid EK in %s: %v", ekFile, err)
+	}
+}
+
+// sameDir reports whether the config file is written to keyDir.
+func sameDir(outFile, keyDir string) bool {
+	outDir, err := filepath.Abs(filepath.Dir(outFile))
+	if err != nil {
+		return false
+	}
+	dir, err := filepath.Abs(keyDir)
+	if err != nil {
+		return false
+	}
+	return outDir == dir
+}
+
+func main() {
+	opts := parseOptions()
+
+	keyDir, err := filepath.Abs(opts.keyDir)
+	if err != nil {
+		mu.Fatalf("error: %v", err)
+	}
+	byName := opts.outFile != "" && sameDir(opts.outFile, keyDir)
+
+	var config strings.Builder
+	config.WriteString("# NAME PUB_IK_FILE PUB_EK_FILE\n")
+	for i, name := range memberNames(keyDir) {
+		ikFile := filepath.Join(keyDir, name+ikSuffix)
+		ekFile := filepath.Join(keyDir, name+ekSuffix)
+		checkKeys(ikFile, ekFile)
+
+		if byName {
+			ikFile, ekFile = filepath.Base(ikFile), filepath.Base(ekFile)
+		}
+		fmt.Fprintf(&config, "# INDEX %d\n%s %s %s\n", i+1, name, ikFile, ekFile)
+	}
+
+	if opts.outFile == "" {
+		fmt.Print(config.String())
+		return
+	}
+
+	err = fileutl.Write(opts.outFile, 0644, func(w io.Writer) error {
+		_, err := io.WriteString(w, config.String())
+		return err
+	})
+	if err != nil {
+		mu.Fatalf("error: can't write config file: %v", err)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/syslab-wm/art/internal/defaults"
+	"github.com/syslab-wm/mu"
+)
+
+const shortUsage = "Usage: gen_config [options] KEY_DIR"
+const usage = `Usage: gen_config [options] KEY_DIR
+
+Generate a group config file (see setup_group) from a directory of members'
+public keys.
+
+KEY_DIR must hold, for each member NAME, an identity key NAME-ik-pub.pem
+and an ephemeral key NAME-ek-pub.pem, as created by genpkey.  Members are
+listed in filename order, so a member's INDEX is its position among the
+sorted names, starting at 1.
+
+positional arguments:
+  KEY_DIR
+    The directory that holds the members' public keys.
+
+options:
+  -h, -help
+    Show this usage statement and exit.
+
+  -out CONFIG_FILE
+    Write the config to CONFIG_FILE instead of stdout.  setup_group looks for
+    a config's key files in the config's directory: if CONFIG_FILE is in
+    KEY_DIR, the key files are listed by name; otherwise, and when writing to
+    stdout, they are listed by absolute path.
+
+examples:
+  ./gen_config -out keys/group.conf keys`
+
+func printUsage() {
+	fmt.Println(usage)
+}
+
+type options struct {
+	// positional arguments
+	keyDir string
+
+	// options
+	outFile string
+}
+
+func parseOptions() *options {
+	opts := options{}
+
+	flag.Usage = printUsage
+	flag.StringVar(&opts.outFile, "out", "", "")
+	if err := defaults.Load(flag.CommandLine, "gen_config"); err != nil {
+		mu.Fatalf("error: %v", err)
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		mu.Fatalf(shortUsage)
+	}
+	opts.keyDir = flag.Arg(0)
+
+	return &opts
+}
@@ -1,12 +1,14 @@
 package main
 
 import (
-	"crypto/ecdh"
 	"crypto/ed25519"
 	"crypto/rand"
 	"fmt"
+	"io"
+	"os"
 
 	"github.com/syslab-wm/art"
+	"github.com/syslab-wm/art/internal/fileutl"
 	"github.com/syslab-wm/mu"
 )
 
@@ -16,11 +18,12 @@ func createKeyNames(basePath, format, keyType string) (string, string) {
 	return pubPath, privPath
 }
 
-func generateIKPair(pubPath, privPath string, encoding art.KeyEncoding) error {
-	pubKey, privKey, err := ed25519.GenerateKey(rand.Reader)
+func generateIKPair(pubPath, privPath string, encoding art.KeyEncoding, r io.Reader) error {
+	privKey, err := art.IKKeyGenFrom(r)
 	if err != nil {
 		return err
 	}
+	pubKey := privKey.Public().(ed25519.PublicKey)
 
 	err = art.WritePublicIKToFile(pubKey, pubPath, encoding)
 	if err != nil {
@@ -35,9 +38,10 @@ func generateIKPair(pubPath, privPath string, encoding art.KeyEncoding) error {
 	return nil
 }
 
-func generateEKPair(pubPath, privPath string, encoding art.KeyEncoding) error {
-	curve := ecdh.X25519()
-	privKey, err := curve.GenerateKey(rand.Reader)
+func generateEKPair(pubPath, privPath string, encoding art.KeyEncoding, r io.Reader,
+	signKey ed25519.PrivateKey) error {
+
+	privKey, err := art.DHKeyGenFrom(r)
 	if err != nil {
 		return err
 	}
@@ -53,6 +57,14 @@ func generateEKPair(pubPath, privPath string, encoding art.KeyEncoding) error {
 		return err
 	}
 
+	if signKey != nil {
+		sig := art.SignPrekey(signKey, pubKey)
+		err = fileutl.WriteFile(art.PrekeySignatureFile(pubPath), sig, 0644)
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -63,10 +75,33 @@ func main() {
 
 	pubPath, privPath := createKeyNames(opts.basePath, opts.outform, opts.keytype)
 
+	r := rand.Reader
+	switch {
+	case opts.randFile != "":
+		file, err := os.Open(opts.randFile)
+		if err != nil {
+			mu.Fatalf("error: can't open rand file: %v", err)
+		}
+		defer file.Close()
+		r = file
+	case opts.seed != "":
+		// the key type is part of the seed, so that the IK and the EK
+		// generated from the same SEED differ
+		r = art.NewSeededReader([]byte(opts.keytype + ":" + opts.seed))
+	}
+
+	var signKey ed25519.PrivateKey
+	if opts.signKey != "" {
+		signKey, err = art.ReadPrivateIKFromFile(opts.signKey, art.EncodingPEM)
+		if err != nil {
+			mu.Fatalf("error: can't read -sign-key: %v", err)
+		}
+	}
+
 	if opts.keytype == "ik" {
-		err = generateIKPair(pubPath, privPath, opts.encoding)
+		err = generateIKPair(pubPath, privPath, opts.encoding, r)
 	} else {
-		err = generateEKPair(pubPath, privPath, opts.encoding)
+		err = generateEKPair(pubPath, privPath, opts.encoding, r, signKey)
 	}
 
 	if err != nil {
@@ -6,6 +6,7 @@ import (
 	"strings"
 
 	"github.com/syslab-wm/art"
+	"github.com/syslab-wm/art/internal/defaults"
 	"github.com/syslab-wm/mu"
 )
 
@@ -37,9 +38,29 @@ options:
   -outform raw|der|pem  (default: pem)
     The encoding for the key files.
 
+  -rand-file FILE
+    Read the randomness for the key from FILE (e.g., a hardware RNG such as
+    /dev/hwrng) instead of the operating system's RNG.  The key is derived
+    from the next 32 bytes of FILE.
+
+  -sign-key PRIV_IK_FILE
+    For an ek key, also sign the public key with the owner's (PEM-encoded)
+    private identity key PRIV_IK_FILE, as setup_group -signed-prekeys
+    requires.  The signature, which is over the decoded key rather than its
+    file, is written to the public key file's name with a .sig suffix.
+
+  -seed SEED
+    FOR TESTING AND DEBUGGING ONLY.  Derive the key deterministically from
+    the string SEED, instead of generating it randomly; the same SEED and
+    KEYTYPE always yield the same key.  Anyone who knows SEED can derive the
+    private key.
+
 examples:
     # generate an ephemeral ECDH (X25519) keypair for alice
-  ./genpkey -outform der -keytype ek alice`
+  ./genpkey -outform der -keytype ek alice
+
+    # generate a prekey for alice, signed by alice's identity key
+  ./genpkey -keytype ek -sign-key alice-ik.pem alice`
 
 type options struct {
 	// positional
@@ -49,6 +70,9 @@ type options struct {
 	outform  string
 	encoding art.KeyEncoding // derived from outform
 	keytype  string
+	randFile string
+	seed     string
+	signKey  string
 }
 
 func printUsage() {
@@ -63,6 +87,12 @@ func parseOptions() *options {
 	flag.Usage = printUsage
 	flag.StringVar(&opts.keytype, "keytype", "ik", "")
 	flag.StringVar(&opts.outform, "outform", "pem", "")
+	flag.StringVar(&opts.randFile, "rand-file", "", "")
+	flag.StringVar(&opts.seed, "seed", "", "")
+	flag.StringVar(&opts.signKey, "sign-key", "", "")
+	if err := defaults.Load(flag.CommandLine, "genpkey"); err != nil {
+		mu.Fatalf("error: %v", err)
+	}
 	flag.Parse()
 
 	opts.keytype = strings.ToLower(opts.keytype)
@@ -76,6 +106,14 @@ func parseOptions() *options {
 		mu.Fatalf("error: %v", err)
 	}
 
+	if opts.randFile != "" && opts.seed != "" {
+		mu.Fatalf("error: -rand-file and -seed are mutually exclusive")
+	}
+
+	if opts.signKey != "" && opts.keytype != "ek" {
+		mu.Fatalf("error: -sign-key requires -keytype ek")
+	}
+
 	if flag.NArg() != 1 {
 		mu.Fatalf(shortUsage)
 	}
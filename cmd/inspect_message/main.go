@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+
+	"github.com/syslab-wm/art"
+	"github.com/syslab-wm/mu"
+)
+
+// description describes a setup or an update message.  The fields that do
+// not apply to the message's kind are omitted.
+type description struct {
+	Kind       string `json:"kind"`
+	Encoding   string `json:"encoding"`
+	Version    int    `json:"version,omitempty"`
+	Compressed bool   `json:"compressed"`
+
+	// setup messages
+	Suite          *art.Suite `json:"suite,omitempty"`
+	DefaultSuite   bool       `json:"defaultSuite,omitempty"`
+	Supported      *bool      `json:"supported,omitempty"`
+	Unsupported    string     `json:"unsupported,omitempty"`
+	Members        int        `json:"members,omitempty"`
+	TreeDepth      int        `json:"treeDepth,omitempty"`
+	TreeHash       string     `json:"treeHash,omitempty"`
+	SUK            string     `json:"suk,omitempty"`
+	Initiator      int        `json:"initiator,omitempty"`
+	InitiatorIK    string     `json:"initiatorIK,omitempty"`
+	SignatureError string     `json:"signatureError,omitempty"`
+
+	// update messages
+	Updater  int `json:"updater,omitempty"`
+	Epoch    int `json:"epoch,omitempty"`
+	PathKeys int `json:"pathKeys,omitempty"`
+}
+
+// describeSetupMessage describes the (decompressed) setup message data.
+func describeSetupMessage(d *description, data []byte, opts *options) {
+	d.Kind = "setup message"
+	d.Encoding = "json"
+	if art.IsBinarySetupMessage(data) {
+		d.Encoding = "binary"
+		var err error
+		if d.Version, err = art.BinarySetupMessageVersion(data); err != nil {
+			mu.Fatalf("error: %v", err)
+		}
+	}
+
+	setupMsg, err := art.DecodeSetupMessage(data)
+	if err != nil {
+		mu.Fatalf("error decoding setup message: %v", err)
+	}
+
+	d.Suite = setupMsg.GetSuite()
+	d.DefaultSuite = setupMsg.Suite == nil
+	supported := true
+	if err := setupMsg.Suite.Check(); err != nil {
+		supported = false
+		d.Unsupported = strings.ReplaceAll(err.Error(), "\n", "; ")
+	}
+	d.Supported = &supported
+	if !supported {
+		return
+	}
+
+	if err := setupMsg.Validate(); err != nil {
+		mu.Fatalf("error: invalid setup message:\n%v", err)
+	}
+
+	tree := setupMsg.GetPublicTree()
+	d.Members = len(setupMsg.IKeys)
+	for _, depth := range art.LeafDepths(d.Members) {
+		d.TreeDepth = max(d.TreeDepth, depth)
+	}
+	d.TreeHash = hex.EncodeToString(tree.Hash())
+	d.SUK = art.Fingerprint(setupMsg.GetSetupKey().Bytes())
+
+	findInitiator(d, setupMsg, data, opts)
+}
+
+// findInitiator identifies the initiator as the member whose IK verifies the
+// setup message's signature, if the signature file exists.
+func findInitiator(d *description, setupMsg *art.SetupMessage, data []byte, opts *options) {
+	sigFile := opts.sigFile
+	if sigFile == "" {
+		sigFile = opts.msgFile + ".sig"
+	}
+	sig, err := os.ReadFile(sigFile)
+	if errors.Is(err, fs.ErrNotExist) && opts.sigFile == "" {
+		return
+	}
+	if err != nil {
+		mu.Fatalf("error: can't read signature file: %v", err)
+	}
+
+	// indices maps the members' IKs in iks to their INDEXes, skipping blank
+	// leaves, which have no IK
+	iks := make([]crypto.PublicKey, 0, len(setupMsg.IKeys))
+	indices := make([]int, 0, len(setupMsg.IKeys))
+	for i, pem := range setupMsg.IKeys {
+		if len(pem) == 0 {
+			continue
+		}
+		ik, err := art.UnmarshalVerifyingKeyFromPEM(pem)
+		if err != nil {
+			mu.Fatalf("error: malformed IK of member %d: %v", i+1, err)
+		}
+		iks = append(iks, ik)
+		indices = append(indices, i+1)
+	}
+
+	i, err := art.VerifyAny(iks, data, sig)
+	if err != nil {
+		d.SignatureError = fmt.Sprintf("%s: %v", sigFile, err)
+		return
+	}
+	d.Initiator = indices[i]
+	if d.InitiatorIK, err = art.PublicKeyFingerprint(iks[i]); err != nil {
+		mu.Fatalf("error: %v", err)
+	}
+}
+
+// describeUpdateMessage describes the (decompressed) update message data.
+func describeUpdateMessage(d *description, data []byte) {
+	d.Kind = "update message"
+	d.Encoding = "json"
+
+	updateMsg, err := art.DecodeUpdateMessage(data)
+	if err != nil {
+		mu.Fatalf("error decoding update message: %v", err)
+	}
+	d.Updater = updateMsg.Idx
+	d.Epoch = updateMsg.Epoch
+	d.PathKeys = len(updateMsg.PathPublicKeys)
+}
+
+// printText prints the description as aligned "name: value" lines.
+func printText(d *description) {
+	var lines [][2]string
+	add := func(name, format string, args ...any) {
+		lines = append(lines, [2]string{name, fmt.Sprintf(format, args...)})
+	}
+
+	add("kind", "%s", d.Kind)
+	encoding := d.Encoding
+	if d.Version != 0 {
+		encoding = fmt.Sprintf("%s, version %d", encoding, d.Version)
+	}
+	if d.Compressed {
+		encoding += ", gzip-compressed"
+	}
+	add("encoding", "%s", encoding)
+
+	if d.Suite != nil {
+		order := d.Suite.Order
+		if order == "" {
+			order = art.OrderLevel
+		}
+		combine := d.Suite.Combine
+		if combine == "" {
+			combine = art.CombineDH
+		}
+		suite := fmt.Sprintf("curve %s, signature %s, kdf %s, combine %s, order %s",
+			d.Suite.Curve, d.Suite.Signature, d.Suite.KDF, combine, order)
+		if d.DefaultSuite {
+			suite += " (default)"
+		}
+		add("suite", "%s", suite)
+		if *d.Supported {
+			add("supported", "yes")
+		} else {
+			add("supported", "no: %s", d.Unsupported)
+		}
+	}
+	if d.Members != 0 {
+		add("members", "%d", d.Members)
+		add("tree depth", "%d", d.TreeDepth)
+		add("tree hash", "%s", d.TreeHash)
+		add("suk", "%s", d.SUK)
+		switch {
+		case d.Initiator != 0:
+			add("initiator", "member %d, IK %s", d.Initiator, d.InitiatorIK)
+		case d.SignatureError != "":
+			add("initiator", "unknown (%s)", d.SignatureError)
+		default:
+			add("initiator", "unknown (no signature)")
+		}
+	}
+
+	if d.Kind == "update message" {
+		add("updater", "member %d", d.Updater)
+		if d.Epoch != 0 {
+			add("epoch", "%d", d.Epoch)
+		} else {
+			add("epoch", "unknown (the message predates epochs)")
+		}
+		add("path keys", "%d", d.PathKeys)
+	}
+
+	width := 0
+	for _, line := range lines {
+		width = max(width, len(line[0]))
+	}
+	for _, line := range lines {
+		fmt.Printf("%-*s  %s\n", width+1, line[0]+":", line[1])
+	}
+}
+
+func main() {
+	opts := parseOptions()
+
+	raw, err := os.ReadFile(opts.msgFile)
+	if err != nil {
+		mu.Fatalf("error: can't read message file: %v", err)
+	}
+	data, err := art.ReadMessageFile(opts.msgFile)
+	if err != nil {
+		mu.Fatalf("error: can't read message file: %v", err)
+	}
+
+	d := description{Compressed: !bytes.Equal(raw, data)}
+	switch kind := art.SniffData(data); kind {
+	case art.FileSetupMessage:
+		describeSetupMessage(&d, data, opts)
+	case art.FileUpdateMessage:
+		describeUpdateMessage(&d, data)
+	default:
+		mu.Fatalf("error: %s is a %s, not a setup or an update message", opts.msgFile, kind)
+	}
+
+	if !opts.json {
+		printText(&d)
+		return
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(&d); err != nil {
+		mu.Fatalf("error: can't write the description: %v", err)
+	}
+}
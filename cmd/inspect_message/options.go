@@ -0,0 +1,80 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/syslab-wm/art/internal/defaults"
+	"github.com/syslab-wm/mu"
+)
+
+const shortUsage = "Usage: inspect_message [options] MSG_FILE"
+const usage = `Usage: inspect_message [options] MSG_FILE
+
+Describe a setup or an update message, without any private key: what the
+message is, and whether this build can process it.
+
+For a setup message, the program prints the encoding (JSON, or binary and
+its version) and whether the file is gzip-compressed; the suite (curve,
+signature scheme, KDF, node key combination and tree key order) and whether
+this build supports it; the number of members and the depth of the tree;
+the tree hash (the SHA-256 digest of the tree's raw public keys, in level
+order, whatever the message's key order); the fingerprint (the hex-encoded
+SHA-256 digest of the raw public key) of the setup key (SUK); and, if the
+message's signature is available, the INDEX and the IK fingerprint of the
+member whose IK verifies it, i.e., the initiator.  A setup message does not
+name its initiator, so without the signature the initiator is unknown.
+
+For an update message, the program prints the updater's INDEX, the epoch
+after the update, and the number of keys on the updater's path.
+
+positional arguments:
+  MSG_FILE
+	The message file.
+
+options:
+  -h, -help
+    Show this usage statement and exit.
+
+  -sig-file SIG_FILE
+    The setup message's signature file, to identify the initiator.  If
+    omitted, MSG_FILE.sig is used, if it exists.
+
+  -json
+    Print the description as a JSON object rather than as text.
+
+examples:
+  ./inspect_message setup.msg
+  ./inspect_message -json cici_update_key`
+
+func printUsage() {
+	fmt.Println(usage)
+}
+
+type options struct {
+	// positional arguments
+	msgFile string
+
+	// options
+	sigFile string
+	json    bool
+}
+
+func parseOptions() *options {
+	opts := options{}
+
+	flag.Usage = printUsage
+	flag.StringVar(&opts.sigFile, "sig-file", "", "")
+	flag.BoolVar(&opts.json, "json", false, "")
+	if err := defaults.Load(flag.CommandLine, "inspect_message"); err != nil {
+		mu.Fatalf("error: %v", err)
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		mu.Fatalf(shortUsage)
+	}
+	opts.msgFile = flag.Arg(0)
+
+	return &opts
+}
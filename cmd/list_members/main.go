@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/syslab-wm/art"
+	"github.com/syslab-wm/mu"
+)
+
+// safetyNumber returns the line with the safety number of the stage key of
+// the state in file.
+func safetyNumber(file string) string {
+	kind, err := art.SniffFile(file)
+	if err != nil {
+		mu.Fatalf("error: can't read file: %v", err)
+	}
+	if kind != art.FileTreeState {
+		mu.Fatalf("error: -safety-number needs a state file, but %s is a %s", file, kind)
+	}
+
+	state, err := art.LoadPartialTreeState(file)
+	if err != nil {
+		mu.Fatalf("error reading tree state from %s: %v", file, err)
+	}
+	if state.Sk == nil {
+		mu.Fatalf("error: %s has no stage key (see repair_state)", file)
+	}
+	return fmt.Sprintf("safety number (epoch %d): %s", state.Epoch,
+		art.StageKeyFingerprint(state.Sk))
+}
+
+// readMembers reads the members' IKs and leaf metadata from file, which is a
+// setup message or a tree state.
+func readMembers(file string) (iKeys [][]byte, metadata []string) {
+	kind, err := art.SniffFile(file)
+	if err != nil {
+		mu.Fatalf("error: can't read file: %v", err)
+	}
+
+	switch kind {
+	case art.FileSetupMessage:
+		var setupMsg art.SetupMessage
+		setupMsg.Read(file)
+		return setupMsg.IKeys, setupMsg.LeafMetadata
+	case art.FileTreeState:
+		state, err := art.LoadPartialTreeState(file)
+		if err != nil {
+			mu.Fatalf("error reading tree state from %s: %v", file, err)
+		}
+		return state.IKeys, state.LeafMetadata
+	default:
+		mu.Fatalf("error: %s is neither a setup message nor a tree state", file)
+		return nil, nil
+	}
+}
+
+func main() {
+	opts := parseOptions()
+
+	iKeys, metadata := readMembers(opts.file)
+	var safetyNumberLine string
+	if opts.safetyNumber {
+		safetyNumberLine = safetyNumber(opts.file)
+	}
+	if len(metadata) != 0 && len(metadata) != len(iKeys) {
+		mu.Fatalf("error: %d members but %d leaf metadata entries", len(iKeys),
+			len(metadata))
+	}
+
+	for i, pem := range iKeys {
+		// no member holds a blank leaf
+		if len(pem) == 0 {
+			fmt.Printf("%d\t(blank)\n", i+1)
+			continue
+		}
+		ik, err := art.UnmarshalPublicIKFromPEM(pem)
+		if err != nil {
+			mu.Fatalf("error: malformed IK of member %d: %v", i+1, err)
+		}
+
+		line := fmt.Sprintf("%d\t%s", i+1, art.Fingerprint(ik))
+		if len(metadata) != 0 && metadata[i] != "" {
+			line += "\t" + metadata[i]
+		}
+		fmt.Println(line)
+	}
+
+	if opts.safetyNumber {
+		fmt.Println(safetyNumberLine)
+	}
+}
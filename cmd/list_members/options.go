@@ -0,0 +1,65 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/syslab-wm/art/internal/defaults"
+	"github.com/syslab-wm/mu"
+)
+
+const shortUsage = "Usage: list_members [options] FILE"
+const usage = `Usage: list_members [options] FILE
+
+List the members of a group: one line per member, with the member's INDEX,
+the fingerprint of its IK (the hex-encoded SHA-256 digest of the raw Ed25519
+public key), and the metadata of its leaf, if any (see setup_group's
+-leaf-metadata).
+
+positional arguments:
+  FILE
+	A setup message, or a member's state file.
+
+options:
+  -h, -help
+    Show this usage statement and exit.
+
+  -safety-number
+    After the members, print the safety number of the state's stage key
+    (and the state's epoch): 60 digits that members can read to each other
+    out-of-band to confirm that they are in the same group, at the same
+    epoch.  FILE must be a state file with a stage key.
+
+examples:
+  ./list_members setup.msg
+  ./list_members -safety-number alice-state.json`
+
+func printUsage() {
+	fmt.Println(usage)
+}
+
+type options struct {
+	// positional arguments
+	file string
+
+	// options
+	safetyNumber bool
+}
+
+func parseOptions() *options {
+	opts := options{}
+
+	flag.Usage = printUsage
+	flag.BoolVar(&opts.safetyNumber, "safety-number", false, "")
+	if err := defaults.Load(flag.CommandLine, "list_members"); err != nil {
+		mu.Fatalf("error: %v", err)
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		mu.Fatalf(shortUsage)
+	}
+	opts.file = flag.Arg(0)
+
+	return &opts
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"crypto"
+
+	"github.com/syslab-wm/art"
+	"github.com/syslab-wm/art/internal/fileutl"
+	"github.com/syslab-wm/art/internal/jsonutl"
+	"github.com/syslab-wm/mu"
+)
+
+// verifyInput fails unless the signature in opts.inSigFile of the message in
+// opts.inFile verifies with the public key of sk, so that -sign never
+// re-signs a message that its signer did not sign.
+func verifyInput(opts *options, sk crypto.Signer) {
+	valid, err := art.VerifySignatureWithKey(sk.Public(), opts.inFile, opts.inSigFile)
+	if err != nil {
+		mu.Fatalf("error: %v", err)
+	}
+	if !valid {
+		mu.Fatalf("error: the signature %s of %s does not verify with the key in %s; "+
+			"use -no-verify to re-sign it anyway", opts.inSigFile, opts.inFile,
+			opts.privIKFile)
+	}
+}
+
+func main() {
+	opts := parseOptions()
+
+	var sk crypto.Signer
+	if opts.privIKFile != "" {
+		var err error
+		sk, err = art.ReadSigningKeyFromFile(opts.privIKFile, art.EncodingPEM)
+		if err != nil {
+			mu.Fatalf("error: can't read private key file: %v", err)
+		}
+		if !opts.noVerify {
+			verifyInput(opts, sk)
+		}
+	}
+
+	data, err := art.ReadMessageFile(opts.inFile)
+	if err != nil {
+		mu.Fatalf("error: can't read message file: %v", err)
+	}
+
+	setupMsg, err := art.DecodeSetupMessage(data)
+	if err != nil {
+		mu.Fatalf("error: can't decode message file: %v", err)
+	}
+
+	if opts.privIKFile != "" {
+		err = setupMsg.SetSignatureScheme(opts.privIKFile)
+		if err != nil {
+			mu.Fatalf("error: %v", err)
+		}
+	}
+
+	to := opts.to
+	if to == "" {
+		to = "binary"
+		if art.IsBinarySetupMessage(data) {
+			to = "json"
+		}
+	}
+
+	var encoded []byte
+	if to == "json" {
+		encoded, err = jsonutl.Marshal(setupMsg)
+	} else {
+		encoded, err = setupMsg.MarshalBinary()
+	}
+	if err != nil {
+		mu.Fatalf("error: can't encode message: %v", err)
+	}
+	err = art.WriteMessageFile(opts.outFile, encoded)
+	if err != nil {
+		mu.Fatalf("error: can't write message file: %v", err)
+	}
+
+	if sk != nil {
+		// the signature covers the uncompressed bytes, as SignFile's does
+		sig, err := art.Sign(sk, encoded)
+		if err != nil {
+			mu.Fatalf("error: can't sign message: %v", err)
+		}
+		err = fileutl.WriteFile(opts.sigFile, sig, 0440)
+		if err != nil {
+			mu.Fatalf("error: can't write signature file: %v", err)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/syslab-wm/art/internal/defaults"
+	"github.com/syslab-wm/mu"
+)
+
+const shortUsage = "Usage: msgconv [options] IN_FILE OUT_FILE"
+const usage = `Usage: msgconv [options] IN_FILE OUT_FILE
+
+Convert a setup message between the JSON and binary encodings.
+
+positional arguments:
+  IN_FILE
+    The setup message to convert.  The encoding of IN_FILE, and whether it
+    is gzip-compressed, are detected automatically.
+
+  OUT_FILE
+    The file to write the converted setup message to.  If OUT_FILE ends in
+    .gz, it is gzip-compressed.
+
+options:
+  -h, -help
+    Show this usage statement and exit.
+
+  -to json|binary
+    The encoding of OUT_FILE.  If omitted, OUT_FILE uses whichever encoding
+    IN_FILE does not.
+
+  -sign PRIV_IK_FILE
+    Sign OUT_FILE with the initiator's private identity key (a PEM-encoded
+    ED25519 key).  Because the signature covers the encoded bytes, a
+    converted message must be re-signed before members can verify it.
+    IN_FILE's signature must verify with the same key, so that a message
+    the initiator did not sign is never re-signed (see -no-verify).
+
+  -sig-file SIG_FILE
+    The signature file to write when -sign is given.  If omitted, the
+    signature is saved to file OUT_FILE.sig
+
+  -in-sig-file IN_SIG_FILE
+    The signature of IN_FILE to verify when -sign is given.  If omitted,
+    the signature is read from IN_FILE.sig
+
+  -no-verify
+    Re-sign IN_FILE with -sign without verifying its signature.
+
+examples:
+  ./msgconv -to binary -sign alice-ik.pem setup.msg setup.bin`
+
+type options struct {
+	// positional
+	inFile  string
+	outFile string
+
+	// options
+	to         string
+	privIKFile string
+	sigFile    string
+	inSigFile  string
+	noVerify   bool
+}
+
+func printUsage() {
+	fmt.Println(usage)
+}
+
+func parseOptions() *options {
+	opts := options{}
+
+	flag.Usage = printUsage
+	flag.StringVar(&opts.to, "to", "", "")
+	flag.StringVar(&opts.privIKFile, "sign", "", "")
+	flag.StringVar(&opts.sigFile, "sig-file", "", "")
+	flag.StringVar(&opts.inSigFile, "in-sig-file", "", "")
+	flag.BoolVar(&opts.noVerify, "no-verify", false, "")
+	if err := defaults.Load(flag.CommandLine, "msgconv"); err != nil {
+		mu.Fatalf("error: %v", err)
+	}
+	flag.Parse()
+
+	opts.to = strings.ToLower(opts.to)
+	if opts.to != "" && opts.to != "json" && opts.to != "binary" {
+		mu.Fatalf("error: -to invalid value %q (must be json|binary)", opts.to)
+	}
+
+	if flag.NArg() != 2 {
+		mu.Fatalf(shortUsage)
+	}
+	opts.inFile = flag.Arg(0)
+	opts.outFile = flag.Arg(1)
+
+	if opts.sigFile == "" {
+		opts.sigFile = opts.outFile + ".sig"
+	}
+	if opts.inSigFile == "" {
+		opts.inSigFile = opts.inFile + ".sig"
+	}
+
+	return &opts
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"os"
+
+	"github.com/syslab-wm/art"
+	"github.com/syslab-wm/mu"
+)
+
+func main() {
+	opts := parseOptions()
+
+	var setupMsg art.SetupMessage
+	setupMsg.Read(opts.setupMessageFile)
+	if err := setupMsg.Validate(); err != nil {
+		mu.Fatalf("error: invalid setup message:\n%v", err)
+	}
+
+	leafKeys := make([]*ecdh.PrivateKey, 0, len(opts.leafKeyFiles))
+	for _, file := range opts.leafKeyFiles {
+		leafKey, err := art.ReadPrivateEKFromFile(file, art.EncodingPEM)
+		if err != nil {
+			mu.Fatalf("error: can't read leaf key %s: %v", file, err)
+		}
+		leafKeys = append(leafKeys, leafKey)
+	}
+
+	var prevStageKey ed25519.PrivateKey
+	if opts.prevStageKeyFile != "" {
+		var err error
+		prevStageKey, err = art.ReadPrivateIKFromFile(opts.prevStageKeyFile, art.EncodingPEM)
+		if err != nil {
+			mu.Fatalf("error: can't read previous stage key: %v", err)
+		}
+	}
+
+	stageKey, err := art.OracleStageKey(&setupMsg, leafKeys, prevStageKey)
+	if err != nil {
+		mu.Fatalf("error: %v", err)
+	}
+
+	pem, err := art.MarshalPrivateIKToPEM(stageKey)
+	if err != nil {
+		mu.Fatalf("error encoding stage key: %v", err)
+	}
+	os.Stdout.Write(pem)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/syslab-wm/art/internal/defaults"
+	"github.com/syslab-wm/mu"
+)
+
+const shortUsage = "Usage: oracle_stage_key [options] SETUP_MSG_FILE LEAF_KEY_FILE..."
+const usage = `Usage: oracle_stage_key [options] SETUP_MSG_FILE LEAF_KEY_FILE...
+
+FOR TESTING AND KEY ESCROW ONLY.  Compute the group's stage key from every
+member's private leaf key, as a reference for the stage keys that the members
+derive on their own.  The leaf keys are combined up the tree, as the
+initiator does at setup, so that the result does not depend on any member's
+copath or state.  Members never need this tool, and whoever holds all the
+leaf keys can read all of the group's traffic.
+
+The stage key is written to stdout, as a PEM-encoded Ed25519 private key (the
+format of the stage-key-*.pem files of the other tools).
+
+positional arguments:
+  SETUP_MSG_FILE
+	The group's setup message.  Its signature is not verified.
+
+  LEAF_KEY_FILE...
+	The members' private leaf keys, one file per member, in INDEX order.  Each
+	is a PEM-encoded X25519 private key (e.g., from process_setup_message
+	-out-leaf-key or setup_group -leaf-keys).
+
+options:
+  -h, -help
+    Show this usage statement and exit.
+
+  -prev-stage-key STAGE_KEY_FILE
+    Compute the stage key that follows the one in STAGE_KEY_FILE, for the
+    tree of the given leaf keys, e.g., after a member updated its leaf key.
+    Without this option, the result is the stage key of the setup message,
+    and the leaf keys must be the leaves of the setup message's tree.
+
+examples:
+  ./oracle_stage_key setup.msg alice-lk.pem bob-lk.pem cici-lk.pem
+  ./oracle_stage_key -prev-stage-key stage-0.pem setup.msg alice-lk.pem \
+		bob-lk.pem cici-lk-1.pem`
+
+func printUsage() {
+	fmt.Println(usage)
+}
+
+type options struct {
+	// positional arguments
+	setupMessageFile string
+	leafKeyFiles     []string
+
+	// options
+	prevStageKeyFile string
+}
+
+func parseOptions() *options {
+	opts := options{}
+
+	flag.Usage = printUsage
+	flag.StringVar(&opts.prevStageKeyFile, "prev-stage-key", "", "")
+	if err := defaults.Load(flag.CommandLine, "oracle_stage_key"); err != nil {
+		mu.Fatalf("error: %v", err)
+	}
+	flag.Parse()
+
+	if flag.NArg() < 2 {
+		mu.Fatalf(shortUsage)
+	}
+	opts.setupMessageFile = flag.Arg(0)
+	opts.leafKeyFiles = flag.Args()[1:]
+
+	return &opts
+}
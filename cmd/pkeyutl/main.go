@@ -1,7 +1,6 @@
 package main
 
 import (
-	"crypto/ed25519"
 	"fmt"
 	"os"
 
@@ -10,13 +9,12 @@ import (
 )
 
 func doSign(privPath string, keyform art.KeyEncoding, msgData []byte, sigfile string) error {
-	privKey, err := art.ReadPrivateIKFromFile(privPath, keyform)
+	privKey, err := art.ReadSigningKeyFromFile(privPath, keyform)
 	if err != nil {
 		return fmt.Errorf("can't read private key file: %v", err)
 	}
 
-	// regular Ed25519
-	sigData, err := privKey.Sign(nil, msgData, &ed25519.Options{Hash: 0})
+	sigData, err := art.Sign(privKey, msgData)
 	if err != nil {
 		return fmt.Errorf("can't sign message: %v", err)
 	}
@@ -30,7 +28,7 @@ func doSign(privPath string, keyform art.KeyEncoding, msgData []byte, sigfile st
 }
 
 func doVerify(pubPath string, keyform art.KeyEncoding, msgData []byte, sigfile string) (bool, error) {
-	pubKey, err := art.ReadPublicIKFromFile(pubPath, keyform)
+	pubKey, err := art.ReadVerifyingKeyFromFile(pubPath, keyform)
 	if err != nil {
 		return false, fmt.Errorf("can't read public key file: %v", err)
 	}
@@ -39,9 +37,11 @@ func doVerify(pubPath string, keyform art.KeyEncoding, msgData []byte, sigfile s
 	if err != nil {
 		return false, fmt.Errorf("can't read sigfile: %v", err)
 	}
+	if err := art.CheckSignatureFormat(pubKey, sigData); err != nil {
+		return false, err
+	}
 
-	// regular Ed25519
-	valid := ed25519.Verify(pubKey, msgData, sigData)
+	valid := art.Verify(pubKey, msgData, sigData)
 	return valid, nil
 }
 
@@ -5,6 +5,7 @@ import (
 	"fmt"
 
 	"github.com/syslab-wm/art"
+	"github.com/syslab-wm/art/internal/defaults"
 	"github.com/syslab-wm/mu"
 )
 
@@ -27,13 +28,15 @@ options:
 
   -verify
     Verify SIGFILE is a valid signature for MSGFILE using KEYFILE, which must
-    be an ED25519 public key. The process prints a message with the
+    be an ED25519 or ECDSA P-256 public key. The process prints a message with the
     verification results, and has an exit status of 0 if verification
     succeeded, and 1 if it failed.
 
   -key KEYFILE
-    For signing, an ED25519 private key.  For verifying, an ED25519 signing
-    key.
+    For signing, an ED25519 or ECDSA P-256 private key.  For verifying, an
+    ED25519 or ECDSA P-256 public key.  The signature algorithm follows from
+    the key's type; raw keys are always ED25519.  A raw private key may be
+    either the 32-byte seed or the 64-byte expanded key.
 
   -keyform raw|der|pem  (default: pem)
     The encoding for KEYFILE.
@@ -77,6 +80,9 @@ func parseOptions() *options {
 	flag.StringVar(&opts.keyform, "keyform", "pem", "")
 	flag.StringVar(&opts.sigfile, "sigfile", "", "")
 
+	if err := defaults.Load(flag.CommandLine, "pkeyutl"); err != nil {
+		mu.Fatalf("error: %v", err)
+	}
 	flag.Parse()
 
 	if !opts.sign && !opts.verify {
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/syslab-wm/art"
+	"github.com/syslab-wm/mu"
+)
+
+// readCopathNodes assembles the copath of the member from the per-node files
+// named by COPATH_FILE: the .json files in a directory, or the files that
+// match a glob pattern.
+func readCopathNodes(opts *options) *art.CopathMessage {
+	var files []string
+	var err error
+
+	info, err := os.Stat(opts.copathFile)
+	if err == nil && info.IsDir() {
+		files, err = filepath.Glob(filepath.Join(opts.copathFile, "*.json"))
+	} else {
+		files, err = filepath.Glob(opts.copathFile)
+	}
+	if err != nil {
+		mu.Fatalf("error: bad COPATH_FILE pattern: %v", err)
+	}
+	if len(files) == 0 {
+		mu.Fatalf("error: no copath node files match %s", opts.copathFile)
+	}
+
+	nodes := make([]art.CopathNode, 0, len(files))
+	for _, file := range files {
+		node, err := art.ReadCopathNode(file)
+		if err != nil {
+			mu.Fatalf("error: %s: %v", file, err)
+		}
+		nodes = append(nodes, *node)
+	}
+
+	copath, err := art.AssembleCopath(opts.index, opts.numLeaves, nodes)
+	if err != nil {
+		mu.Fatalf("error: can't assemble the copath: %v", err)
+	}
+	return copath
+}
+
+// verifyMAC fails unless the copath's MAC verifies with the stage key in
+// opts.stageKeyFile.
+func verifyMAC(opts *options, copath *art.CopathMessage) {
+	stageKey, err := art.ReadPrivateIKFromFile(opts.stageKeyFile, art.EncodingPEM)
+	if err != nil {
+		mu.Fatalf("error: can't read stage key file: %v", err)
+	}
+	mac, err := os.ReadFile(opts.macFile)
+	if err != nil {
+		mu.Fatalf("error: can't read copath MAC file: %v", err)
+	}
+	if !copath.VerifyMAC(stageKey, mac) {
+		mu.Fatalf("error: the copath's MAC %s does not verify with the stage key",
+			opts.macFile)
+	}
+}
+
+func main() {
+	opts := parseOptions()
+
+	suk, err := art.ReadPublicEKFromFile(opts.sukFile, art.EncodingPEM)
+	if err != nil {
+		mu.Fatalf("error: can't read SUK file: %v", err)
+	}
+
+	var copath art.CopathMessage
+	if opts.numLeaves != 0 {
+		copath = *readCopathNodes(opts)
+	} else {
+		copath.Read(opts.copathFile)
+	}
+	if copath.Idx != opts.index {
+		mu.Fatalf("error: COPATH_FILE is for member %d, not member %d",
+			copath.Idx, opts.index)
+	}
+	if !opts.noVerify {
+		verifyMAC(opts, &copath)
+	}
+
+	leafKey := art.DeriveLeafKeyOrFail(opts.privEKFile, suk)
+
+	treeKey, err := copath.DeriveTreeKey(leafKey)
+	if err != nil {
+		mu.Fatalf("error: can't derive the tree key: %v", err)
+	}
+
+	err = art.WritePrivateEKToFile(treeKey, opts.treeKeyFile, art.EncodingPEM)
+	if err != nil {
+		mu.Fatalf("error: can't write tree key file: %v", err)
+	}
+
+	fmt.Printf("public tree key: %s\n", art.Fingerprint(art.PublicOf(treeKey).Bytes()))
+}
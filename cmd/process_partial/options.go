@@ -0,0 +1,155 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+
+	"github.com/syslab-wm/art"
+	"github.com/syslab-wm/art/internal/defaults"
+	"github.com/syslab-wm/mu"
+)
+
+const shortUsage = `Usage: process_partial [options] INDEX PRIV_EK_FILE SUK_FILE \
+	COPATH_FILE`
+const usage = `Usage: process_partial [options] INDEX PRIV_EK_FILE SUK_FILE \
+	COPATH_FILE
+
+Derive the tree key as the group member at position INDEX from just the
+member's copath, rather than from the full setup message.  This is meant for
+bandwidth-constrained members.
+
+Note that the stage key is derived over every public key in the tree and
+every member's identity key, so it cannot be computed from the copath alone;
+this program derives the tree key (the private key of the root).
+
+The copath is authenticated with its MAC under the group's stage key (see
+extract_copath), which the member must therefore hold; give it with
+-stage-key, or skip the check, explicitly, with -no-verify.
+
+positional arguments:
+  INDEX
+	The index position of the 'current' group member, this index is based off
+	the member's position in the group config file, where the first entry is
+	at index 1.
+
+  PRIV_EK_FILE
+	The 'current' group member's private ephemeral key file (also called a
+	prekey).  This is a PEM-encoded X25519 private key.
+
+  SUK_FILE
+	The group's public setup key (SUK).  This is a PEM-encoded X25519 public
+	key.
+
+  COPATH_FILE
+	The file containing the member's copath, as written by extract_copath.
+	With -num-leaves, COPATH_FILE is instead a directory, or a glob pattern
+	(quoted, e.g. 'bob.d/node-*.json'), of files that each hold one copath
+	node, as written by extract_copath -split; every .json file in a
+	directory is read.  The nodes may come in any order, but all of the
+	member's copath nodes must be present, and no others.
+
+options:
+  -h, -help
+    Show this usage statement and exit.
+
+  -out-tree-key TREE_KEY_FILE
+    The file to write the tree key to, as a PEM-encoded X25519 private key.
+    If not provided, the default is tree-key.pem.
+
+  -stage-key STAGE_KEY_FILE
+    The stage key to verify the copath's MAC with, as a PEM-encoded Ed25519
+    private key.  This is required unless -no-verify is given.
+
+  -mac-file MAC_FILE
+    The copath's MAC, as written by extract_copath.  If not provided, the
+    default is COPATH_FILE.mac; with -num-leaves, it is required (unless
+    -no-verify is given).
+
+  -no-verify
+    Derive the tree key without verifying the copath's MAC, e.g., for a
+    member that does not hold the stage key.  A tampered copath then goes
+    undetected, and yields the wrong tree key.
+
+  -num-leaves N
+    The number of leaves (members) in the tree; this is required, and only
+    allowed, when COPATH_FILE names per-node files, which do not record the
+    size of the tree.
+
+examples:
+  ./process_partial -stage-key bob-stage-key.pem 2 bob-ek.pem suk.pem bob.copath
+  ./process_partial -stage-key bob-stage-key.pem -num-leaves 5 \
+		-mac-file bob.copath.mac 2 bob-ek.pem suk.pem bob.d`
+
+func printUsage() {
+	fmt.Println(usage)
+}
+
+type options struct {
+	// positional arguments
+	index      int
+	privEKFile string
+	sukFile    string
+	copathFile string
+
+	// options
+	treeKeyFile  string
+	stageKeyFile string
+	macFile      string
+	noVerify     bool
+	numLeaves    int
+}
+
+func parseOptions() *options {
+	var err error
+	opts := options{}
+
+	flag.Usage = printUsage
+	flag.StringVar(&opts.treeKeyFile, "out-tree-key", "tree-key.pem", "")
+	flag.StringVar(&opts.stageKeyFile, "stage-key", "", "")
+	flag.StringVar(&opts.macFile, "mac-file", "", "")
+	flag.BoolVar(&opts.noVerify, "no-verify", false, "")
+	flag.IntVar(&opts.numLeaves, "num-leaves", 0, "")
+	if err := defaults.Load(flag.CommandLine, "process_partial"); err != nil {
+		mu.Fatalf("error: %v", err)
+	}
+	flag.Parse()
+
+	if flag.NArg() != 4 {
+		mu.Fatalf(shortUsage)
+	}
+
+	opts.index, err = strconv.Atoi(flag.Arg(0))
+	if err != nil {
+		mu.Fatalf("error converting positional argument INDEX to int: %v", err)
+	}
+	opts.privEKFile = flag.Arg(1)
+	opts.sukFile = flag.Arg(2)
+	opts.copathFile = flag.Arg(3)
+
+	copathKind := art.FileCopathMessage
+	if opts.numLeaves != 0 {
+		copathKind = art.FileUnknown
+	}
+	err = art.CheckArgKinds(flag.Args(), art.FileUnknown, art.FilePEMKey, art.FilePEMKey,
+		copathKind)
+	if err != nil {
+		mu.Fatalf("error: %v", err)
+	}
+
+	if !opts.noVerify {
+		if opts.stageKeyFile == "" {
+			mu.Fatalf("error: -stage-key is required to verify the copath's MAC " +
+				"(or give -no-verify)")
+		}
+		if opts.macFile == "" {
+			if opts.numLeaves != 0 {
+				mu.Fatalf("error: -mac-file is required with -num-leaves (or give " +
+					"-no-verify)")
+			}
+			opts.macFile = opts.copathFile + ".mac"
+		}
+	}
+
+	return &opts
+}
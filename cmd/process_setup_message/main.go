@@ -1,19 +1,329 @@
 package main
 
 import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/syslab-wm/art"
+	"github.com/syslab-wm/art/internal/auditlog"
+	"github.com/syslab-wm/art/internal/fputl"
+	"github.com/syslab-wm/art/internal/profile"
+	"github.com/syslab-wm/art/internal/watchdog"
+	"github.com/syslab-wm/mu"
 )
 
+// auditSkippedVerification records that the setup message's signature was
+// not verified, why, and which message was accepted.
+func auditSkippedVerification(setupMsgFile, reason string) {
+	data, err := art.ReadMessageFile(setupMsgFile)
+	if err != nil {
+		mu.Fatalf("error: can't read setup message file: %v", err)
+	}
+
+	fmt.Fprintf(os.Stderr, "AUDIT: signature verification SKIPPED for %s "+
+		"(sha256 %s); trusted source: %s\n", setupMsgFile, art.Fingerprint(data),
+		reason)
+}
+
+// checkSukHistory warns if the setup message's SUK is listed in historyFile,
+// and then adds it to the list.
+func checkSukHistory(setupMsg *art.SetupMessage, historyFile string) {
+	seen, err := fputl.ReadFile(historyFile)
+	if err != nil {
+		mu.Fatalf("error: can't read SUK history file: %v", err)
+	}
+
+	id := art.Fingerprint(setupMsg.GetSetupKey().Bytes())
+	if seen[id] {
+		fmt.Fprintf(os.Stderr, "warning: the SUK (%s) was used by a setup message "+
+			"processed earlier; the initiator reused its setup key\n", id)
+		return
+	}
+
+	err = fputl.AppendFile(historyFile, []string{id})
+	if err != nil {
+		mu.Fatalf("error: can't update SUK history file: %v", err)
+	}
+}
+
+// readInitiatorIK reads the initiator's IK that the setup message must be
+// signed by: the IK in INITIATOR_PUB_IK_FILE or, with -ik-rotation, the IK
+// that the chain of rotations leads to from it.
+func readInitiatorIK(opts *options) crypto.PublicKey {
+	ik, err := art.ReadVerifyingKeyFromFile(opts.initiatorPubIKFile, art.EncodingPEM)
+	if err != nil {
+		mu.Fatalf("error: can't read initiator's IK: %v", err)
+	}
+	if opts.ikRotationFile == "" {
+		return ik
+	}
+
+	chain, err := art.ReadIKRotationsFromFile(opts.ikRotationFile)
+	if err != nil {
+		mu.Fatalf("error: can't read IK rotation file: %v", err)
+	}
+	ik, err = art.FollowIKRotations(ik, chain)
+	if err != nil {
+		mu.Fatalf("error: can't follow the initiator's IK rotations: %v", err)
+	}
+	return ik
+}
+
+// verifySignature fails if the setup message is not signed by the
+// initiator's IK ik.
+func verifySignature(opts *options, ik crypto.PublicKey) {
+	valid, err := art.VerifySignatureWithKey(ik, opts.setupMessageFile, opts.sigFile)
+	if err != nil {
+		mu.Fatalf("error: %v", err)
+	}
+	if !valid {
+		mu.Fatalf("error: message signature verification failed for %v",
+			opts.setupMessageFile)
+	}
+}
+
+// verifyAnySignature fails unless the setup message is signed by one of the
+// trusted IKs: INITIATOR_PUB_IK_FILE or a .pem file in the -ik-dir.  It
+// reports which IK matched, and returns it.
+func verifyAnySignature(opts *options) crypto.PublicKey {
+	files, err := filepath.Glob(filepath.Join(opts.ikDir, "*.pem"))
+	if err != nil {
+		mu.Fatalf("error: %v", err)
+	}
+	files = append([]string{opts.initiatorPubIKFile}, files...)
+
+	iks := make([]crypto.PublicKey, 0, len(files))
+	for _, file := range files {
+		ik, err := art.ReadVerifyingKeyFromFile(file, art.EncodingPEM)
+		if err != nil {
+			mu.Fatalf("error: can't read trusted IK %s: %v", file, err)
+		}
+		iks = append(iks, ik)
+	}
+
+	data, err := art.ReadMessageFile(opts.setupMessageFile)
+	if err != nil {
+		mu.Fatalf("error: can't read setup message file: %v", err)
+	}
+	sig, err := os.ReadFile(opts.sigFile)
+	if err != nil {
+		mu.Fatalf("error: can't read signature file: %v", err)
+	}
+
+	i, err := art.VerifyAny(iks, data, sig)
+	if err != nil {
+		mu.Fatalf("error: message signature verification failed for %v: %v",
+			opts.setupMessageFile, err)
+	}
+
+	id, err := art.PublicKeyFingerprint(iks[i])
+	if err != nil {
+		mu.Fatalf("error: %v", err)
+	}
+	fmt.Fprintf(os.Stderr, "setup message signed by the IK in %s (%s)\n", files[i], id)
+	return iks[i]
+}
+
+// explainCopath prints the copath of the member at position index in the
+// state's tree, in the order in which the path keys are derived from it.
+func explainCopath(index int, state *art.TreeState) {
+	indices, err := art.CoPathIndices(state.PublicTree, index)
+	if err != nil {
+		mu.Fatalf("error: %v", err)
+	}
+	copath, err := art.CoPath(state.PublicTree, index, nil)
+	if err != nil {
+		mu.Fatalf("error: %v", err)
+	}
+
+	fmt.Fprintf(os.Stderr, "copath of member %d, from the root's child down:\n", index)
+	for i, pk := range copath {
+		fmt.Fprintf(os.Stderr, "  node %d\t%s\n", indices[i], art.Fingerprint(pk.Bytes()))
+	}
+}
+
+// audit appends a record of the processed setup message to logFile.  The
+// signer is the initiator's IK, or nil if the signature was not verified.
+func audit(logFile string, opts *options, signer crypto.PublicKey,
+	setupMsg *art.SetupMessage, state *art.TreeState) {
+
+	rec := auditlog.Record{
+		Time:     time.Now().UTC(),
+		Type:     "setup",
+		File:     opts.setupMessageFile,
+		Member:   opts.index,
+		Epoch:    state.Epoch,
+		StageKey: art.Fingerprint(state.StageKey().Public().(ed25519.PublicKey)),
+	}
+	hash := setupMsg.Hash()
+	rec.MessageHash = hex.EncodeToString(hash[:])
+
+	if signer != nil {
+		var err error
+		rec.Signer, err = art.PublicKeyFingerprint(signer)
+		if err != nil {
+			mu.Fatalf("error: %v", err)
+		}
+	}
+
+	if err := auditlog.Append(logFile, &rec); err != nil {
+		mu.Fatalf("error: can't write audit log: %v", err)
+	}
+}
+
+// readSuppliedLeafKey reads the member's leaf key from the -leaf-key-file,
+// and fails unless it is the member's leaf in the setup message's tree.
+func readSuppliedLeafKey(opts *options, setupMsg *art.SetupMessage) *ecdh.PrivateKey {
+	leafKey, err := art.ReadPrivateEKFromFile(opts.suppliedLeafKeyFile, art.EncodingPEM)
+	if err != nil {
+		mu.Fatalf("error: can't read leaf key file: %v", err)
+	}
+	if err := setupMsg.CheckLeafKey(opts.index, leafKey); err != nil {
+		mu.Fatalf("error: %s: %v", opts.suppliedLeafKeyFile, err)
+	}
+	return leafKey
+}
+
+// saveState writes the member's state to the -out-state file.
+func saveState(opts *options, state *art.TreeState) {
+	if !opts.noOverwrite {
+		state.Save(opts.treeStateFile)
+		return
+	}
+
+	err := art.SaveNewTreeState(opts.treeStateFile, state)
+	if errors.Is(err, fs.ErrExist) {
+		mu.Fatalf("error: %s already exists (-no-overwrite)", opts.treeStateFile)
+	}
+	if err != nil {
+		mu.Fatalf("error saving tree state to %s: %v", opts.treeStateFile, err)
+	}
+}
+
+// printStageKey writes the stage key to stdout, as a PEM-encoded Ed25519
+// private key.
+func printStageKey(state *art.TreeState) {
+	pem, err := art.MarshalPrivateIKToPEM(state.Sk)
+	if err != nil {
+		mu.Fatalf("error encoding stage key: %v", err)
+	}
+	os.Stdout.Write(pem)
+}
+
 func main() {
 	opts := parseOptions()
+	defer profile.Start(opts.cpuProfile, opts.memProfile)()
+	wd := watchdog.Start(opts.timeout)
+
+	var setupMsg art.SetupMessage
+	setupMsg.Read(opts.setupMessageFile)
+
+	// fail fast, before verifying the signature, if the group uses algorithms
+	// this build doesn't support
+	if err := setupMsg.Suite.Check(); err != nil {
+		mu.Fatalf("error: unsupported setup message:\n%v", err)
+	}
+
+	var initiatorIK crypto.PublicKey
+	if opts.trustedSource != "" {
+		auditSkippedVerification(opts.setupMessageFile, opts.trustedSource)
+	} else if opts.ikDir != "" {
+		initiatorIK = verifyAnySignature(opts)
+	} else {
+		initiatorIK = readInitiatorIK(opts)
+		verifySignature(opts, initiatorIK)
+	}
+
+	if opts.sukFile != "" {
+		if err := setupMsg.SetSetupKeyFromFile(opts.sukFile); err != nil {
+			mu.Fatalf("error: %v", err)
+		}
+	}
+
+	if err := setupMsg.Validate(); err != nil {
+		mu.Fatalf("error: invalid setup message:\n%v", err)
+	}
+
+	if err := setupMsg.CheckPrivateEK(opts.index, opts.privEKFile); err != nil {
+		mu.Fatalf("error: %v", err)
+	}
+
+	// nothing has been written yet; from here on, don't time out part way
+	// through writing the output
+	wd.Disarm()
+
+	if opts.outDir != "" {
+		if err := os.MkdirAll(opts.outDir, 0750); err != nil {
+			mu.Fatalf("error: can't create out-dir: %v", err)
+		}
+	}
+
+	var leafKey *ecdh.PrivateKey
+	if opts.suppliedLeafKeyFile != "" {
+		leafKey = readSuppliedLeafKey(opts, &setupMsg)
+	} else {
+		leafKey = art.DeriveLeafKeyOrFail(opts.privEKFile, setupMsg.GetSetupKey())
+	}
+	state := setupMsg.NewTreeState(opts.index, leafKey)
+	state.MACKey = opts.stateMACKey
+
+	if opts.explain {
+		explainCopath(opts.index, state)
+	}
+
+	if opts.verifyPath {
+		if err := state.VerifyPath(opts.index); err != nil {
+			mu.Fatalf("error: %v", err)
+		}
+	}
+
+	if !opts.noState {
+		saveState(opts, state)
+	}
+
+	// update from the saved state, exactly as update_key would
+	if opts.updateFile != "" {
+		var err error
+		state, err = art.LoadTreeStateWithMAC(opts.treeStateFile, opts.stateMACKey)
+		if err != nil {
+			mu.Fatalf("error reading tree state from %s: %v", opts.treeStateFile, err)
+		}
+		updateMsg, stageKey := state.UpdateKey(opts.index)
+		updateMsg.Save(opts.updateFile)
+		updateMsg.SaveMac(stageKey, opts.updateFile+".mac")
+		state.Save(opts.treeStateFile)
+	}
+
+	// after any update, so that the record describes the saved state
+	if opts.auditLog != "" {
+		audit(opts.auditLog, opts, initiatorIK, &setupMsg, state)
+	}
+
+	if opts.sukHistory != "" {
+		checkSukHistory(&setupMsg, opts.sukHistory)
+	}
 
-	state := art.ProcessSetupMessage(opts.index, opts.privEKFile,
-		opts.setupMessageFile, opts.initiatorPubIKFile, opts.sigFile)
+	if opts.leafKeyFile != "" {
+		err := art.WritePrivateEKToFile(state.Lk, opts.leafKeyFile, art.EncodingPEM)
+		if err != nil {
+			mu.Fatalf("error: can't write leaf key file: %v", err)
+		}
+		fmt.Fprintf(os.Stderr, "warning: %s holds the private leaf key; keep it secret\n",
+			opts.leafKeyFile)
+	}
 
-	state.Save(opts.treeStateFile)
-	state.SaveStageKey(fmt.Sprintf("stage-key-process-setup-msg-%d-%d.pem",
-		opts.index, time.Now().Unix()))
+	if opts.noState {
+		printStageKey(state)
+	} else {
+		state.SaveStageKey(filepath.Join(opts.outDir, fmt.Sprintf(
+			"stage-key-process-setup-msg-%d-%d.pem", opts.index, time.Now().Unix())))
+	}
 }
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/syslab-wm/art"
+	"github.com/syslab-wm/art/internal/auditlog"
+	"github.com/syslab-wm/art/internal/defaults"
+	"github.com/syslab-wm/art/internal/jsonutl"
+)
+
+// runMainEnv, when set in the environment, makes the test binary run main
+// instead of the tests, so that a test can run the program as a child
+// process (see run).
+const runMainEnv = "ART_TEST_RUN_MAIN"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(runMainEnv) != "" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// run runs process_setup_message with args in dir, and returns its stdout.
+// It fails the test if the program fails.
+func run(t *testing.T, dir string, args ...string) []byte {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), runMainEnv+"=1", defaults.FileEnv+"=")
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("process_setup_message %v: %v\n%s", args, err, stderr.Bytes())
+	}
+	return stdout.Bytes()
+}
+
+// writeGroup sets up a group of two members in dir, and writes the files
+// that member 2 processes the setup message with: setup.msg and its
+// signature setup.msg.sig, member 2's private EK ek.pem, and the initiator's
+// public IK ik.pem.  It returns the initiator's state and member 2's, as the
+// library derives them.
+func writeGroup(t *testing.T, dir string) (initiator, member *art.TreeState) {
+	t.Helper()
+	r := art.NewSeededReader([]byte("art test process_setup_message"))
+	members := make([]*art.Member, 2)
+	iks := make([]ed25519.PrivateKey, 2)
+	eks := make([]*ecdh.PrivateKey, 2)
+	for i := range members {
+		var err error
+		if iks[i], err = art.IKKeyGenFrom(r); err != nil {
+			t.Fatal(err)
+		}
+		if eks[i], err = art.DHKeyGenFrom(r); err != nil {
+			t.Fatal(err)
+		}
+		members[i] = art.NewMemberFromKeys(fmt.Sprintf("member%d", i+1),
+			iks[i].Public().(ed25519.PublicKey), eks[i].PublicKey())
+	}
+	initiator, setupMsg := art.SetupGroupFromMembers(members, "", &art.SetupOptions{Rand: r})
+
+	msg, err := jsonutl.Marshal(setupMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := art.Sign(iks[0], msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{"setup.msg": msg, "setup.msg.sig": sig}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = art.WritePrivateEKToFile(eks[1], filepath.Join(dir, "ek.pem"), art.EncodingPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = art.WritePublicIKToFile(iks[0].Public().(ed25519.PublicKey),
+		filepath.Join(dir, "ik.pem"), art.EncodingPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	member, err = art.ProcessSetupMessageBytes(2, eks[1], msg, sig, iks[0].Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return initiator, member
+}
+
+// listDir returns the names of the files in dir.
+func listDir(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names
+}
+
+// TestNoState checks that with -no-state, the program writes no file, and
+// writes the member's stage key to stdout.
+func TestNoState(t *testing.T) {
+	dir := t.TempDir()
+	_, want := writeGroup(t, dir)
+	inputs := listDir(t, dir)
+
+	out := run(t, dir, "-no-state", "2", "ek.pem", "ik.pem", "setup.msg")
+	if files := listDir(t, dir); !slices.Equal(files, inputs) {
+		t.Errorf("the directory holds %v, want only the inputs %v", files, inputs)
+	}
+	sk, err := art.UnmarshalPrivateIKFromPEM(out)
+	if err != nil {
+		t.Fatalf("can't decode the stage key on stdout: %v", err)
+	}
+	if !art.StageKeyEqual(sk, want.Sk) {
+		t.Error("the stage key on stdout is not the member's")
+	}
+
+	// without -no-state, the state is saved, with the same stage key
+	if out := run(t, dir, "2", "ek.pem", "ik.pem", "setup.msg"); len(out) != 0 {
+		t.Errorf("the program wrote %q to stdout", out)
+	}
+	state, err := art.LoadTreeState(filepath.Join(dir, "state.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !art.StageKeyEqual(state.Sk, want.Sk) {
+		t.Error("the saved stage key is not the member's")
+	}
+}
+
+// TestPostJoinUpdate checks that after -post-join-update, the member's leaf
+// key, which the initiator chose through the SUK, no longer yields the
+// group's stage key, and that the audit record describes the saved state,
+// after the update.
+func TestPostJoinUpdate(t *testing.T) {
+	dir := t.TempDir()
+	initiator, joined := writeGroup(t, dir)
+
+	run(t, dir, "-post-join-update", "update.msg", "-audit-log", "audit.jsonl", "2",
+		"ek.pem", "ik.pem", "setup.msg")
+	state, err := art.LoadTreeState(filepath.Join(dir, "state.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Epoch != 1 || state.Lk.Equal(joined.Lk) {
+		t.Fatalf("the saved state is at epoch %d, with the joined leaf key %v; want an "+
+			"update", state.Epoch, state.Lk.Equal(joined.Lk))
+	}
+
+	msg, err := os.ReadFile(filepath.Join(dir, "update.msg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mac, err := os.ReadFile(filepath.Join(dir, "update.msg.mac"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := art.ProcessUpdateMessageBytes(initiator, 1, msg, mac); err != nil {
+		t.Fatal(err)
+	}
+	if !art.StageKeyEqual(initiator.Sk, state.Sk) {
+		t.Fatal("the initiator's stage key after the update is not the member's")
+	}
+
+	// whoever knows the joined leaf key, as the initiator does, can process
+	// the update as member 2, but derives another stage key
+	if err := art.ProcessUpdateMessageBytes(joined, 2, msg, mac); err != nil {
+		t.Fatal(err)
+	}
+	if art.StageKeyEqual(joined.Sk, state.Sk) {
+		t.Error("the joined leaf key still yields the group's stage key")
+	}
+
+	file, err := os.Open(filepath.Join(dir, "audit.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var recs []auditlog.Record
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var rec auditlog.Record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			t.Fatal(err)
+		}
+		recs = append(recs, rec)
+	}
+	wantKey := art.Fingerprint(state.Sk.Public().(ed25519.PublicKey))
+	if len(recs) != 1 || recs[0].Epoch != 1 || recs[0].StageKey != wantKey {
+		t.Errorf("got audit records %+v, want one at epoch 1 with stage key %s", recs,
+			wantKey)
+	}
+}
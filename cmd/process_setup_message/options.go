@@ -3,8 +3,12 @@ package main
 import (
 	"flag"
 	"fmt"
+	"path/filepath"
 	"strconv"
+	"time"
 
+	"github.com/syslab-wm/art"
+	"github.com/syslab-wm/art/internal/defaults"
 	"github.com/syslab-wm/mu"
 )
 
@@ -26,7 +30,8 @@ positional arguments:
 	This is a PEM-encoded X25519 private key.
 
   INITIATOR_PUB_IK_FILE
-    The initiator's public identity key.  This is a PEM-encoded ED25519 key.
+    The initiator's public identity key.  This is a PEM-encoded ED25519 or
+    ECDSA P-256 key.
 
   SETUP_MSG_FILE
 	The file containing the group setup message.
@@ -43,6 +48,125 @@ options:
     The file to output the node's state after processing the setup message. If
     not provided, the default is state.json. 
 
+  -out-dir OUT_DIR
+    The output directory: the program places STATE_FILE, LEAF_KEY_FILE,
+    UPDATE_FILE (and its MAC), and the stage key file in OUT_DIR, creating it
+    if it does not exist.  If not provided, the paths are relative to the
+    current directory.
+
+  -no-overwrite
+    Fail if STATE_FILE already exists, rather than replacing it.  An existing
+    state may hold a leaf key that is still needed (e.g., the member's state
+    in another group, or after an update), which replacing it loses for
+    good.  The check and the write are atomic.  By default, STATE_FILE is
+    replaced.
+
+  -no-state
+    Don't write the member's state to disk: write just the stage key to
+    stdout, as a PEM-encoded ED25519 private key, instead of to a
+    stage-key-process-setup-msg-*.pem file.  This is for stateless services
+    that derive the stage key and immediately hand it off; without the
+    state, the member cannot process later update messages.  STATE_FILE is
+    ignored, and -no-state cannot be combined with -no-overwrite or
+    -post-join-update.
+
+  -verify-path
+    After deriving the member's keys, check that the private key derived for
+    each node on the member's path matches the node's public key in the
+    setup message's tree.  A mismatch means that the tree is corrupt; the
+    program then fails without writing any output.
+
+  -explain
+	Print to stderr the member's copath in the processed tree, in the order
+	in which the path keys are derived from it (the root's child first):
+	each node's index in the level-order listing of the tree and the SHA-256
+	fingerprint of its public key.  This tells a wrong copath apart from a
+	wrong key derivation when members' keys diverge.
+
+  -suk-file SUK_FILE
+    The group's public setup key (SUK), as a PEM-encoded X25519 public key.
+    This overrides the SUK in SETUP_MSG_FILE, and is required if the setup
+    message does not carry a SUK (e.g., because the SUK is distributed
+    alongside the prekey bundle).
+
+  -out-leaf-key LEAF_KEY_FILE
+    Also write the member's derived private leaf key to LEAF_KEY_FILE, as a
+    PEM-encoded X25519 private key, so that it can be backed up or moved to
+    another device.  WARNING: this file is as sensitive as the member's
+    private ephemeral key; anyone who holds it can derive the group's stage
+    key until the member next updates their leaf key.
+
+  -leaf-key-file LEAF_KEY_FILE
+    Use the private leaf key in LEAF_KEY_FILE, a PEM-encoded X25519 private
+    key, instead of deriving it from PRIV_EK_FILE and the setup message's SUK:
+    the member's key from setup_group -leaf-keys.  The program fails unless
+    the key is the member's leaf in the setup message's tree.  PRIV_EK_FILE
+    must still be the member's EK.
+
+  -post-join-update UPDATE_FILE
+    After processing the setup message, immediately update the member's leaf
+    key, as update_key does, and write the update message to UPDATE_FILE and
+    its MAC to UPDATE_FILE.mac.  The initiator chose the member's initial
+    leaf key (through the SUK), and so can compute the stage key until the
+    member updates; the other members process UPDATE_FILE with
+    process_update_message.  STATE_FILE is the state after the update.
+
+  -suk-history SUK_HISTORY_FILE
+    A file that lists the IDs of the setup keys (SUKs) of the setup messages
+    processed earlier, one per line; the SUK ID is the hex-encoded SHA-256
+    digest of the raw X25519 public key.  If the setup message's SUK is in
+    this list, the program prints a warning, since a reused SUK repeats the
+    member's leaf key.  Afterwards, the SUK's ID is appended to
+    SUK_HISTORY_FILE.  The file is created if it does not exist.
+
+  -audit-log AUDIT_LOG_FILE
+    Append a record of the processed setup message to AUDIT_LOG_FILE, as a
+    line of JSON with the time, the message file and its SHA-256 hash, the
+    fingerprint of the initiator's IK (omitted with -trusted-source), the
+    member's INDEX, and the resulting epoch and stage key fingerprint (the
+    SHA-256 digest of the stage key's public half).  The record is synced
+    to disk before the program exits.  The file is created if it does not
+    exist.
+
+  -timeout DURATION
+    Fail if processing takes longer than DURATION (e.g., 30s or 2m), rather
+    than hanging on a stuck filesystem.  The deadline applies until the
+    program starts writing its output, which is never cut short.  If not
+    provided, there is no timeout.
+
+  -ik-rotation ROTATION_FILE
+    Accept setup messages signed by the initiator's current IK, which
+    ROTATION_FILE (see rotate_ik) links to the trusted IK in
+    INITIATOR_PUB_IK_FILE through a chain of rotations, each signed by the
+    IK before it.  The program fails if any link of the chain does not
+    verify.  Ignored with -trusted-source.
+
+  -ik-dir IK_DIR
+    Accept setup messages signed by any of the trusted IKs: the IK in
+    INITIATOR_PUB_IK_FILE, or one of the PEM-encoded public IKs in the .pem
+    files in IK_DIR (e.g., both the old and the new IK while the initiator
+    rotates its IK).  The program reports on stderr which IK signed the
+    message.  -ik-dir cannot be combined with -ik-rotation.
+
+  -trusted-source REASON
+    Skip verifying the setup message's signature because the message was
+    received over an already-authenticated channel; REASON describes that
+    channel (e.g., "provisioned over mTLS by the fleet manager").  The
+    decision is recorded in an audit line on stderr with REASON and the
+    SHA-256 hash of SETUP_MSG_FILE.  INITIATOR_PUB_IK_FILE and -sig-file are
+    ignored.  By default, the signature is always verified.
+
+  -cpuprofile FILE
+    Write a pprof CPU profile of the run to FILE (see go tool pprof).
+
+  -memprofile FILE
+    Write a pprof heap profile to FILE at the end of the run.
+
+  -state-mac-key KEY_FILE
+    Protect the state file with an HMAC keyed by the contents of KEY_FILE
+    (at least 16 bytes): the MAC is written with the state, and reading a
+    state whose MAC is missing or does not verify fails.  All the tools that
+    use the state must be given the same key.
 
 examples:
   ./process_setup_message -out-state bob-state.json 2 bob-ek.pem \
@@ -60,8 +184,27 @@ type options struct {
 	setupMessageFile   string
 
 	// options
-	sigFile       string
-	treeStateFile string
+	sigFile             string
+	treeStateFile       string
+	outDir              string
+	noOverwrite         bool
+	noState             bool
+	verifyPath          bool
+	explain             bool
+	leafKeyFile         string
+	suppliedLeafKeyFile string
+	sukFile             string
+	trustedSource       string
+	ikRotationFile      string
+	ikDir               string
+	sukHistory          string
+	updateFile          string
+	auditLog            string
+	timeout             time.Duration
+	cpuProfile          string
+	memProfile          string
+	stateMACKeyFile     string
+	stateMACKey         []byte
 }
 
 func parseOptions() *options {
@@ -71,8 +214,36 @@ func parseOptions() *options {
 	flag.Usage = printUsage
 	flag.StringVar(&opts.sigFile, "sig-file", "", "")
 	flag.StringVar(&opts.treeStateFile, "out-state", "state.json", "")
+	flag.StringVar(&opts.outDir, "out-dir", "", "")
+	flag.BoolVar(&opts.noOverwrite, "no-overwrite", false, "")
+	flag.BoolVar(&opts.noState, "no-state", false, "")
+	flag.BoolVar(&opts.verifyPath, "verify-path", false, "")
+	flag.BoolVar(&opts.explain, "explain", false, "")
+	flag.StringVar(&opts.leafKeyFile, "out-leaf-key", "", "")
+	flag.StringVar(&opts.suppliedLeafKeyFile, "leaf-key-file", "", "")
+	flag.StringVar(&opts.sukFile, "suk-file", "", "")
+	flag.StringVar(&opts.trustedSource, "trusted-source", "", "")
+	flag.StringVar(&opts.ikRotationFile, "ik-rotation", "", "")
+	flag.StringVar(&opts.ikDir, "ik-dir", "", "")
+	flag.StringVar(&opts.sukHistory, "suk-history", "", "")
+	flag.StringVar(&opts.updateFile, "post-join-update", "", "")
+	flag.StringVar(&opts.auditLog, "audit-log", "", "")
+	flag.DurationVar(&opts.timeout, "timeout", 0, "")
+	flag.StringVar(&opts.cpuProfile, "cpuprofile", "", "")
+	flag.StringVar(&opts.memProfile, "memprofile", "", "")
+	flag.StringVar(&opts.stateMACKeyFile, "state-mac-key", "", "")
+	if err := defaults.Load(flag.CommandLine, "process_setup_message"); err != nil {
+		mu.Fatalf("error: %v", err)
+	}
 	flag.Parse()
 
+	if opts.stateMACKeyFile != "" {
+		opts.stateMACKey, err = art.ReadStateMACKeyFile(opts.stateMACKeyFile)
+		if err != nil {
+			mu.Fatalf("error: can't read state MAC key: %v", err)
+		}
+	}
+
 	if flag.NArg() != 4 {
 		mu.Fatalf(shortUsage)
 	}
@@ -86,9 +257,31 @@ func parseOptions() *options {
 	opts.initiatorPubIKFile = flag.Arg(2)
 	opts.setupMessageFile = flag.Arg(3)
 
+	err = art.CheckArgKinds(flag.Args(), art.FileUnknown, art.FilePEMKey, art.FilePEMKey,
+		art.FileSetupMessage)
+	if err != nil {
+		mu.Fatalf("error: %v", err)
+	}
+
+	if opts.noState && (opts.noOverwrite || opts.updateFile != "") {
+		mu.Fatalf("error: -no-state cannot be combined with -no-overwrite or -post-join-update")
+	}
+
+	if opts.ikDir != "" && opts.ikRotationFile != "" {
+		mu.Fatalf("error: -ik-dir cannot be combined with -ik-rotation")
+	}
+
 	if opts.sigFile == "" {
 		opts.sigFile = opts.setupMessageFile + ".sig"
 	}
 
+	opts.treeStateFile = filepath.Join(opts.outDir, opts.treeStateFile)
+	if opts.leafKeyFile != "" {
+		opts.leafKeyFile = filepath.Join(opts.outDir, opts.leafKeyFile)
+	}
+	if opts.updateFile != "" {
+		opts.updateFile = filepath.Join(opts.outDir, opts.updateFile)
+	}
+
 	return &opts
 }
@@ -1,19 +1,112 @@
 package main
 
 import (
+	"crypto/ed25519"
 	"fmt"
+	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/syslab-wm/art"
+	"github.com/syslab-wm/art/internal/auditlog"
+	"github.com/syslab-wm/art/internal/profile"
+	"github.com/syslab-wm/art/internal/watchdog"
+	"github.com/syslab-wm/mu"
 )
 
+// explainCopath prints the copath of the member at position index in the
+// state's tree, in the order in which the path keys are derived from it.
+func explainCopath(index int, state *art.TreeState) {
+	indices, err := art.CoPathIndices(state.PublicTree, index)
+	if err != nil {
+		mu.Fatalf("error: %v", err)
+	}
+	copath, err := art.CoPath(state.PublicTree, index, nil)
+	if err != nil {
+		mu.Fatalf("error: %v", err)
+	}
+
+	fmt.Fprintf(os.Stderr, "copath of member %d, from the root's child down:\n", index)
+	for i, pk := range copath {
+		fmt.Fprintf(os.Stderr, "  node %d\t%s\n", indices[i], art.Fingerprint(pk.Bytes()))
+	}
+}
+
+// audit appends a record of the update message that produced state to
+// logFile.
+func audit(logFile string, opts *options, state *art.TreeState) {
+	data, err := art.ReadMessageFile(opts.updateMessageFile)
+	if err != nil {
+		mu.Fatalf("error: can't read update message file: %v", err)
+	}
+	updateMsg, err := art.DecodeUpdateMessage(data)
+	if err != nil {
+		mu.Fatalf("error: can't decode update message: %v", err)
+	}
+
+	rec := auditlog.Record{
+		Time:        time.Now().UTC(),
+		Type:        "update",
+		File:        opts.updateMessageFile,
+		MessageHash: art.Fingerprint(data),
+		Member:      opts.index,
+		Epoch:       state.Epoch,
+		StageKey:    art.Fingerprint(state.StageKey().Public().(ed25519.PublicKey)),
+
+		ClaimedUpdater: updateMsg.Idx,
+	}
+	if err := auditlog.Append(logFile, &rec); err != nil {
+		mu.Fatalf("error: can't write audit log: %v", err)
+	}
+}
+
 func main() {
 	opts := parseOptions()
+	defer profile.Start(opts.cpuProfile, opts.memProfile)()
+	wd := watchdog.Start(opts.timeout)
 
-	state := art.ProcessUpdateMessage(opts.index, opts.treeStateFile,
-		opts.updateMessageFile, opts.macFile)
+	if opts.verifyState {
+		err := art.VerifyTreeStateFile(opts.index, opts.treeStateFile, opts.stateMACKey)
+		if err != nil {
+			mu.Fatalf("error: %v", err)
+		}
+	}
 
+	var updateMsg art.UpdateMessage
+	updateMsg.Read(opts.updateMessageFile)
+
+	state, err := art.LoadTreeStateWithMAC(opts.treeStateFile, opts.stateMACKey)
+	if err != nil {
+		mu.Fatalf("error reading tree state from %s: %v", opts.treeStateFile, err)
+	}
+	updateMsg.VerifyUpdateMessage(state.Sk, opts.macFile)
+	state.ProcessUpdateMessage(opts.index, &updateMsg)
+
+	if opts.explain {
+		explainCopath(opts.index, state)
+	}
+
+	if opts.verifyPath {
+		if err := state.VerifyPath(opts.index); err != nil {
+			mu.Fatalf("error: %v", err)
+		}
+	}
+
+	// nothing has been written yet; from here on, don't time out part way
+	// through writing the output
+	wd.Disarm()
 	state.Save(opts.treeStateFile)
-	state.SaveStageKey(fmt.Sprintf("stage-key-process-update-msg-%d-%d.pem",
-		opts.index, time.Now().Unix()))
+
+	if opts.outDir != "" {
+		if err := os.MkdirAll(opts.outDir, 0750); err != nil {
+			mu.Fatalf("error: can't create out-dir: %v", err)
+		}
+	}
+
+	if opts.auditLog != "" {
+		audit(opts.auditLog, opts, state)
+	}
+
+	state.SaveStageKey(filepath.Join(opts.outDir, fmt.Sprintf(
+		"stage-key-process-update-msg-%d-%d.pem", opts.index, time.Now().Unix())))
 }
@@ -4,7 +4,10 @@ import (
 	"flag"
 	"fmt"
 	"strconv"
+	"time"
 
+	"github.com/syslab-wm/art"
+	"github.com/syslab-wm/art/internal/defaults"
 	"github.com/syslab-wm/mu"
 )
 
@@ -39,9 +42,58 @@ options:
 	The update message's corresponding mac file. If omitted a default file is 
 	UPDATE_MSG_FILE.mac.
 
+  -out-dir OUT_DIR
+	Write the stage key file to OUT_DIR, creating it if it does not exist,
+	instead of to the current directory.  STATE_FILE is updated in place.
+
+  -verify-state
+	Before processing, check STATE_FILE for corruption: the leaf key must
+	match the member's leaf, and the keys derived from it must match the
+	public keys on the member's path to the root.
+
+  -verify-path
+	After applying the update, check that the private key derived for each
+	node on the member's path matches the node's public key in the updated
+	tree.  A mismatch means that the update's path keys (or the state) are
+	corrupt; the program then fails without replacing STATE_FILE.
+
+  -explain
+	Print to stderr the member's copath in the processed tree, in the order
+	in which the path keys are derived from it (the root's child first):
+	each node's index in the level-order listing of the tree and the SHA-256
+	fingerprint of its public key.  This tells a wrong copath apart from a
+	wrong key derivation when members' keys diverge.
+
+  -audit-log AUDIT_LOG_FILE
+	Append a record of the processed update message to AUDIT_LOG_FILE, as a
+	line of JSON with the time, the message file and its SHA-256 hash, the
+	member's INDEX, the resulting epoch and stage key fingerprint (see
+	process_setup_message), and the INDEX the message claims as its
+	updater.  The claimed updater is not authenticated: the MAC shows only
+	that the sender held the stage key.  The record is synced to disk
+	before the program exits.  The file is created if it does not exist.
+
+  -timeout DURATION
+	Fail if processing takes longer than DURATION (e.g., 30s or 2m), rather
+	than hanging on a stuck filesystem.  The deadline applies until the
+	program starts writing its output, which is never cut short.  If
+	omitted, there is no timeout.
+
   -h, -help
     Show this usage statement and exit.
 
+  -cpuprofile FILE
+	Write a pprof CPU profile of the run to FILE (see go tool pprof).
+
+  -memprofile FILE
+	Write a pprof heap profile to FILE at the end of the run.
+
+  -state-mac-key KEY_FILE
+	Protect the state file with an HMAC keyed by the contents of KEY_FILE
+	(at least 16 bytes): the MAC is written with the state, and reading a
+	state whose MAC is missing or does not verify fails.  All the tools that
+	use the state must be given the same key.
+
 examples:
   ./process_update_message 2 bob-ek.pem bob-state cici_update_key`
 
@@ -57,7 +109,17 @@ type options struct {
 	updateMessageFile string
 
 	// options
-	macFile string
+	macFile         string
+	outDir          string
+	auditLog        string
+	timeout         time.Duration
+	verifyState     bool
+	verifyPath      bool
+	explain         bool
+	cpuProfile      string
+	memProfile      string
+	stateMACKeyFile string
+	stateMACKey     []byte
 }
 
 func parseOptions() *options {
@@ -65,8 +127,27 @@ func parseOptions() *options {
 	opts := options{}
 
 	flag.Usage = printUsage
+	flag.DurationVar(&opts.timeout, "timeout", 0, "")
+	flag.StringVar(&opts.outDir, "out-dir", "", "")
+	flag.BoolVar(&opts.verifyState, "verify-state", false, "")
+	flag.BoolVar(&opts.verifyPath, "verify-path", false, "")
+	flag.BoolVar(&opts.explain, "explain", false, "")
+	flag.StringVar(&opts.auditLog, "audit-log", "", "")
+	flag.StringVar(&opts.cpuProfile, "cpuprofile", "", "")
+	flag.StringVar(&opts.memProfile, "memprofile", "", "")
+	flag.StringVar(&opts.stateMACKeyFile, "state-mac-key", "", "")
+	if err := defaults.Load(flag.CommandLine, "process_update_message"); err != nil {
+		mu.Fatalf("error: %v", err)
+	}
 	flag.Parse()
 
+	if opts.stateMACKeyFile != "" {
+		opts.stateMACKey, err = art.ReadStateMACKeyFile(opts.stateMACKeyFile)
+		if err != nil {
+			mu.Fatalf("error: can't read state MAC key: %v", err)
+		}
+	}
+
 	if flag.NArg() != 4 {
 		mu.Fatalf(shortUsage)
 	}
@@ -79,6 +160,12 @@ func parseOptions() *options {
 	opts.treeStateFile = flag.Arg(2)
 	opts.updateMessageFile = flag.Arg(3)
 
+	err = art.CheckArgKinds(flag.Args(), art.FileUnknown, art.FilePEMKey, art.FileTreeState,
+		art.FileUpdateMessage)
+	if err != nil {
+		mu.Fatalf("error: %v", err)
+	}
+
 	if opts.macFile == "" {
 		opts.macFile = opts.updateMessageFile + ".mac"
 	}
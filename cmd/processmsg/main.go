@@ -8,6 +8,7 @@ import (
 	"crypto/sha256"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -369,21 +370,34 @@ func deriveLeafKey(ekPath string, suk *ecdh.PublicKey) (*ecdh.PrivateKey, error)
 	return leafKey, nil
 }
 
+// decodeMessageFile decodes the JSON-encoded message in fileName into v.  It
+// fails if the file holds anything after the message, such as a trailing byte
+// or a second message.
+func decodeMessageFile(fileName string, v any) error {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return fmt.Errorf("can't open message file: %v", err)
+	}
+	defer file.Close()
+
+	dec := json.NewDecoder(file)
+	if err := dec.Decode(v); err != nil {
+		return fmt.Errorf("can't decode message from file: %v", err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return errors.New("the message file has data after the message")
+	}
+	return nil
+}
+
 func processMessage(opts *options, state *treeState) ed25519.PrivateKey {
 	// decoding the message file
 	// TODO: message should be a public struct in internal/proto/; make it
 	// serializable to json.
 	var m message
-	dec_message, err := os.Open(opts.setupMsg)
-	if err != nil {
-		mu.Fatalf("error opening message file:", err)
+	if err := decodeMessageFile(opts.setupMsg, &m); err != nil {
+		mu.Fatalf("error: %v", err)
 	}
-	dec := json.NewDecoder(dec_message)
-	err = dec.Decode(&m)
-	if err != nil {
-		mu.Fatalf("error decoding message from file:", err)
-	}
-	dec_message.Close()
 
 	// XXX: unmarshalling all the keys (may be unnecessary)
 	EKS := make([]*ecdh.PublicKey, 0, len(m.EKeys))
@@ -445,16 +459,9 @@ func processMessage(opts *options, state *treeState) ed25519.PrivateKey {
 func processUpdateMessage(opts *options, updateMsg string, state *treeState) ed25519.PrivateKey {
 	// decoding the message file
 	var upMsg updateMessage
-	dec_message, err := os.Open(updateMsg)
-	if err != nil {
-		mu.Fatalf("error opening message file: %v", err)
+	if err := decodeMessageFile(updateMsg, &upMsg); err != nil {
+		mu.Fatalf("error: %v", err)
 	}
-	dec := json.NewDecoder(dec_message)
-	err = dec.Decode(&upMsg)
-	if err != nil {
-		mu.Fatalf("error decoding message from file: %v", err)
-	}
-	dec_message.Close()
 
 	// verify the signature on the update message with the current stage key
 	valid, err := verifyMAC(state.sk, upMsg, updateMsg+".mac")
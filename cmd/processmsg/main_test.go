@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// TestDecodeMessageFileTrailingData checks that a setup or update message
+// file is rejected when anything follows the message.
+func TestDecodeMessageFileTrailingData(t *testing.T) {
+	setup, err := json.Marshal(message{
+		IKeys:    [][]byte{[]byte("ik")},
+		EKeys:    [][]byte{[]byte("ek")},
+		Suk:      []byte("suk"),
+		TreeKeys: [][]byte{[]byte("tree key")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	update, err := json.Marshal(updateMessage{Idx: 2, PathPublicKeys: [][]byte{[]byte("key")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		msg  []byte
+		v    func() any
+	}{
+		{"setup", setup, func() any { return new(message) }},
+		{"update", update, func() any { return new(updateMessage) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			files := []struct {
+				name string
+				data []byte
+				ok   bool
+			}{
+				{"message", tt.msg, true},
+				{"message and newline", append(slices.Clip(tt.msg), '\n'), true},
+				{"trailing byte", append(slices.Clip(tt.msg), 'x'), false},
+				{"second message", append(slices.Clip(tt.msg), tt.msg...), false},
+			}
+			for _, f := range files {
+				file := filepath.Join(dir, f.name)
+				if err := os.WriteFile(file, f.data, 0600); err != nil {
+					t.Fatal(err)
+				}
+				err := decodeMessageFile(file, tt.v())
+				if (err == nil) != f.ok {
+					t.Errorf("%s: got error %v, want success %v", f.name, err, f.ok)
+				}
+			}
+		})
+	}
+}
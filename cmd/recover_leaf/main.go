@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/syslab-wm/art"
+	"github.com/syslab-wm/mu"
+)
+
+func main() {
+	opts := parseOptions()
+
+	state, err := art.LoadPartialTreeState(opts.treeStateFile)
+	if err != nil {
+		mu.Fatalf("error reading tree state from %s: %v", opts.treeStateFile, err)
+	}
+	if state.Lk != nil {
+		mu.Fatalf("error: %s already has a leaf key", opts.treeStateFile)
+	}
+
+	sealed, err := art.ReadSealedLeafKeyFromFile(opts.sealedFile)
+	if err != nil {
+		mu.Fatalf("error: can't read sealed leaf key: %v", err)
+	}
+	if sealed.Index != opts.index {
+		mu.Fatalf("error: %s is the leaf key of member %d, not %d", opts.sealedFile,
+			sealed.Index, opts.index)
+	}
+
+	ik, err := art.ReadSigningKeyFromFile(opts.privIKFile, art.EncodingPEM)
+	if err != nil {
+		mu.Fatalf("error: can't read private IK: %v", err)
+	}
+	leafKey, err := sealed.Open(ik)
+	if err != nil {
+		mu.Fatalf("error: %v", err)
+	}
+
+	probe := *state
+	probe.Lk = leafKey
+	if probe.LeafIndex() != opts.index {
+		mu.Fatalf("error: the recovered leaf key is not member %d's leaf in %s; the "+
+			"member has updated its leaf key since sealing it", opts.index,
+			opts.treeStateFile)
+	}
+
+	var setupMsg *art.SetupMessage
+	if opts.setupMsgFile != "" {
+		setupMsg = new(art.SetupMessage)
+		setupMsg.Read(opts.setupMsgFile)
+	}
+
+	rederived, err := state.RepairLeafKey(opts.index, leafKey, setupMsg)
+	if err != nil {
+		mu.Fatalf("error: %v", err)
+	}
+	if rederived {
+		fmt.Fprintf(os.Stderr, "warning: %s has no stage key; re-derived the stage key "+
+			"as of setup from %s, which is wrong if any update was applied\n",
+			opts.treeStateFile, opts.setupMsgFile)
+	}
+
+	if opts.leafKeyFile != "" {
+		err := art.WritePrivateEKToFile(leafKey, opts.leafKeyFile, art.EncodingPEM)
+		if err != nil {
+			mu.Fatalf("error: can't write leaf key file: %v", err)
+		}
+	}
+
+	state.Save(opts.outStateFile)
+}
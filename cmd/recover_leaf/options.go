@@ -0,0 +1,122 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+
+	"github.com/syslab-wm/art"
+	"github.com/syslab-wm/art/internal/defaults"
+	"github.com/syslab-wm/mu"
+)
+
+const shortUsage = `Usage: recover_leaf [options] INDEX PRIV_IK_FILE SEALED_FILE \
+	STATE_FILE`
+const usage = `Usage: recover_leaf [options] INDEX PRIV_IK_FILE SEALED_FILE \
+	STATE_FILE
+
+Recover the leaf key of the group member at position INDEX from the sealed
+leaf key that seal_leaf wrote, and restore it to a state that is missing it,
+such as a copy of another member's public state (as repair_state does with a
+leaf key re-derived from the member's ephemeral key).
+
+The leaf key must still be the member's leaf in STATE_FILE's tree, i.e., the
+member must not have updated its leaf key after sealing it.  If STATE_FILE
+is also missing the stage key, the stage key is re-derived as of setup from
+the setup message given with -setup-msg, which is only correct if no update
+message has been applied to the state; the program prints a warning when it
+does so.
+
+positional arguments:
+  INDEX
+	The index position of the group member, this index is based off the
+	member's position in the group config file, where the first entry is at
+	index 1.
+
+  PRIV_IK_FILE
+	The member's private identity key file, which the leaf key was sealed
+	under.
+
+  SEALED_FILE
+	The sealed leaf key.
+
+  STATE_FILE
+	The state to restore the leaf key to.
+
+options:
+  -h, -help
+    Show this usage statement and exit.
+
+  -out-state OUT_STATE_FILE
+    The file to write the restored state to.  If not provided, STATE_FILE is
+    replaced.
+
+  -setup-msg SETUP_MSG_FILE
+    The setup message the state was derived from, which is required if the
+    state is missing the stage key.  The stage key is re-derived from the
+    message's tree keys, in the order of its suite, just as
+    process_setup_message derives it.  The state must still have the
+    message's tree.
+
+  -out-leaf-key LEAF_KEY_FILE
+    Also write the recovered private leaf key to LEAF_KEY_FILE, as a
+    PEM-encoded X25519 private key.
+
+examples:
+  ./recover_leaf -out-state bob-state.json 2 bob-ik.pem bob-leaf.sealed \
+		bob-public-state.json`
+
+func printUsage() {
+	fmt.Println(usage)
+}
+
+type options struct {
+	// positional arguments
+	index         int
+	privIKFile    string
+	sealedFile    string
+	treeStateFile string
+
+	// options
+	outStateFile string
+	setupMsgFile string
+	leafKeyFile  string
+}
+
+func parseOptions() *options {
+	var err error
+	opts := options{}
+
+	flag.Usage = printUsage
+	flag.StringVar(&opts.outStateFile, "out-state", "", "")
+	flag.StringVar(&opts.setupMsgFile, "setup-msg", "", "")
+	flag.StringVar(&opts.leafKeyFile, "out-leaf-key", "", "")
+	if err := defaults.Load(flag.CommandLine, "recover_leaf"); err != nil {
+		mu.Fatalf("error: %v", err)
+	}
+	flag.Parse()
+
+	if flag.NArg() != 4 {
+		mu.Fatalf(shortUsage)
+	}
+
+	opts.index, err = strconv.Atoi(flag.Arg(0))
+	if err != nil {
+		mu.Fatalf("error converting positional argument INDEX to int: %v", err)
+	}
+	opts.privIKFile = flag.Arg(1)
+	opts.sealedFile = flag.Arg(2)
+	opts.treeStateFile = flag.Arg(3)
+
+	err = art.CheckArgKinds(flag.Args(), art.FileUnknown, art.FilePEMKey, art.FileUnknown,
+		art.FileTreeState)
+	if err != nil {
+		mu.Fatalf("error: %v", err)
+	}
+
+	if opts.outStateFile == "" {
+		opts.outStateFile = opts.treeStateFile
+	}
+
+	return &opts
+}
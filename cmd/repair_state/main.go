@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/syslab-wm/art"
+	"github.com/syslab-wm/mu"
+)
+
+func main() {
+	opts := parseOptions()
+
+	state, err := art.LoadPartialTreeStateWithMAC(opts.treeStateFile, opts.stateMACKey)
+	if err != nil {
+		mu.Fatalf("error reading tree state from %s: %v", opts.treeStateFile, err)
+	}
+	if state.Lk != nil {
+		mu.Fatalf("error: %s already has a leaf key", opts.treeStateFile)
+	}
+
+	suk, err := art.ReadPublicEKFromFile(opts.sukFile, art.EncodingPEM)
+	if err != nil {
+		mu.Fatalf("error: can't read SUK file: %v", err)
+	}
+	leafKey := art.DeriveLeafKeyOrFail(opts.privEKFile, suk)
+
+	var setupMsg *art.SetupMessage
+	if opts.setupMsgFile != "" {
+		setupMsg = new(art.SetupMessage)
+		setupMsg.Read(opts.setupMsgFile)
+	}
+
+	rederived, err := state.RepairLeafKey(opts.index, leafKey, setupMsg)
+	if err != nil {
+		mu.Fatalf("error: %v", err)
+	}
+	if rederived {
+		fmt.Fprintf(os.Stderr, "warning: %s has no stage key; re-derived the stage key "+
+			"as of setup from %s, which is wrong if any update was applied\n",
+			opts.treeStateFile, opts.setupMsgFile)
+	}
+
+	state.Save(opts.outStateFile)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+
+	"github.com/syslab-wm/art"
+	"github.com/syslab-wm/art/internal/defaults"
+	"github.com/syslab-wm/mu"
+)
+
+const shortUsage = `Usage: repair_state [options] INDEX PRIV_EK_FILE SUK_FILE \
+	STATE_FILE`
+const usage = `Usage: repair_state [options] INDEX PRIV_EK_FILE SUK_FILE \
+	STATE_FILE
+
+Repair the state of the group member at position INDEX that is missing the
+member's leaf key (e.g., a state written by an older tool), by re-deriving
+the leaf key from the member's private ephemeral key and the group's setup
+key (SUK).
+
+This only works while the member's leaf key is still the one derived at
+setup, i.e., if the member has not updated its leaf key since.  If the
+state is also missing the stage key, the stage key is re-derived as of
+setup from the setup message given with -setup-msg, which is only correct
+if no update message has been applied to the state; the program prints a
+warning when it does so.
+
+positional arguments:
+  INDEX
+	The index position of the group member, this index is based off the
+	member's position in the group config file, where the first entry is at
+	index 1.
+
+  PRIV_EK_FILE
+	The group member's private ephemeral key file (also called a prekey).
+	This is a PEM-encoded X25519 private key.
+
+  SUK_FILE
+	The group's public setup key (SUK).  This is a PEM-encoded X25519 public
+	key.
+
+  STATE_FILE
+	The member's state file to repair.
+
+options:
+  -h, -help
+    Show this usage statement and exit.
+
+  -out-state OUT_STATE_FILE
+    The file to write the repaired state to.  If not provided, STATE_FILE is
+    replaced.
+
+  -setup-msg SETUP_MSG_FILE
+    The setup message the state was derived from, which is required if the
+    state is missing the stage key.  The stage key is re-derived from the
+    message's tree keys, in the order of its suite, just as
+    process_setup_message derives it.  The state must still have the
+    message's tree.
+
+  -state-mac-key KEY_FILE
+    Protect the state file with an HMAC keyed by the contents of KEY_FILE
+    (at least 16 bytes): the MAC is written with the state, and reading a
+    state whose MAC is missing or does not verify fails.  All the tools that
+    use the state must be given the same key.
+
+examples:
+  ./repair_state -out-state bob-state.json 2 bob-ek.pem suk.pem \
+		bob-public-state.json`
+
+func printUsage() {
+	fmt.Println(usage)
+}
+
+type options struct {
+	// positional arguments
+	index         int
+	privEKFile    string
+	sukFile       string
+	treeStateFile string
+
+	// options
+	outStateFile    string
+	setupMsgFile    string
+	stateMACKeyFile string
+	stateMACKey     []byte
+}
+
+func parseOptions() *options {
+	var err error
+	opts := options{}
+
+	flag.Usage = printUsage
+	flag.StringVar(&opts.outStateFile, "out-state", "", "")
+	flag.StringVar(&opts.setupMsgFile, "setup-msg", "", "")
+	flag.StringVar(&opts.stateMACKeyFile, "state-mac-key", "", "")
+	if err := defaults.Load(flag.CommandLine, "repair_state"); err != nil {
+		mu.Fatalf("error: %v", err)
+	}
+	flag.Parse()
+
+	if opts.stateMACKeyFile != "" {
+		opts.stateMACKey, err = art.ReadStateMACKeyFile(opts.stateMACKeyFile)
+		if err != nil {
+			mu.Fatalf("error: can't read state MAC key: %v", err)
+		}
+	}
+
+	if flag.NArg() != 4 {
+		mu.Fatalf(shortUsage)
+	}
+
+	opts.index, err = strconv.Atoi(flag.Arg(0))
+	if err != nil {
+		mu.Fatalf("error converting positional argument INDEX to int: %v", err)
+	}
+	opts.privEKFile = flag.Arg(1)
+	opts.sukFile = flag.Arg(2)
+	opts.treeStateFile = flag.Arg(3)
+
+	err = art.CheckArgKinds(flag.Args(), art.FileUnknown, art.FilePEMKey, art.FilePEMKey,
+		art.FileTreeState)
+	if err != nil {
+		mu.Fatalf("error: %v", err)
+	}
+
+	if opts.outStateFile == "" {
+		opts.outStateFile = opts.treeStateFile
+	}
+
+	return &opts
+}
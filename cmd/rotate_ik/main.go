@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+
+	"github.com/syslab-wm/art"
+	"github.com/syslab-wm/mu"
+)
+
+func main() {
+	opts := parseOptions()
+
+	oldSK, err := art.ReadSigningKeyFromFile(opts.oldPrivIKFile, art.EncodingPEM)
+	if err != nil {
+		mu.Fatalf("error: can't read old IK: %v", err)
+	}
+	newPK, err := art.ReadVerifyingKeyFromFile(opts.newPubIKFile, art.EncodingPEM)
+	if err != nil {
+		mu.Fatalf("error: can't read new IK: %v", err)
+	}
+
+	rotation, err := art.NewIKRotation(oldSK, newPK)
+	if err != nil {
+		mu.Fatalf("error: %v", err)
+	}
+
+	var chain []*art.IKRotation
+	if opts.append {
+		chain, err = art.ReadIKRotationsFromFile(opts.rotationFile)
+		if err != nil {
+			mu.Fatalf("error: can't read rotation file: %v", err)
+		}
+		if len(chain) != 0 && !bytes.Equal(chain[len(chain)-1].NewIK, rotation.OldIK) {
+			mu.Fatalf("error: the chain in %s does not end with %s's key",
+				opts.rotationFile, opts.oldPrivIKFile)
+		}
+	}
+	chain = append(chain, rotation)
+
+	if err := art.WriteIKRotationsToFile(chain, opts.rotationFile); err != nil {
+		mu.Fatalf("error: can't write rotation file: %v", err)
+	}
+}
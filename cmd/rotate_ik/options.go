@@ -0,0 +1,78 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/syslab-wm/art/internal/defaults"
+	"github.com/syslab-wm/mu"
+)
+
+const shortUsage = "Usage: rotate_ik [options] OLD_PRIV_IK_FILE NEW_PUB_IK_FILE"
+const usage = `Usage: rotate_ik [options] OLD_PRIV_IK_FILE NEW_PUB_IK_FILE
+
+Rotate the initiator's identity key (IK): sign, with the old IK, a statement
+that the initiator's IK is now the new IK.  Members that trust the old IK
+pass the statement to process_setup_message with -ik-rotation, to accept
+setup messages signed by the new IK.
+
+positional arguments:
+  OLD_PRIV_IK_FILE
+    The initiator's current private IK, as a PEM-encoded Ed25519 or ECDSA
+    P-256 private key.
+
+  NEW_PUB_IK_FILE
+    The initiator's new public IK, as a PEM-encoded Ed25519 or ECDSA P-256
+    public key.
+
+options:
+  -h, -help
+    Show this usage statement and exit.
+
+  -out ROTATION_FILE
+    The file to write the rotation to, as a chain (a JSON array) of
+    rotations, oldest first.  If not provided, the default is
+    ik-rotation.json.
+
+  -append
+    Append the rotation to the chain in ROTATION_FILE, which must end with
+    the rotation to OLD_PRIV_IK_FILE's key, rather than starting a new
+    chain; members that trust any earlier IK in the chain can then follow
+    it to the new IK.
+
+examples:
+  ./rotate_ik -out ik-rotation.json alice-ik.pem alice2-ik-pub.pem`
+
+func printUsage() {
+	fmt.Println(usage)
+}
+
+type options struct {
+	// positional arguments
+	oldPrivIKFile string
+	newPubIKFile  string
+
+	// options
+	rotationFile string
+	append       bool
+}
+
+func parseOptions() *options {
+	opts := options{}
+
+	flag.Usage = printUsage
+	flag.StringVar(&opts.rotationFile, "out", "ik-rotation.json", "")
+	flag.BoolVar(&opts.append, "append", false, "")
+	if err := defaults.Load(flag.CommandLine, "rotate_ik"); err != nil {
+		mu.Fatalf("error: %v", err)
+	}
+	flag.Parse()
+
+	if flag.NArg() != 2 {
+		mu.Fatalf(shortUsage)
+	}
+	opts.oldPrivIKFile = flag.Arg(0)
+	opts.newPubIKFile = flag.Arg(1)
+
+	return &opts
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"github.com/syslab-wm/art"
+	"github.com/syslab-wm/mu"
+)
+
+func main() {
+	opts := parseOptions()
+
+	state, err := art.LoadTreeState(opts.treeStateFile)
+	if err != nil {
+		mu.Fatalf("error reading tree state from %s: %v", opts.treeStateFile, err)
+	}
+	if state.LeafIndex() != opts.index {
+		mu.Fatalf("error: the leaf key in %s is not the leaf key of member %d",
+			opts.treeStateFile, opts.index)
+	}
+
+	ik, err := art.ReadSigningKeyFromFile(opts.privIKFile, art.EncodingPEM)
+	if err != nil {
+		mu.Fatalf("error: can't read private IK: %v", err)
+	}
+
+	sealed, err := art.SealLeafKey(ik, opts.index, state.Lk)
+	if err != nil {
+		mu.Fatalf("error: can't seal the leaf key: %v", err)
+	}
+	if err := art.WriteSealedLeafKeyToFile(sealed, opts.sealedFile); err != nil {
+		mu.Fatalf("error: can't write sealed leaf key: %v", err)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+
+	"github.com/syslab-wm/art"
+	"github.com/syslab-wm/art/internal/defaults"
+	"github.com/syslab-wm/mu"
+)
+
+const shortUsage = "Usage: seal_leaf [options] INDEX PRIV_IK_FILE STATE_FILE"
+const usage = `Usage: seal_leaf [options] INDEX PRIV_IK_FILE STATE_FILE
+
+Seal the private leaf key of the group member at position INDEX: encrypt it
+under a key derived from the member's private identity key (IK), so that the
+member can recover it with recover_leaf after losing its state.
+
+The sealed leaf key is only as secret as the IK.  It goes stale when the
+member updates its leaf key (with update_key or -post-join-update), so seal
+the leaf key again after each such update; the other members' updates don't
+affect it.
+
+positional arguments:
+  INDEX
+	The index position of the group member, this index is based off the
+	member's position in the group config file, where the first entry is at
+	index 1.
+
+  PRIV_IK_FILE
+	The member's private identity key file.  This is a PEM-encoded Ed25519 or
+	ECDSA P-256 private key.
+
+  STATE_FILE
+	The member's state file, which holds the leaf key.
+
+options:
+  -h, -help
+    Show this usage statement and exit.
+
+  -out SEALED_FILE
+    The file to write the sealed leaf key to.  If not provided, the default
+    is leaf-key.sealed.
+
+examples:
+  ./seal_leaf -out bob-leaf.sealed 2 bob-ik.pem bob-state.json`
+
+func printUsage() {
+	fmt.Println(usage)
+}
+
+type options struct {
+	// positional arguments
+	index         int
+	privIKFile    string
+	treeStateFile string
+
+	// options
+	sealedFile string
+}
+
+func parseOptions() *options {
+	var err error
+	opts := options{}
+
+	flag.Usage = printUsage
+	flag.StringVar(&opts.sealedFile, "out", "leaf-key.sealed", "")
+	if err := defaults.Load(flag.CommandLine, "seal_leaf"); err != nil {
+		mu.Fatalf("error: %v", err)
+	}
+	flag.Parse()
+
+	if flag.NArg() != 3 {
+		mu.Fatalf(shortUsage)
+	}
+
+	opts.index, err = strconv.Atoi(flag.Arg(0))
+	if err != nil {
+		mu.Fatalf("error converting positional argument INDEX to int: %v", err)
+	}
+	opts.privIKFile = flag.Arg(1)
+	opts.treeStateFile = flag.Arg(2)
+
+	err = art.CheckArgKinds(flag.Args(), art.FileUnknown, art.FilePEMKey, art.FileTreeState)
+	if err != nil {
+		mu.Fatalf("error: %v", err)
+	}
+
+	return &opts
+}
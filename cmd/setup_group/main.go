@@ -1,26 +1,222 @@
 package main
 
 import (
+	"crypto/ecdh"
+	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/syslab-wm/art"
+	"github.com/syslab-wm/art/internal/fputl"
+	"github.com/syslab-wm/art/internal/profile"
+	"github.com/syslab-wm/art/transport"
 	"github.com/syslab-wm/mu"
 )
 
+// prekeyIDs returns the IDs of the prekeys that the setup consumed (see
+// art.ConsumedPrekeys), and fails if any of them is listed in consumedFile.
+func prekeyIDs(state *art.TreeState, setupMsg *art.SetupMessage,
+	leafKeys map[string]*ecdh.PrivateKey, consumedFile string) []string {
+
+	consumed, err := fputl.ReadFile(consumedFile)
+	if err != nil {
+		mu.Fatalf("error: can't read consumed prekeys file: %v", err)
+	}
+
+	ids, err := art.ConsumedPrekeys(state, setupMsg, leafKeys, consumed)
+	if err != nil {
+		mu.Fatalf("error: %v", err)
+	}
+	return ids
+}
+
+// sukID returns the ID of setupMsg's SUK, and fails if it is listed in
+// historyFile.
+func sukID(setupMsg *art.SetupMessage, historyFile string) string {
+	used, err := fputl.ReadFile(historyFile)
+	if err != nil {
+		mu.Fatalf("error: can't read SUK history file: %v", err)
+	}
+
+	id := art.Fingerprint(setupMsg.GetSetupKey().Bytes())
+	if used[id] {
+		mu.Fatalf("error: the SUK (%s) was already used in an earlier setup", id)
+	}
+
+	return id
+}
+
+// readLeafMetadata reads the leaf metadata file, in which each line is a
+// member's name followed by the metadata of its leaf (the rest of the line).
+// As in the config file, blank lines and lines that start with # are skipped.
+func readLeafMetadata(metadataFile string) map[string]string {
+	data, err := os.ReadFile(metadataFile)
+	if err != nil {
+		mu.Fatalf("error: can't read leaf metadata file: %v", err)
+	}
+
+	metadata := make(map[string]string)
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		name := strings.Fields(line)[0]
+		value := strings.TrimPrefix(line, name)
+		if _, ok := metadata[name]; ok {
+			mu.Fatalf("error: %s:%d: duplicate leaf metadata for %q", metadataFile,
+				i+1, name)
+		}
+		metadata[name] = strings.TrimSpace(value)
+	}
+	return metadata
+}
+
+// readLeafKeys reads the leaf keys file, in which each line is a member's
+// name followed by the member's private leaf key file.  Relative paths are
+// relative to the directory of the leaf keys file, and blank lines and lines
+// that start with # are skipped.
+func readLeafKeys(leafKeysFile string) map[string]*ecdh.PrivateKey {
+	data, err := os.ReadFile(leafKeysFile)
+	if err != nil {
+		mu.Fatalf("error: can't read leaf keys file: %v", err)
+	}
+
+	keys := make(map[string]*ecdh.PrivateKey)
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			mu.Fatalf("error: %s:%d: expected NAME PRIV_LEAF_KEY_FILE", leafKeysFile, i+1)
+		}
+		name, keyFile := fields[0], fields[1]
+		if _, ok := keys[name]; ok {
+			mu.Fatalf("error: %s:%d: duplicate leaf key for %q", leafKeysFile, i+1, name)
+		}
+		if !filepath.IsAbs(keyFile) {
+			keyFile = filepath.Join(filepath.Dir(leafKeysFile), keyFile)
+		}
+
+		keys[name], err = art.ReadPrivateEKFromFile(keyFile, art.EncodingPEM)
+		if err != nil {
+			mu.Fatalf("error: %s:%d: can't read leaf key: %v", leafKeysFile, i+1, err)
+		}
+	}
+	return keys
+}
+
+// newMembers reads the key files of the members given with -members.
+func newMembers(files []memberFiles) []*art.Member {
+	members := make([]*art.Member, 0, len(files))
+	for _, f := range files {
+		m, err := art.NewMember(f.name, f.pubIKFile, f.pubEKFile)
+		if err != nil {
+			mu.Fatalf("error: creating new group member %v", err)
+		}
+		members = append(members, m)
+	}
+	return members
+}
+
 func main() {
+	var err error
+	var prekeys []string
+	var suk string
+
 	opts := parseOptions()
+	defer profile.Start(opts.cpuProfile, opts.memProfile)()
+
+	setupOpts := &art.SetupOptions{
+		SignedPrekeys: opts.signedPrekeys,
+		Workers:       opts.workers,
+		VerifyAll:     opts.verifyAll,
+		TreeOrder:     opts.treeOrder,
+		EpochSecret:   opts.epochSecret,
+		Compact:       opts.compact,
+	}
+	if opts.leafMetadataFile != "" {
+		setupOpts.LeafMetadata = readLeafMetadata(opts.leafMetadataFile)
+	}
+	if opts.leafKeysFile != "" {
+		setupOpts.LeafKeys = readLeafKeys(opts.leafKeysFile)
+	}
+	setupOpts.SignatureScheme, err = art.SignatureSchemeOfKeyFile(opts.privIKFile)
+	if err != nil {
+		mu.Fatalf("error: %v", err)
+	}
+	if opts.sukSeed != "" {
+		setupOpts.Rand = art.NewSeededReader([]byte(opts.sukSeed))
+	}
+	if opts.sukFile != "" {
+		setupOpts.SetupKey, err = art.ReadPrivateEKFromFile(opts.sukFile, art.EncodingPEM)
+		if err != nil {
+			mu.Fatalf("error: can't read SUK file: %v", err)
+		}
+	}
+
+	var state *art.TreeState
+	var setupMsg *art.SetupMessage
+	switch {
+	case opts.members != nil:
+		state, setupMsg = art.SetupGroupFromMembers(newMembers(opts.members),
+			opts.initiator, setupOpts)
+	case opts.stdinConfig:
+		state, setupMsg = art.SetupGroupFromMembers(art.GetMembersFromJSON(os.Stdin),
+			opts.initiator, setupOpts)
+	default:
+		state, setupMsg = art.SetupGroup(opts.configFile, opts.initiator, setupOpts)
+	}
 
-	state, setupMsg := art.SetupGroup(opts.configFile, opts.initiator)
+	if opts.prekeysFile != "" {
+		prekeys = prekeyIDs(state, setupMsg, setupOpts.LeafKeys, opts.prekeysFile)
+	}
+	if opts.sukHistory != "" {
+		suk = sukID(setupMsg, opts.sukHistory)
+	}
 
-	err := os.MkdirAll(opts.outDir, 0750)
+	err = os.MkdirAll(opts.outDir, 0750)
 	if err != nil {
 		mu.Fatalf("error: can't create out-dir: %v", err)
 	}
 
+	// write the state before the message, so that a message is never sent
+	// for a group whose initiator failed to save its state
+	state.MACKey = opts.stateMACKey
+	state.Save(opts.treeStateFile)
+	state.SaveStageKey(filepath.Join(opts.outDir, "stage-key.pem"))
+
 	setupMsg.Save(opts.msgFile)
 	setupMsg.SaveSign(opts.sigFile, opts.msgFile, opts.privIKFile)
 
-	state.Save(opts.treeStateFile)
-	state.SaveStageKey(filepath.Join(opts.outDir, "stage-key.pem"))
+	// record the prekeys and the SUK as used before publishing the message,
+	// so that a message is never sent with prekeys that could be used again
+	if opts.prekeysFile != "" {
+		err = fputl.AppendFile(opts.prekeysFile, prekeys)
+		if err != nil {
+			mu.Fatalf("error: can't update consumed prekeys file: %v", err)
+		}
+	}
+
+	if opts.sukHistory != "" {
+		err = fputl.AppendFile(opts.sukHistory, []string{suk})
+		if err != nil {
+			mu.Fatalf("error: can't update SUK history file: %v", err)
+		}
+	}
+
+	if opts.publishDir != "" {
+		err = transport.SendFiles(transport.NewDir(opts.publishDir, 1),
+			transport.KindSetup, opts.msgFile, opts.sigFile)
+		if err != nil {
+			mu.Fatalf("error: can't publish setup message: %v", err)
+		}
+	}
+
+	fmt.Printf("initiator's INDEX: %d\n", state.LeafIndex())
 }
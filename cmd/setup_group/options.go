@@ -4,22 +4,29 @@ import (
 	"flag"
 	"fmt"
 	"path/filepath"
+	"strings"
 
+	"github.com/syslab-wm/art"
+	"github.com/syslab-wm/art/internal/defaults"
 	"github.com/syslab-wm/mu"
 )
 
-const shortUsage = "setup_group [options] CONFIG_FILE PRIV_IK_FILE"
+const shortUsage = "setup_group [options] CONFIG_FILE PRIV_IK_FILE\n" +
+	"       setup_group [options] -members MEMBERS PRIV_IK_FILE\n" +
+	"       setup_group [options] -stdin-config PRIV_IK_FILE"
 
 const usage = `setup_group [options] CONFIG_FILE PRIV_IK_FILE
+       setup_group [options] -members MEMBERS PRIV_IK_FILE
+       setup_group [options] -stdin-config PRIV_IK_FILE
 
 Setup the ART group.
 
 positional arguments:
   CONFIG_FILE
     The config file has one line per group member (including the initiator).
-    Each line consists of three whitespace-separated fields:
+    Each line consists of three or four whitespace-separated fields:
 
-      NAME PUB_IK_FILE PUB_EK_FILE
+      NAME PUB_IK_FILE PUB_EK_FILE [INDEX]
 
     where,
       NAME: 
@@ -33,35 +40,186 @@ positional arguments:
         The member's ephemeral key file (also called a prekey).  This is
         a PEM-encoded X25519 public key.
 
-    Empty lines are ignored, as are lines that start with a '#'.
+      INDEX:
+        Optional.  The member's position in the tree, for deployments where
+        positions are assigned externally.  Either every member or no member
+        has an INDEX, and the INDEXes must be unique and from 1 to 4 times
+        the number of members (and at most 1048576).  If they are sparse,
+        the tree has a leaf for every INDEX up to the largest, and the
+        leaves of the missing INDEXes are blank: they have random keys that
+        no member holds.  Blank leaves cost as much as members' leaves to
+        set up and to update over (see -compact).
+
+    Empty lines are ignored, as are lines that start with a '#'.  Without
+    explicit INDEXes, a member's INDEX is its position in the file, starting
+    at 1.  gen_config generates a config file from a directory of members'
+    public keys.  CONFIG_FILE is omitted if -members or -stdin-config is
+    given.
 
   PRIV_IK_FILE
     The initiator's private identity key file.  This is a PEM-encoded ED25519
-    key.  This key signs the setup message; the signature is written to
-    SIG_FILE.
+    or ECDSA P-256 key.  This key signs the setup message; the signature is
+    written to SIG_FILE.
 
 options:
+  -members MEMBERS
+    Specify the members inline, instead of in a CONFIG_FILE.  MEMBERS is a
+    comma-separated list of PUB_IK_FILE:PUB_EK_FILE pairs, one per member,
+    in INDEX order.  A member's NAME is the base name of its PUB_IK_FILE,
+    without the suffix -ik-pub.pem (or, failing that, without its
+    extension); e.g., alice-ik-pub.pem:alice-ek-pub.pem is member alice.
+    The resulting setup is the same as with the equivalent CONFIG_FILE.
+
+  -stdin-config
+    Read the group config from stdin, in JSON, instead of from a
+    CONFIG_FILE.  The config is an array with one object per member:
+
+      [{"ik": PUB_IK_FILE, "ek": PUB_EK_FILE, "index": INDEX, "name": NAME}, ...]
+
+    where "index" and "name" are optional.  A member without a "name" is
+    named as with -members, and the INDEXes follow the rules of CONFIG_FILE.
+    Relative paths are relative to the working directory.  Unknown fields
+    are an error.
+
   -initiator NAME
     The name of the initiator (e.g. alice).  This must match one of the
     names in CONFIG_FILE.  If this option is not provided, the initiator
-    is the first entry in the CONFIG_FILE.
+    is the member at the lowest INDEX (by default, the first entry in the
+    CONFIG_FILE).
 
   -out-dir OUT_DIR
     The output directory.  The program will place various output files
     in this directory, such as the leaf key for each member.  If not
-    provided, the program sets out-dir to basename(CONFIG_FILE).dir.
+    provided, the program sets out-dir to basename(CONFIG_FILE).dir (or
+    group.dir with -members or -stdin-config).
     If the out-dir does not exist, the program creates it.
 
   -out-state STATE_FILE
     The file to output the node's state. If not provided, the default is 
-	state.json. 
+	state.json.  This is the initiator's complete state (including its own
+	leaf key and the stage key), so the initiator does not need to process
+	its own setup message.  The program prints the initiator's INDEX, which
+	the initiator passes to update_key and process_update_message.
 
   -msg-file MSG_FILE
     The message file. If omitted, the message is saved to file setup.msg
+    If MSG_FILE ends in .gz, the message is gzip-compressed; the signature
+    covers the uncompressed message, and the other tools decompress it
+    transparently.
 
   -sig-file SIG_FILE
 	The signature file. If omitted, the signature is saved to file MSG_FILE.sig
 
+  -suk-seed SEED
+    FOR TESTING AND DEBUGGING ONLY.  Derive the initiator's leaf key and the
+    setup key (SUK) deterministically from the string SEED, instead of
+    generating them randomly.  Given the same CONFIG_FILE and SEED, the
+    resulting tree, setup message, and stage key are bit-for-bit identical.
+    Anyone who knows SEED can derive every member's leaf key.
+
+  -suk-file SUK_FILE
+    FOR TESTING AND DEBUGGING ONLY.  Use the PEM-encoded X25519 private key
+    in SUK_FILE as the setup key (SUK) instead of generating one.  The
+    initiator's leaf key is still random unless -suk-seed is also given.  The
+    program refuses to setup the group if the SUK is one of the members' EKs.
+
+  -consumed-prekeys PREKEYS_FILE
+    A file that lists the IDs of one-time prekeys (the members' ephemeral
+    keys) that have already been used in a group setup, one per line.  The
+    prekey ID is the hex-encoded SHA-256 digest of the raw X25519 public key.
+    If any prekey that the setup uses is in this list, the program refuses
+    to setup the group.  A prekey is used if the member's leaf key is derived
+    from it; the initiator's prekey, and those of the members given in
+    -leaf-keys, are not.  After a successful setup, and before the setup
+    message is published, the IDs of the prekeys used are appended to
+    PREKEYS_FILE.  The file is created if it does not exist.
+
+  -signed-prekeys
+    Require each member's prekey to be signed by the member's identity key,
+    so that the initiator only uses authentic prekeys.  The signature of
+    PUB_EK_FILE is read from PUB_EK_FILE.sig, which the member creates with
+
+      genpkey -keytype ek -sign-key NAME-ik.pem NAME
+
+    If any signature is missing or invalid, the program refuses to setup the
+    group.
+
+  -verify-all
+    Before writing any output, check that every member derives the
+    initiator's stage key from the setup message, by processing the message
+    as each member would (with the leaf keys the initiator derived).  If any
+    member would derive a different key, the program refuses to setup the
+    group.  This takes one DH per node on each member's path to the root.
+
+  -workers N
+    The number of goroutines that derive the members' leaf keys, one DH per
+    member.  If not provided, the default is the number of CPUs the program
+    may use (GOMAXPROCS), capped at 64; cost_estimate shows the effect.
+
+  -suk-history SUK_HISTORY_FILE
+    A file that lists the IDs of the setup keys (SUKs) used in earlier group
+    setups, one per line, in the format of PREKEYS_FILE.  Reusing a SUK
+    repeats the members' leaf keys, so the program refuses to setup the group
+    if its SUK is in this list (which can only happen with -suk-seed or
+    -suk-file).  After a successful setup, the SUK's ID is appended to
+    SUK_HISTORY_FILE.  The file is created if it does not exist.
+
+  -tree-order level|in
+    The order of the tree's keys in the setup message, for interoperability
+    with implementations that exchange the tree as a flat array: level
+    (level by level, from the root; the node indices of the other tools) or
+    in (in-order: left subtree, node, right subtree).  The order is recorded
+    in the message's suite.  If not provided, the keys are in level order,
+    and the suite does not name an order, so that older builds can read the
+    message.
+
+  -epoch-secret
+    Derive, along with each stage key, an epoch secret from which the next
+    stage key is derived, so that the stage key itself never feeds the key
+    schedule.  This is recorded in the message's suite (as the KDF
+    HKDF-SHA256-epoch); older builds refuse such a message, as they would
+    derive different stage keys after the first update.
+
+  -compact
+    Ignore the gaps between sparse INDEXes: place the members at consecutive
+    positions, in INDEX order, so that the tree has no blank leaves.  To
+    rebalance a group whose blank leaves lengthen its paths, set it up anew
+    with -compact (and fresh prekeys); the members then process the new
+    setup message at their compacted INDEXes, which list_members shows.
+
+  -leaf-metadata METADATA_FILE
+    Annotate the members' leaves with human-readable metadata (e.g., an email
+    address), which list_members displays.  Each line of METADATA_FILE is a
+    member's name followed by the metadata of its leaf; members without a
+    line get no metadata.  The metadata is signed along with the setup
+    message, but does not affect the keys.
+
+  -leaf-keys LEAF_KEYS_FILE
+    Use supplied leaf keys for some members, instead of deriving them from
+    the SUK and the members' EKs (e.g., keys agreed on with the members in a
+    different key-agreement step).  Each line of LEAF_KEYS_FILE is a member's
+    name followed by a file with the member's private leaf key, a PEM-encoded
+    X25519 private key; relative paths are relative to the directory of
+    LEAF_KEYS_FILE.  Each such member must process the setup message with
+    process_setup_message -leaf-key-file and the same key.
+
+  -publish DIR
+    After writing the setup message and its signature, also send them to the
+    group through the message directory DIR, as the next NNNNNN-setup.msg
+    (and .sig).  Members receive the messages in DIR in order.
+
+  -cpuprofile FILE
+    Write a pprof CPU profile of the run to FILE (see go tool pprof).
+
+  -memprofile FILE
+    Write a pprof heap profile to FILE at the end of the run.
+
+  -state-mac-key KEY_FILE
+	Protect the state file with an HMAC keyed by the contents of KEY_FILE
+	(at least 16 bytes): the MAC is written with the state, and reading a
+	state whose MAC is missing or does not verify fails.  All the tools that
+	use the state must be given the same key.
+
 example:
     ./setup_group -initiator alice -out-dir group.d -msg-file setup.msg \
 		-sig-file setup.msg.sig group.cfg alice-ik.pem`
@@ -76,33 +234,137 @@ type options struct {
 	privIKFile string
 
 	// options
-	initiator     string
-	outDir        string
-	msgFile       string
-	sigFile       string
-	treeStateFile string
+	members          []memberFiles
+	stdinConfig      bool
+	initiator        string
+	outDir           string
+	msgFile          string
+	sigFile          string
+	treeStateFile    string
+	prekeysFile      string
+	sukSeed          string
+	sukFile          string
+	sukHistory       string
+	signedPrekeys    bool
+	workers          int
+	verifyAll        bool
+	publishDir       string
+	leafMetadataFile string
+	leafKeysFile     string
+	treeOrder        string
+	epochSecret      bool
+	compact          bool
+	cpuProfile       string
+	memProfile       string
+	stateMACKeyFile  string
+	stateMACKey      []byte
+}
+
+// memberFiles are the key files of a member given with -members.
+type memberFiles struct {
+	name      string
+	pubIKFile string
+	pubEKFile string
+}
+
+// parseMembers parses the -members list.
+func parseMembers(arg string) []memberFiles {
+	var members []memberFiles
+	names := make(map[string]bool)
+
+	for i, entry := range strings.Split(arg, ",") {
+		ik, ek, ok := strings.Cut(entry, ":")
+		if !ok || ik == "" || ek == "" || strings.Contains(ek, ":") {
+			mu.Fatalf("error: -members entry %d (%q) is not of the form PUB_IK_FILE:PUB_EK_FILE",
+				i+1, entry)
+		}
+
+		name := art.MemberName(ik)
+		if names[name] {
+			mu.Fatalf("error: -members has multiple entries for %q", name)
+		}
+		names[name] = true
+
+		members = append(members, memberFiles{name: name, pubIKFile: ik, pubEKFile: ek})
+	}
+
+	return members
 }
 
 func parseOptions() *options {
+	var membersArg string
 	opts := options{}
 
 	flag.Usage = printUsage
+	flag.StringVar(&membersArg, "members", "", "")
+	flag.BoolVar(&opts.stdinConfig, "stdin-config", false, "")
 	flag.StringVar(&opts.initiator, "initiator", "", "")
 	flag.StringVar(&opts.outDir, "out-dir", "", "")
 	flag.StringVar(&opts.msgFile, "msg-file", "setup.msg", "")
 	flag.StringVar(&opts.sigFile, "sig-file", "", "")
 	flag.StringVar(&opts.treeStateFile, "out-state", "state.json", "")
+	flag.StringVar(&opts.prekeysFile, "consumed-prekeys", "", "")
+	flag.StringVar(&opts.sukSeed, "suk-seed", "", "")
+	flag.StringVar(&opts.sukFile, "suk-file", "", "")
+	flag.StringVar(&opts.sukHistory, "suk-history", "", "")
+	flag.BoolVar(&opts.signedPrekeys, "signed-prekeys", false, "")
+	flag.IntVar(&opts.workers, "workers", 0, "")
+	flag.BoolVar(&opts.verifyAll, "verify-all", false, "")
+	flag.StringVar(&opts.publishDir, "publish", "", "")
+	flag.StringVar(&opts.leafMetadataFile, "leaf-metadata", "", "")
+	flag.StringVar(&opts.leafKeysFile, "leaf-keys", "", "")
+	flag.StringVar(&opts.treeOrder, "tree-order", "", "")
+	flag.BoolVar(&opts.epochSecret, "epoch-secret", false, "")
+	flag.BoolVar(&opts.compact, "compact", false, "")
+	flag.StringVar(&opts.cpuProfile, "cpuprofile", "", "")
+	flag.StringVar(&opts.memProfile, "memprofile", "", "")
+	flag.StringVar(&opts.stateMACKeyFile, "state-mac-key", "", "")
+	if err := defaults.Load(flag.CommandLine, "setup_group"); err != nil {
+		mu.Fatalf("error: %v", err)
+	}
 	flag.Parse()
 
-	if flag.NArg() != 2 {
-		mu.Fatalf(shortUsage)
+	if opts.stateMACKeyFile != "" {
+		key, err := art.ReadStateMACKeyFile(opts.stateMACKeyFile)
+		if err != nil {
+			mu.Fatalf("error: can't read state MAC key: %v", err)
+		}
+		opts.stateMACKey = key
 	}
 
-	opts.configFile = flag.Arg(0)
-	opts.privIKFile = flag.Arg(1)
+	if opts.treeOrder != "" && opts.treeOrder != art.OrderLevel &&
+		opts.treeOrder != art.OrderIn {
+		mu.Fatalf("error: -tree-order invalid value %q (must be level|in)", opts.treeOrder)
+	}
+
+	if opts.workers < 0 {
+		mu.Fatalf("error: -workers must be at least 1")
+	}
+
+	if membersArg != "" && opts.stdinConfig {
+		mu.Fatalf("error: -members and -stdin-config are mutually exclusive")
+	}
 
-	if opts.outDir == "" {
-		opts.outDir = filepath.Base(opts.configFile) + ".dir"
+	if membersArg != "" || opts.stdinConfig {
+		if flag.NArg() != 1 {
+			mu.Fatalf(shortUsage)
+		}
+		if membersArg != "" {
+			opts.members = parseMembers(membersArg)
+		}
+		opts.privIKFile = flag.Arg(0)
+		if opts.outDir == "" {
+			opts.outDir = "group.dir"
+		}
+	} else {
+		if flag.NArg() != 2 {
+			mu.Fatalf(shortUsage)
+		}
+		opts.configFile = flag.Arg(0)
+		opts.privIKFile = flag.Arg(1)
+		if opts.outDir == "" {
+			opts.outDir = filepath.Base(opts.configFile) + ".dir"
+		}
 	}
 
 	if opts.sigFile == "" {
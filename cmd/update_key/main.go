@@ -2,20 +2,62 @@ package main
 
 import (
 	"fmt"
+	"io"
+	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/syslab-wm/art"
+	"github.com/syslab-wm/art/internal/profile"
+	"github.com/syslab-wm/art/transport"
+	"github.com/syslab-wm/mu"
 )
 
 func main() {
 	opts := parseOptions()
+	defer profile.Start(opts.cpuProfile, opts.memProfile)()
 
-	updateMsg, state, stageKey := art.UpdateKey(opts.index, opts.treeStateFile)
+	if opts.verifyState {
+		err := art.VerifyTreeStateFile(opts.index, opts.treeStateFile, opts.stateMACKey)
+		if err != nil {
+			mu.Fatalf("error: %v", err)
+		}
+	}
+
+	var r io.Reader
+	if opts.randFile != "" {
+		file, err := os.Open(opts.randFile)
+		if err != nil {
+			mu.Fatalf("error: can't open rand file: %v", err)
+		}
+		defer file.Close()
+		r = file
+	}
+
+	if opts.outDir != "" {
+		if err := os.MkdirAll(opts.outDir, 0750); err != nil {
+			mu.Fatalf("error: can't create out-dir: %v", err)
+		}
+	}
+
+	state, err := art.LoadTreeStateWithMAC(opts.treeStateFile, opts.stateMACKey)
+	if err != nil {
+		mu.Fatalf("error reading tree state from %s: %v", opts.treeStateFile, err)
+	}
+	updateMsg, stageKey := state.UpdateKeyFrom(opts.index, r)
 
 	updateMsg.Save(opts.updateFile)
-	updateMsg.SaveMac(*stageKey, opts.macFile)
+	updateMsg.SaveMac(stageKey, opts.macFile)
+
+	if opts.publishDir != "" {
+		err := transport.SendFiles(transport.NewDir(opts.publishDir, 1),
+			transport.KindUpdate, opts.updateFile, opts.macFile)
+		if err != nil {
+			mu.Fatalf("error: can't publish update message: %v", err)
+		}
+	}
 
 	state.Save(opts.treeStateFile)
-	state.SaveStageKey(fmt.Sprintf("stage-key-update-key-%d-%d.pem",
-		opts.index, time.Now().Unix()))
+	state.SaveStageKey(filepath.Join(opts.outDir, fmt.Sprintf(
+		"stage-key-update-key-%d-%d.pem", opts.index, time.Now().Unix())))
 }
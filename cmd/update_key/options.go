@@ -3,8 +3,11 @@ package main
 import (
 	"flag"
 	"fmt"
+	"path/filepath"
 	"strconv"
 
+	"github.com/syslab-wm/art"
+	"github.com/syslab-wm/art/internal/defaults"
 	"github.com/syslab-wm/mu"
 )
 
@@ -39,6 +42,39 @@ options:
   	The MAC for the update message will be written to MAC_FILE. If omitted, the 
 	MAC is saved to file UPDATE_FILE.mac
 
+  -out-dir OUT_DIR
+	The output directory: the program places UPDATE_FILE, MAC_FILE, and the
+	stage key file in OUT_DIR, creating it if it does not exist.  TREE_FILE
+	is updated in place.  If omitted, the paths are relative to the current
+	directory.
+
+  -rand-file FILE
+	Read the randomness for the new leaf key from FILE (e.g., a hardware RNG
+	such as /dev/hwrng) instead of the operating system's RNG.  The key is
+	derived from the next 32 bytes of FILE.
+
+  -verify-state
+	Before updating, check TREE_FILE for corruption: the leaf key must match
+	the member's leaf, and the keys derived from it must match the public
+	keys on the member's path to the root.
+
+  -publish DIR
+	After writing the update message and its MAC, also send them to the group
+	through the message directory DIR, as the next NNNNNN-update.msg (and
+	.mac).
+
+  -cpuprofile FILE
+	Write a pprof CPU profile of the run to FILE (see go tool pprof).
+
+  -memprofile FILE
+	Write a pprof heap profile to FILE at the end of the run.
+
+  -state-mac-key KEY_FILE
+	Protect the state file with an HMAC keyed by the contents of KEY_FILE
+	(at least 16 bytes): the MAC is written with the state, and reading a
+	state whose MAC is missing or does not verify fails.  All the tools that
+	use the state must be given the same key.
+
 examples:  
   ./update_key -update-file cici_update_key 3 cici-ek.pem cici-state`
 
@@ -52,8 +88,16 @@ type options struct {
 	treeStateFile string
 
 	// options
-	updateFile string
-	macFile    string
+	updateFile      string
+	macFile         string
+	outDir          string
+	randFile        string
+	verifyState     bool
+	publishDir      string
+	cpuProfile      string
+	memProfile      string
+	stateMACKeyFile string
+	stateMACKey     []byte
 }
 
 func parseOptions() *options {
@@ -63,8 +107,25 @@ func parseOptions() *options {
 	flag.Usage = printUsage
 	flag.StringVar(&opts.updateFile, "update-file", "update_key.msg", "")
 	flag.StringVar(&opts.macFile, "mac-file", "", "")
+	flag.StringVar(&opts.outDir, "out-dir", "", "")
+	flag.StringVar(&opts.randFile, "rand-file", "", "")
+	flag.BoolVar(&opts.verifyState, "verify-state", false, "")
+	flag.StringVar(&opts.publishDir, "publish", "", "")
+	flag.StringVar(&opts.cpuProfile, "cpuprofile", "", "")
+	flag.StringVar(&opts.memProfile, "memprofile", "", "")
+	flag.StringVar(&opts.stateMACKeyFile, "state-mac-key", "", "")
+	if err := defaults.Load(flag.CommandLine, "update_key"); err != nil {
+		mu.Fatalf("error: %v", err)
+	}
 	flag.Parse()
 
+	if opts.stateMACKeyFile != "" {
+		opts.stateMACKey, err = art.ReadStateMACKeyFile(opts.stateMACKeyFile)
+		if err != nil {
+			mu.Fatalf("error: can't read state MAC key: %v", err)
+		}
+	}
+
 	if flag.NArg() != 2 {
 		mu.Fatalf(shortUsage)
 	}
@@ -76,8 +137,16 @@ func parseOptions() *options {
 
 	opts.treeStateFile = flag.Arg(1)
 
+	err = art.CheckArgKinds(flag.Args(), art.FileUnknown, art.FileTreeState)
+	if err != nil {
+		mu.Fatalf("error: %v", err)
+	}
+
+	opts.updateFile = filepath.Join(opts.outDir, opts.updateFile)
 	if opts.macFile == "" {
 		opts.macFile = opts.updateFile + ".mac"
+	} else {
+		opts.macFile = filepath.Join(opts.outDir, opts.macFile)
 	}
 
 	return &opts
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"fmt"
+
+	"github.com/syslab-wm/art"
+	"github.com/syslab-wm/mu"
+)
+
+// report prints the pass/fail line of the key in file, and returns whether
+// the key passed.
+func report(file string, err error) bool {
+	if err != nil {
+		fmt.Printf("FAIL  %s: %v\n", file, err)
+		return false
+	}
+	fmt.Printf("PASS  %s\n", file)
+	return true
+}
+
+// checkEK checks the EK in ekFile, which must not be a duplicate of a key in
+// seen (keyed by the raw key, with the file it was first seen in), and, if
+// ik is not nil, must be signed by ik.
+func checkEK(ekFile string, ik ed25519.PublicKey, seen map[string]string) error {
+	ek, err := art.ReadPublicEKFromFile(ekFile, art.EncodingPEM)
+	if err != nil {
+		return fmt.Errorf("can't read the EK: %v", err)
+	}
+	if err := art.CheckPublicEK(ek); err != nil {
+		return err
+	}
+
+	if first, ok := seen[string(ek.Bytes())]; ok {
+		return fmt.Errorf("the EK is a duplicate of %s", first)
+	}
+	seen[string(ek.Bytes())] = ekFile
+
+	if ik != nil {
+		return art.VerifyPrekeySignature(ik, ekFile, art.PrekeySignatureFile(ekFile))
+	}
+	return nil
+}
+
+func main() {
+	opts := parseOptions()
+
+	ik, err := art.ReadPublicIKFromFile(opts.ikFile, art.EncodingPEM)
+	if err != nil {
+		err = fmt.Errorf("can't read the IK: %v", err)
+	}
+	ok := report(opts.ikFile, err)
+
+	var signer ed25519.PublicKey
+	if opts.signed {
+		if !ok {
+			mu.Fatalf("error: can't check the EKs' signatures without a valid IK")
+		}
+		signer = ik
+	}
+
+	seen := make(map[string]string)
+	failed := 0
+	for _, ekFile := range opts.ekFiles {
+		if !report(ekFile, checkEK(ekFile, signer, seen)) {
+			failed++
+		}
+	}
+
+	if !ok || failed != 0 {
+		mu.Fatalf("error: the bundle is invalid (%d of %d EKs failed)", failed,
+			len(opts.ekFiles))
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/syslab-wm/art/internal/defaults"
+	"github.com/syslab-wm/mu"
+)
+
+const shortUsage = "Usage: validate_bundle [options] PUB_IK_FILE PUB_EK_FILE..."
+const usage = `Usage: validate_bundle [options] PUB_IK_FILE PUB_EK_FILE...
+
+Check a member's prekey bundle (the member's public IK and public EKs)
+before using it in a setup: that the IK is a valid Ed25519 key, that each
+EK is a valid X25519 key (and not a low-order point, with which the
+member's leaf key would be zero), that no EK appears twice, and, with
+-signed, that each EK is signed by the IK.  The program prints a
+pass/fail line for each key, and exits with a nonzero status if any key
+fails.
+
+positional arguments:
+  PUB_IK_FILE
+    The member's public identity key.  This is a PEM-encoded ED25519 key.
+
+  PUB_EK_FILE...
+    The member's public ephemeral keys (prekeys).  Each is a PEM-encoded
+    X25519 key.
+
+options:
+  -h, -help
+    Show this usage statement and exit.
+
+  -signed
+    Require each EK to be signed by the IK, as setup_group -signed-prekeys
+    does.  The signature of PUB_EK_FILE is in PUB_EK_FILE.sig.
+
+examples:
+  ./validate_bundle -signed alice-ik-pub.pem alice-ek-pub.pem`
+
+func printUsage() {
+	fmt.Println(usage)
+}
+
+type options struct {
+	// positional arguments
+	ikFile  string
+	ekFiles []string
+
+	// options
+	signed bool
+}
+
+func parseOptions() *options {
+	opts := options{}
+
+	flag.Usage = printUsage
+	flag.BoolVar(&opts.signed, "signed", false, "")
+	if err := defaults.Load(flag.CommandLine, "validate_bundle"); err != nil {
+		mu.Fatalf("error: %v", err)
+	}
+	flag.Parse()
+
+	if flag.NArg() < 2 {
+		mu.Fatalf(shortUsage)
+	}
+	opts.ikFile = flag.Arg(0)
+	opts.ekFiles = flag.Args()[1:]
+
+	return &opts
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/syslab-wm/art"
+	"github.com/syslab-wm/art/internal/watchdog"
+	"github.com/syslab-wm/mu"
+)
+
+func main() {
+	opts := parseOptions()
+	watchdog.Start(opts.timeout)
+
+	art.VerifyMessageSignature(opts.initiatorPubIKFile, opts.setupMessageFile,
+		opts.sigFile)
+
+	var setupMsg art.SetupMessage
+	setupMsg.Read(opts.setupMessageFile)
+
+	mode := art.ValidateFast
+	if opts.deep {
+		mode = art.ValidateDeep
+	}
+	if err := setupMsg.ValidateMode(mode); err != nil {
+		mu.Fatalf("error: invalid setup message:\n%v", err)
+	}
+
+	fmt.Printf("%s: OK (%d members)\n", opts.setupMessageFile, len(setupMsg.IKeys))
+}
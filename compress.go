@@ -0,0 +1,73 @@
+package art
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/syslab-wm/art/internal/fileutl"
+)
+
+// Message files may be gzip-compressed: a message file is compressed when it
+// is written if its name ends in .gz, and is decompressed when it is read if
+// it starts with the gzip magic bytes, whatever its name.  A message's
+// signature always covers the decompressed bytes, so compressing or
+// decompressing a signed message does not invalidate its signature.
+
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// maxMessageSize bounds the size of a decompressed message, so that a small
+// compressed file cannot exhaust memory.
+const maxMessageSize = 1 << 30
+
+// decompress returns the decompressed data if data is gzip-compressed, and
+// data otherwise.
+func decompress(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, gzipMagic) {
+		return data, nil
+	}
+
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("can't decompress message: %v", err)
+	}
+	defer r.Close()
+
+	out, err := io.ReadAll(io.LimitReader(r, maxMessageSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("can't decompress message: %v", err)
+	}
+	if len(out) > maxMessageSize {
+		return nil, fmt.Errorf("decompressed message is larger than %d bytes", maxMessageSize)
+	}
+	return out, nil
+}
+
+// ReadMessageFile returns the (decompressed) contents of a message file.
+func ReadMessageFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return decompress(data)
+}
+
+// WriteMessageFile writes data to the message file at path, compressing it
+// if path ends in .gz.  The file is replaced atomically.
+func WriteMessageFile(path string, data []byte) error {
+	return fileutl.Write(path, 0644, func(w io.Writer) error {
+		if !strings.HasSuffix(path, ".gz") {
+			_, err := w.Write(data)
+			return err
+		}
+
+		zw := gzip.NewWriter(w)
+		if _, err := zw.Write(data); err != nil {
+			return err
+		}
+		return zw.Close()
+	})
+}
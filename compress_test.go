@@ -0,0 +1,92 @@
+package art
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestGzipMessageFile checks that a gzipped setup message reads, verifies,
+// and processes the same as the plain one.
+func TestGzipMessageFile(t *testing.T) {
+	g := newTestGroup(t, "gzip message file", 3, nil)
+	dir := t.TempDir()
+	sigFile := filepath.Join(dir, "setup.sig")
+	if err := os.WriteFile(sigFile, g.sig, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"setup.json", "setup.json.gz"} {
+		t.Run(name, func(t *testing.T) {
+			file := filepath.Join(dir, name)
+			if err := WriteMessageFile(file, g.msg); err != nil {
+				t.Fatal(err)
+			}
+			raw, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if compressed := bytes.HasPrefix(raw, gzipMagic); compressed !=
+				(filepath.Ext(name) == ".gz") {
+				t.Errorf("the file is compressed: %v", compressed)
+			}
+
+			data, err := ReadMessageFile(file)
+			if err != nil {
+				t.Fatalf("ReadMessageFile: %v", err)
+			}
+			if !bytes.Equal(data, g.msg) {
+				t.Fatal("ReadMessageFile does not return the message")
+			}
+
+			valid, err := VerifySignatureWithKey(g.iks[0].Public(), file, sigFile)
+			if err != nil || !valid {
+				t.Errorf("the signature does not verify: %v", err)
+			}
+
+			state, err := ProcessSetupMessageBytes(2, g.eks[1], data, g.sig,
+				g.iks[0].Public())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !StageKeyEqual(state.Sk, g.states[1].Sk) {
+				t.Error("the message gives another stage key")
+			}
+		})
+	}
+}
+
+func TestReadMessageFileCorruptGzip(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "msg.json.gz")
+	if err := WriteMessageFile(file, []byte(`{"idx": 1}`)); err != nil {
+		t.Fatal(err)
+	}
+	compressed, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"magic only", gzipMagic},
+		{"truncated", compressed[:len(compressed)-4]},
+		{"corrupt checksum", flipBit(compressed, len(compressed)-5)},
+		{"corrupt header", flipBit(compressed, 2)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the magic bytes make it gzip, whatever the file's name
+			file := filepath.Join(dir, "msg.json")
+			if err := os.WriteFile(file, tt.data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if data, err := ReadMessageFile(file); err == nil {
+				t.Errorf("ReadMessageFile read %q", data)
+			}
+		})
+	}
+}
@@ -0,0 +1,276 @@
+package art
+
+import (
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/syslab-wm/art/internal/fileutl"
+	"github.com/syslab-wm/art/internal/jsonutl"
+	"github.com/syslab-wm/mu"
+)
+
+// CopathNode is a public key on a member's copath, along with its node
+// index (see PathIndices).
+type CopathNode struct {
+	Node int    `json:"node"`
+	Key  []byte `json:"key"`
+}
+
+// CopathMessage carries just the public keys a member needs to derive the
+// tree key: the keys of the siblings of the nodes on the member's path,
+// ordered from the root's child down to the member's leaf's sibling (the
+// order of CoPath).
+type CopathMessage struct {
+	Idx       int          `json:"idx"`
+	NumLeaves int          `json:"numLeaves"`
+	Copath    []CopathNode `json:"copath"`
+}
+
+// CopathIndices returns the node indices of the copath of the member at
+// position leafIndex, in the order of CoPath (top-down).
+func CopathIndices(root *PublicNode, leafIndex int) ([]int, error) {
+	path, err := PathIndices(root, leafIndex)
+	if err != nil {
+		return nil, err
+	}
+
+	// the path runs from the leaf up to the root; the copath runs down
+	links := newTreeLinks(root)
+	indices := make([]int, 0, len(path)-1)
+	for i := len(path) - 2; i >= 0; i-- {
+		indices = append(indices, links.sibling(path[i]))
+	}
+
+	return indices, nil
+}
+
+// NewCopathMessage extracts from the public tree root the copath of the
+// member at position leafIndex, for the member to process with
+// DeriveTreeKey (e.g., with process_partial).
+func NewCopathMessage(root *PublicNode, leafIndex int) (*CopathMessage, error) {
+	indices, err := CopathIndices(root, leafIndex)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := root.MarshalKeys()
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal the tree's public keys: %v", err)
+	}
+
+	cm := &CopathMessage{
+		Idx:       leafIndex,
+		NumLeaves: root.NumLeaves(),
+		Copath:    make([]CopathNode, 0, len(indices)),
+	}
+	for _, index := range indices {
+		cm.Copath = append(cm.Copath, CopathNode{Node: index, Key: keys[index]})
+	}
+
+	return cm, nil
+}
+
+func (cm *CopathMessage) Save(fileName string) {
+	jsonutl.Encode(fileName, cm)
+}
+
+func (cm *CopathMessage) Read(msgFilePath string) {
+	msgFile, err := os.Open(msgFilePath)
+	if err != nil {
+		mu.Fatalf("error opening copath file: %v", err)
+	}
+	defer msgFile.Close()
+
+	msg, err := ReadCopathMessage(msgFile)
+	if err != nil {
+		mu.Fatalf("error: %v", err)
+	}
+	*cm = *msg
+}
+
+// ReadCopathMessage decodes a JSON-encoded copath message from r.  It fails
+// if r holds anything after the message, such as a trailing byte or a second
+// message.
+func ReadCopathMessage(r io.Reader) (*CopathMessage, error) {
+	var cm CopathMessage
+	dec := json.NewDecoder(r)
+	if err := dec.Decode(&cm); err != nil {
+		return nil, fmt.Errorf("can't decode copath: %v", err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("the copath file has data after the copath")
+	}
+	return &cm, nil
+}
+
+// copathMACInfo prefixes the bytes of a copath message's MAC, so that the
+// MAC of a copath can't pass for that of an update message, which is keyed
+// by the same stage keys.
+const copathMACInfo = "art copath message"
+
+// macBytes returns the bytes that the copath message's MAC covers: the JSON
+// encoding of the message, which is the same whether the message was read
+// whole or assembled from its nodes.
+func (cm *CopathMessage) macBytes() []byte {
+	data, err := json.Marshal(cm)
+	if err != nil {
+		mu.Fatalf("error encoding copath message: %v", err)
+	}
+	return append([]byte(copathMACInfo), data...)
+}
+
+// MAC returns the copath message's MAC under the stage key sk: the stage key
+// of the state (or for a copath of the setup message, the stage key derived
+// at setup) whose tree the copath was extracted from.  Like an update
+// message's MAC, it shows that the copath comes from a holder of the stage
+// key, so the member must hold the key too in order to verify it.
+func (cm *CopathMessage) MAC(sk ed25519.PrivateKey) []byte {
+	mac := NewHMAC(sk)
+	mac.Write(cm.macBytes())
+	return mac.Sum(nil)
+}
+
+// SaveMac writes the copath message's MAC under sk to macFile.
+func (cm *CopathMessage) SaveMac(sk ed25519.PrivateKey, macFile string) {
+	err := fileutl.WriteFile(macFile, cm.MAC(sk), 0440)
+	if err != nil {
+		mu.Fatalf("can't write copath MAC file: %v", err)
+	}
+}
+
+// VerifyMAC reports whether mac is the copath message's MAC under sk.
+func (cm *CopathMessage) VerifyMAC(sk ed25519.PrivateKey, mac []byte) bool {
+	return hmac.Equal(cm.MAC(sk), mac)
+}
+
+// AssembleCopath assembles the copath message of the member at position
+// leafIndex in a tree with numLeaves leaves from its copath nodes, given in
+// any order (e.g., received as separate files; see ReadCopathNode).  It
+// fails unless nodes holds exactly the nodes of the member's copath.
+func AssembleCopath(leafIndex, numLeaves int, nodes []CopathNode) (*CopathMessage, error) {
+	if numLeaves < 1 {
+		return nil, fmt.Errorf("invalid number of leaves %d", numLeaves)
+	}
+	expected, err := CopathIndices(newPublicTreeShape(numLeaves), leafIndex)
+	if err != nil {
+		return nil, err
+	}
+
+	onCopath := make(map[int]bool, len(expected))
+	for _, index := range expected {
+		onCopath[index] = true
+	}
+
+	byIndex := make(map[int]CopathNode, len(nodes))
+	for _, node := range nodes {
+		if !onCopath[node.Node] {
+			return nil, fmt.Errorf("node %d is not on the copath of member %d of %d",
+				node.Node, leafIndex, numLeaves)
+		}
+		if _, ok := byIndex[node.Node]; ok {
+			return nil, fmt.Errorf("node %d is given more than once", node.Node)
+		}
+		byIndex[node.Node] = node
+	}
+
+	cm := &CopathMessage{
+		Idx:       leafIndex,
+		NumLeaves: numLeaves,
+		Copath:    make([]CopathNode, 0, len(expected)),
+	}
+	for _, index := range expected {
+		node, ok := byIndex[index]
+		if !ok {
+			return nil, fmt.Errorf("copath node %d of member %d of %d is missing",
+				index, leafIndex, numLeaves)
+		}
+		cm.Copath = append(cm.Copath, node)
+	}
+
+	return cm, nil
+}
+
+// SaveNodes writes each of the copath's nodes to its own file in dir, as
+// the JSON encoding of the CopathNode, named node-N.json for node index N.
+func (cm *CopathMessage) SaveNodes(dir string) {
+	for _, node := range cm.Copath {
+		jsonutl.Encode(filepath.Join(dir, fmt.Sprintf("node-%d.json", node.Node)), node)
+	}
+}
+
+// ReadCopathNode reads a copath node written by SaveNodes.
+func ReadCopathNode(fileName string) (*CopathNode, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	var node CopathNode
+	if err := json.Unmarshal(data, &node); err != nil {
+		return nil, fmt.Errorf("can't decode copath node: %v", err)
+	}
+	if len(node.Key) == 0 {
+		return nil, errors.New("copath node has no key")
+	}
+	return &node, nil
+}
+
+// Validate checks that the copath has exactly the nodes, in order, of the
+// copath of member Idx in a tree with NumLeaves leaves.
+func (cm *CopathMessage) Validate() error {
+	if cm.NumLeaves < 1 {
+		return fmt.Errorf("invalid number of leaves %d", cm.NumLeaves)
+	}
+
+	shape := newPublicTreeShape(cm.NumLeaves)
+	expected, err := CopathIndices(shape, cm.Idx)
+	if err != nil {
+		return err
+	}
+
+	if len(cm.Copath) != len(expected) {
+		return fmt.Errorf("copath has %d nodes; expected %d for member %d of %d",
+			len(cm.Copath), len(expected), cm.Idx, cm.NumLeaves)
+	}
+
+	for i, node := range cm.Copath {
+		if node.Node != expected[i] {
+			return fmt.Errorf("copath entry %d is node %d; expected node %d",
+				i+1, node.Node, expected[i])
+		}
+	}
+
+	return nil
+}
+
+// DeriveTreeKey derives the tree key (the root's private key) from the
+// member's leaf key and the copath.
+func (cm *CopathMessage) DeriveTreeKey(leafKey *ecdh.PrivateKey) (*ecdh.PrivateKey, error) {
+	if err := cm.Validate(); err != nil {
+		return nil, err
+	}
+
+	copathKeys := make([]*ecdh.PublicKey, 0, len(cm.Copath))
+	for _, node := range cm.Copath {
+		key, err := UnmarshalPublicEKFromPEM(node.Key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal public key of node %d: %v",
+				node.Node, err)
+		}
+		copathKeys = append(copathKeys, key)
+	}
+
+	pathKeys, err := PathNodeKeys(leafKey, copathKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	return pathKeys[len(pathKeys)-1], nil
+}
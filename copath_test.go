@@ -0,0 +1,186 @@
+package art
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestCopathMAC(t *testing.T) {
+	g := newTestGroup(t, "copath mac", 5, nil)
+	state := g.states[0]
+
+	copath, err := NewCopathMessage(state.PublicTree, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mac := copath.MAC(state.Sk)
+	if !copath.VerifyMAC(state.Sk, mac) {
+		t.Fatal("the copath's MAC does not verify")
+	}
+
+	// the MAC covers the copath as assembled from its nodes, in any order
+	nodes := append([]CopathNode(nil), copath.Copath...)
+	nodes[0], nodes[len(nodes)-1] = nodes[len(nodes)-1], nodes[0]
+	assembled, err := AssembleCopath(3, copath.NumLeaves, nodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !assembled.VerifyMAC(state.Sk, mac) {
+		t.Error("the MAC does not verify on the assembled copath")
+	}
+
+	tests := []struct {
+		name   string
+		tamper func(cm *CopathMessage)
+	}{
+		{"member", func(cm *CopathMessage) { cm.Idx = 4 }},
+		{"size", func(cm *CopathMessage) { cm.NumLeaves = 6 }},
+		{"key", func(cm *CopathMessage) { cm.Copath[0].Key = cm.Copath[1].Key }},
+		{"node", func(cm *CopathMessage) { cm.Copath[0].Node++ }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tampered := *copath
+			tampered.Copath = append([]CopathNode(nil), copath.Copath...)
+			tt.tamper(&tampered)
+			if tampered.VerifyMAC(state.Sk, mac) {
+				t.Error("the MAC verifies on a tampered copath")
+			}
+		})
+	}
+
+	other := newTestGroup(t, "copath mac other", 5, nil)
+	if copath.VerifyMAC(other.states[0].Sk, mac) {
+		t.Error("the MAC verifies with another group's stage key")
+	}
+
+	// an update message with the same stage key can't pass for the copath
+	msg, _ := g.makeUpdate(t, 2)
+	updateMsg, err := DecodeUpdateMessage(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if copath.VerifyMAC(state.Sk, updateMsg.MAC(state.Sk)) {
+		t.Error("an update message's MAC verifies as the copath's")
+	}
+}
+
+// TestCopathNodeFiles checks that a member derives the same tree key from its
+// copath saved as one file and as per-node files, read back in any order,
+// and that the nodes must be exactly those of its copath.
+func TestCopathNodeFiles(t *testing.T) {
+	const index = 3
+	g := newTestGroup(t, "copath node files", 6, nil)
+	state := g.states[index-1]
+	copath, err := NewCopathMessage(state.PublicTree, index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+
+	file := filepath.Join(dir, "copath.json")
+	copath.Save(file)
+	var single CopathMessage
+	single.Read(file)
+	want, err := single.DeriveTreeKey(state.Lk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !want.Equal(state.DeriveTreeKey(index)) {
+		t.Fatal("the tree key from the copath file is not the member's")
+	}
+
+	nodeDir := filepath.Join(dir, "nodes")
+	if err := os.Mkdir(nodeDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	copath.SaveNodes(nodeDir)
+	files, err := filepath.Glob(filepath.Join(nodeDir, "node-*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != len(copath.Copath) {
+		t.Fatalf("got %d node files, want %d", len(files), len(copath.Copath))
+	}
+	var nodes []CopathNode
+	for _, file := range files {
+		node, err := ReadCopathNode(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodes = append(nodes, *node)
+	}
+
+	reversed := slices.Clone(nodes)
+	slices.Reverse(reversed)
+	for _, order := range [][]CopathNode{nodes, reversed} {
+		assembled, err := AssembleCopath(index, copath.NumLeaves, order)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := assembled.DeriveTreeKey(state.Lk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !got.Equal(want) {
+			t.Error("the tree key from the node files differs from the copath file's")
+		}
+	}
+
+	other, err := NewCopathMessage(state.PublicTree, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		nodes []CopathNode
+	}{
+		{"missing node", nodes[1:]},
+		{"duplicate node", append(slices.Clone(nodes), nodes[0])},
+		{"node off the copath", append(slices.Clone(nodes), other.Copath[len(other.Copath)-1])},
+		{"no nodes", nil},
+	}
+	for _, tt := range tests {
+		if _, err := AssembleCopath(index, copath.NumLeaves, tt.nodes); err == nil {
+			t.Errorf("%s: AssembleCopath succeeded", tt.name)
+		}
+	}
+}
+
+// TestReadCopathMessageTrailingData checks that a copath file is rejected when
+// anything follows the copath.
+func TestReadCopathMessageTrailingData(t *testing.T) {
+	g := newTestGroup(t, "copath trailing data", 4, nil)
+	copath, err := NewCopathMessage(g.states[1].PublicTree, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "copath.json")
+	copath.Save(file)
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		ok   bool
+	}{
+		{"copath", data, true},
+		{"trailing byte", append(slices.Clip(data), 'x'), false},
+		{"second copath", append(slices.Clip(data), data...), false},
+	}
+	for _, tt := range tests {
+		got, err := ReadCopathMessage(bytes.NewReader(tt.data))
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: got error %v, want success %v", tt.name, err, tt.ok)
+		}
+		if err == nil && got.Idx != copath.Idx {
+			t.Errorf("%s: got copath of member %d, want %d", tt.name, got.Idx, copath.Idx)
+		}
+	}
+}
@@ -1,33 +1,190 @@
 package art
 
 import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
 	"crypto/ed25519"
 	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"hash"
+	"io"
 	"os"
+	"strings"
 
 	"github.com/syslab-wm/mu"
+	"golang.org/x/crypto/cryptobyte"
+	"golang.org/x/crypto/cryptobyte/asn1"
+	"golang.org/x/crypto/hkdf"
 )
 
 func NewHMAC(key []byte) hash.Hash {
 	return hmac.New(sha256.New, key)
 }
 
+// NewSeededReader returns a deterministic stream of pseudorandom bytes
+// expanded from seed with HKDF-SHA256.  It is meant only for producing
+// reproducible keys for tests and debugging; never use it for real keys.
+func NewSeededReader(seed []byte) io.Reader {
+	return hkdf.New(sha256.New, seed, nil, []byte("art seeded reader"))
+}
+
+// Fingerprint returns the hex-encoded SHA-256 digest of data.  The
+// fingerprint of a key is computed over its raw encoding.
+func Fingerprint(data []byte) string {
+	digest := sha256.Sum256(data)
+	return hex.EncodeToString(digest[:])
+}
+
+// PublicKeyFingerprint returns the fingerprint of the identity key pk, which
+// must be an Ed25519 or an ECDSA P-256 key.  The raw encoding of an ECDSA key
+// is its uncompressed point.
+func PublicKeyFingerprint(pk crypto.PublicKey) (string, error) {
+	switch key := pk.(type) {
+	case ed25519.PublicKey:
+		return Fingerprint(key), nil
+	case *ecdsa.PublicKey:
+		ecdhKey, err := key.ECDH()
+		if err != nil {
+			return "", err
+		}
+		return Fingerprint(ecdhKey.Bytes()), nil
+	default:
+		return "", fmt.Errorf("unsupported identity key type %T", pk)
+	}
+}
+
+// safetyNumberInfo is the HKDF info of the bytes of a safety number.
+const safetyNumberInfo = "art safety number"
+
+// StageKeyFingerprint returns the safety number of the stage key: 60 decimal
+// digits, in twelve groups of five, which members can read to each other
+// out-of-band to confirm that they derived the same stage key, i.e., that
+// they are in the same group, at the same epoch.  The digits come from
+// HKDF-SHA256 of the stage key (each group is 5 bytes of output, modulo
+// 100000), so they reveal nothing about the key.  stageKey is the seed or
+// the expanded key (as in TreeState.Sk); both give the same number.
+func StageKeyFingerprint(stageKey []byte) string {
+	if len(stageKey) == ed25519.PrivateKeySize {
+		stageKey = ed25519.PrivateKey(stageKey).Seed()
+	}
+
+	const groups, groupBytes = 12, 5
+	digest := make([]byte, groups*groupBytes)
+	r := hkdf.New(sha256.New, stageKey, nil, []byte(safetyNumberInfo))
+	if _, err := io.ReadFull(r, digest); err != nil {
+		mu.Fatalf("StageKeyFingerprint failed: %v", err)
+	}
+
+	digits := make([]string, groups)
+	for i := range digits {
+		var n uint64
+		for _, b := range digest[i*groupBytes : (i+1)*groupBytes] {
+			n = n<<8 | uint64(b)
+		}
+		digits[i] = fmt.Sprintf("%05d", n%100000)
+	}
+	return strings.Join(digits, " ")
+}
+
+// Sign signs msg with sk, which must be an Ed25519 or an ECDSA P-256 key.
+// Ed25519 signs msg directly; ECDSA signs the SHA-256 digest of msg, and
+// produces an ASN.1-encoded signature.
+func Sign(sk crypto.Signer, msg []byte) ([]byte, error) {
+	switch key := sk.(type) {
+	case ed25519.PrivateKey:
+		// regular Ed25519
+		return key.Sign(nil, msg, &ed25519.Options{Hash: 0})
+	case *ecdsa.PrivateKey:
+		digest := sha256.Sum256(msg)
+		return ecdsa.SignASN1(rand.Reader, key, digest[:])
+	default:
+		return nil, fmt.Errorf("unsupported signing key type %T", sk)
+	}
+}
+
+// ErrMalformedSignature is returned for a signature that cannot be a
+// signature of the verifying key's scheme, such as a truncated signature
+// file.
+var ErrMalformedSignature = errors.New("malformed signature")
+
+// CheckSignatureFormat checks that sig has the format of a signature by pk,
+// which must be an Ed25519 or an ECDSA P-256 key: 64 bytes for Ed25519, and
+// an ASN.1 SEQUENCE of two INTEGERs for ECDSA.  It does not verify the
+// signature, but lets callers report a truncated or oversized signature as
+// such, rather than as a failed verification.
+func CheckSignatureFormat(pk crypto.PublicKey, sig []byte) error {
+	switch pk.(type) {
+	case ed25519.PublicKey:
+		if len(sig) != ed25519.SignatureSize {
+			return fmt.Errorf("%w: signature is %d bytes, expected %d",
+				ErrMalformedSignature, len(sig), ed25519.SignatureSize)
+		}
+	case *ecdsa.PublicKey:
+		var inner, r, s cryptobyte.String
+		input := cryptobyte.String(sig)
+		if !input.ReadASN1(&inner, asn1.SEQUENCE) || !input.Empty() ||
+			!inner.ReadASN1(&r, asn1.INTEGER) || !inner.ReadASN1(&s, asn1.INTEGER) ||
+			!inner.Empty() {
+			return fmt.Errorf("%w: the %d-byte signature is not an ASN.1-encoded "+
+				"ECDSA signature", ErrMalformedSignature, len(sig))
+		}
+	}
+	return nil
+}
+
+// Verify reports whether sig is a valid signature of msg by pk, which must
+// be an Ed25519 or an ECDSA P-256 key (see Sign).
+func Verify(pk crypto.PublicKey, msg, sig []byte) bool {
+	switch key := pk.(type) {
+	case ed25519.PublicKey:
+		return ed25519.Verify(key, msg, sig)
+	case *ecdsa.PublicKey:
+		digest := sha256.Sum256(msg)
+		return ecdsa.VerifyASN1(key, digest[:], sig)
+	default:
+		return false
+	}
+}
+
+// ErrNoMatchingKey is returned by VerifyAny if none of the keys verifies the
+// signature.
+var ErrNoMatchingKey = errors.New("the signature does not verify with any of the keys")
+
+// VerifyAny reports which of the public keys pks, if any, sig is a valid
+// signature of msg by: it returns the index in pks of the first key that
+// verifies, or ErrNoMatchingKey.  Keys of a scheme that sig cannot be a
+// signature of (see CheckSignatureFormat) are skipped.
+func VerifyAny(pks []crypto.PublicKey, msg, sig []byte) (int, error) {
+	for i, pk := range pks {
+		if CheckSignatureFormat(pk, sig) != nil {
+			continue
+		}
+		count(signatureVerifications)
+		if Verify(pk, msg, sig) {
+			return i, nil
+		}
+	}
+	count(signatureFailures)
+	return -1, ErrNoMatchingKey
+}
+
 func SignFile(privIKFile string, msgFile string) ([]byte, error) {
-	sk, err := ReadPrivateIKFromFile(privIKFile, EncodingPEM)
+	sk, err := ReadSigningKeyFromFile(privIKFile, EncodingPEM)
 	if err != nil {
 		return nil, fmt.Errorf("can't read private key file: %v", err)
 	}
 
-	msgData, err := os.ReadFile(msgFile)
+	msgData, err := ReadMessageFile(msgFile)
 	if err != nil {
 		return nil, fmt.Errorf("error: can't read message file: %v", err)
 	}
 
-	// regular Ed25519
-	sig, err := sk.Sign(nil, msgData, &ed25519.Options{Hash: 0})
+	sig, err := Sign(sk, msgData)
 	if err != nil {
 		return nil, fmt.Errorf("can't sign message: %v", err)
 	}
@@ -36,12 +193,17 @@ func SignFile(privIKFile string, msgFile string) ([]byte, error) {
 }
 
 func VerifySignature(pkPath, msgFile, sigFile string) (bool, error) {
-	pk, err := ReadPublicIKFromFile(pkPath, EncodingPEM)
+	pk, err := ReadVerifyingKeyFromFile(pkPath, EncodingPEM)
 	if err != nil {
 		return false, fmt.Errorf("can't read public key file: %v", err)
 	}
+	return VerifySignatureWithKey(pk, msgFile, sigFile)
+}
 
-	msgData, err := os.ReadFile(msgFile)
+// VerifySignatureWithKey is like VerifySignature, but takes the public key
+// itself rather than the name of its file.
+func VerifySignatureWithKey(pk crypto.PublicKey, msgFile, sigFile string) (bool, error) {
+	msgData, err := ReadMessageFile(msgFile)
 	if err != nil {
 		return false, fmt.Errorf("can't read message file: %v", err)
 	}
@@ -50,11 +212,81 @@ func VerifySignature(pkPath, msgFile, sigFile string) (bool, error) {
 	if err != nil {
 		return false, fmt.Errorf("can't read signature file: %v", err)
 	}
+	if err := CheckSignatureFormat(pk, sigData); err != nil {
+		return false, fmt.Errorf("signature file %s: %w", sigFile, err)
+	}
 
-	valid := ed25519.Verify(pk, msgData, sigData)
+	count(signatureVerifications)
+	valid := Verify(pk, msgData, sigData)
+	if !valid {
+		count(signatureFailures)
+	}
 	return valid, nil
 }
 
+// PrekeySignatureFile returns the name of the file that holds the signature
+// of the prekey (public EK) in ekFile: ekFile with a .sig suffix.
+func PrekeySignatureFile(ekFile string) string {
+	return ekFile + ".sig"
+}
+
+// prekeySignatureInfo separates the signatures of prekeys from the other
+// signatures an identity key makes, e.g., of setup messages.
+const prekeySignatureInfo = "art prekey"
+
+// prekeySignedBytes returns the bytes that a signature of the prekey ek is
+// over: prekeySignatureInfo, followed by the raw X25519 public key.
+func prekeySignedBytes(ek *ecdh.PublicKey) []byte {
+	return append([]byte(prekeySignatureInfo), ek.Bytes()...)
+}
+
+// SignPrekey returns the signature of the prekey (public EK) ek by its
+// owner's identity key ik.  The signature is over the decoded key, not over
+// a file that holds it, so it holds for the key in any encoding.
+func SignPrekey(ik ed25519.PrivateKey, ek *ecdh.PublicKey) []byte {
+	return ed25519.Sign(ik, prekeySignedBytes(ek))
+}
+
+// VerifyPrekey checks that sig is the signature of the prekey ek by the
+// identity key ik (see SignPrekey).
+func VerifyPrekey(ik ed25519.PublicKey, ek *ecdh.PublicKey, sig []byte) error {
+	if err := CheckSignatureFormat(ik, sig); err != nil {
+		return err
+	}
+
+	count(signatureVerifications)
+	if !ed25519.Verify(ik, prekeySignedBytes(ek), sig) {
+		count(signatureFailures)
+		return errors.New("invalid prekey signature")
+	}
+	return nil
+}
+
+// VerifyPrekeySignature checks that sigFile holds the owner's signature, by
+// their identity key ik, of the public EK in the PEM file ekFile (see
+// VerifyPrekey), as made by
+//
+//	genpkey -keytype ek -sign-key NAME-ik.pem NAME
+func VerifyPrekeySignature(ik ed25519.PublicKey, ekFile, sigFile string) error {
+	ek, err := ReadPublicEKFromFile(ekFile, EncodingPEM)
+	if err != nil {
+		return fmt.Errorf("can't read prekey file: %v", err)
+	}
+	return verifyPrekeyFile(ik, ek, sigFile)
+}
+
+// verifyPrekeyFile is VerifyPrekey for the signature in sigFile.
+func verifyPrekeyFile(ik ed25519.PublicKey, ek *ecdh.PublicKey, sigFile string) error {
+	sig, err := os.ReadFile(sigFile)
+	if err != nil {
+		return fmt.Errorf("can't read prekey signature file: %v", err)
+	}
+	if err := VerifyPrekey(ik, ek, sig); err != nil {
+		return fmt.Errorf("prekey signature file %s: %w", sigFile, err)
+	}
+	return nil
+}
+
 func VerifyMessageSignature(publicKeyPath, msgFile, sigFile string) {
 	valid, err := VerifySignature(publicKeyPath, msgFile, sigFile)
 	if err != nil {
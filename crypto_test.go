@@ -0,0 +1,433 @@
+package art
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVerifyPrekey(t *testing.T) {
+	members, iks, eks := testMembers(t, 2, testReader("verify prekey"))
+	ek := eks[0].PublicKey()
+	sig := SignPrekey(iks[0], ek)
+
+	pem, err := MarshalPublicEKToPEM(ek)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		ik   ed25519.PublicKey
+		ek   *ecdh.PublicKey
+		sig  []byte
+		ok   bool
+	}{
+		{"valid", members[0].pubIK, ek, sig, true},
+		{"another member's IK", members[1].pubIK, ek, sig, false},
+		{"another member's EK", members[0].pubIK, eks[1].PublicKey(), sig, false},
+		{"truncated signature", members[0].pubIK, ek, sig[1:], false},
+		{"signature of the raw key", members[0].pubIK, ek,
+			ed25519.Sign(iks[0], ek.Bytes()), false},
+		{"signature of the PEM file", members[0].pubIK, ek,
+			ed25519.Sign(iks[0], pem), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := VerifyPrekey(tt.ik, tt.ek, tt.sig)
+			if (err == nil) != tt.ok {
+				t.Errorf("got error %v, want success %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+// writeMembers writes the public keys of members to PEM files in dir, and
+// returns the members as read back from them.
+func writeMembers(t *testing.T, dir string, members []*Member) []*Member {
+	t.Helper()
+	read := make([]*Member, len(members))
+	for i, m := range members {
+		ikFile := filepath.Join(dir, fmt.Sprintf("member%d-ik-pub.pem", i+1))
+		ekFile := filepath.Join(dir, fmt.Sprintf("member%d-ek-pub.pem", i+1))
+		if err := WritePublicIKToFile(m.pubIK, ikFile, EncodingPEM); err != nil {
+			t.Fatal(err)
+		}
+		if err := WritePublicEKToFile(m.pubEK, ekFile, EncodingPEM); err != nil {
+			t.Fatal(err)
+		}
+
+		var err error
+		if read[i], err = NewMember(m.name, ikFile, ekFile); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return read
+}
+
+func TestSetupSignedPrekeys(t *testing.T) {
+	const n = 3
+	members, iks, eks := testMembers(t, n, testReader("signed prekeys"))
+
+	tests := []struct {
+		name string
+		// sign returns the signature of member i's prekey, or nil for none
+		sign func(i int) []byte
+		ok   bool
+	}{
+		{"signed", func(i int) []byte {
+			return SignPrekey(iks[i], eks[i].PublicKey())
+		}, true},
+		{"unsigned", func(i int) []byte { return nil }, false},
+		{"signed by another member", func(i int) []byte {
+			return SignPrekey(iks[(i+1)%n], eks[i].PublicKey())
+		}, false},
+		{"another prekey signed", func(i int) []byte {
+			return SignPrekey(iks[i], eks[(i+1)%n].PublicKey())
+		}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			read := writeMembers(t, t.TempDir(), members)
+			for i, m := range read {
+				sig := tt.sign(i)
+				if sig == nil {
+					continue
+				}
+				err := os.WriteFile(PrekeySignatureFile(m.pubEKFile), sig, 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			opts := &SetupOptions{Rand: testReader("signed prekeys setup"),
+				SignedPrekeys: true}
+			_, _, err := CreateGroupFromMembers(read, "", opts)
+			if (err == nil) != tt.ok {
+				t.Errorf("got error %v, want success %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestCheckSignatureFormat(t *testing.T) {
+	r := testReader("signature format")
+	_, iks, _ := testMembers(t, 1, r)
+	p256, err := ecdsa.GenerateKey(elliptic.P256(), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := []byte("message")
+	edSig, err := Sign(iks[0], msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecSig, err := Sign(p256, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		pk   crypto.PublicKey
+		sig  []byte
+		ok   bool
+	}{
+		{"Ed25519", iks[0].Public(), edSig, true},
+		{"Ed25519, 63 bytes", iks[0].Public(), edSig[:63], false},
+		{"Ed25519, 65 bytes", iks[0].Public(), append(edSig, 0), false},
+		{"Ed25519, empty", iks[0].Public(), nil, false},
+		{"ECDSA", &p256.PublicKey, ecSig, true},
+		{"ECDSA, truncated", &p256.PublicKey, ecSig[:len(ecSig)-1], false},
+		{"ECDSA, trailing data", &p256.PublicKey, append(ecSig, 0), false},
+		{"ECDSA, not a SEQUENCE", &p256.PublicKey, append([]byte{0x04}, ecSig[1:]...),
+			false},
+		{"ECDSA, one INTEGER", &p256.PublicKey, []byte{0x30, 0x03, 0x02, 0x01, 0x01},
+			false},
+		{"ECDSA, an Ed25519 signature", &p256.PublicKey, edSig, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckSignatureFormat(tt.pk, tt.sig)
+			if tt.ok {
+				if err != nil {
+					t.Errorf("CheckSignatureFormat: %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrMalformedSignature) {
+				t.Errorf("got error %v, want ErrMalformedSignature", err)
+			}
+		})
+	}
+}
+
+func TestVerifySignatureWithKeyMalformed(t *testing.T) {
+	_, iks, _ := testMembers(t, 1, testReader("malformed signature file"))
+	dir := t.TempDir()
+	msgFile := filepath.Join(dir, "msg")
+	if err := os.WriteFile(msgFile, []byte("message"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sig, err := Sign(iks[0], []byte("message"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, sig := range [][]byte{sig[:63], append(sig, 0)} {
+		sigFile := filepath.Join(dir, "msg.sig")
+		if err := os.WriteFile(sigFile, sig, 0644); err != nil {
+			t.Fatal(err)
+		}
+		_, err := VerifySignatureWithKey(iks[0].Public(), msgFile, sigFile)
+		if !errors.Is(err, ErrMalformedSignature) {
+			t.Errorf("%d-byte signature file: got error %v, want ErrMalformedSignature",
+				len(sig), err)
+		}
+	}
+}
+
+// writeSigningKeys writes the private key sk, as a PEM block of type
+// pemType, and its public key to PEM files in dir, and returns their names.
+func writeSigningKeys(t *testing.T, dir, pemType string, sk crypto.Signer) (skFile,
+	pkFile string) {
+
+	t.Helper()
+	var der []byte
+	var err error
+	if pemType == ECPrivateKeyPEMTypeString {
+		der, err = x509.MarshalECPrivateKey(sk.(*ecdsa.PrivateKey))
+	} else {
+		der, err = x509.MarshalPKCS8PrivateKey(sk)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkDER, err := x509.MarshalPKIXPublicKey(sk.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	skFile, pkFile = filepath.Join(dir, "ik.pem"), filepath.Join(dir, "ik-pub.pem")
+	err = os.WriteFile(skFile, pem.EncodeToMemory(&pem.Block{Type: pemType, Bytes: der}),
+		0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(pkFile, pem.EncodeToMemory(&pem.Block{
+		Type: PublicKeyPEMTypeString, Bytes: pkDER}), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return skFile, pkFile
+}
+
+func TestSignVerifyRoundTrip(t *testing.T) {
+	r := testReader("sign verify round trip")
+	_, iks, _ := testMembers(t, 1, r)
+	p256, err := ecdsa.GenerateKey(elliptic.P256(), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := ecdsa.GenerateKey(elliptic.P256(), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		sk      crypto.Signer
+		pemType string
+		scheme  string
+	}{
+		{"Ed25519", iks[0], PrivateKeyPEMTypeString, SignatureEd25519},
+		{"ECDSA P-256, PKCS #8", p256, PrivateKeyPEMTypeString, SignatureECDSAP256},
+		{"ECDSA P-256, SEC 1", p256, ECPrivateKeyPEMTypeString, SignatureECDSAP256},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			skFile, pkFile := writeSigningKeys(t, dir, tt.pemType, tt.sk)
+			msgFile, sigFile := filepath.Join(dir, "msg"), filepath.Join(dir, "msg.sig")
+			if err := os.WriteFile(msgFile, []byte("message"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			scheme, err := SignatureSchemeOfKeyFile(skFile)
+			if err != nil || scheme != tt.scheme {
+				t.Errorf("got scheme %q (error %v), want %q", scheme, err, tt.scheme)
+			}
+
+			sig, err := SignFile(skFile, msgFile)
+			if err != nil {
+				t.Fatalf("SignFile: %v", err)
+			}
+			if err := os.WriteFile(sigFile, sig, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if valid, err := VerifySignature(pkFile, msgFile, sigFile); err != nil || !valid {
+				t.Errorf("the signature does not verify: %v", err)
+			}
+
+			if Verify(other.Public(), []byte("message"), sig) {
+				t.Error("the signature verifies with another key")
+			}
+			if Verify(tt.sk.Public(), []byte("massage"), sig) {
+				t.Error("the signature verifies for another message")
+			}
+		})
+	}
+}
+
+// TestSetupSignedWithP256 checks that a setup message signed with an ECDSA
+// P-256 IK records the scheme, verifies, and is processed.
+func TestSetupSignedWithP256(t *testing.T) {
+	r := testReader("setup p256")
+	members, _, eks := testMembers(t, 3, r)
+	p256, err := ecdsa.GenerateKey(elliptic.P256(), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	skFile, _ := writeSigningKeys(t, dir, PrivateKeyPEMTypeString, p256)
+
+	scheme, err := SignatureSchemeOfKeyFile(skFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, setupMsg, err := CreateGroupFromMembers(members, "",
+		&SetupOptions{Rand: r, SignatureScheme: scheme})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgFile, sigFile := filepath.Join(dir, "setup.json"), filepath.Join(dir, "setup.sig")
+	setupMsg.Save(msgFile)
+	setupMsg.SaveSign(sigFile, msgFile, skFile)
+
+	valid, err := VerifySignatureWithKey(&p256.PublicKey, msgFile, sigFile)
+	if err != nil || !valid {
+		t.Fatalf("the setup message's signature does not verify: %v", err)
+	}
+
+	msg, err := ReadMessageFile(msgFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := os.ReadFile(sigFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, err := ProcessSetupMessageBytes(2, eks[1], msg, sig, &p256.PublicKey)
+	if err != nil {
+		t.Fatalf("ProcessSetupMessageBytes: %v", err)
+	}
+	decoded, err := DecodeSetupMessage(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.GetSuite().Signature != SignatureECDSAP256 {
+		t.Errorf("the message's suite names %q", decoded.GetSuite().Signature)
+	}
+	if state.Sk == nil {
+		t.Error("the member has no stage key")
+	}
+}
+
+// TestVerifyAny checks that VerifyAny identifies the key that made a
+// signature among keys of both schemes, and returns ErrNoMatchingKey if none
+// of them did.
+func TestVerifyAny(t *testing.T) {
+	r := testReader("verify any")
+	_, iks, _ := testMembers(t, 3, r)
+	p256, err := ecdsa.GenerateKey(elliptic.P256(), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pks := []crypto.PublicKey{iks[0].Public(), p256.Public(), iks[1].Public()}
+	msg := []byte("setup message")
+
+	tests := []struct {
+		name   string
+		signer crypto.Signer
+		want   int
+	}{
+		{"first", iks[0], 0},
+		{"ECDSA among Ed25519", p256, 1},
+		{"last", iks[1], 2},
+		{"none", iks[2], -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sig, err := Sign(tt.signer, msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := VerifyAny(pks, msg, sig)
+			if tt.want < 0 {
+				if !errors.Is(err, ErrNoMatchingKey) || got != -1 {
+					t.Errorf("got key %d and error %v, want ErrNoMatchingKey", got, err)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("got key %d and error %v, want key %d", got, err, tt.want)
+			}
+		})
+	}
+
+	sig, err := Sign(iks[0], msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := VerifyAny(pks, []byte("another message"), sig); !errors.Is(err,
+		ErrNoMatchingKey) {
+		t.Errorf("another message: got error %v, want ErrNoMatchingKey", err)
+	}
+	if _, err := VerifyAny(nil, msg, sig); !errors.Is(err, ErrNoMatchingKey) {
+		t.Errorf("no keys: got error %v, want ErrNoMatchingKey", err)
+	}
+}
+
+// TestStageKeyFingerprint checks the safety number of a fixed stage key
+// against the digits of its HKDF-SHA256 output, computed independently, and
+// that the seed and the expanded key give the same number, which differs for
+// another stage key.
+func TestStageKeyFingerprint(t *testing.T) {
+	seed := make([]byte, StageKeySize)
+	for i := range seed {
+		seed[i] = byte(i)
+	}
+	const want = "18423 37252 46619 70765 72162 92998 29918 83297 28346 53085 89668 78708"
+	if got := StageKeyFingerprint(seed); got != want {
+		t.Errorf("got safety number %q, want %q", got, want)
+	}
+	if got := StageKeyFingerprint(ed25519.NewKeyFromSeed(seed)); got != want {
+		t.Errorf("expanded key: got safety number %q, want %q", got, want)
+	}
+
+	g := newTestGroup(t, "stage key fingerprint", 2, nil)
+	fp := StageKeyFingerprint(g.states[0].Sk)
+	if fp == want {
+		t.Error("another stage key has the same safety number")
+	}
+	if StageKeyFingerprint(g.states[1].Sk) != fp {
+		t.Error("members with the same stage key have different safety numbers")
+	}
+	g.update(t, 1)
+	if StageKeyFingerprint(g.states[0].Sk) == fp {
+		t.Error("the safety number did not change with the stage key")
+	}
+}
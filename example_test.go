@@ -0,0 +1,64 @@
+package art_test
+
+import (
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/syslab-wm/art"
+)
+
+// Alice sets up a group with Bob, and each of them prints the safety number
+// of the stage key they derived.  The keys are drawn from a seeded reader so
+// that the output is reproducible; real keys come from crypto/rand.
+func Example() {
+	r := art.NewSeededReader([]byte("art example"))
+
+	// each member publishes an identity key and a prekey
+	var members []*art.Member
+	var iks []ed25519.PrivateKey
+	var eks []*ecdh.PrivateKey
+	for _, name := range []string{"alice", "bob"} {
+		ik, err := art.IKKeyGenFrom(r)
+		if err != nil {
+			log.Fatal(err)
+		}
+		ek, err := art.DHKeyGenFrom(r)
+		if err != nil {
+			log.Fatal(err)
+		}
+		iks = append(iks, ik)
+		eks = append(eks, ek)
+		members = append(members, art.NewMemberFromKeys(name,
+			ik.Public().(ed25519.PublicKey), ek.PublicKey()))
+	}
+
+	// alice, the initiator, sets up the group and signs the setup message
+	alice, setupMsg, err := art.CreateGroupFromMembers(members, "alice",
+		&art.SetupOptions{Rand: r})
+	if err != nil {
+		log.Fatal(err)
+	}
+	msg, err := json.Marshal(setupMsg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	sig, err := art.Sign(iks[0], msg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// bob, at position 2, verifies and processes the setup message
+	bob, err := art.ProcessSetupMessageBytes(2, eks[1], msg, sig, iks[0].Public())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Println("alice:", art.StageKeyFingerprint(alice.Sk))
+	fmt.Println("bob:  ", art.StageKeyFingerprint(bob.Sk))
+	// Output:
+	// alice: 38317 27738 38030 37754 10160 52281 10356 87541 28781 29253 73844 24174
+	// bob:   38317 27738 38030 37754 10160 52281 10356 87541 28781 29253 73844 24174
+}
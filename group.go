@@ -4,10 +4,16 @@ import (
 	"bufio"
 	"crypto/ecdh"
 	"crypto/ed25519"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/syslab-wm/mu"
 )
@@ -21,6 +27,19 @@ type Member struct {
 	leafKey   *ecdh.PrivateKey // X25519
 }
 
+// newBlankMember returns the member of a blank leaf: a position in the tree
+// that no member holds, left by a sparse assignment of INDEXes (see
+// placeMembers).
+func newBlankMember() *Member {
+	return &Member{}
+}
+
+// isBlank reports whether m is the member of a blank leaf, which has no keys
+// (see newBlankMember).
+func (m *Member) isBlank() bool {
+	return m.pubIK == nil && m.pubEK == nil
+}
+
 type Group struct {
 	members   []*Member
 	initiator *Member
@@ -32,104 +51,308 @@ func (g *Group) addMember(m *Member) {
 
 func (g *Group) member(name string) *Member {
 	for _, m := range g.members {
-		if m.name == name {
+		if !m.isBlank() && m.name == name {
 			return m
 		}
 	}
 	return nil
 }
 
+// first returns the member at the lowest INDEX, skipping blank leaves.
 func (g *Group) first() *Member {
-	return g.members[0]
+	for _, m := range g.members {
+		if !m.isBlank() {
+			return m
+		}
+	}
+	return nil
 }
 
-func (g *Group) setInitiator(name string) {
+func (g *Group) setInitiator(name string) error {
 	if name == "" {
 		g.initiator = g.first()
-		return
+		return nil
 	}
 
 	g.initiator = g.member(name)
 	if g.initiator == nil {
-		mu.Fatalf("error: initiator %q not found in config file", name)
+		return fmt.Errorf("initiator %q is not a member of the group", name)
 	}
+	return nil
 }
 
-func (g *Group) generateLeafKeys(setupKey *ecdh.PrivateKey) []*ecdh.PrivateKey {
-	leafKeys := make([]*ecdh.PrivateKey, 0, len(g.members))
-	for _, member := range g.members {
-		if member.name == g.initiator.name {
-			leafKeys = append(leafKeys, g.initiator.leafKey)
+// generateLeafKeys derives the members' leaf keys, in order.  The DHs are
+// independent, so they are spread over the given number of goroutines.
+func (g *Group) generateLeafKeys(setupKey *ecdh.PrivateKey,
+	workers int) ([]*ecdh.PrivateKey, error) {
+
+	leafKeys := make([]*ecdh.PrivateKey, len(g.members))
+	errs := make([]error, len(g.members))
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				leafKeys[i], errs[i] = g.generateLeafKey(setupKey, g.members[i])
+			}
+		}()
+	}
+
+	for i := range g.members {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return leafKeys, nil
+}
+
+func (g *Group) generateLeafKey(setupKey *ecdh.PrivateKey,
+	member *Member) (*ecdh.PrivateKey, error) {
+
+	if member == g.initiator || member.isBlank() {
+		return member.leafKey, nil
+	}
+
+	raw, err := KeyExchange(setupKey, member.pubEK)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate the leaf key of %q: %v", member.name, err)
+	}
+
+	member.leafKey, err = UnmarshalPrivateX25519FromRaw(raw)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal the leaf key of %q: %v", member.name,
+			err)
+	}
+	return member.leafKey, nil
+}
+
+func (g *Group) generateInitiatorKeys(initiator string,
+	opts *SetupOptions) (*ecdh.PrivateKey, error) {
+
+	var err error
+
+	leafKeyGen, setupKeyGen := DHKeyGen, KeyExchangeKeyGen
+	if opts.Rand != nil {
+		keyGen := func() (*ecdh.PrivateKey, error) { return DHKeyGenFrom(opts.Rand) }
+		leafKeyGen, setupKeyGen = keyGen, keyGen
+	}
+
+	if err := g.setInitiator(initiator); err != nil {
+		return nil, err
+	}
+	g.initiator.leafKey, err = leafKeyGen()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate initiator's leaf key: %v", err)
+	}
+
+	// the keys of blank leaves are random as well, and, as no member holds
+	// them, are discarded once the tree is built
+	for i, m := range g.members {
+		if !m.isBlank() {
 			continue
 		}
-
-		raw, err := KeyExchange(setupKey, member.pubEK)
+		m.leafKey, err = leafKeyGen()
 		if err != nil {
-			mu.Fatalf("failed to generate leafKey")
+			return nil, fmt.Errorf("failed to generate the key of blank leaf %d: %v",
+				i+1, err)
 		}
+	}
 
-		member.leafKey, err = UnmarshalPrivateX25519FromRaw(raw)
-		if err != nil {
-			mu.Fatalf("failed to unmarshal leafKey")
+	if opts.SetupKey != nil {
+		return opts.SetupKey, nil
+	}
+
+	setupKey, err := setupKeyGen()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate the setup key (suk): %v", err)
+	}
+
+	return setupKey, nil
+}
+
+// leafMetadata returns the metadata of the members' leaves, in member order,
+// from the map of member names to metadata.
+func (g *Group) leafMetadata(byName map[string]string) ([]string, error) {
+	var unknown []string
+	for name := range byName {
+		if g.member(name) == nil {
+			unknown = append(unknown, name)
 		}
-		leafKeys = append(leafKeys, member.leafKey)
 	}
-	return leafKeys
+	if len(unknown) != 0 {
+		sort.Strings(unknown)
+		return nil, fmt.Errorf("leaf metadata for non-members: %s",
+			strings.Join(unknown, ", "))
+	}
+
+	metadata := make([]string, len(g.members))
+	for i, m := range g.members {
+		metadata[i] = byName[m.name]
+	}
+	return metadata, nil
 }
 
-func (g *Group) generateInitiatorKeys(initiator string) *ecdh.PrivateKey {
-	var err error
+// applyLeafKeys replaces the derived leaf keys of the members in byName (a
+// map of member names to leaf keys) with the supplied ones.
+func (g *Group) applyLeafKeys(leafKeys []*ecdh.PrivateKey,
+	byName map[string]*ecdh.PrivateKey) error {
 
-	g.setInitiator(initiator)
-	g.initiator.leafKey, err = DHKeyGen()
-	if err != nil {
-		mu.Fatalf("failed to generate initiator's leaf key: %v", err)
+	var unknown []string
+	for name := range byName {
+		if g.member(name) == nil {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) != 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("leaf keys for non-members: %s", strings.Join(unknown, ", "))
 	}
 
-	setupKey, err := KeyExchangeKeyGen()
-	if err != nil {
-		mu.Fatalf("failed to generate the setup key (suk): %v", err)
+	for i, m := range g.members {
+		if key, ok := byName[m.name]; ok {
+			m.leafKey = key
+			leafKeys[i] = key
+		}
 	}
+	return nil
+}
 
-	return setupKey
+// checkSetupKey returns an error if the SUK is one of the members' EKs.  The
+// members' leaf keys are DH(SUK, EK), so a SUK that is also a member's
+// prekey (a copy-paste error in the config or in -suk-file) gives that
+// member's leaf key to whoever holds either private key.
+func (g *Group) checkSetupKey(suk *ecdh.PrivateKey) error {
+	pub := PublicOf(suk)
+	for i, m := range g.members {
+		if !m.isBlank() && m.pubEK.Equal(pub) {
+			return fmt.Errorf("the SUK is the EK of member %d (%s); the SUK must be "+
+				"distinct from every member's EK", i+1, m.name)
+		}
+	}
+	return nil
 }
 
-func (g *Group) createSetupMessage(suk *ecdh.PublicKey, treePublic *PublicNode) *SetupMessage {
+// ConsumedPrekeys returns the IDs (see Fingerprint) of the prekeys that the
+// setup of a group consumed, given the initiator's state and the setup
+// message: the EKs of the members whose leaf keys are DH(SUK, EK).  The
+// initiator's EK is not one, since its leaf key is random, and neither are
+// the EKs of the members whose leaf keys are among leafKeys (see
+// SetupOptions.LeafKeys).  consumed is the set of IDs of the prekeys that
+// earlier setups consumed; if any of the prekeys is in it, ConsumedPrekeys
+// returns an error.
+func ConsumedPrekeys(state *TreeState, setupMsg *SetupMessage,
+	leafKeys map[string]*ecdh.PrivateKey, consumed map[string]bool) ([]string, error) {
+
+	supplied := make([]*ecdh.PublicKey, 0, len(leafKeys))
+	for _, key := range leafKeys {
+		supplied = append(supplied, PublicOf(key))
+	}
+	isSupplied := func(leaf *ecdh.PublicKey) bool {
+		for _, pub := range supplied {
+			if pub.Equal(leaf) {
+				return true
+			}
+		}
+		return false
+	}
+
+	leaves := state.PublicTree.Leaves()
+	if len(leaves) != len(setupMsg.EKeys) {
+		return nil, fmt.Errorf("the setup message has %d EKs for a tree of %d leaves",
+			len(setupMsg.EKeys), len(leaves))
+	}
+	initiator := state.LeafIndex()
+
+	ids := make([]string, 0, len(setupMsg.EKeys))
+	for i, pem := range setupMsg.EKeys {
+		if i+1 == initiator || len(pem) == 0 || isSupplied(leaves[i].GetPk()) {
+			continue
+		}
+
+		ek, err := UnmarshalPublicEKFromPEM(pem)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal the public EK of member %d: %v",
+				i+1, err)
+		}
+		id := Fingerprint(ek.Bytes())
+		if consumed[id] {
+			return nil, fmt.Errorf("the prekey of member %d (%s) was already consumed",
+				i+1, id)
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
+func (g *Group) createSetupMessage(suk *ecdh.PublicKey,
+	treePublic *PublicNode) (*SetupMessage, error) {
+
 	// marshall identity keys, ephemeral keys, suk and tree public keys
 	marshalledEKS := make([][]byte, 0, len(g.members))
 	marshalledIKS := make([][]byte, 0, len(g.members))
 
 	for _, member := range g.members {
+		// a blank leaf has an empty IKey and EKey
+		if member.isBlank() {
+			marshalledEKS = append(marshalledEKS, []byte{})
+			marshalledIKS = append(marshalledIKS, []byte{})
+			continue
+		}
+
 		marshalledEK, err := MarshalPublicEKToPEM(member.pubEK)
 		if err != nil {
-			mu.Fatalf("failed to marshal public EK: %v", err)
+			return nil, fmt.Errorf("failed to marshal public EK: %v", err)
 		}
 		marshalledEKS = append(marshalledEKS, marshalledEK)
 
 		marshalledIK, err := MarshalPublicIKToPEM(member.pubIK)
 		if err != nil {
-			mu.Fatalf("failed to marshal public IK: %v", err)
+			return nil, fmt.Errorf("failed to marshal public IK: %v", err)
 		}
 		marshalledIKS = append(marshalledIKS, marshalledIK)
 	}
 
 	marshalledSuk, err := MarshalPublicEKToPEM(suk)
 	if err != nil {
-		mu.Fatalf("failed to marshal public SUK: %v", err)
+		return nil, fmt.Errorf("failed to marshal public SUK: %v", err)
 	}
 
 	marshalledPubKeys, err := treePublic.MarshalKeys()
 	if err != nil {
-		mu.Fatalf("failed to marshal the tree's public keys: %v", err)
+		return nil, fmt.Errorf("failed to marshal the tree's public keys: %v", err)
 	}
 	msg := SetupMessage{
 		IKeys:    marshalledIKS,
 		EKeys:    marshalledEKS,
 		Suk:      marshalledSuk,
 		TreeKeys: marshalledPubKeys,
+		Suite:    DefaultSuite(),
 	}
 
-	return &msg
+	return &msg, nil
+}
+
+// verifyPrekeys returns an error unless each member's EK file is signed by
+// the member's IK.
+func verifyPrekeys(members []*Member) error {
+	for _, m := range members {
+		if m.isBlank() {
+			continue
+		}
+		err := verifyPrekeyFile(m.pubIK, m.pubEK, PrekeySignatureFile(m.pubEKFile))
+		if err != nil {
+			return fmt.Errorf("the prekey of %q is not authentic: %v", m.name, err)
+		}
+	}
+	return nil
 }
 
 func (g *Group) addMembers(members []*Member) *Group {
@@ -151,7 +374,9 @@ func resolvePath(rel, start string) string {
 	return filepath.Join(dir, file)
 }
 
-func newMember(name, pubIKFile, pubEKFile string) (*Member, error) {
+// NewMember reads the public identity and ephemeral keys of the group member
+// called name from the PEM-encoded files pubIKFile and pubEKFile.
+func NewMember(name, pubIKFile, pubEKFile string) (*Member, error) {
 	var err error
 
 	m := &Member{name: name, pubIKFile: pubIKFile, pubEKFile: pubEKFile}
@@ -171,38 +396,133 @@ func newMember(name, pubIKFile, pubEKFile string) (*Member, error) {
 	return m, nil
 }
 
-func getNewMember(fields []string, configDir string) *Member {
+// NewMemberFromKeys returns the group member called name with the public
+// identity key ik and ephemeral key ek, for setting up a group in memory.
+// Since the member has no EK file, it cannot be used with
+// SetupOptions.SignedPrekeys.
+func NewMemberFromKeys(name string, ik ed25519.PublicKey, ek *ecdh.PublicKey) *Member {
+	return &Member{name: name, pubIK: ik, pubEK: ek}
+}
+
+func getNewMember(fields []string, configDir string) (*Member, error) {
 	name, pubIKFile, pubEKFile := fields[0], fields[1], fields[2]
 
 	// expects pubIKFile, pubEKFile and config file are in the same directory
 	pubIKFile = resolvePath(pubIKFile, configDir)
 	pubEKFile = resolvePath(pubEKFile, configDir)
 
-	member, err := newMember(name, pubIKFile, pubEKFile)
+	member, err := NewMember(name, pubIKFile, pubEKFile)
 	if err != nil {
-		mu.Fatalf("error: creating new group member %v", err)
+		return nil, fmt.Errorf("creating new group member %v", err)
 	}
 
-	return member
+	return member, nil
 }
 
-func validateMember(fields []string, lineNum int, nameSet map[string]bool) {
+func validateMember(fields []string, lineNum int, nameSet map[string]bool) error {
 	numFields := len(fields)
 
-	if numFields != 3 {
-		mu.Fatalf("error: config file line %d has %d fields; expected 3", lineNum,
+	if numFields != 3 && numFields != 4 {
+		return fmt.Errorf("config file line %d has %d fields; expected 3 or 4", lineNum,
 			numFields)
 	}
 
 	name := fields[0]
 	if exists := nameSet[name]; exists {
-		mu.Fatalf("error: config file has multiple entries for %q", name)
+		return fmt.Errorf("config file has multiple entries for %q", name)
 	}
 	nameSet[name] = true
+	return nil
 }
 
-func getAllMembers(file *os.File) []*Member {
+// MaxIndex is the largest explicit INDEX of a member, in a group of any size.
+//
+// MaxLeavesPerMember bounds the INDEXes by the number of members: a group of
+// n members has INDEXes of at most MaxLeavesPerMember*n.  Every leaf up to
+// the largest INDEX is in the tree, blank or not, and the initiator computes
+// a DH for each node of the tree (about two per leaf) to build it, so without
+// this bound a single member with a large INDEX would make setup compute
+// millions of DHs.
+const (
+	MaxIndex           = 1 << 20
+	MaxLeavesPerMember = 4
+)
+
+// maxIndex returns the largest explicit INDEX in a group of numMembers
+// members (see MaxLeavesPerMember).
+func maxIndex(numMembers int) int {
+	return min(MaxIndex, MaxLeavesPerMember*numMembers)
+}
+
+// placeMembers reorders the members by their explicit indices (the optional
+// fourth config field; indices[i] is 0 if member i has none).  Either every
+// member or no member must have an explicit index, and the indices must be
+// unique and from 1 to maxIndex(len(members)).  If they are sparse, the tree
+// has a leaf for every index up to the largest, and the leaves of the missing
+// indices are blank (see newBlankMember).
+func placeMembers(members []*Member, indices []int) ([]*Member, error) {
+	numExplicit := 0
+	for _, index := range indices {
+		numExplicit += mu.BoolToInt(index != 0)
+	}
+	if numExplicit == 0 {
+		return members, nil
+	}
+	if numExplicit != len(members) {
+		return nil, fmt.Errorf("%d of %d members have an explicit INDEX; either all or "+
+			"none must", numExplicit, len(members))
+	}
+
+	numLeaves, limit := 0, maxIndex(len(members))
+	for i, index := range indices {
+		if index < 1 || index > limit {
+			return nil, fmt.Errorf("member %q has INDEX %d; expected an INDEX from 1 to %d "+
+				"(%d per member)", members[i].name, index, limit, MaxLeavesPerMember)
+		}
+		numLeaves = max(numLeaves, index)
+	}
+
+	placed := make([]*Member, numLeaves)
+	for i, index := range indices {
+		if placed[index-1] != nil {
+			return nil, fmt.Errorf("members %q and %q have the same INDEX %d",
+				placed[index-1].name, members[i].name, index)
+		}
+		placed[index-1] = members[i]
+	}
+	for i := range placed {
+		if placed[i] == nil {
+			placed[i] = newBlankMember()
+		}
+	}
+
+	return placed, nil
+}
+
+// CompactMembers returns the members other than those of blank leaves, in
+// the same order.  Placed at consecutive INDEXes from 1, they make the tree of
+// least depth for their number (see SetupOptions.Compact).
+func CompactMembers(members []*Member) []*Member {
+	compact := make([]*Member, 0, len(members))
+	for _, m := range members {
+		if !m.isBlank() {
+			compact = append(compact, m)
+		}
+	}
+	return compact
+}
+
+func parseIndex(field string, lineNum int) (int, error) {
+	index, err := strconv.Atoi(field)
+	if err != nil || index < 1 {
+		return 0, fmt.Errorf("config file line %d has an invalid INDEX %q", lineNum, field)
+	}
+	return index, nil
+}
+
+func getAllMembers(file *os.File) ([]*Member, error) {
 	members := make([]*Member, 0)
+	indices := make([]int, 0)
 	nameSet := make(map[string]bool)
 
 	lineNum := 0
@@ -219,25 +539,156 @@ func getAllMembers(file *os.File) []*Member {
 			continue
 		}
 
-		validateMember(fields, lineNum, nameSet)
-		members = append(members, getNewMember(fields, file.Name()))
+		if err := validateMember(fields, lineNum, nameSet); err != nil {
+			return nil, err
+		}
+		member, err := getNewMember(fields, file.Name())
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, member)
+
+		index := 0
+		if len(fields) == 4 {
+			index, err = parseIndex(fields[3], lineNum)
+			if err != nil {
+				return nil, err
+			}
+		}
+		indices = append(indices, index)
 	}
 
 	if err := scanner.Err(); err != nil {
-		mu.Fatalf("error: failed to read config file: %v", err)
+		return nil, fmt.Errorf("failed to read config file: %v", err)
 	}
 
 	if len(members) == 0 {
-		mu.Fatalf("error: no members in the group")
+		return nil, errors.New("no members in the group")
 	}
 
+	return placeMembers(members, indices)
+}
+
+// MemberName derives a member's name from the name of its IK file: the base
+// name without the suffix -ik-pub.pem or, failing that, without its
+// extension.
+func MemberName(pubIKFile string) string {
+	base := filepath.Base(pubIKFile)
+	if name, ok := strings.CutSuffix(base, "-ik-pub.pem"); ok && name != "" {
+		return name
+	}
+	return strings.TrimSuffix(base, filepath.Ext(base))
+}
+
+// A MemberConfig is an entry of a JSON group config (see
+// GetMembersFromJSON): the member's key files and, optionally, its name and
+// INDEX.
+type MemberConfig struct {
+	Name  string `json:"name,omitempty"`
+	IK    string `json:"ik"`
+	EK    string `json:"ek"`
+	Index *int   `json:"index,omitempty"`
+}
+
+// GetMembersFromJSON reads a group config in JSON from r: an array with one
+// MemberConfig per member, e.g.,
+//
+//	[{"ik": "alice-ik-pub.pem", "ek": "alice-ek-pub.pem", "index": 1}, ...]
+//
+// A member without a name is named after its IK file (see MemberName).  The
+// rules for INDEXes are those of the config file.  Unlike in a config file,
+// relative key file paths are relative to the working directory.  On error,
+// GetMembersFromJSON exits; ReadMembersFromJSON returns the error instead.
+func GetMembersFromJSON(r io.Reader) []*Member {
+	members, err := ReadMembersFromJSON(r)
+	if err != nil {
+		mu.Fatalf("error: %v", err)
+	}
 	return members
 }
 
-func getMembersFromFile(configFile string) []*Member {
+// ReadMembersFromJSON is like GetMembersFromJSON, but returns an error
+// rather than exiting.
+func ReadMembersFromJSON(r io.Reader) ([]*Member, error) {
+	var entries []json.RawMessage
+	dec := json.NewDecoder(r)
+	if err := dec.Decode(&entries); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) {
+			return nil, errors.New("the JSON config is not an array of members")
+		}
+		return nil, fmt.Errorf("can't parse the JSON config: %v", err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("the JSON config has data after the array of members")
+	}
+
+	members := make([]*Member, 0, len(entries))
+	indices := make([]int, 0, len(entries))
+	nameSet := make(map[string]bool)
+
+	for i, entry := range entries {
+		config, err := parseMemberConfig(entry)
+		if err != nil {
+			return nil, fmt.Errorf("JSON config entry %d (%s): %v", i+1, entry, err)
+		}
+
+		if nameSet[config.Name] {
+			return nil, fmt.Errorf("JSON config has multiple entries for %q", config.Name)
+		}
+		nameSet[config.Name] = true
+
+		member, err := NewMember(config.Name, config.IK, config.EK)
+		if err != nil {
+			return nil, fmt.Errorf("creating new group member %v", err)
+		}
+		members = append(members, member)
+
+		index := 0
+		if config.Index != nil {
+			index = *config.Index
+		}
+		indices = append(indices, index)
+	}
+
+	if len(members) == 0 {
+		return nil, errors.New("no members in the group")
+	}
+
+	return placeMembers(members, indices)
+}
+
+// parseMemberConfig decodes and checks a JSON config entry.
+func parseMemberConfig(entry json.RawMessage) (*MemberConfig, error) {
+	var config MemberConfig
+	dec := json.NewDecoder(strings.NewReader(string(entry)))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&config); err != nil {
+		return nil, err
+	}
+
+	if config.IK == "" {
+		return nil, errors.New("missing \"ik\"")
+	}
+	if config.EK == "" {
+		return nil, errors.New("missing \"ek\"")
+	}
+	if config.Index != nil && *config.Index < 1 {
+		return nil, fmt.Errorf("invalid index %d", *config.Index)
+	}
+	if config.Name == "" {
+		config.Name = MemberName(config.IK)
+	}
+
+	return &config, nil
+}
+
+// ReadMembersFromFile reads the members of the group, in order, from the
+// config file configFile (see SetupGroup).
+func ReadMembersFromFile(configFile string) ([]*Member, error) {
 	file, err := os.Open(configFile)
 	if err != nil {
-		mu.Fatalf("error: can't open config file: %v", err)
+		return nil, fmt.Errorf("can't open config file: %v", err)
 	}
 	defer file.Close()
 
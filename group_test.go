@@ -0,0 +1,565 @@
+package art
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/syslab-wm/art/internal/jsonutl"
+)
+
+// A testGroup is a group set up in memory, with the state of every member:
+// states[i-1] is the state of the member at position i, and member 1 is the
+// initiator.
+type testGroup struct {
+	setupMsg *SetupMessage
+	msg, sig []byte
+
+	iks    []ed25519.PrivateKey
+	eks    []*ecdh.PrivateKey
+	states []*TreeState
+}
+
+// testReader returns a deterministic source of randomness for the keys of
+// the test named name.
+func testReader(name string) io.Reader {
+	return NewSeededReader([]byte("art test " + name))
+}
+
+// testMembers generates the keys of n members from r.
+func testMembers(t testing.TB, n int, r io.Reader) ([]*Member, []ed25519.PrivateKey,
+	[]*ecdh.PrivateKey) {
+
+	t.Helper()
+	members := make([]*Member, n)
+	iks := make([]ed25519.PrivateKey, n)
+	eks := make([]*ecdh.PrivateKey, n)
+	for i := range members {
+		var err error
+		if iks[i], err = IKKeyGenFrom(r); err != nil {
+			t.Fatal(err)
+		}
+		if eks[i], err = DHKeyGenFrom(r); err != nil {
+			t.Fatal(err)
+		}
+		members[i] = NewMemberFromKeys(fmt.Sprintf("member%d", i+1),
+			iks[i].Public().(ed25519.PublicKey), eks[i].PublicKey())
+	}
+	return members, iks, eks
+}
+
+// newTestGroup sets up a group of n members with opts (which may be nil), with
+// keys drawn deterministically from name, and has every member but the
+// initiator process the signed setup message.
+func newTestGroup(t testing.TB, name string, n int, opts *SetupOptions) *testGroup {
+	t.Helper()
+
+	r := testReader(name)
+	members, iks, eks := testMembers(t, n, r)
+	if opts == nil {
+		opts = &SetupOptions{}
+	}
+	if opts.Rand == nil {
+		opts.Rand = r
+	}
+
+	state, setupMsg := SetupGroupFromMembers(members, "", opts)
+	msg, err := jsonutl.Marshal(setupMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := Sign(iks[0], msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g := &testGroup{setupMsg: setupMsg, msg: msg, sig: sig, iks: iks, eks: eks,
+		states: []*TreeState{state}}
+	for i := 2; i <= n; i++ {
+		state, err := ProcessSetupMessageBytes(i, eks[i-1], msg, sig, iks[0].Public())
+		if err != nil {
+			t.Fatalf("member %d: %v", i, err)
+		}
+		g.states = append(g.states, state)
+	}
+	return g
+}
+
+// update has the member at position index update its leaf key, and every
+// other member process the update.  It returns the encoded update message and
+// its MAC.
+func (g *testGroup) update(t testing.TB, index int) (msg, mac []byte) {
+	t.Helper()
+
+	updateMsg, prevStageKey := g.states[index-1].UpdateKeyFrom(index, testReader(
+		fmt.Sprintf("update %d %d", index, g.states[index-1].Epoch)))
+	mac = updateMsg.MAC(prevStageKey)
+	msg, err := json.Marshal(updateMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, state := range g.states {
+		if i+1 == index {
+			continue
+		}
+		if err := ProcessUpdateMessageBytes(state, i+1, msg, mac); err != nil {
+			t.Fatalf("member %d processing the update of member %d: %v", i+1, index, err)
+		}
+	}
+	return msg, mac
+}
+
+// cloneState returns a deep copy of state, by encoding and decoding it.
+func cloneState(t testing.TB, state *TreeState) *TreeState {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := WriteTreeState(&buf, state); err != nil {
+		t.Fatal(err)
+	}
+	clone, err := ReadTreeState(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return clone
+}
+
+// makeUpdate has the member at position index update its leaf key, without
+// the other members processing the update, and returns the encoded update
+// message and its MAC.
+func (g *testGroup) makeUpdate(t testing.TB, index int) (msg, mac []byte) {
+	t.Helper()
+	state := g.states[index-1]
+	updateMsg, prevStageKey := state.UpdateKeyFrom(index, testReader(
+		fmt.Sprintf("queued update %d %d", index, state.Epoch)))
+	msg, err := json.Marshal(updateMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg, updateMsg.MAC(prevStageKey)
+}
+
+// checkAgree fails unless every member has the same stage key.
+func (g *testGroup) checkAgree(t testing.TB) {
+	t.Helper()
+	for i, state := range g.states {
+		if !StageKeyEqual(state.Sk, g.states[0].Sk) {
+			t.Fatalf("member %d's stage key differs from member 1's", i+1)
+		}
+	}
+}
+
+func TestCreateGroupFromMembersErrors(t *testing.T) {
+	members, _, eks := testMembers(t, 3, testReader("create group errors"))
+	otherKey, err := DHKeyGenFrom(testReader("create group errors other"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		members   []*Member
+		initiator string
+		opts      *SetupOptions
+	}{
+		{"no members", nil, "", nil},
+		{"unknown initiator", members, "nobody", nil},
+		{"SUK is an EK", members, "", &SetupOptions{SetupKey: eks[1]}},
+		{"metadata for a non-member", members, "",
+			&SetupOptions{LeafMetadata: map[string]string{"nobody": "x"}}},
+		{"leaf key for a non-member", members, "",
+			&SetupOptions{LeafKeys: map[string]*ecdh.PrivateKey{"nobody": otherKey}}},
+		{"unknown tree order", members, "", &SetupOptions{TreeOrder: "sideways"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state, setupMsg, err := CreateGroupFromMembers(tt.members, tt.initiator, tt.opts)
+			if err == nil {
+				t.Fatal("CreateGroupFromMembers succeeded")
+			}
+			if state != nil || setupMsg != nil {
+				t.Error("CreateGroupFromMembers returned a group along with its error")
+			}
+		})
+	}
+}
+
+// TestSetupKeyIsEK checks that setting up a group fails if the SUK is any
+// member's EK, the initiator's included, and names the member.
+func TestSetupKeyIsEK(t *testing.T) {
+	r := testReader("setup key is ek")
+	members, _, eks := testMembers(t, 3, r)
+	for i, ek := range eks {
+		_, _, err := CreateGroupFromMembers(members, "", &SetupOptions{Rand: r, SetupKey: ek})
+		want := fmt.Sprintf("the SUK is the EK of member %d (member%d)", i+1, i+1)
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("SUK is member %d's EK: got error %v, want %q", i+1, err, want)
+		}
+	}
+
+	suk, err := DHKeyGenFrom(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, setupMsg, err := CreateGroupFromMembers(members, "", &SetupOptions{Rand: r,
+		SetupKey: suk})
+	if err != nil {
+		t.Fatalf("distinct SUK: %v", err)
+	}
+	if !setupMsg.GetSetupKey().Equal(suk.PublicKey()) {
+		t.Error("the setup message's SUK is not the given one")
+	}
+}
+
+func TestReadMembersFromJSONErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+	}{
+		{"empty", "[]"},
+		{"not an array", `{"ik": "a-ik-pub.pem", "ek": "a-ek-pub.pem"}`},
+		{"malformed", `[{"ik": `},
+		{"trailing data", "[] []"},
+		{"missing ik", `[{"ek": "a-ek-pub.pem"}]`},
+		{"missing ek", `[{"ik": "a-ik-pub.pem"}]`},
+		{"unknown field", `[{"ik": "a-ik-pub.pem", "ek": "a-ek-pub.pem", "ik2": ""}]`},
+		{"invalid index", `[{"ik": "a-ik-pub.pem", "ek": "a-ek-pub.pem", "index": 0}]`},
+		{"missing key file", `[{"ik": "/nonexistent/a-ik-pub.pem", "ek": "a-ek-pub.pem"}]`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ReadMembersFromJSON(strings.NewReader(tt.config)); err == nil {
+				t.Error("ReadMembersFromJSON succeeded")
+			}
+		})
+	}
+}
+
+func TestConsumedPrekeys(t *testing.T) {
+	r := testReader("consumed prekeys")
+	members, _, eks := testMembers(t, 3, r)
+	leafKey, err := DHKeyGenFrom(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// member 3's leaf key is supplied, so only member 2's prekey is used
+	leafKeys := map[string]*ecdh.PrivateKey{"member3": leafKey}
+	state, setupMsg, err := CreateGroupFromMembers(members, "",
+		&SetupOptions{Rand: r, LeafKeys: leafKeys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := func(i int) string { return Fingerprint(eks[i-1].PublicKey().Bytes()) }
+
+	tests := []struct {
+		name     string
+		consumed []string
+		ok       bool
+	}{
+		{"fresh", nil, true},
+		{"unused prekeys consumed", []string{id(1), id(3)}, true},
+		{"reused prekey", []string{id(2)}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			consumed := make(map[string]bool)
+			for _, id := range tt.consumed {
+				consumed[id] = true
+			}
+			ids, err := ConsumedPrekeys(state, setupMsg, leafKeys, consumed)
+			if (err == nil) != tt.ok {
+				t.Fatalf("got error %v, want success %v", err, tt.ok)
+			}
+			if err == nil && (len(ids) != 1 || ids[0] != id(2)) {
+				t.Errorf("got prekeys %v, want only member 2's", ids)
+			}
+		})
+	}
+}
+
+// TestSuppliedLeafKeys sets up a group in which members 3 and 4 bring their
+// own leaf keys, and checks that they and the members whose leaf keys are
+// derived from their EKs agree on the stage key, before and after an update.
+func TestSuppliedLeafKeys(t *testing.T) {
+	const n = 4
+	r := testReader("supplied leaf keys")
+	members, _, eks := testMembers(t, n, r)
+	leafKeys := make(map[string]*ecdh.PrivateKey)
+	for _, name := range []string{"member3", "member4"} {
+		key, err := DHKeyGenFrom(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		leafKeys[name] = key
+	}
+	state, setupMsg, err := CreateGroupFromMembers(members, "",
+		&SetupOptions{Rand: r, LeafKeys: leafKeys, VerifyAll: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g := &testGroup{setupMsg: setupMsg, states: []*TreeState{state}}
+	for i := 2; i <= n; i++ {
+		leafKey, ok := leafKeys[fmt.Sprintf("member%d", i)]
+		if !ok {
+			if leafKey, err = DeriveLeafKeyFromEK(eks[i-1], setupMsg.GetSetupKey()); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := setupMsg.CheckLeafKey(i, leafKey); err != nil {
+			t.Fatalf("member %d: %v", i, err)
+		}
+		g.states = append(g.states, setupMsg.NewTreeState(i, leafKey))
+	}
+	g.checkAgree(t)
+
+	// the key derived from member 3's EK is not its leaf key
+	derived, err := DeriveLeafKeyFromEK(eks[2], setupMsg.GetSetupKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := setupMsg.CheckLeafKey(3, derived); err == nil {
+		t.Error("CheckLeafKey accepted member 3's derived leaf key")
+	}
+	if err := setupMsg.CheckLeafKey(4, leafKeys["member3"]); err == nil {
+		t.Error("CheckLeafKey accepted member 3's leaf key for member 4")
+	}
+
+	g.update(t, 3)
+	g.checkAgree(t)
+}
+
+// placeSparse writes the keys of members to a temporary directory, and reads
+// them back from a JSON config that gives members[i] the INDEX indices[i].
+func placeSparse(t *testing.T, members []*Member, indices []int) []*Member {
+	t.Helper()
+	read := writeMembers(t, t.TempDir(), members)
+
+	var config strings.Builder
+	config.WriteString("[")
+	for i, m := range read {
+		if i > 0 {
+			config.WriteString(", ")
+		}
+		fmt.Fprintf(&config, `{"name": %q, "ik": %q, "ek": %q, "index": %d}`, m.name,
+			m.pubIKFile, m.pubEKFile, indices[i])
+	}
+	config.WriteString("]")
+	placed, err := ReadMembersFromJSON(strings.NewReader(config.String()))
+	if err != nil {
+		t.Fatalf("ReadMembersFromJSON: %v", err)
+	}
+	return placed
+}
+
+// TestSparseIndices sets up a group whose members have sparse INDEXes, 2, 3
+// and 5, so that leaves 1 and 4 are blank, and checks that the placed
+// members derive the initiator's stage key, before and after an update.
+func TestSparseIndices(t *testing.T) {
+	r := testReader("sparse indices")
+	members, iks, eks := testMembers(t, 3, r)
+	indices := []int{5, 2, 3}
+	placed := placeSparse(t, members, indices)
+	if len(placed) != 5 || !placed[0].isBlank() || !placed[3].isBlank() {
+		t.Fatalf("the members are not placed at INDEXes 2, 3 and 5 with blanks at 1 " +
+			"and 4")
+	}
+
+	// the initiator is the member at the lowest INDEX, member2
+	initiator, setupMsg, err := CreateGroupFromMembers(placed, "",
+		&SetupOptions{Rand: r, VerifyAll: true})
+	if err != nil {
+		t.Fatalf("CreateGroupFromMembers: %v", err)
+	}
+	if got := initiator.LeafIndex(); got != 2 {
+		t.Fatalf("the initiator is at INDEX %d, want 2", got)
+	}
+	if err := setupMsg.ValidateMode(ValidateDeep); err != nil {
+		t.Fatalf("the setup message is invalid: %v", err)
+	}
+	binMsg, err := setupMsg.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary: %v", err)
+	}
+	decoded, err := DecodeSetupMessage(binMsg)
+	if err != nil {
+		t.Fatalf("DecodeSetupMessage: %v", err)
+	}
+	if !reflect.DeepEqual(decoded.IKeys, setupMsg.IKeys) ||
+		!reflect.DeepEqual(decoded.EKeys, setupMsg.EKeys) {
+		t.Error("the blank leaves do not survive the binary encoding")
+	}
+
+	msg, err := jsonutl.Marshal(setupMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := Sign(iks[1], msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g := &testGroup{states: []*TreeState{initiator}}
+	for _, i := range []int{0, 2} {
+		state, err := ProcessSetupMessageBytes(indices[i], eks[i], msg, sig, iks[1].Public())
+		if err != nil {
+			t.Fatalf("member at INDEX %d: %v", indices[i], err)
+		}
+		g.states = append(g.states, state)
+	}
+	g.checkAgree(t)
+
+	for _, blank := range []int{1, 4} {
+		_, err := ProcessSetupMessageBytes(blank, eks[0], msg, sig, iks[1].Public())
+		if err == nil {
+			t.Errorf("ProcessSetupMessageBytes accepted blank leaf %d", blank)
+		}
+	}
+
+	// the member at INDEX 5 (states[1]) updates
+	updateMsg, prevStageKey := g.states[1].UpdateKeyFrom(5, r)
+	update, err := json.Marshal(updateMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range []struct {
+		state *TreeState
+		index int
+	}{{g.states[0], 2}, {g.states[2], 3}} {
+		err := ProcessUpdateMessageBytes(m.state, m.index, update,
+			updateMsg.MAC(prevStageKey))
+		if err != nil {
+			t.Fatalf("member at INDEX %d: %v", m.index, err)
+		}
+	}
+	g.checkAgree(t)
+}
+
+// TestCompact sets up a group whose sparse INDEXes, 12, 1 and 6, leave most
+// of its leaves blank, and sets it up anew with SetupOptions.Compact: the
+// compact tree is shallower, and the members, at their compacted INDEXes,
+// derive the initiator's stage key.
+func TestCompact(t *testing.T) {
+	r := testReader("compact")
+	members, iks, eks := testMembers(t, 3, r)
+	placed := placeSparse(t, members, []int{12, 1, 6})
+
+	sparse, _, err := CreateGroupFromMembers(placed, "", &SetupOptions{Rand: r})
+	if err != nil {
+		t.Fatalf("CreateGroupFromMembers: %v", err)
+	}
+	initiator, setupMsg, err := CreateGroupFromMembers(placed, "",
+		&SetupOptions{Rand: r, Compact: true})
+	if err != nil {
+		t.Fatalf("CreateGroupFromMembers, compact: %v", err)
+	}
+	if got := len(setupMsg.IKeys); got != 3 {
+		t.Fatalf("the compact tree has %d leaves, want 3", got)
+	}
+	if initiator.PublicTree.Height >= sparse.PublicTree.Height {
+		t.Errorf("the compact tree has height %d, want less than the sparse tree's %d",
+			initiator.PublicTree.Height, sparse.PublicTree.Height)
+	}
+
+	msg, err := jsonutl.Marshal(setupMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the initiator is member2, at the lowest INDEX
+	sig, err := Sign(iks[1], msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// member3 moves from INDEX 6 to 2, and member1 from 12 to 3
+	g := &testGroup{states: []*TreeState{initiator}}
+	for _, m := range []struct{ member, index int }{{3, 2}, {1, 3}} {
+		state, err := ProcessSetupMessageBytes(m.index, eks[m.member-1], msg, sig,
+			iks[1].Public())
+		if err != nil {
+			t.Fatalf("member%d at INDEX %d: %v", m.member, m.index, err)
+		}
+		g.states = append(g.states, state)
+	}
+	g.checkAgree(t)
+}
+
+func TestPlaceMembersErrors(t *testing.T) {
+	members, _, _ := testMembers(t, 3, testReader("place members errors"))
+
+	tests := []struct {
+		name    string
+		indices []int
+	}{
+		{"some without INDEX", []int{1, 0, 3}},
+		{"duplicate", []int{1, 4, 4}},
+		{"past MaxIndex", []int{1, 2, MaxIndex + 1}},
+		{"past MaxLeavesPerMember", []int{1, 2, 3*MaxLeavesPerMember + 1}},
+		{"negative", []int{1, 2, -3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := placeMembers(members, tt.indices); err == nil {
+				t.Error("placeMembers succeeded")
+			}
+		})
+	}
+
+	// the largest INDEX a group of three members may have
+	placed, err := placeMembers(members, []int{1, 2, 3 * MaxLeavesPerMember})
+	if err != nil {
+		t.Fatalf("got error %v at the largest INDEX, want success", err)
+	}
+	if len(placed) != 3*MaxLeavesPerMember {
+		t.Errorf("got %d leaves, want %d", len(placed), 3*MaxLeavesPerMember)
+	}
+}
+
+// TestTranscriptHash checks that members that apply the same messages have
+// equal transcript hashes, and that applying a different update yields a
+// different one.
+func TestTranscriptHash(t *testing.T) {
+	g := newTestGroup(t, "transcript hash", 3, nil)
+	checkEqual := func() {
+		t.Helper()
+		for i, state := range g.states {
+			if !bytes.Equal(state.TranscriptHash, g.states[0].TranscriptHash) {
+				t.Fatalf("member %d's transcript hash differs from member 1's", i+1)
+			}
+		}
+	}
+	checkEqual()
+	setupHash := g.states[0].TranscriptHash
+
+	// an update member 1 and member 3 never see
+	other := cloneState(t, g.states[1])
+	otherMsg, otherPrevSk := other.UpdateKeyFrom(2, testReader("other update"))
+	otherMAC := otherMsg.MAC(otherPrevSk)
+	otherBytes, err := json.Marshal(otherMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diverged := cloneState(t, g.states[2])
+
+	g.update(t, 2)
+	checkEqual()
+	if bytes.Equal(g.states[0].TranscriptHash, setupHash) {
+		t.Error("the update did not change the transcript hash")
+	}
+
+	if err := ProcessUpdateMessageBytes(diverged, 3, otherBytes, otherMAC); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(diverged.TranscriptHash, g.states[2].TranscriptHash) {
+		t.Error("a different update gave the same transcript hash")
+	}
+}
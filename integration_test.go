@@ -0,0 +1,335 @@
+package art
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/syslab-wm/art/internal/jsonutl"
+)
+
+// TestGroupLifecycle runs groups of several sizes through setup and a round
+// of updates in memory, as the setup_group, process_setup_message,
+// update_key, and process_update_message tools do, and checks that every
+// member agrees on the stage key after each step.
+func TestGroupLifecycle(t *testing.T) {
+	for _, n := range []int{1, 2, 3, 5, 8} {
+		t.Run(fmt.Sprintf("members=%d", n), func(t *testing.T) {
+			g := newTestGroup(t, fmt.Sprintf("lifecycle %d", n), n, nil)
+			g.checkAgree(t)
+
+			for index := n; index >= 1; index-- {
+				g.update(t, index)
+				g.checkAgree(t)
+				for i, state := range g.states {
+					if state.Epoch != n-index+1 {
+						t.Fatalf("member %d is at epoch %d; want %d", i+1, state.Epoch,
+							n-index+1)
+					}
+				}
+			}
+		})
+	}
+}
+
+// TestTwoMemberLifecycle runs a two-member group, the smallest with a
+// nontrivial tree, through setup from a config file, processing the setup
+// message, and an update by each member in turn, and checks that the members
+// agree on the stage key after every step.
+func TestTwoMemberLifecycle(t *testing.T) {
+	r := testReader("two members")
+	members, iks, eks := testMembers(t, 2, r)
+
+	dir := t.TempDir()
+	writeMembers(t, dir, members)
+	configFile := filepath.Join(dir, "config")
+	config := "member1 member1-ik-pub.pem member1-ek-pub.pem\n" +
+		"member2 member2-ik-pub.pem member2-ek-pub.pem\n"
+	if err := os.WriteFile(configFile, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	initiator, setupMsg, err := CreateGroup(configFile, "", &SetupOptions{Rand: r})
+	if err != nil {
+		t.Fatalf("CreateGroup: %v", err)
+	}
+	msg, err := jsonutl.Marshal(setupMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := Sign(iks[0], msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	member, err := ProcessSetupMessageBytes(2, eks[1], msg, sig, iks[0].Public())
+	if err != nil {
+		t.Fatalf("ProcessSetupMessageBytes: %v", err)
+	}
+	if !StageKeyEqual(initiator.Sk, member.Sk) {
+		t.Fatal("the members disagree on the stage key after setup")
+	}
+
+	states := []*TreeState{initiator, member}
+	for _, index := range []int{1, 2} {
+		updater, other := states[index-1], states[2-index]
+		updateMsg, prevStageKey := updater.UpdateKeyFrom(index,
+			testReader(fmt.Sprintf("two members update %d", index)))
+		msg, err := json.Marshal(updateMsg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ProcessUpdateMessageBytes(other, 3-index, msg, updateMsg.MAC(prevStageKey))
+		if err != nil {
+			t.Fatalf("member %d processing member %d's update: %v", 3-index, index, err)
+		}
+		if !StageKeyEqual(updater.Sk, other.Sk) {
+			t.Fatalf("the members disagree on the stage key after member %d's update",
+				index)
+		}
+		if StageKeyEqual(updater.Sk, prevStageKey) {
+			t.Fatalf("member %d's update did not change the stage key", index)
+		}
+	}
+}
+
+// encodeSetup encodes setupMsg, which a test has changed, and, if resign is
+// set, signs it with the initiator's IK, as a malicious or buggy initiator
+// would.  Otherwise, the signature is the one of the unchanged message.
+func (g *testGroup) encodeSetup(t *testing.T, setupMsg *SetupMessage,
+	resign bool) (msg, sig []byte) {
+
+	t.Helper()
+	msg, err := jsonutl.Marshal(setupMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resign {
+		return msg, g.sig
+	}
+	sig, err = Sign(g.iks[0], msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg, sig
+}
+
+func TestProcessSetupMessageRejects(t *testing.T) {
+	const n = 5
+	g := newTestGroup(t, "process setup rejects", n, nil)
+
+	tests := []struct {
+		name string
+		// tamper changes the message, which is re-signed if resign is set
+		tamper func(sm *SetupMessage)
+		resign bool
+		sig    func(sig []byte) []byte
+		index  int
+		// signer is the member whose IK the signature is checked with
+		signer int
+	}{
+		{"flipped signature bit", nil, false,
+			func(sig []byte) []byte { return flipBit(sig, 0) }, 2, 1},
+		{"truncated signature", nil, false, func(sig []byte) []byte { return sig[1:] }, 2, 1},
+		{"another member's IK", nil, false, nil, 2, 3},
+		{"tampered tree", func(sm *SetupMessage) { sm.TreeKeys[3] = sm.TreeKeys[4] },
+			false, nil, 2, 1},
+		{"tampered IKs", func(sm *SetupMessage) { sm.IKeys[1] = sm.IKeys[2] }, false, nil,
+			2, 1},
+		{"index 0", nil, false, nil, 0, 1},
+		{"index past the last member", nil, false, nil, n + 1, 1},
+		{"another member's index", nil, false, nil, 3, 1},
+		{"re-signed, too few tree keys", func(sm *SetupMessage) {
+			sm.TreeKeys = sm.TreeKeys[1:]
+		}, true, nil, 2, 1},
+		{"re-signed, duplicate tree keys", func(sm *SetupMessage) {
+			sm.TreeKeys[3] = sm.TreeKeys[4]
+		}, true, nil, 2, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, sig := g.msg, g.sig
+			if tt.tamper != nil {
+				tampered := *g.setupMsg
+				tampered.TreeKeys = append([][]byte(nil), g.setupMsg.TreeKeys...)
+				tampered.IKeys = append([][]byte(nil), g.setupMsg.IKeys...)
+				tt.tamper(&tampered)
+				msg, sig = g.encodeSetup(t, &tampered, tt.resign)
+			}
+			if tt.sig != nil {
+				sig = tt.sig(sig)
+			}
+
+			// the EK is always member 2's, so that only the index is wrong
+			// in the index cases
+			ik := g.iks[tt.signer-1].Public()
+			_, err := ProcessSetupMessageBytes(tt.index, g.eks[1], msg, sig, ik)
+			if err == nil {
+				t.Error("ProcessSetupMessageBytes accepted the message")
+			}
+		})
+	}
+}
+
+// TestProcessSetupMessageTamperedTree checks that a member processing a setup
+// message whose tree the initiator replaced a key of, and re-signed, does not
+// derive the group's stage key: the tree's keys are hashed into it.
+func TestProcessSetupMessageTamperedTree(t *testing.T) {
+	const n = 5
+	g := newTestGroup(t, "process setup tampered tree", n, nil)
+
+	for i := range g.setupMsg.TreeKeys {
+		t.Run(fmt.Sprintf("tree key %d", i+1), func(t *testing.T) {
+			tampered := *g.setupMsg
+			tampered.TreeKeys = append([][]byte(nil), g.setupMsg.TreeKeys...)
+			tampered.TreeKeys[i] = tampered.Suk
+			msg, sig := g.encodeSetup(t, &tampered, true)
+
+			state, err := ProcessSetupMessageBytes(2, g.eks[1], msg, sig, g.iks[0].Public())
+			if err != nil {
+				// rejected outright, e.g., as a key that is the SUK
+				return
+			}
+			if StageKeyEqual(state.Sk, g.states[1].Sk) {
+				t.Error("the tampered tree gives the group's stage key")
+			}
+		})
+	}
+}
+
+func TestProcessUpdateMessageRejects(t *testing.T) {
+	const n = 5
+	g := newTestGroup(t, "process update rejects", n, nil)
+	updateMsg, prevStageKey := g.states[2].UpdateKeyFrom(3,
+		testReader("process update rejects"))
+
+	tests := []struct {
+		name string
+		// tamper changes the message, which is re-MAC'd with the stage key
+		// the update replaces if remac is set, as any member could
+		tamper func(um *UpdateMessage)
+		remac  bool
+		mac    func(mac []byte) []byte
+	}{
+		{"flipped MAC bit", nil, false, func(mac []byte) []byte { return flipBit(mac, 0) }},
+		{"truncated MAC", nil, false, func(mac []byte) []byte { return mac[1:] }},
+		{"tampered path key", func(um *UpdateMessage) {
+			um.PathPublicKeys[1] = um.PathPublicKeys[2]
+		}, false, nil},
+		{"tampered index", func(um *UpdateMessage) { um.Idx = 4 }, false, nil},
+		{"re-MAC'd, index 0", func(um *UpdateMessage) { um.Idx = 0 }, true, nil},
+		{"re-MAC'd, index past the last member", func(um *UpdateMessage) {
+			um.Idx = n + 1
+		}, true, nil},
+		{"re-MAC'd, too few path keys", func(um *UpdateMessage) {
+			um.PathPublicKeys = um.PathPublicKeys[1:]
+		}, true, nil},
+		{"re-MAC'd, malformed path key", func(um *UpdateMessage) {
+			um.PathPublicKeys[1] = []byte("not a key")
+		}, true, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			um := *updateMsg
+			um.PathPublicKeys = append([][]byte(nil), updateMsg.PathPublicKeys...)
+			mac := updateMsg.MAC(prevStageKey)
+			if tt.tamper != nil {
+				tt.tamper(&um)
+			}
+			if tt.remac {
+				mac = um.MAC(prevStageKey)
+			}
+			if tt.mac != nil {
+				mac = tt.mac(mac)
+			}
+			msg, err := json.Marshal(&um)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			state := cloneState(t, g.states[1])
+			if err := ProcessUpdateMessageBytes(state, 2, msg, mac); err == nil {
+				t.Fatal("ProcessUpdateMessageBytes accepted the message")
+			}
+			if !StageKeyEqual(state.Sk, g.states[1].Sk) || state.Epoch != 0 {
+				t.Error("a rejected update changed the state")
+			}
+		})
+	}
+}
+
+// flipBit returns a copy of data with the lowest bit of byte i flipped.
+func flipBit(data []byte, i int) []byte {
+	flipped := bytes.Clone(data)
+	flipped[i] ^= 1
+	return flipped
+}
+
+func TestValidateTranscript(t *testing.T) {
+	const n = 4
+	g := newTestGroup(t, "validate transcript", n, nil)
+	var updates []TranscriptUpdate
+	for _, index := range []int{1, 2, 3, 1} {
+		msg, mac := g.update(t, index)
+		updates = append(updates, TranscriptUpdate{Msg: msg, MAC: mac})
+	}
+
+	// withEpoch returns update with its (unMAC'd) epoch set to epoch
+	withEpoch := func(update TranscriptUpdate, epoch int) TranscriptUpdate {
+		updateMsg, err := DecodeUpdateMessage(update.Msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		updateMsg.Epoch = epoch
+		msg, err := json.Marshal(updateMsg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return TranscriptUpdate{Msg: msg, MAC: update.MAC}
+	}
+	var unversioned []TranscriptUpdate
+	for _, update := range updates {
+		unversioned = append(unversioned, withEpoch(update, 0))
+	}
+
+	tests := []struct {
+		name    string
+		updates []TranscriptUpdate
+		ok      bool
+	}{
+		{"valid", updates, true},
+		{"valid, no epochs", unversioned, true},
+		{"setup only", nil, true},
+		{"gap", []TranscriptUpdate{updates[0], updates[2], updates[3]}, false},
+		{"out of order", []TranscriptUpdate{updates[1], updates[0], updates[2],
+			updates[3]}, false},
+		{"gap, no epochs", []TranscriptUpdate{unversioned[0], unversioned[2]}, false},
+		{"gap, forged epoch", []TranscriptUpdate{updates[0], withEpoch(updates[2], 2)},
+			false},
+		{"replayed update", []TranscriptUpdate{updates[0], updates[0]}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sk, err := ValidateTranscript(n, g.eks[n-1], g.msg, g.sig, g.iks[0].Public(),
+				tt.updates)
+			if (err == nil) != tt.ok {
+				t.Fatalf("got error %v, want success %v", err, tt.ok)
+			}
+			if err == nil && len(tt.updates) == len(updates) &&
+				!StageKeyEqual(sk, g.states[n-1].Sk) {
+				t.Error("the final stage key is not the member's")
+			}
+		})
+	}
+
+	// the member replaying the transcript can't be an updater in it
+	_, err := ValidateTranscript(1, g.eks[0], g.msg, g.sig, g.iks[0].Public(), updates)
+	if err == nil {
+		t.Error("ValidateTranscript accepted a transcript with the member's own update")
+	}
+}
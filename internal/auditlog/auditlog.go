@@ -0,0 +1,73 @@
+// Package auditlog appends a record of each message a member processes to an
+// append-only log, one JSON object per line, for compliance.  Unlike debug
+// output, each record is synced to disk before the program goes on, so that
+// the log survives a crash.
+package auditlog
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+)
+
+// A Record describes a processed message and the state it resulted in.  The
+// hashes and fingerprints are hex-encoded SHA-256 digests (see
+// art.Fingerprint).
+type Record struct {
+	Time time.Time `json:"time"`
+
+	// Type is "setup" or "update".
+	Type string `json:"type"`
+
+	// File is the message file, as given on the command line.
+	File string `json:"file"`
+
+	// MessageHash is the digest of the (uncompressed) message.
+	MessageHash string `json:"messageHash"`
+
+	// Signer is the fingerprint of the identity key of the initiator whose
+	// signature on a setup message was verified.  It is empty for a setup
+	// message whose signature was not verified, and for update messages,
+	// which are only MAC'd with the stage key, and so are not signed.
+	Signer string `json:"signer,omitempty"`
+
+	// ClaimedUpdater is the INDEX of the member that an update message
+	// claims to be from.  It is NOT authenticated: the MAC shows only that
+	// the sender held the stage key, which every member does, so any member
+	// can claim any index.
+	ClaimedUpdater int `json:"claimedUpdater,omitempty"`
+
+	// Member is the INDEX of the member that processed the message.
+	Member int `json:"member"`
+
+	// Epoch and StageKey are the epoch and the fingerprint of the (public
+	// half of the) stage key after processing the message.
+	Epoch    int    `json:"epoch"`
+	StageKey string `json:"stageKey"`
+}
+
+// Append appends rec to the log at path, creating the log if needed, and
+// syncs it to disk.
+func Append(path string, rec *Record) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+
+	if _, err = file.Write(line); err != nil {
+		file.Close()
+		return err
+	}
+	if err = file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
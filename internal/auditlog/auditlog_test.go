@@ -0,0 +1,69 @@
+package auditlog
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestAppend checks that n appends, the first of which creates the log,
+// leave n records in the log, one per line, in order.
+func TestAppend(t *testing.T) {
+	const n = 5
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	now := time.Now().UTC().Truncate(time.Second)
+	for i := 0; i < n; i++ {
+		rec := &Record{Time: now, Type: "update", File: "update.msg", ClaimedUpdater: 2,
+			Member: 1, Epoch: i + 1, StageKey: "fingerprint"}
+		if i == 0 {
+			rec.Type, rec.Signer, rec.ClaimedUpdater = "setup", "signer", 0
+		}
+		if err := Append(path, rec); err != nil {
+			t.Fatalf("append %d: %v", i+1, err)
+		}
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	var recs []Record
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var rec Record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			t.Fatalf("line %d: %v", len(recs)+1, err)
+		}
+		recs = append(recs, rec)
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(recs) != n {
+		t.Fatalf("got %d records, want %d", len(recs), n)
+	}
+	for i, rec := range recs {
+		if rec.Epoch != i+1 || !rec.Time.Equal(now) {
+			t.Errorf("record %d has epoch %d and time %v, want %d and %v", i+1,
+				rec.Epoch, rec.Time, i+1, now)
+		}
+	}
+	if recs[0].Type != "setup" || recs[0].Signer != "signer" || recs[1].Type != "update" {
+		t.Errorf("got records %+v and %+v, want a setup and then an update", recs[0],
+			recs[1])
+	}
+}
+
+// TestAppendError checks that Append reports a log it can't open.
+func TestAppendError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "missing", "audit.jsonl")
+	if err := Append(path, &Record{Type: "setup"}); err == nil {
+		t.Error("Append succeeded in a missing directory")
+	}
+}
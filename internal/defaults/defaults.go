@@ -0,0 +1,134 @@
+// Package defaults reads default option values for the command-line tools
+// from a defaults file, so that a team's scripts can share settings (such as
+// the timeout) instead of repeating them on every invocation.  The file is
+// only read if the ART_DEFAULTS environment variable names it; a file in the
+// current directory is never picked up implicitly.
+//
+// The file is a small subset of TOML: one "name = value" pair per line, where
+// name is the name of a flag (without the leading dash) and value is either
+// bare or a double-quoted string.  Pairs before the first "[tool]" section
+// header apply to every tool; pairs after a header apply only to that tool.
+// Lines that start with a '#' are comments.  For example:
+//
+//	timeout = "30s"
+//
+//	[process_update_message]
+//	verify-state = true
+//
+// Only the flags in Allowed can be set, so that a defaults file can tune the
+// tools or enable extra checks, but never disable a check, change which keys
+// are trusted, or redirect where keys and states are read or written.
+// Allowed flags that a tool does not have are ignored, so one file can serve
+// every tool.  Options given on the command line override the file.
+package defaults
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// FileEnv is the environment variable that names the defaults file.
+const FileEnv = "ART_DEFAULTS"
+
+// Allowed are the flags that a defaults file may set: performance tuning, and
+// checks that are off by default.  Trust and key or state path flags (e.g.,
+// -trusted-source, -suk-file, -leaf-key-file or -out-state) are deliberately
+// missing.
+var Allowed = map[string]bool{
+	"timeout":       true,
+	"workers":       true,
+	"verify-state":  true,
+	"verify-path":   true,
+	"verify-all":    true,
+	"deep":          true,
+	"explain":       true,
+	"json":          true,
+	"no-overwrite":  true,
+	"safety-number": true,
+}
+
+// Load sets flags from the entries for tool in the defaults file named by
+// FileEnv, if it is set.  It must be called after the flags are defined and
+// before they are parsed, so that the command line overrides the defaults.
+func Load(flags *flag.FlagSet, tool string) error {
+	path := os.Getenv(FileEnv)
+	if path == "" {
+		return nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("can't open defaults file: %v", err)
+	}
+	defer f.Close()
+
+	return load(f, path, flags, tool)
+}
+
+func load(f *os.File, path string, flags *flag.FlagSet, tool string) error {
+	section := ""
+	lineNum := 0
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") {
+				return fmt.Errorf("%s:%d: malformed section header %q", path, lineNum, line)
+			}
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+
+		name, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return fmt.Errorf("%s:%d: expected NAME = VALUE", path, lineNum)
+		}
+		name = strings.TrimSpace(name)
+		value, err := parseValue(strings.TrimSpace(value))
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", path, lineNum, err)
+		}
+
+		if !Allowed[name] {
+			return fmt.Errorf("%s:%d: %s can't be set from a defaults file", path,
+				lineNum, name)
+		}
+		if section != "" && section != tool {
+			continue
+		}
+		if flags.Lookup(name) == nil {
+			continue
+		}
+		if err := flags.Set(name, value); err != nil {
+			return fmt.Errorf("%s:%d: invalid value %q for %s: %v", path, lineNum,
+				value, name, err)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read defaults file: %v", err)
+	}
+	return nil
+}
+
+// parseValue unquotes a double-quoted value; bare values are used as is.
+func parseValue(value string) (string, error) {
+	if !strings.HasPrefix(value, `"`) {
+		return value, nil
+	}
+	s, err := strconv.Unquote(value)
+	if err != nil {
+		return "", fmt.Errorf("malformed string %s", value)
+	}
+	return s, nil
+}
@@ -0,0 +1,121 @@
+package defaults
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newFlags returns a flag set with a tuning flag, a check and a trust flag.
+func newFlags() (*flag.FlagSet, *time.Duration, *bool, *string) {
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	timeout := flags.Duration("timeout", 0, "")
+	verify := flags.Bool("verify-state", false, "")
+	trusted := flags.String("trusted-source", "", "")
+	return flags, timeout, verify, trusted
+}
+
+func writeDefaults(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "defaults.toml")
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		name        string
+		contents    string
+		wantTimeout time.Duration
+		wantVerify  bool
+		wantErr     string
+	}{
+		{
+			name:        "global",
+			contents:    "timeout = \"30s\"\nverify-state = true\n",
+			wantTimeout: 30 * time.Second,
+			wantVerify:  true,
+		},
+		{
+			name:        "sections",
+			contents:    "timeout = 1s\n[other]\ntimeout = 2s\n[tool]\nverify-state = true\n",
+			wantTimeout: time.Second,
+			wantVerify:  true,
+		},
+		{
+			name:     "trust flag",
+			contents: "trusted-source = \"evil.pem\"\n",
+			wantErr:  "trusted-source can't be set",
+		},
+		{
+			name:     "key path flag in another tool's section",
+			contents: "[other]\nsuk-file = \"suk.pem\"\n",
+			wantErr:  "suk-file can't be set",
+		},
+		{
+			name:     "malformed",
+			contents: "timeout 30s\n",
+			wantErr:  "expected NAME = VALUE",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(FileEnv, writeDefaults(t, tt.contents))
+			flags, timeout, verify, trusted := newFlags()
+
+			err := Load(flags, "tool")
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Load: got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Load: %v", err)
+			}
+			if *timeout != tt.wantTimeout || *verify != tt.wantVerify || *trusted != "" {
+				t.Errorf("got timeout %v, verify-state %v, trusted-source %q; want %v, %v, \"\"",
+					*timeout, *verify, *trusted, tt.wantTimeout, tt.wantVerify)
+			}
+		})
+	}
+}
+
+func TestLoadIgnoresWorkingDirectory(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "art.toml"), []byte("timeout = 1s\n"),
+		0600); err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	t.Setenv(FileEnv, "")
+	flags, timeout, _, _ := newFlags()
+	if err := Load(flags, "tool"); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if *timeout != 0 {
+		t.Errorf("Load read ./art.toml without %s: timeout is %v", FileEnv, *timeout)
+	}
+}
+
+func TestLoadMissingFile(t *testing.T) {
+	t.Setenv(FileEnv, filepath.Join(t.TempDir(), "missing.toml"))
+	flags, _, _, _ := newFlags()
+	if err := Load(flags, "tool"); err == nil {
+		t.Error("Load succeeded with a missing defaults file")
+	}
+}
@@ -0,0 +1,80 @@
+// Package fileutl writes files atomically: a file is either completely
+// replaced or left untouched, even if the program crashes or the disk fills
+// up part way through the write.
+package fileutl
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Write atomically replaces the file at path with the output of write.  The
+// output is written to a temporary file in the same directory, which is
+// synced and then renamed to path.  On error, the temporary file is removed
+// and path is unchanged.
+func Write(path string, perm os.FileMode, write func(w io.Writer) error) error {
+	return writeTemp(path, perm, write, func(tmp string) error {
+		return os.Rename(tmp, path)
+	})
+}
+
+// WriteNew is like Write, but fails with an error that wraps fs.ErrExist if
+// path already exists, rather than replacing it.  The check and the write
+// are one atomic step: the temporary file is hard-linked to path, which
+// fails if path exists, even if another process creates it concurrently.
+func WriteNew(path string, perm os.FileMode, write func(w io.Writer) error) error {
+	return writeTemp(path, perm, write, func(tmp string) error {
+		if err := os.Link(tmp, path); err != nil {
+			return err
+		}
+		return os.Remove(tmp)
+	})
+}
+
+// writeTemp writes the output of write to a synced temporary file next to
+// path, and then calls install to put it into place.  On error, the
+// temporary file is removed.
+func writeTemp(path string, perm os.FileMode, write func(w io.Writer) error,
+	install func(tmp string) error) (err error) {
+
+	dir, base := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+
+	tmp, err := os.CreateTemp(dir, "."+base+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	if err = write(tmp); err != nil {
+		return err
+	}
+	if err = tmp.Chmod(perm); err != nil {
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+
+	return install(tmp.Name())
+}
+
+// WriteFile is like os.WriteFile, but atomically replaces the file (see
+// Write).
+func WriteFile(path string, data []byte, perm os.FileMode) error {
+	return Write(path, perm, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
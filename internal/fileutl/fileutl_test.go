@@ -0,0 +1,94 @@
+package fileutl
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// checkOnly fails unless dir holds only the file name with contents want.
+func checkOnly(t *testing.T, dir, name, want string) {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != name {
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		t.Fatalf("the directory holds %v, want only %s", names, name)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != want {
+		t.Errorf("%s holds %q, want %q", name, data, want)
+	}
+}
+
+// TestWriteFailed checks that a write that fails part way through, as on a
+// full disk, leaves the original file intact and no temporary file behind.
+func TestWriteFailed(t *testing.T) {
+	errFull := errors.New("no space left on device")
+	failing := func(w io.Writer) error {
+		if _, err := io.WriteString(w, "half of the new"); err != nil {
+			return err
+		}
+		return errFull
+	}
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state.json")
+	if err := os.WriteFile(path, []byte("original"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Write(path, 0600, failing); !errors.Is(err, errFull) {
+		t.Fatalf("Write: got error %v, want the write's error", err)
+	}
+	checkOnly(t, dir, "state.json", "original")
+
+	// WriteNew fails the same way for a file that does not exist yet
+	os.Remove(path)
+	if err := WriteNew(path, 0600, failing); !errors.Is(err, errFull) {
+		t.Fatalf("WriteNew: got error %v, want the write's error", err)
+	}
+	if entries, err := os.ReadDir(dir); err != nil || len(entries) != 0 {
+		t.Errorf("WriteNew left %d files behind", len(entries))
+	}
+}
+
+func TestWrite(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "msg")
+	if err := os.WriteFile(path, []byte("original"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := WriteFile(path, []byte("replaced"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	checkOnly(t, dir, "msg", "replaced")
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0640 {
+		t.Errorf("the file's mode is %v, want %v", info.Mode().Perm(), fs.FileMode(0640))
+	}
+
+	err = WriteNew(path, 0600, func(w io.Writer) error {
+		_, err := io.WriteString(w, "new")
+		return err
+	})
+	if !errors.Is(err, fs.ErrExist) {
+		t.Errorf("WriteNew over an existing file: got error %v, want fs.ErrExist", err)
+	}
+	checkOnly(t, dir, "msg", "replaced")
+}
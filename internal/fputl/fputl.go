@@ -0,0 +1,61 @@
+// Package fputl reads and appends files that hold a list of key
+// fingerprints, one per line.
+package fputl
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+)
+
+// ReadFile returns the set of fingerprints in path.  A missing file is
+// treated as an empty list.  Empty lines and lines that start with a '#' are
+// ignored.
+func ReadFile(path string) (map[string]bool, error) {
+	set := make(map[string]bool)
+
+	file, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return set, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		set[line] = true
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", path, err)
+	}
+
+	return set, nil
+}
+
+// AppendFile appends fingerprints to path, creating the file if needed.
+func AppendFile(path string, fingerprints []string) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+
+	for _, fp := range fingerprints {
+		_, err = fmt.Fprintln(file, fp)
+		if err != nil {
+			file.Close()
+			return err
+		}
+	}
+
+	return file.Close()
+}
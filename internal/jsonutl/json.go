@@ -1,21 +1,38 @@
 package jsonutl
 
 import (
+	"bytes"
 	"encoding/json"
-	"os"
+	"io"
 
+	"github.com/syslab-wm/art/internal/fileutl"
 	"github.com/syslab-wm/mu"
 )
 
+// Marshal returns the indented JSON encoding of data, exactly as Encode
+// writes it.
+func Marshal(data interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetIndent("", "    ")
+	if err := enc.Encode(data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Encode writes the indented JSON encoding of data to fileName.  The file is
+// replaced atomically, so a failed write never leaves a partial file behind.
 func Encode(fileName string, data interface{}) {
-	file, err := os.Create(fileName)
+	err := fileutl.Write(fileName, 0644, func(w io.Writer) error {
+		b, err := Marshal(data)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(b)
+		return err
+	})
 	if err != nil {
-		mu.Fatalf("error creating file: %v", err)
+		mu.Fatalf("error writing file: %v", err)
 	}
-
-	enc := json.NewEncoder(file)
-	enc.SetIndent("", "    ")
-	enc.Encode(data)
-
-	defer file.Close()
 }
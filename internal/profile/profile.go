@@ -0,0 +1,57 @@
+// Package profile writes pprof CPU and memory profiles of a command's run,
+// for measuring where the time goes (e.g., in PathNodeKeys and
+// DeriveStageKey) on large groups.
+package profile
+
+import (
+	"os"
+	"runtime"
+	"runtime/pprof"
+
+	"github.com/syslab-wm/mu"
+)
+
+// Start starts writing a CPU profile to cpuFile, and returns a function that
+// stops it and writes a heap profile to memFile.  An empty file name
+// disables that profile; if both are empty, Start does nothing, and the
+// returned function is a no-op.  The profiles of a run that fails are not
+// written.
+func Start(cpuFile, memFile string) (stop func()) {
+	var cpu *os.File
+	if cpuFile != "" {
+		var err error
+		cpu, err = os.Create(cpuFile)
+		if err != nil {
+			mu.Fatalf("error: can't create CPU profile: %v", err)
+		}
+		if err := pprof.StartCPUProfile(cpu); err != nil {
+			mu.Fatalf("error: can't start CPU profile: %v", err)
+		}
+	}
+
+	return func() {
+		if cpu != nil {
+			pprof.StopCPUProfile()
+			if err := cpu.Close(); err != nil {
+				mu.Fatalf("error: can't write CPU profile: %v", err)
+			}
+		}
+
+		if memFile != "" {
+			writeHeapProfile(memFile)
+		}
+	}
+}
+
+func writeHeapProfile(memFile string) {
+	f, err := os.Create(memFile)
+	if err != nil {
+		mu.Fatalf("error: can't create memory profile: %v", err)
+	}
+	defer f.Close()
+
+	runtime.GC() // up-to-date statistics
+	if err := pprof.WriteHeapProfile(f); err != nil {
+		mu.Fatalf("error: can't write memory profile: %v", err)
+	}
+}
@@ -0,0 +1,57 @@
+// Package watchdog bounds the running time of a command, so that a stuck
+// filesystem (e.g., a hung network mount) never hangs a processing run
+// indefinitely.
+package watchdog
+
+import (
+	"sync"
+	"time"
+
+	"github.com/syslab-wm/mu"
+)
+
+// A Watchdog exits the program if it is still reading its input after a
+// timeout.  Once the program starts writing its output, it disarms the
+// watchdog (see Disarm), so that the program is never stopped part way
+// through writing its files.
+type Watchdog struct {
+	timeout  time.Duration
+	deadline time.Time
+
+	mu       sync.Mutex
+	disarmed bool
+}
+
+// Start starts a watchdog that exits the program with an error if it has
+// not been disarmed after timeout.  A timeout of zero or less disables the
+// watchdog.
+func Start(timeout time.Duration) *Watchdog {
+	w := &Watchdog{timeout: timeout}
+	if timeout <= 0 {
+		return w
+	}
+
+	w.deadline = time.Now().Add(timeout)
+	time.AfterFunc(timeout, w.expire)
+	return w
+}
+
+func (w *Watchdog) expire() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.disarmed {
+		mu.Fatalf("error: timed out after %v", w.timeout)
+	}
+}
+
+// Disarm checks the deadline, exiting the program if it has passed, and
+// otherwise stops the watchdog.  Call it before the program's first write:
+// after Disarm returns, the watchdog never exits the program.
+func (w *Watchdog) Disarm() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.timeout > 0 && !time.Now().Before(w.deadline) {
+		mu.Fatalf("error: timed out after %v", w.timeout)
+	}
+	w.disarmed = true
+}
@@ -0,0 +1,54 @@
+package watchdog
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+// expireEnv makes the test binary run a watchdog that expires, for
+// TestExpire.
+const expireEnv = "WATCHDOG_TEST_EXPIRE"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(expireEnv) != "" {
+		Start(time.Millisecond)
+		time.Sleep(time.Second)
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+func TestDisarm(t *testing.T) {
+	tests := []struct {
+		name    string
+		timeout time.Duration
+	}{
+		{"disabled", 0},
+		{"negative", -time.Second},
+		{"before the deadline", 20 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := Start(tt.timeout)
+			w.Disarm()
+			// the test binary exits if the watchdog fires
+			time.Sleep(2 * tt.timeout)
+		})
+	}
+}
+
+func TestExpire(t *testing.T) {
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), expireEnv+"=1")
+	out, err := cmd.CombinedOutput()
+	if err == nil {
+		t.Fatal("the program did not exit with an error after the timeout")
+	}
+	if !strings.Contains(string(out), "timed out") {
+		t.Errorf("got output %q, want a timeout error", out)
+	}
+}
@@ -0,0 +1,104 @@
+package art
+
+import (
+	"container/list"
+	"crypto/ecdh"
+	"fmt"
+	"sync"
+)
+
+// KeyParser unmarshals PEM-encoded public EKs (X25519) and caches the
+// results in a size-bounded LRU, keyed by the PEM bytes.  It is useful when
+// processing many messages whose trees share most of their nodes.  A
+// KeyParser is safe for concurrent use.
+type KeyParser struct {
+	lock    sync.Mutex
+	size    int
+	lru     *list.List // front is most recently used
+	entries map[string]*list.Element
+}
+
+type keyParserEntry struct {
+	pem string
+	key *ecdh.PublicKey
+}
+
+// NewKeyParser returns a KeyParser that caches at most size keys.
+func NewKeyParser(size int) *KeyParser {
+	if size < 1 {
+		size = 1
+	}
+	return &KeyParser{
+		size:    size,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// UnmarshalPublicEKFromPEM is the caching version of the package-level
+// UnmarshalPublicEKFromPEM.  Failed parses are not cached.
+func (p *KeyParser) UnmarshalPublicEKFromPEM(pemData []byte) (*ecdh.PublicKey, error) {
+	p.lock.Lock()
+	if elem, ok := p.entries[string(pemData)]; ok {
+		p.lru.MoveToFront(elem)
+		key := elem.Value.(*keyParserEntry).key
+		p.lock.Unlock()
+		return key, nil
+	}
+	p.lock.Unlock()
+
+	key, err := UnmarshalPublicEKFromPEM(pemData)
+	if err != nil {
+		return nil, err
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if elem, ok := p.entries[string(pemData)]; ok {
+		// another goroutine parsed the same key in the meantime
+		p.lru.MoveToFront(elem)
+		return elem.Value.(*keyParserEntry).key, nil
+	}
+
+	entry := &keyParserEntry{pem: string(pemData), key: key}
+	p.entries[entry.pem] = p.lru.PushFront(entry)
+
+	if p.lru.Len() > p.size {
+		oldest := p.lru.Back()
+		p.lru.Remove(oldest)
+		delete(p.entries, oldest.Value.(*keyParserEntry).pem)
+	}
+
+	return key, nil
+}
+
+// Len returns the number of keys in the cache.
+func (p *KeyParser) Len() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.lru.Len()
+}
+
+// UnmarshalKeysToPublicTree is the caching version of the package-level
+// UnmarshalKeysToPublicTree.
+func (p *KeyParser) UnmarshalKeysToPublicTree(marshalledKeys [][]byte) (*PublicNode, error) {
+	return p.UnmarshalKeysToPublicTreeOrder(marshalledKeys, OrderLevel)
+}
+
+// UnmarshalKeysToPublicTreeOrder is the caching version of the package-level
+// UnmarshalKeysToPublicTreeOrder.
+func (p *KeyParser) UnmarshalKeysToPublicTreeOrder(marshalledKeys [][]byte,
+	order string) (*PublicNode, error) {
+
+	keys := make([]*ecdh.PublicKey, 0, len(marshalledKeys))
+	for _, pem := range marshalledKeys {
+		key, err := p.UnmarshalPublicEKFromPEM(pem)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal public EK: %v", err)
+		}
+		keys = append(keys, key)
+	}
+
+	return publicTreeFromKeys(keys, order)
+}
@@ -0,0 +1,109 @@
+package art
+
+import (
+	"bytes"
+	"testing"
+)
+
+// TestKeyParserLRU checks that the parser returns cached keys for repeated
+// PEM bytes, and evicts the least recently used key past its size.
+func TestKeyParserLRU(t *testing.T) {
+	sm := syntheticSetupMessage(t, 3)
+	pems := sm.EKeys // 3 distinct keys
+	p := NewKeyParser(2)
+
+	parse := func(i int) {
+		t.Helper()
+		key, err := p.UnmarshalPublicEKFromPEM(pems[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := UnmarshalPublicEKFromPEM(pems[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !key.Equal(want) {
+			t.Fatalf("key %d: the parser returned another key", i)
+		}
+	}
+	cached := func(i int) bool {
+		p.lock.Lock()
+		defer p.lock.Unlock()
+		_, ok := p.entries[string(pems[i])]
+		return ok
+	}
+
+	parse(0)
+	first, _ := p.UnmarshalPublicEKFromPEM(pems[0])
+	again, _ := p.UnmarshalPublicEKFromPEM(pems[0])
+	if first != again || p.Len() != 1 {
+		t.Fatalf("a repeated key was not a cache hit (%d keys cached)", p.Len())
+	}
+
+	parse(1)
+	parse(0) // key 1 is now the least recently used
+	parse(2)
+	if p.Len() != 2 {
+		t.Fatalf("the cache holds %d keys, want its size, 2", p.Len())
+	}
+	if !cached(0) || cached(1) || !cached(2) {
+		t.Errorf("cached keys 0, 1, 2: %v, %v, %v; want key 1 evicted", cached(0),
+			cached(1), cached(2))
+	}
+
+	if _, err := p.UnmarshalPublicEKFromPEM([]byte("not a key")); err == nil {
+		t.Error("the parser accepted a malformed key")
+	}
+	if p.Len() != 2 {
+		t.Errorf("a failed parse was cached")
+	}
+}
+
+// TestKeyParserTreeOrder checks that the parser decodes trees in either order
+// as the package-level UnmarshalKeysToPublicTreeOrder does.
+func TestKeyParserTreeOrder(t *testing.T) {
+	tree := syntheticSetupMessage(t, 5).GetPublicTree()
+	p := NewKeyParser(100)
+	for _, order := range []string{OrderLevel, OrderIn} {
+		keys, err := tree.MarshalKeysOrder(order)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := p.UnmarshalKeysToPublicTreeOrder(keys, order)
+		if err != nil {
+			t.Fatalf("order %s: %v", order, err)
+		}
+		if !bytes.Equal(decoded.Hash(), tree.Hash()) {
+			t.Errorf("order %s: the decoded tree differs", order)
+		}
+	}
+}
+
+// BenchmarkKeyParser parses messages that share a tree of 1023 nodes but for
+// their last leaf, cycling through 10k such messages, with and without a
+// KeyParser.
+func BenchmarkKeyParser(b *testing.B) {
+	const numMessages = 10000
+	sm := syntheticSetupMessage(b, 512)
+	leaves := syntheticSetupMessage(b, numMessages).EKeys
+	keys := make([][]byte, len(sm.TreeKeys))
+	copy(keys, sm.TreeKeys)
+
+	parsers := []struct {
+		name  string
+		parse func(keys [][]byte) (*PublicNode, error)
+	}{
+		{"uncached", UnmarshalKeysToPublicTree},
+		{"cached", NewKeyParser(2 * len(keys)).UnmarshalKeysToPublicTree},
+	}
+	for _, p := range parsers {
+		b.Run(p.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				keys[len(keys)-1] = leaves[i%numMessages]
+				if _, err := p.parse(keys); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
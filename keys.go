@@ -2,8 +2,12 @@ package art
 
 import (
 	"bytes"
+	"crypto"
 	"crypto/ecdh"
+	"crypto/ecdsa"
 	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/x509"
 	"encoding/pem"
 	"errors"
@@ -277,6 +281,18 @@ func WritePrivateEKToFile(key *ecdh.PrivateKey, path string, encoding KeyEncodin
 
 /* N.B., ed25519.PublicKey and ed25519.PrivateKey are just aliases for []byte * */
 
+var utf8BOM = []byte{0xef, 0xbb, 0xbf}
+
+// normalizePEM strips a leading UTF-8 byte order mark, converts CRLF (and
+// lone CR) line endings to LF, and trims surrounding whitespace, so that PEM
+// files written on Windows or by editors that add blank lines still decode.
+func normalizePEM(pemData []byte) []byte {
+	pemData = bytes.TrimPrefix(pemData, utf8BOM)
+	pemData = bytes.ReplaceAll(pemData, []byte("\r\n"), []byte("\n"))
+	pemData = bytes.ReplaceAll(pemData, []byte("\r"), []byte("\n"))
+	return append(bytes.TrimSpace(pemData), '\n')
+}
+
 /********************************************************************
  * Public Identity Key (IK) - ed25519
  ********************************************************************/
@@ -304,7 +320,7 @@ func UnmarshalPublicIKFromDER(derData []byte) (ed25519.PublicKey, error) {
 }
 
 func UnmarshalPublicIKFromPEM(pemData []byte) (ed25519.PublicKey, error) {
-	block, _ := pem.Decode(pemData)
+	block, _ := pem.Decode(normalizePEM(pemData))
 	if block == nil {
 		return nil, errors.New("PEM-decode failed")
 	}
@@ -337,12 +353,24 @@ func ReadPublicIKFromFile(path string, encoding KeyEncoding) (ed25519.PublicKey,
  * Private Identity Key (ik) - ed25519
  ********************************************************************/
 
+// UnmarshalPrivateIKFromRaw accepts both raw forms of an Ed25519 private
+// key: the 32-byte seed (RFC 8032) and the 64-byte expanded key (the seed
+// followed by the public key, as in crypto/ed25519).  Either way, the result
+// is the expanded key.
 func UnmarshalPrivateIKFromRaw(data []byte) (ed25519.PrivateKey, error) {
-	if len(data) != ed25519.PrivateKeySize {
-		return nil, errors.New("invalid ed25519 private key size")
+	switch len(data) {
+	case ed25519.SeedSize:
+		return ed25519.NewKeyFromSeed(data), nil
+	case ed25519.PrivateKeySize:
+		key := ed25519.NewKeyFromSeed(data[:ed25519.SeedSize])
+		if !bytes.Equal(key[ed25519.SeedSize:], data[ed25519.SeedSize:]) {
+			return nil, errors.New("invalid ed25519 private key: the public key does not match the seed")
+		}
+		return key, nil
+	default:
+		return nil, fmt.Errorf("invalid ed25519 private key size %d; expected %d (seed) or %d",
+			len(data), ed25519.SeedSize, ed25519.PrivateKeySize)
 	}
-	// TODO: what happens if raw is not an valid privatekey?
-	return ed25519.PrivateKey(data), nil
 }
 
 func UnmarshalPrivateIKFromDER(derData []byte) (ed25519.PrivateKey, error) {
@@ -360,7 +388,7 @@ func UnmarshalPrivateIKFromDER(derData []byte) (ed25519.PrivateKey, error) {
 }
 
 func UnmarshalPrivateIKFromPEM(pemData []byte) (ed25519.PrivateKey, error) {
-	block, _ := pem.Decode(pemData)
+	block, _ := pem.Decode(normalizePEM(pemData))
 	if block == nil {
 		return nil, errors.New("PEM-decode failed")
 	}
@@ -414,7 +442,7 @@ func UnmarshalPublicEKFromDER(derData []byte) (*ecdh.PublicKey, error) {
 }
 
 func UnmarshalPublicEKFromPEM(pemData []byte) (*ecdh.PublicKey, error) {
-	block, _ := pem.Decode(pemData)
+	block, _ := pem.Decode(normalizePEM(pemData))
 	if block == nil {
 		return nil, errors.New("PEM-decode failed")
 	}
@@ -444,6 +472,25 @@ func ReadPublicEKFromFile(path string, encoding KeyEncoding) (*ecdh.PublicKey, e
 	}
 }
 
+// CheckPublicEK returns an error if pk is not an X25519 key, or is one of
+// the low-order points, with which every DH yields zero whatever the private
+// key; any 32 bytes decode as an X25519 key, so decoding alone does not catch
+// these.
+func CheckPublicEK(pk *ecdh.PublicKey) error {
+	if pk.Curve() != ecdh.X25519() {
+		return errors.New("the key is not an X25519 key")
+	}
+
+	probe, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	if _, err := probe.ECDH(pk); err != nil {
+		return errors.New("the key is a low-order X25519 point")
+	}
+	return nil
+}
+
 /*******************************************************************
  * Private Ephemeral Key (ek, also called a setup key) - x25519
  ********************************************************************/
@@ -468,7 +515,7 @@ func UnmarshalPrivateEKFromDER(derData []byte) (*ecdh.PrivateKey, error) {
 }
 
 func UnmarshalPrivateEKFromPEM(pemData []byte) (*ecdh.PrivateKey, error) {
-	block, _ := pem.Decode(pemData)
+	block, _ := pem.Decode(normalizePEM(pemData))
 	if block == nil {
 		return nil, errors.New("PEM-decode failed")
 	}
@@ -497,6 +544,139 @@ func ReadPrivateEKFromFile(path string, encoding KeyEncoding) (*ecdh.PrivateKey,
 	}
 }
 
+/********************************************************************
+ * Signing keys - Ed25519 or ECDSA P-256
+ *
+ * An IK used only for signing (e.g., the initiator's key for signing the
+ * setup message) may also be an ECDSA P-256 key, for environments whose PKI
+ * only issues P-256 keys.  The signature algorithm follows from the key's
+ * type.  P-256 keys are accepted in the standard PKIX ("PUBLIC KEY"), PKCS #8
+ * ("PRIVATE KEY") and SEC 1 ("EC PRIVATE KEY") encodings.
+ ********************************************************************/
+
+const (
+	PublicKeyPEMTypeString    = "PUBLIC KEY"
+	PrivateKeyPEMTypeString   = "PRIVATE KEY"
+	ECPrivateKeyPEMTypeString = "EC PRIVATE KEY"
+)
+
+func checkSigningCurve(key *ecdsa.PublicKey) error {
+	if key.Curve != elliptic.P256() {
+		return fmt.Errorf("unsupported ECDSA curve %s (must be P-256)", key.Curve.Params().Name)
+	}
+	return nil
+}
+
+func UnmarshalVerifyingKeyFromDER(derData []byte) (crypto.PublicKey, error) {
+	tmp, err := x509.ParsePKIXPublicKey(derData)
+	if err != nil {
+		return nil, err
+	}
+
+	switch key := tmp.(type) {
+	case ed25519.PublicKey:
+		return key, nil
+	case *ecdsa.PublicKey:
+		if err := checkSigningCurve(key); err != nil {
+			return nil, err
+		}
+		return key, nil
+	default:
+		return nil, errors.New("result of DER-decode is not an Ed25519 or ECDSA public key")
+	}
+}
+
+func UnmarshalVerifyingKeyFromPEM(pemData []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(normalizePEM(pemData))
+	if block == nil {
+		return nil, errors.New("PEM-decode failed")
+	}
+	if block.Type != PublicIKPEMTypeString && block.Type != PublicKeyPEMTypeString {
+		return nil, fmt.Errorf("failed to PEM-decode public signing key: expected PEM type string %q or %q; got %q",
+			PublicIKPEMTypeString, PublicKeyPEMTypeString, block.Type)
+	}
+	return UnmarshalVerifyingKeyFromDER(block.Bytes)
+}
+
+func ReadVerifyingKeyFromFile(path string, encoding KeyEncoding) (crypto.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch encoding {
+	case EncodingRaw:
+		return UnmarshalPublicIKFromRaw(data)
+	case EncodingDER:
+		return UnmarshalVerifyingKeyFromDER(data)
+	case EncodingPEM:
+		return UnmarshalVerifyingKeyFromPEM(data)
+	default:
+		return nil, fmt.Errorf("cannot read public signing key from file: unrecognized encoding format %q", encoding)
+	}
+}
+
+func UnmarshalSigningKeyFromDER(derData []byte) (crypto.Signer, error) {
+	tmp, err := x509.ParsePKCS8PrivateKey(derData)
+	if err != nil {
+		return nil, err
+	}
+
+	switch key := tmp.(type) {
+	case ed25519.PrivateKey:
+		return key, nil
+	case *ecdsa.PrivateKey:
+		if err := checkSigningCurve(&key.PublicKey); err != nil {
+			return nil, err
+		}
+		return key, nil
+	default:
+		return nil, errors.New("result of DER-decode is not an Ed25519 or ECDSA private key")
+	}
+}
+
+func UnmarshalSigningKeyFromPEM(pemData []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(normalizePEM(pemData))
+	if block == nil {
+		return nil, errors.New("PEM-decode failed")
+	}
+
+	switch block.Type {
+	case PrivateIKPEMTypeString, PrivateKeyPEMTypeString:
+		return UnmarshalSigningKeyFromDER(block.Bytes)
+	case ECPrivateKeyPEMTypeString:
+		key, err := x509.ParseECPrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkSigningCurve(&key.PublicKey); err != nil {
+			return nil, err
+		}
+		return key, nil
+	default:
+		return nil, fmt.Errorf("failed to PEM-decode private signing key: unexpected PEM type string %q",
+			block.Type)
+	}
+}
+
+func ReadSigningKeyFromFile(path string, encoding KeyEncoding) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch encoding {
+	case EncodingRaw:
+		return UnmarshalPrivateIKFromRaw(data)
+	case EncodingDER:
+		return UnmarshalSigningKeyFromDER(data)
+	case EncodingPEM:
+		return UnmarshalSigningKeyFromPEM(data)
+	default:
+		return nil, fmt.Errorf("cannot read private signing key from file: unrecognized encoding format %q", encoding)
+	}
+}
+
 /*******************************************************************
  * Leaf Key and Node Keys - x25519
  *
@@ -507,3 +687,11 @@ func UnmarshalPrivateX25519FromRaw(data []byte) (*ecdh.PrivateKey, error) {
 	curve := ecdh.X25519()
 	return curve.NewPrivateKey(data)
 }
+
+// PublicOf returns the public key of a derived X25519 private key (a leaf,
+// path, or tree key).  All code that needs the public counterpart of such a
+// key should go through this function, so that, e.g., the public root is
+// computed identically everywhere.
+func PublicOf(key *ecdh.PrivateKey) *ecdh.PublicKey {
+	return key.PublicKey()
+}
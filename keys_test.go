@@ -0,0 +1,197 @@
+package art
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPublicOf(t *testing.T) {
+	tests := []struct {
+		name string
+		priv string
+		pub  string
+	}{
+		{"RFC 7748 Alice", rfc7748AlicePriv, rfc7748AlicePub},
+		{"RFC 7748 Bob", rfc7748BobPriv, rfc7748BobPub},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := hex.EncodeToString(PublicOf(hexPrivateKey(t, tt.priv)).Bytes())
+			if got != tt.pub {
+				t.Errorf("got %s, want %s", got, tt.pub)
+			}
+		})
+	}
+}
+
+// TestPublicOfTree checks that each node of a public tree holds PublicOf of
+// the private key of the node it was computed from, and in particular that
+// the public root is the public key of the tree secret.
+func TestPublicOfTree(t *testing.T) {
+	_, _, eks := testMembers(t, 5, testReader("public of tree"))
+	root, err := CreateTree(eks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	public := root.PublicKeys()
+	if !public.GetPk().Equal(PublicOf(root.GetSk())) {
+		t.Error("the public root is not the public key of the tree secret")
+	}
+
+	var check func(node *Node, pub *PublicNode)
+	check = func(node *Node, pub *PublicNode) {
+		if (node == nil) != (pub == nil) {
+			t.Fatal("the public tree's shape differs from the tree's")
+		}
+		if node == nil {
+			return
+		}
+		if !pub.GetPk().Equal(PublicOf(node.sk)) {
+			t.Errorf("the public key of the node at (%d, %d) is not PublicOf its "+
+				"private key", node.x, node.y)
+		}
+		check(node.left, pub.Left)
+		check(node.right, pub.Right)
+	}
+	check(root, public)
+}
+
+// TestPrivateIKForms checks that each form of an Ed25519 private key file
+// loads as the same key, which signs messages that verify with its public
+// key.
+func TestPrivateIKForms(t *testing.T) {
+	_, iks, _ := testMembers(t, 1, testReader("private ik forms"))
+	ik := iks[0]
+	der, err := MarshalPrivateIKToDER(ik)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pem, err := MarshalPrivateIKToPEM(ik)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		data     []byte
+		encoding KeyEncoding
+	}{
+		{"raw seed", ik.Seed(), EncodingRaw},
+		{"raw expanded key", ik, EncodingRaw},
+		{"PKCS #8 DER", der, EncodingDER},
+		{"PKCS #8 PEM", pem, EncodingPEM},
+	}
+
+	msg := []byte("message")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "ik")
+			if err := os.WriteFile(file, tt.data, 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			key, err := ReadPrivateIKFromFile(file, tt.encoding)
+			if err != nil {
+				t.Fatalf("ReadPrivateIKFromFile: %v", err)
+			}
+			if !key.Equal(ik) {
+				t.Error("ReadPrivateIKFromFile loaded another key")
+			}
+			signer, err := ReadSigningKeyFromFile(file, tt.encoding)
+			if err != nil {
+				t.Fatalf("ReadSigningKeyFromFile: %v", err)
+			}
+
+			for _, sk := range []ed25519.PrivateKey{key, signer.(ed25519.PrivateKey)} {
+				sig, err := Sign(sk, msg)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !Verify(ik.Public(), msg, sig) {
+					t.Error("the signature does not verify with the public key")
+				}
+			}
+		})
+	}
+
+	wrongPublic := append(ik.Seed(), iks[0].Public().(ed25519.PublicKey)...)
+	wrongPublic[len(wrongPublic)-1] ^= 1
+	for _, data := range [][]byte{wrongPublic, ik.Seed()[1:], append(ik, 0)} {
+		if _, err := UnmarshalPrivateIKFromRaw(data); err == nil {
+			t.Errorf("UnmarshalPrivateIKFromRaw accepted a %d-byte key", len(data))
+		}
+	}
+}
+
+// TestPEMLineEndings checks that PEM keys written with Windows line endings,
+// a byte order mark, or surrounding blank lines decode as the original keys.
+func TestPEMLineEndings(t *testing.T) {
+	r := testReader("pem line endings")
+	_, iks, eks := testMembers(t, 1, r)
+	ikPEM, err := MarshalPrivateIKToPEM(iks[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicIKPEM, err := MarshalPublicIKToPEM(iks[0].Public().(ed25519.PublicKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ekPEM, err := MarshalPrivateEKToPEM(eks[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicEKPEM, err := MarshalPublicEKToPEM(eks[0].PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	variants := []struct {
+		name string
+		fix  func([]byte) []byte
+	}{
+		{"LF", func(b []byte) []byte { return b }},
+		{"CRLF", func(b []byte) []byte {
+			return bytes.ReplaceAll(b, []byte("\n"), []byte("\r\n"))
+		}},
+		{"CR", func(b []byte) []byte {
+			return bytes.ReplaceAll(b, []byte("\n"), []byte("\r"))
+		}},
+		{"BOM and CRLF", func(b []byte) []byte {
+			return append([]byte("\xef\xbb\xbf"), bytes.ReplaceAll(b, []byte("\n"),
+				[]byte("\r\n"))...)
+		}},
+		{"blank lines", func(b []byte) []byte {
+			return append(append([]byte("\r\n\r\n"), b...), "\r\n\r\n"...)
+		}},
+	}
+
+	for _, v := range variants {
+		t.Run(v.name, func(t *testing.T) {
+			if key, err := UnmarshalPrivateIKFromPEM(v.fix(ikPEM)); err != nil {
+				t.Errorf("private IK: %v", err)
+			} else if !key.Equal(iks[0]) {
+				t.Error("private IK: decoded another key")
+			}
+			if key, err := UnmarshalPublicIKFromPEM(v.fix(publicIKPEM)); err != nil {
+				t.Errorf("public IK: %v", err)
+			} else if !key.Equal(iks[0].Public()) {
+				t.Error("public IK: decoded another key")
+			}
+			if key, err := UnmarshalPrivateEKFromPEM(v.fix(ekPEM)); err != nil {
+				t.Errorf("private EK: %v", err)
+			} else if !key.Equal(eks[0]) {
+				t.Error("private EK: decoded another key")
+			}
+			if key, err := UnmarshalPublicEKFromPEM(v.fix(publicEKPEM)); err != nil {
+				t.Errorf("public EK: %v", err)
+			} else if !key.Equal(eks[0].PublicKey()) {
+				t.Error("public EK: decoded another key")
+			}
+		})
+	}
+}
@@ -5,24 +5,54 @@ import (
 	"crypto/ecdh"
 	"crypto/ed25519"
 	"crypto/hmac"
+	"crypto/sha256"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 
+	"github.com/syslab-wm/art/internal/fileutl"
 	"github.com/syslab-wm/art/internal/jsonutl"
 	"github.com/syslab-wm/mu"
 )
 
+// A SetupMessage has an IKey and an EKey for each leaf of the tree, in leaf
+// order.  Both are empty for a blank leaf, which no member holds; a group
+// config with sparse INDEXes leaves such gaps.
 type SetupMessage struct {
 	IKeys    [][]byte `json:"iKeys"`
 	EKeys    [][]byte `json:"eKeys"`
 	Suk      []byte   `json:"suk"`
 	TreeKeys [][]byte `json:"treeKeys"`
+
+	// Suite is nil in setup messages from before suites were recorded; such
+	// messages use the default suite.
+	Suite *Suite `json:"suite,omitempty"`
+
+	// LeafMetadata, if not empty, annotates each member's leaf, in member
+	// order, with a human-readable string (e.g., a name or an email address)
+	// for tooling such as list_members.  It is signed along with the rest of
+	// the message, but is not an input of the stage key.
+	LeafMetadata []string `json:"leafMetadata,omitempty"`
+
+	// raw holds the bytes the message was decoded from, if any.
+	raw []byte
 }
 
+// Save writes the JSON encoding of the setup message to fileName, compressed
+// if fileName ends in .gz.
 func (sm *SetupMessage) Save(fileName string) {
-	jsonutl.Encode(fileName, sm)
+	data, err := jsonutl.Marshal(sm)
+	if err != nil {
+		mu.Fatalf("error encoding setup message: %v", err)
+	}
+
+	err = WriteMessageFile(fileName, data)
+	if err != nil {
+		mu.Fatalf("error writing file: %v", err)
+	}
 }
 
 // TODO: why is this part of the SetupMessage struct?
@@ -32,19 +62,32 @@ func (sm *SetupMessage) SaveSign(sigFile, msgFile, privIKFile string) {
 		mu.Fatalf("error signing message file: %v", err)
 	}
 
-	err = os.WriteFile(sigFile, sig, 0440)
+	err = fileutl.WriteFile(sigFile, sig, 0440)
 	if err != nil {
 		mu.Fatalf("can't write signature file: %v", err)
 	}
 
 }
 
+// Decode reads a setup message, in either the JSON or the binary encoding,
+// and possibly gzip-compressed, from file.
 func (sm *SetupMessage) Decode(file *os.File) {
-	dec := json.NewDecoder(file)
-	err := dec.Decode(&sm)
+	data, err := io.ReadAll(file)
+	if err != nil {
+		mu.Fatalf("error reading message from file: %v", err)
+	}
+
+	data, err = decompress(data)
+	if err != nil {
+		mu.Fatalf("error reading message from file: %v", err)
+	}
+
+	msg, err := DecodeSetupMessage(data)
 	if err != nil {
-		mu.Fatalf("error decoding message from file:", err)
+		mu.Fatalf("error decoding message from file: %v", err)
 	}
+	*sm = *msg
+	sm.raw = data
 }
 
 func (sm *SetupMessage) Read(msgFilePath string) {
@@ -57,6 +100,22 @@ func (sm *SetupMessage) Read(msgFilePath string) {
 	sm.Decode(msgFile)
 }
 
+// Hash returns the SHA-256 digest of the setup message's bytes: the
+// (decompressed) bytes it was decoded from, or, for a message created by
+// SetupGroup, the bytes that Save writes.  These are the bytes the
+// initiator's signature covers.
+func (sm *SetupMessage) Hash() [sha256.Size]byte {
+	if sm.raw != nil {
+		return sha256.Sum256(sm.raw)
+	}
+
+	data, err := jsonutl.Marshal(sm)
+	if err != nil {
+		mu.Fatalf("error encoding setup message: %v", err)
+	}
+	return sha256.Sum256(data)
+}
+
 func (sm *SetupMessage) GetSetupKey() *ecdh.PublicKey {
 	suk, err := UnmarshalPublicEKFromPEM(sm.Suk)
 	if err != nil {
@@ -65,8 +124,84 @@ func (sm *SetupMessage) GetSetupKey() *ecdh.PublicKey {
 	return suk
 }
 
+// SetSetupKeyFromFile replaces the setup message's SUK with the public key in
+// sukFile, for deployments where the SUK travels separately from the message
+// (e.g., with the prekey bundle).
+func (sm *SetupMessage) SetSetupKeyFromFile(sukFile string) error {
+	suk, err := ReadPublicEKFromFile(sukFile, EncodingPEM)
+	if err != nil {
+		return fmt.Errorf("can't read SUK file: %v", err)
+	}
+
+	sm.Suk, err = MarshalPublicEKToPEM(suk)
+	if err != nil {
+		return fmt.Errorf("failed to marshal public SUK: %v", err)
+	}
+	return nil
+}
+
+// CheckPrivateEK checks that the private ephemeral key in privEKFile is the
+// one the initiator used for the member at position index, i.e., that its
+// public key is EKeys[index-1].  Without this check, the wrong private EK
+// silently yields the wrong leaf key (and so the wrong stage key).
+func (sm *SetupMessage) CheckPrivateEK(index int, privEKFile string) error {
+	if index < 1 || index > len(sm.EKeys) {
+		return fmt.Errorf("index %d out of range [1, %d]", index, len(sm.EKeys))
+	}
+
+	ek, err := ReadPrivateEKFromFile(privEKFile, EncodingPEM)
+	if err != nil {
+		return fmt.Errorf("can't read private key file: %v", err)
+	}
+
+	return sm.checkEK(index, ek)
+}
+
+// checkEK is CheckPrivateEK for the private EK ek.
+func (sm *SetupMessage) checkEK(index int, ek *ecdh.PrivateKey) error {
+	if index < 1 || index > len(sm.EKeys) {
+		return fmt.Errorf("index %d out of range [1, %d]", index, len(sm.EKeys))
+	}
+
+	if sm.isBlank(index) {
+		return fmt.Errorf("the leaf at index %d is blank; no member holds it", index)
+	}
+	expected, err := UnmarshalPublicEKFromPEM(sm.EKeys[index-1])
+	if err != nil {
+		return fmt.Errorf("malformed EKey #%d: %v", index, err)
+	}
+
+	if !PublicOf(ek).Equal(expected) {
+		return fmt.Errorf("private EK does not match leaf at index %d", index)
+	}
+	return nil
+}
+
+// CheckLeafKey checks that leafKey is the leaf key of the member at position
+// index, i.e., that its public key is the member's leaf in the tree.  This
+// is the check for a leaf key supplied by the member (see
+// SetupOptions.LeafKeys) rather than derived from its EK.
+func (sm *SetupMessage) CheckLeafKey(index int, leafKey *ecdh.PrivateKey) error {
+	tree := sm.GetPublicTree()
+	if err := checkLeafIndex(tree, index); err != nil {
+		return err
+	}
+
+	if !tree.Leaves()[index-1].GetPk().Equal(PublicOf(leafKey)) {
+		return fmt.Errorf("the leaf key is not the key of the leaf at index %d", index)
+	}
+	return nil
+}
+
+// isBlank reports whether the leaf at position index, which must be in
+// range, is blank: no member holds it, so its EKey (and, in a valid message,
+// its IKey) is empty.
+func (sm *SetupMessage) isBlank(index int) bool {
+	return len(sm.EKeys[index-1]) == 0
+}
+
 func (sm *SetupMessage) GetPublicTree() *PublicNode {
-	tree, err := UnmarshalKeysToPublicTree(sm.TreeKeys)
+	tree, err := UnmarshalKeysToPublicTreeOrder(sm.TreeKeys, sm.GetSuite().Order)
 	if err != nil {
 		mu.Fatalf("error unmarshalling the public tree keys: %v", err)
 	}
@@ -85,42 +220,301 @@ func (sm *SetupMessage) DeriveStageKey(treeSecret *ecdh.PrivateKey) []byte {
 		mu.Fatalf("DeriveStageKey failed: %v", err)
 	}
 
-	return stageKey
+	// expanded, as in TreeState.DeriveStageKey
+	return ed25519.NewKeyFromSeed(stageKey)
+}
+
+// DeriveEpochSecret returns the epoch secret that goes with the stage key
+// DeriveStageKey derives from treeSecret, or nil if the message's suite does
+// not derive epoch secrets.
+func (sm *SetupMessage) DeriveEpochSecret(treeSecret *ecdh.PrivateKey) []byte {
+	if sm.GetSuite().KDF != KDFHKDFSHA256Epoch {
+		return nil
+	}
+
+	epochSecret, err := DeriveEpochSecret(&StageKeyInfo{
+		PrevStageKey:  make([]byte, StageKeySize),
+		TreeSecretKey: treeSecret.Bytes(),
+		IKeys:         sm.IKeys,
+		TreeKeys:      sm.TreeKeys,
+	})
+	if err != nil {
+		mu.Fatalf("DeriveEpochSecret failed: %v", err)
+	}
+	return epochSecret
+}
+
+// ValidationMode selects how thoroughly ValidateMode checks a setup message.
+type ValidationMode int
+
+const (
+	// ValidateFast makes a single O(N) pass over the message's keys.
+	ValidateFast ValidationMode = iota
+
+	// ValidateDeep also builds the public tree and cross-checks each
+	// member's path against it, which is O(N log N).
+	ValidateDeep
+)
+
+// Validate checks that the setup message is well-formed; it is the same as
+// ValidateMode(ValidateFast).
+func (sm *SetupMessage) Validate() error {
+	return sm.ValidateMode(ValidateFast)
+}
+
+// ValidateMode checks that the setup message is well-formed.  Rather than
+// stopping at the first problem, it reports every problem it finds, joined
+// into a single error.  The deep checks only run if the fast ones pass.
+func (sm *SetupMessage) ValidateMode(mode ValidationMode) error {
+	var errs []error
+
+	if err := sm.Suite.Check(); err != nil {
+		errs = append(errs, err)
+	}
+
+	n := len(sm.IKeys)
+	if n == 0 {
+		errs = append(errs, errors.New("setup message has no members (IKeys is empty)"))
+	}
+	if len(sm.EKeys) != n {
+		errs = append(errs, fmt.Errorf("setup message has %d IKeys but %d EKeys",
+			n, len(sm.EKeys)))
+	}
+
+	if len(sm.LeafMetadata) != 0 && len(sm.LeafMetadata) != n {
+		errs = append(errs, fmt.Errorf("setup message has %d IKeys but %d leaf "+
+			"metadata entries", n, len(sm.LeafMetadata)))
+	}
+
+	if len(sm.Suk) == 0 {
+		errs = append(errs, errors.New("setup message is missing the SUK"))
+	} else if _, err := UnmarshalPublicEKFromPEM(sm.Suk); err != nil {
+		errs = append(errs, fmt.Errorf("malformed SUK: %v", err))
+	}
+
+	numBlank := 0
+	for i := 1; i <= n && i <= len(sm.EKeys); i++ {
+		ikBlank, ekBlank := len(sm.IKeys[i-1]) == 0, len(sm.EKeys[i-1]) == 0
+		if ikBlank != ekBlank {
+			errs = append(errs, fmt.Errorf("leaf %d has an empty IKey or EKey, but not "+
+				"both, as a blank leaf has", i))
+		}
+		numBlank += mu.BoolToInt(ikBlank && ekBlank)
+	}
+	if n > 0 && numBlank == n {
+		errs = append(errs, errors.New("every leaf of the setup message is blank"))
+	}
+
+	zeroIK := make([]byte, ed25519.PublicKeySize)
+	seenIKs := make(map[string]int)
+	for i, pem := range sm.IKeys {
+		if len(pem) == 0 {
+			continue
+		}
+		key, err := UnmarshalPublicIKFromPEM(pem)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("malformed IKey #%d: %v", i+1, err))
+			continue
+		}
+		if bytes.Equal(key, zeroIK) {
+			errs = append(errs, fmt.Errorf("IKey #%d is the all-zero key", i+1))
+			continue
+		}
+		raw := string(key)
+		if j, ok := seenIKs[raw]; ok {
+			errs = append(errs, fmt.Errorf("IKeys #%d and #%d are identical", j, i+1))
+			continue
+		}
+		seenIKs[raw] = i + 1
+	}
+
+	for i, pem := range sm.EKeys {
+		if len(pem) == 0 {
+			continue
+		}
+		if _, err := UnmarshalPublicEKFromPEM(pem); err != nil {
+			errs = append(errs, fmt.Errorf("malformed EKey #%d: %v", i+1, err))
+		}
+	}
+
+	if len(sm.TreeKeys) == 0 {
+		errs = append(errs, errors.New("setup message contains no tree"))
+	} else if n > 0 && len(sm.TreeKeys) != 2*n-1 {
+		errs = append(errs, fmt.Errorf("setup message has %d tree keys; expected %d for %d members",
+			len(sm.TreeKeys), 2*n-1, n))
+	}
+
+	seen := make(map[string]int)
+	for i, pem := range sm.TreeKeys {
+		key, err := UnmarshalPublicEKFromPEM(pem)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("malformed tree key #%d: %v", i+1, err))
+			continue
+		}
+		raw := string(key.Bytes())
+		if j, ok := seen[raw]; ok {
+			errs = append(errs, fmt.Errorf("tree keys #%d and #%d are identical", j, i+1))
+			continue
+		}
+		seen[raw] = i + 1
+	}
+
+	if mode == ValidateDeep && len(errs) == 0 {
+		errs = append(errs, sm.crossCheck()...)
+	}
+
+	if len(errs) != 0 {
+		count(validationFailures)
+	}
+	return errors.Join(errs...)
+}
+
+// crossCheck checks the tree keys against the rest of the message: the tree
+// must be sound (see CheckShape), each member's direct path must end at the
+// member's own leaf, at the depth that a left-balanced tree puts it, and no
+// tree key may be a member's EK or the SUK (the leaf keys are derived from
+// them, never equal to them).  It assumes the fast checks have passed.
+func (sm *SetupMessage) crossCheck() []error {
+	var errs []error
+
+	tree := sm.GetPublicTree()
+	if err := tree.CheckShape(); err != nil {
+		return []error{fmt.Errorf("malformed public tree: %v", err)}
+	}
+	n := len(sm.IKeys)
+	leaves := tree.Leaves()
+	if len(leaves) != n {
+		return []error{fmt.Errorf("public tree has %d leaves; expected %d", len(leaves), n)}
+	}
+
+	depths := LeafDepths(n)
+	for i := 1; i <= n; i++ {
+		path := directPath(tree, i)
+		if path[len(path)-1] != leaves[i-1] {
+			errs = append(errs, fmt.Errorf("direct path of member %d does not end at its leaf", i))
+		}
+		if len(path)-1 != depths[i-1] {
+			errs = append(errs, fmt.Errorf("member %d is at depth %d; expected %d",
+				i, len(path)-1, depths[i-1]))
+		}
+	}
+
+	inputs := make(map[string]string)
+	inputs[string(sm.GetSetupKey().Bytes())] = "the SUK"
+	for i, pem := range sm.EKeys {
+		if len(pem) == 0 {
+			continue
+		}
+		key, _ := UnmarshalPublicEKFromPEM(pem)
+		inputs[string(key.Bytes())] = fmt.Sprintf("EKey #%d", i+1)
+	}
+	for i, node := range tree.levelOrder() {
+		if what, ok := inputs[string(node.GetPk().Bytes())]; ok {
+			errs = append(errs, fmt.Errorf("tree key #%d is %s", i+1, what))
+		}
+	}
+
+	return errs
+}
+
+// NewTreeState derives the tree state of the member at position index, whose
+// leaf key is leafKey, from the (already verified) setup message.
+func (sm *SetupMessage) NewTreeState(index int, leafKey *ecdh.PrivateKey) *TreeState {
+	var state TreeState
+
+	count(setupMessagesProcessed)
+
+	state.PublicTree = sm.GetPublicTree()
+	state.Lk = leafKey
+	state.IKeys = sm.IKeys
+	state.LeafMetadata = sm.LeafMetadata
+
+	treeSecret := state.DeriveTreeKey(index)
+	state.Sk = sm.DeriveStageKey(treeSecret)
+	state.EpochSecret = sm.DeriveEpochSecret(treeSecret)
+	state.extendTranscript(sm.transcriptBytes())
+	state.SetupMessageHash = sm.Hash()
+
+	return &state
+}
+
+// transcriptBytes returns the bytes of the setup message that are hashed into
+// the transcript: its binary encoding, which, unlike the JSON encoding, does
+// not depend on how the keys' PEM files were formatted.
+func (sm *SetupMessage) transcriptBytes() []byte {
+	data, err := sm.MarshalBinary()
+	if err != nil {
+		mu.Fatalf("error encoding setup message for the transcript: %v", err)
+	}
+	return data
 }
 
 type UpdateMessage struct {
 	Idx            int
 	PathPublicKeys [][]byte
+
+	// Epoch is the updater's epoch after the update (see TreeState.Epoch),
+	// or 0 in messages from before epochs were recorded.  It is not MAC'd:
+	// the MAC, under the stage key the update replaces, already fails for an
+	// update applied out of order.  The epoch lets an out-of-order or
+	// missing update be reported as such.
+	Epoch int `json:",omitempty"`
 }
 
 func (um *UpdateMessage) Save(fileName string) {
 	jsonutl.Encode(fileName, um)
 }
 
-func (um *UpdateMessage) SaveMac(sk ed25519.PrivateKey, macFile string) {
-	// converting the update message contents into a byte array
+// macBytes converts the update message contents into the byte array that is
+// MAC'd (and hashed into the transcript).
+func (um *UpdateMessage) macBytes() []byte {
 	bs := make([]byte, 4)
 	binary.LittleEndian.PutUint32(bs, uint32(um.Idx))
 	MACBytes := bytes.Join(um.PathPublicKeys, []byte(" "))
-	MACBytes = append(MACBytes, bs...)
+	return append(MACBytes, bs...)
+}
 
-	// creating the MAC
+// MAC returns the update message's MAC under the stage key sk, which is the
+// updater's stage key before the update.
+func (um *UpdateMessage) MAC(sk ed25519.PrivateKey) []byte {
 	mac := NewHMAC(sk)
-	mac.Write(MACBytes)
-	macData := mac.Sum(nil)
+	mac.Write(um.macBytes())
+	return mac.Sum(nil)
+}
 
-	err := os.WriteFile(macFile, macData, 0440)
+func (um *UpdateMessage) SaveMac(sk ed25519.PrivateKey, macFile string) {
+	err := fileutl.WriteFile(macFile, um.MAC(sk), 0440)
 	if err != nil {
 		mu.Fatalf("can't write MAC signature file: %v", err)
 	}
 }
 
 func (um *UpdateMessage) Decode(file *os.File) {
-	dec := json.NewDecoder(file)
-	err := dec.Decode(&um)
+	data, err := io.ReadAll(file)
 	if err != nil {
-		mu.Fatalf("error decoding message from file:", err)
+		mu.Fatalf("error reading message from file: %v", err)
 	}
+
+	msg, err := DecodeUpdateMessage(data)
+	if err != nil {
+		mu.Fatalf("error decoding message from file: %v", err)
+	}
+	*um = *msg
+}
+
+// DecodeUpdateMessage decodes a JSON-encoded, possibly gzip-compressed,
+// update message.
+func DecodeUpdateMessage(data []byte) (*UpdateMessage, error) {
+	data, err := decompress(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var um UpdateMessage
+	if err := json.Unmarshal(data, &um); err != nil {
+		return nil, err
+	}
+	return &um, nil
 }
 
 func (um *UpdateMessage) Read(msgFilePath string) {
@@ -135,24 +529,42 @@ func (um *UpdateMessage) Read(msgFilePath string) {
 
 func (um *UpdateMessage) verifyMAC(sk ed25519.PrivateKey, macFile string) (bool,
 	error) {
-	// convert the update message contents into a byte array
-	bs := make([]byte, 4)
-	binary.LittleEndian.PutUint32(bs, uint32(um.Idx))
-	MACBytes := bytes.Join(um.PathPublicKeys, []byte(" "))
-	MACBytes = append(MACBytes, bs...)
-
-	// create the MAC
-	mac := NewHMAC(sk)
-	mac.Write(MACBytes)
-	macData := mac.Sum(nil)
-
 	// get the expected MAC data from the MAC file
 	expectedMAC, err := os.ReadFile(macFile)
 	if err != nil {
 		return false, fmt.Errorf("can't read MAC signature file: %v", err)
 	}
 
-	return hmac.Equal(macData, expectedMAC), nil
+	return um.macValid(sk, expectedMAC), nil
+}
+
+// check checks that the update message fits the tree root: that it is for an
+// existing leaf, and has a well-formed key for each node on the leaf's path.
+func (um *UpdateMessage) check(root *PublicNode) error {
+	path, err := PathIndices(root, um.Idx)
+	if err != nil {
+		return err
+	}
+	if len(um.PathPublicKeys) != len(path) {
+		return fmt.Errorf("got %d path keys for leaf %d; expected %d",
+			len(um.PathPublicKeys), um.Idx, len(path))
+	}
+	for i, pem := range um.PathPublicKeys {
+		if _, err := UnmarshalPublicEKFromPEM(pem); err != nil {
+			return fmt.Errorf("malformed path key #%d: %v", i+1, err)
+		}
+	}
+	return nil
+}
+
+// macValid reports whether expectedMAC is the message's MAC under the stage
+// key sk.
+func (um *UpdateMessage) macValid(sk ed25519.PrivateKey, expectedMAC []byte) bool {
+	valid := hmac.Equal(um.MAC(sk), expectedMAC)
+	if !valid {
+		count(macFailures)
+	}
+	return valid
 }
 
 // verify the message signature with the current stage key
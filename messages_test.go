@@ -0,0 +1,264 @@
+package art
+
+import (
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"fmt"
+	"io"
+	"math/rand"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/syslab-wm/art/internal/jsonutl"
+)
+
+// syntheticSetupMessage returns a setup message for n members whose keys are
+// random, rather than derived from one another: it is well-formed, so it
+// passes validation, but cannot be processed.  It is far cheaper to make
+// than a real setup message, which takes a DH for each node of the tree.
+func syntheticSetupMessage(t testing.TB, n int) *SetupMessage {
+	t.Helper()
+	// testReader's HKDF stream is too short for large groups
+	r := rand.New(rand.NewSource(int64(n)))
+
+	// every 32-byte string is an X25519 public key
+	raw := make([]byte, 32)
+	ek := func() []byte {
+		if _, err := io.ReadFull(r, raw); err != nil {
+			t.Fatal(err)
+		}
+		key, err := ecdh.X25519().NewPublicKey(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pem, err := MarshalPublicEKToPEM(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pem
+	}
+
+	sm := &SetupMessage{Suite: DefaultSuite(), Suk: ek()}
+	for i := 0; i < n; i++ {
+		ik := make(ed25519.PublicKey, ed25519.PublicKeySize)
+		if _, err := io.ReadFull(r, ik); err != nil {
+			t.Fatal(err)
+		}
+		pem, err := MarshalPublicIKToPEM(ik)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sm.IKeys = append(sm.IKeys, pem)
+		sm.EKeys = append(sm.EKeys, ek())
+	}
+	for i := 0; i < 2*n-1; i++ {
+		sm.TreeKeys = append(sm.TreeKeys, ek())
+	}
+	return sm
+}
+
+func TestValidateMode(t *testing.T) {
+	const n = 5
+	tests := []struct {
+		name   string
+		tamper func(sm *SetupMessage)
+		fastOK bool
+		deepOK bool
+	}{
+		{"valid", func(sm *SetupMessage) {}, true, true},
+		{"tree key is an EK", func(sm *SetupMessage) { sm.TreeKeys[4] = sm.EKeys[2] },
+			true, false},
+		{"tree key is the SUK", func(sm *SetupMessage) { sm.TreeKeys[0] = sm.Suk },
+			true, false},
+		{"duplicate tree key", func(sm *SetupMessage) { sm.TreeKeys[1] = sm.TreeKeys[2] },
+			false, false},
+		{"missing EK", func(sm *SetupMessage) { sm.EKeys = sm.EKeys[1:] },
+			false, false},
+		{"blank leaf", func(sm *SetupMessage) { sm.IKeys[1], sm.EKeys[1] = nil, nil },
+			true, true},
+		{"empty IK of a non-blank leaf", func(sm *SetupMessage) { sm.IKeys[1] = nil },
+			false, false},
+		{"every leaf blank", func(sm *SetupMessage) {
+			for i := range sm.IKeys {
+				sm.IKeys[i], sm.EKeys[i] = nil, nil
+			}
+		}, false, false},
+		{"missing tree key", func(sm *SetupMessage) { sm.TreeKeys = sm.TreeKeys[1:] },
+			false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm := syntheticSetupMessage(t, n)
+			tt.tamper(sm)
+			if err := sm.ValidateMode(ValidateFast); (err == nil) != tt.fastOK {
+				t.Errorf("ValidateFast: got error %v, want success %v", err, tt.fastOK)
+			}
+			if err := sm.ValidateMode(ValidateDeep); (err == nil) != tt.deepOK {
+				t.Errorf("ValidateDeep: got error %v, want success %v", err, tt.deepOK)
+			}
+		})
+	}
+}
+
+// TestValidateDuplicateIKs checks that a setup message in which two members
+// have the same IK is rejected with an error that names both positions.
+func TestValidateDuplicateIKs(t *testing.T) {
+	sm := syntheticSetupMessage(t, 5)
+	sm.IKeys[3] = sm.IKeys[1]
+	err := sm.Validate()
+	if err == nil {
+		t.Fatal("setup message with duplicate IKs passed validation")
+	}
+	if want := "IKeys #2 and #4 are identical"; !strings.Contains(err.Error(), want) {
+		t.Errorf("got error %q, want it to contain %q", err, want)
+	}
+}
+
+// TestLeafMetadataSigned checks that the leaf metadata is covered by the
+// initiator's signature, but doesn't affect the stage key: changed metadata
+// fails the original signature, and, re-signed, yields the same stage key.
+func TestLeafMetadataSigned(t *testing.T) {
+	g := newTestGroup(t, "leaf metadata signed", 3, &SetupOptions{
+		LeafMetadata: map[string]string{"member1": "alice", "member2": "bob"}})
+	if want := []string{"alice", "bob", ""}; !slices.Equal(g.states[1].LeafMetadata, want) {
+		t.Fatalf("got metadata %q, want %q", g.states[1].LeafMetadata, want)
+	}
+
+	sm := *g.setupMsg
+	sm.LeafMetadata = []string{"alice", "mallory", ""}
+	msg, err := jsonutl.Marshal(&sm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ik := g.iks[0].Public()
+	if _, err := ProcessSetupMessageBytes(2, g.eks[1], msg, g.sig, ik); err == nil {
+		t.Fatal("changed metadata passed the original signature")
+	}
+
+	sig, err := Sign(g.iks[0], msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, err := ProcessSetupMessageBytes(2, g.eks[1], msg, sig, ik)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(state.LeafMetadata, sm.LeafMetadata) {
+		t.Errorf("got metadata %q, want %q", state.LeafMetadata, sm.LeafMetadata)
+	}
+	if !StageKeyEqual(state.Sk, g.states[1].Sk) {
+		t.Error("changing the metadata changed the stage key")
+	}
+}
+
+// TestSetSetupKeyFromFile checks that a member derives the same leaf key
+// from a SUK delivered separately from the setup message as from the SUK
+// embedded in it.
+func TestSetSetupKeyFromFile(t *testing.T) {
+	g := newTestGroup(t, "suk file", 3, nil)
+	dir := t.TempDir()
+	ekFile := filepath.Join(dir, "ek.pem")
+	if err := WritePrivateEKToFile(g.eks[1], ekFile, EncodingPEM); err != nil {
+		t.Fatal(err)
+	}
+	sukFile := filepath.Join(dir, "suk.pem")
+	if err := WritePublicEKToFile(g.setupMsg.GetSetupKey(), sukFile, EncodingPEM); err != nil {
+		t.Fatal(err)
+	}
+
+	want, err := DeriveLeafKey(ekFile, g.setupMsg.GetSetupKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sm := *g.setupMsg
+	sm.Suk = nil
+	if err := sm.Validate(); err == nil {
+		t.Fatal("setup message without a SUK passed validation")
+	}
+	if err := sm.SetSetupKeyFromFile(filepath.Join(dir, "missing.pem")); err == nil {
+		t.Fatal("missing SUK file accepted")
+	}
+	if err := sm.SetSetupKeyFromFile(sukFile); err != nil {
+		t.Fatal(err)
+	}
+	if err := sm.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := DeriveLeafKey(ekFile, sm.GetSetupKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Equal(want) {
+		t.Error("leaf key from the SUK file differs from the one from the message")
+	}
+	if !got.Equal(g.states[1].Lk) {
+		t.Error("leaf key from the SUK file isn't member 2's leaf key")
+	}
+}
+
+// validateBenchSizes are the numbers of members of the setup messages that
+// BenchmarkValidate validates; the largest has a tree of about a million
+// nodes.
+var validateBenchSizes = []int{1 << 10, 1 << 15, 1 << 19}
+
+func BenchmarkValidate(b *testing.B) {
+	for _, n := range validateBenchSizes {
+		sm := syntheticSetupMessage(b, n)
+		for _, mode := range []struct {
+			name string
+			mode ValidationMode
+		}{{"fast", ValidateFast}, {"deep", ValidateDeep}} {
+			b.Run(fmt.Sprintf("%s/nodes=%d", mode.name, 2*n-1), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					if err := sm.ValidateMode(mode.mode); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+// TestDecodeTrailingData checks that a JSON setup message and an update
+// message are rejected when anything follows the message.
+func TestDecodeTrailingData(t *testing.T) {
+	g := newTestGroup(t, "decode trailing data", 3, nil)
+	update, _ := g.makeUpdate(t, 2)
+
+	decoders := []struct {
+		name   string
+		msg    []byte
+		decode func(data []byte) error
+	}{
+		{"setup", g.msg, func(data []byte) error {
+			_, err := DecodeSetupMessage(data)
+			return err
+		}},
+		{"update", update, func(data []byte) error {
+			_, err := DecodeUpdateMessage(data)
+			return err
+		}},
+	}
+	for _, d := range decoders {
+		tests := []struct {
+			name string
+			data []byte
+			ok   bool
+		}{
+			{"message", d.msg, true},
+			{"trailing byte", append(slices.Clip(d.msg), 'x'), false},
+			{"second message", append(slices.Clip(d.msg), d.msg...), false},
+		}
+		for _, tt := range tests {
+			if err := d.decode(tt.data); (err == nil) != tt.ok {
+				t.Errorf("%s, %s: got error %v, want success %v", d.name, tt.name, err,
+					tt.ok)
+			}
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package art
+
+import "sync/atomic"
+
+// Metrics counts the library's operations, for servers that embed ART and
+// want to export the counts (e.g., to Prometheus).  Install a Metrics with
+// SetMetrics; the counters may be read at any time.  When no Metrics is
+// installed (the default), counting costs a single atomic load.
+type Metrics struct {
+	SetupMessagesProcessed atomic.Uint64
+	UpdatesProcessed       atomic.Uint64
+	DHOperations           atomic.Uint64
+	SignatureVerifications atomic.Uint64
+
+	// failures, by type
+	SignatureFailures  atomic.Uint64
+	MACFailures        atomic.Uint64
+	ValidationFailures atomic.Uint64
+}
+
+var metrics atomic.Pointer[Metrics]
+
+// SetMetrics installs m as the library's metrics, replacing any previous
+// Metrics; a nil m disables counting.
+func SetMetrics(m *Metrics) {
+	metrics.Store(m)
+}
+
+// count increments the counter selected by which, if metrics are enabled.
+func count(which func(m *Metrics) *atomic.Uint64) {
+	if m := metrics.Load(); m != nil {
+		which(m).Add(1)
+	}
+}
+
+func setupMessagesProcessed(m *Metrics) *atomic.Uint64 { return &m.SetupMessagesProcessed }
+func updatesProcessed(m *Metrics) *atomic.Uint64       { return &m.UpdatesProcessed }
+func dhOperations(m *Metrics) *atomic.Uint64           { return &m.DHOperations }
+func signatureVerifications(m *Metrics) *atomic.Uint64 { return &m.SignatureVerifications }
+func signatureFailures(m *Metrics) *atomic.Uint64      { return &m.SignatureFailures }
+func macFailures(m *Metrics) *atomic.Uint64            { return &m.MACFailures }
+func validationFailures(m *Metrics) *atomic.Uint64     { return &m.ValidationFailures }
@@ -0,0 +1,66 @@
+package art
+
+import (
+	"sync/atomic"
+	"testing"
+)
+
+// TestMetrics checks the counters after a known sequence of operations: a
+// setup message processed with a good and then a bad signature, an update
+// that two members process, an update with a bad MAC, and an invalid setup
+// message.
+func TestMetrics(t *testing.T) {
+	g := newTestGroup(t, "metrics", 3, nil)
+
+	var m Metrics
+	SetMetrics(&m)
+	defer SetMetrics(nil)
+
+	if _, err := ProcessSetupMessageBytes(2, g.eks[1], g.msg, g.sig, g.iks[0].Public()); err != nil {
+		t.Fatal(err)
+	}
+	badSig := append([]byte(nil), g.sig...)
+	badSig[0] ^= 1
+	if _, err := ProcessSetupMessageBytes(2, g.eks[1], g.msg, badSig,
+		g.iks[0].Public()); err == nil {
+		t.Fatal("ProcessSetupMessageBytes accepted a bad signature")
+	}
+
+	// the update with the bad MAC is never applied, so restore member 1's
+	// state after making it
+	saved := cloneState(t, g.states[0])
+	msg, mac := g.makeUpdate(t, 1)
+	g.states[0] = saved
+	mac[0] ^= 1
+	if err := ProcessUpdateMessageBytes(g.states[1], 2, msg, mac); err == nil {
+		t.Fatal("ProcessUpdateMessageBytes accepted a bad MAC")
+	}
+	g.update(t, 2)
+
+	invalid := *g.setupMsg
+	invalid.TreeKeys = nil
+	if err := invalid.Validate(); err == nil {
+		t.Fatal("setup message with no tree passed validation")
+	}
+
+	tests := []struct {
+		name    string
+		counter *atomic.Uint64
+		want    uint64
+	}{
+		{"SetupMessagesProcessed", &m.SetupMessagesProcessed, 1},
+		{"UpdatesProcessed", &m.UpdatesProcessed, 2},
+		{"SignatureVerifications", &m.SignatureVerifications, 2},
+		{"SignatureFailures", &m.SignatureFailures, 1},
+		{"MACFailures", &m.MACFailures, 1},
+		{"ValidationFailures", &m.ValidationFailures, 1},
+	}
+	for _, tt := range tests {
+		if got := tt.counter.Load(); got != tt.want {
+			t.Errorf("%s = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+	if m.DHOperations.Load() == 0 {
+		t.Error("DHOperations = 0, want the DHs of the setup and the updates")
+	}
+}
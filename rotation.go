@@ -0,0 +1,148 @@
+package art
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/syslab-wm/art/internal/fileutl"
+)
+
+// rotationLabel separates IK rotation signatures from the initiator's other
+// signatures, so that a rotation can't be passed off as a setup message or
+// vice versa.
+var rotationLabel = []byte("art ik rotation")
+
+// An IKRotation is a statement, signed by the initiator's old IK, that the
+// initiator's IK is now NewIK.  Members that trust the old IK follow a chain
+// of rotations, oldest first, to the initiator's current IK (see
+// FollowIKRotations).  The keys are DER-encoded (PKIX) Ed25519 or ECDSA
+// P-256 public keys.
+type IKRotation struct {
+	OldIK []byte `json:"oldIK"`
+	NewIK []byte `json:"newIK"`
+	Sig   []byte `json:"sig"`
+}
+
+// signedBytes returns the bytes the old IK signs: the label, and then each
+// key as a length-prefixed byte string.
+func (r *IKRotation) signedBytes() []byte {
+	var buf bytes.Buffer
+	buf.Write(rotationLabel)
+	putBytes(&buf, r.OldIK)
+	putBytes(&buf, r.NewIK)
+	return buf.Bytes()
+}
+
+// NewIKRotation returns the rotation from the IK oldSK to newPK, signed by
+// oldSK.
+func NewIKRotation(oldSK crypto.Signer, newPK crypto.PublicKey) (*IKRotation, error) {
+	var r IKRotation
+	var err error
+
+	if r.OldIK, err = x509.MarshalPKIXPublicKey(oldSK.Public()); err != nil {
+		return nil, fmt.Errorf("can't encode the old IK: %v", err)
+	}
+	if r.NewIK, err = x509.MarshalPKIXPublicKey(newPK); err != nil {
+		return nil, fmt.Errorf("can't encode the new IK: %v", err)
+	}
+	if bytes.Equal(r.OldIK, r.NewIK) {
+		return nil, errors.New("the new IK is the old IK")
+	}
+
+	if r.Sig, err = Sign(oldSK, r.signedBytes()); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// Verify checks that the rotation is from the IK trusted, and is signed by
+// it, and returns the new IK.
+func (r *IKRotation) Verify(trusted crypto.PublicKey) (crypto.PublicKey, error) {
+	der, err := x509.MarshalPKIXPublicKey(trusted)
+	if err != nil {
+		return nil, fmt.Errorf("can't encode the trusted IK: %v", err)
+	}
+	if !bytes.Equal(r.OldIK, der) {
+		return nil, errors.New("the rotation is not from the trusted IK")
+	}
+
+	if err := CheckSignatureFormat(trusted, r.Sig); err != nil {
+		return nil, err
+	}
+	count(signatureVerifications)
+	if !Verify(trusted, r.signedBytes(), r.Sig) {
+		count(signatureFailures)
+		return nil, errors.New("invalid rotation signature")
+	}
+
+	newIK, err := UnmarshalVerifyingKeyFromDER(r.NewIK)
+	if err != nil {
+		return nil, fmt.Errorf("malformed new IK: %v", err)
+	}
+	return newIK, nil
+}
+
+// FollowIKRotations verifies the chain of rotations, oldest first, from the
+// IK trusted, and returns the IK at the end of the chain.  Each rotation must
+// be from the IK the previous one rotated to.  The chain may start before
+// trusted: the rotations before the first one from trusted are skipped, and
+// if trusted is the chain's last IK, it is returned as is.
+func FollowIKRotations(trusted crypto.PublicKey, chain []*IKRotation) (crypto.PublicKey, error) {
+	der, err := x509.MarshalPKIXPublicKey(trusted)
+	if err != nil {
+		return nil, fmt.Errorf("can't encode the trusted IK: %v", err)
+	}
+
+	start := 0
+	for start < len(chain) && !bytes.Equal(chain[start].OldIK, der) {
+		start++
+	}
+	if start == len(chain) {
+		if len(chain) != 0 && bytes.Equal(chain[len(chain)-1].NewIK, der) {
+			return trusted, nil
+		}
+		return nil, errors.New("no rotation in the chain is from the trusted IK")
+	}
+
+	ik := trusted
+	for i := start; i < len(chain); i++ {
+		if ik, err = chain[i].Verify(ik); err != nil {
+			return nil, fmt.Errorf("rotation #%d: %v", i+1, err)
+		}
+	}
+	return ik, nil
+}
+
+// ReadIKRotationsFromFile reads a chain of rotations, as written by
+// WriteIKRotationsToFile.
+func ReadIKRotationsFromFile(path string) ([]*IKRotation, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var chain []*IKRotation
+	if err := json.Unmarshal(data, &chain); err != nil {
+		return nil, fmt.Errorf("can't decode IK rotations: %v", err)
+	}
+	return chain, nil
+}
+
+// WriteIKRotationsToFile writes a chain of rotations to path, as a JSON
+// array, oldest first.
+func WriteIKRotationsToFile(chain []*IKRotation, path string) error {
+	data, err := json.MarshalIndent(chain, "", "  ")
+	if err != nil {
+		return err
+	}
+	return fileutl.Write(path, 0644, func(w io.Writer) error {
+		_, err := w.Write(append(data, '\n'))
+		return err
+	})
+}
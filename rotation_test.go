@@ -0,0 +1,118 @@
+package art
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"testing"
+)
+
+// publicKeyEqual reports whether the identity keys a and b are equal.
+func publicKeyEqual(a, b crypto.PublicKey) bool {
+	key, ok := a.(interface{ Equal(crypto.PublicKey) bool })
+	return ok && key.Equal(b)
+}
+
+func TestIKRotation(t *testing.T) {
+	r := testReader("ik rotation")
+	_, iks, _ := testMembers(t, 3, r)
+	// ik1 rotates to ik2; ik3 is unrelated
+	ik1, ik2, ik3 := iks[0], iks[1], iks[2]
+
+	rotation, err := NewIKRotation(ik1, ik2.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	newIK, err := rotation.Verify(ik1.Public())
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if !publicKeyEqual(newIK, ik2.Public()) {
+		t.Error("Verify did not return the new IK")
+	}
+
+	if _, err := NewIKRotation(ik1, ik1.Public()); err == nil {
+		t.Error("NewIKRotation accepted a rotation to the old IK")
+	}
+
+	unrelated, err := NewIKRotation(ik3, ik2.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged := *unrelated
+	forged.OldIK = rotation.OldIK
+	swapped := *rotation
+	swapped.NewIK = unrelated.OldIK
+
+	tests := []struct {
+		name     string
+		rotation *IKRotation
+	}{
+		{"from an unrelated IK", unrelated},
+		{"signed by an unrelated IK", &forged},
+		{"new IK replaced", &swapped},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := tt.rotation.Verify(ik1.Public()); err == nil {
+				t.Error("Verify accepted the rotation")
+			}
+		})
+	}
+}
+
+func TestFollowIKRotations(t *testing.T) {
+	r := testReader("follow ik rotations")
+	_, iks, _ := testMembers(t, 4, r)
+	p256, err := ecdsa.GenerateKey(elliptic.P256(), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// iks[0] -> iks[1] -> the P-256 key -> iks[2]; iks[3] is unrelated
+	signers := []crypto.Signer{iks[0], iks[1], p256, iks[2]}
+	var chain []*IKRotation
+	for i := 1; i < len(signers); i++ {
+		rotation, err := NewIKRotation(signers[i-1], signers[i].Public())
+		if err != nil {
+			t.Fatal(err)
+		}
+		chain = append(chain, rotation)
+	}
+	last := iks[2].Public()
+
+	tests := []struct {
+		name    string
+		trusted crypto.PublicKey
+		chain   []*IKRotation
+		// want is the IK at the end of the chain, or nil for an error
+		want crypto.PublicKey
+	}{
+		{"whole chain", iks[0].Public(), chain, last},
+		{"skips the rotations before the trusted IK", iks[1].Public(), chain, last},
+		{"from the P-256 key", p256.Public(), chain, last},
+		{"trusted is the chain's last IK", last, chain, last},
+		{"unrelated IK", iks[3].Public(), chain, nil},
+		{"empty chain", iks[0].Public(), nil, nil},
+		{"missing rotation", iks[0].Public(), []*IKRotation{chain[0], chain[2]}, nil},
+		{"out of order", iks[0].Public(), []*IKRotation{chain[1], chain[0], chain[2]},
+			nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := FollowIKRotations(tt.trusted, tt.chain)
+			if tt.want == nil {
+				if err == nil {
+					t.Error("FollowIKRotations accepted the chain")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("FollowIKRotations: %v", err)
+			}
+			if !publicKeyEqual(got, tt.want) {
+				t.Error("FollowIKRotations did not return the chain's last IK")
+			}
+		})
+	}
+}
@@ -0,0 +1,158 @@
+package art
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+
+	"github.com/syslab-wm/art/internal/fileutl"
+	"golang.org/x/crypto/hkdf"
+)
+
+// sealLabel is the HKDF info of the keys that seal leaf keys, and prefixes
+// the associated data of the sealed keys.
+var sealLabel = []byte("art leaf seal")
+
+// A SealedLeafKey is a member's leaf key encrypted (with AES-256-GCM) under
+// a key derived from the member's private IK, so that a member that loses
+// its state, but not its IK, can recover the leaf key and rejoin the group
+// from a copy of the public tree.  The sealed key is bound to the member's
+// position: it only opens for the same Index.
+//
+// A sealed leaf key goes stale when the member updates its leaf key; the
+// other members' updates do not affect it.
+type SealedLeafKey struct {
+	Index      int    `json:"index"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// sealAEAD returns the AEAD keyed by HKDF-SHA256 of the private IK ik (the
+// Ed25519 seed, or the ECDSA P-256 scalar).
+func sealAEAD(ik crypto.Signer) (cipher.AEAD, error) {
+	var secret []byte
+	switch key := ik.(type) {
+	case ed25519.PrivateKey:
+		secret = key.Seed()
+	case *ecdsa.PrivateKey:
+		secret = key.D.FillBytes(make([]byte, 32))
+	default:
+		return nil, fmt.Errorf("unsupported identity key type %T", ik)
+	}
+
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, nil, sealLabel), key); err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// checkSealIndex checks that index is a member's position that fits the
+// associated data of a sealed key.
+func checkSealIndex(index int) error {
+	if index < 1 || uint64(index) > math.MaxUint32 {
+		return fmt.Errorf("invalid member index %d", index)
+	}
+	return nil
+}
+
+// additionalData returns the associated data of the sealed key: the label,
+// and the member's index as a 4-byte big-endian integer.  The index must
+// have passed checkSealIndex.
+func (s *SealedLeafKey) additionalData() []byte {
+	var buf bytes.Buffer
+	buf.Write(sealLabel)
+	binary.Write(&buf, binary.BigEndian, uint32(s.Index))
+	return buf.Bytes()
+}
+
+// SealLeafKey seals the leaf key of the member at position index under the
+// member's private IK ik.
+func SealLeafKey(ik crypto.Signer, index int, leafKey *ecdh.PrivateKey) (*SealedLeafKey,
+	error) {
+
+	if err := checkSealIndex(index); err != nil {
+		return nil, err
+	}
+	aead, err := sealAEAD(ik)
+	if err != nil {
+		return nil, err
+	}
+
+	s := SealedLeafKey{Index: index, Nonce: make([]byte, aead.NonceSize())}
+	if _, err := rand.Read(s.Nonce); err != nil {
+		return nil, err
+	}
+	s.Ciphertext = aead.Seal(nil, s.Nonce, leafKey.Bytes(), s.additionalData())
+	return &s, nil
+}
+
+// Open decrypts the sealed leaf key with the member's private IK ik.  It
+// fails if ik is not the IK the key was sealed under, or if the sealed key
+// was tampered with.
+func (s *SealedLeafKey) Open(ik crypto.Signer) (*ecdh.PrivateKey, error) {
+	if err := checkSealIndex(s.Index); err != nil {
+		return nil, err
+	}
+	aead, err := sealAEAD(ik)
+	if err != nil {
+		return nil, err
+	}
+	if len(s.Nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("the sealed leaf key's nonce is %d bytes, not %d",
+			len(s.Nonce), aead.NonceSize())
+	}
+
+	raw, err := aead.Open(nil, s.Nonce, s.Ciphertext, s.additionalData())
+	if err != nil {
+		return nil, errors.New("can't open the sealed leaf key: wrong IK, or the " +
+			"sealed key is corrupt")
+	}
+	return UnmarshalPrivateX25519FromRaw(raw)
+}
+
+// ReadSealedLeafKeyFromFile reads a sealed leaf key, as written by
+// WriteSealedLeafKeyToFile.
+func ReadSealedLeafKeyFromFile(path string) (*SealedLeafKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var s SealedLeafKey
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("can't decode sealed leaf key: %v", err)
+	}
+	return &s, nil
+}
+
+// WriteSealedLeafKeyToFile writes the sealed leaf key to path, as JSON.
+func WriteSealedLeafKeyToFile(s *SealedLeafKey, path string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return fileutl.Write(path, 0600, func(w io.Writer) error {
+		_, err := w.Write(append(data, '\n'))
+		return err
+	})
+}
@@ -0,0 +1,56 @@
+package art
+
+import (
+	"testing"
+)
+
+func TestSealLeafKey(t *testing.T) {
+	_, iks, eks := testMembers(t, 2, testReader("seal leaf key"))
+	leafKey := eks[0]
+
+	sealed, err := SealLeafKey(iks[0], 3, leafKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opened, err := sealed.Open(iks[0])
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if !opened.Equal(leafKey) {
+		t.Error("the opened leaf key is not the sealed one")
+	}
+
+	tests := []struct {
+		name   string
+		tamper func(s *SealedLeafKey)
+	}{
+		{"index", func(s *SealedLeafKey) { s.Index = 4 }},
+		{"index 0", func(s *SealedLeafKey) { s.Index = 0 }},
+		{"negative index", func(s *SealedLeafKey) { s.Index = -3 }},
+		{"nonce", func(s *SealedLeafKey) { s.Nonce = flipBit(s.Nonce, 0) }},
+		{"ciphertext", func(s *SealedLeafKey) { s.Ciphertext = flipBit(s.Ciphertext, 0) }},
+		{"truncated nonce", func(s *SealedLeafKey) { s.Nonce = s.Nonce[1:] }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tampered := *sealed
+			tt.tamper(&tampered)
+			if _, err := tampered.Open(iks[0]); err == nil {
+				t.Error("Open accepted the tampered sealed key")
+			}
+		})
+	}
+
+	if _, err := sealed.Open(iks[1]); err == nil {
+		t.Error("Open accepted another member's IK")
+	}
+}
+
+func TestSealLeafKeyInvalidIndex(t *testing.T) {
+	_, iks, eks := testMembers(t, 1, testReader("seal leaf key index"))
+	for _, index := range []int{0, -1, -1 << 32} {
+		if _, err := SealLeafKey(iks[0], index, eks[0]); err == nil {
+			t.Errorf("SealLeafKey accepted index %d", index)
+		}
+	}
+}
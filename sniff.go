@@ -0,0 +1,130 @@
+package art
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"strings"
+)
+
+// A FileKind is the kind of a file the tools read, as guessed from its
+// contents by SniffFile.
+type FileKind int
+
+const (
+	FileUnknown FileKind = iota
+	FilePEMKey
+	FileSetupMessage
+	FileUpdateMessage
+	FileTreeState
+	FileCopathMessage
+	FileSignature
+)
+
+func (kind FileKind) String() string {
+	switch kind {
+	case FilePEMKey:
+		return "PEM key"
+	case FileSetupMessage:
+		return "setup message"
+	case FileUpdateMessage:
+		return "update message"
+	case FileTreeState:
+		return "tree state"
+	case FileCopathMessage:
+		return "copath message"
+	case FileSignature:
+		return "signature"
+	default:
+		return "unknown"
+	}
+}
+
+// jsonKinds maps a field that only one kind of JSON file has to that kind.
+var jsonKinds = map[string]FileKind{
+	"treeKeys":       FileSetupMessage,
+	"PathPublicKeys": FileUpdateMessage,
+	"publicTree":     FileTreeState,
+	"copath":         FileCopathMessage,
+}
+
+// SniffData guesses the kind of file whose contents are data.  It only looks
+// at the file's outline, and does not check that the file is well-formed.
+func SniffData(data []byte) FileKind {
+	if bytes.HasPrefix(data, setupMessageMagic) {
+		return FileSetupMessage
+	}
+
+	if block, _ := pem.Decode(normalizePEM(data)); block != nil {
+		return FilePEMKey
+	}
+
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(data, &fields) == nil {
+		for field, kind := range jsonKinds {
+			if _, ok := fields[field]; ok {
+				return kind
+			}
+		}
+	}
+
+	return FileUnknown
+}
+
+// SniffFile guesses the kind of the file at path (see SniffData).  A
+// signature is raw bytes, which SniffData can't tell from any other binary
+// data, so a file of unknown contents whose name ends in .sig is taken to be
+// a signature.
+func SniffFile(path string) (FileKind, error) {
+	data, err := ReadMessageFile(path)
+	if err != nil {
+		return FileUnknown, err
+	}
+	kind := SniffData(data)
+	if kind == FileUnknown && strings.HasSuffix(path, ".sig") {
+		kind = FileSignature
+	}
+	return kind, nil
+}
+
+// An ArgKindError is returned by CheckArgKinds for a positional argument that
+// looks like another kind of file than the expected one.
+type ArgKindError struct {
+	Arg  int    // the argument's position, starting at 1
+	Path string // the argument
+	Got  FileKind
+	Want FileKind
+}
+
+func (e *ArgKindError) Error() string {
+	return fmt.Sprintf("argument %d looks like %s file but %s was expected", e.Arg,
+		withArticle(e.Got.String()), withArticle(e.Want.String()))
+}
+
+// CheckArgKinds checks that each positional argument args[i] is a file of
+// kind kinds[i] (FileUnknown means any file, and so skips the check).  It
+// returns an error if an argument looks like a known kind of file other than
+// the expected one, e.g., because the user swapped two arguments.  Files that
+// can't be read or whose kind is unknown pass, and are left for the normal
+// error handling.  The error is an *ArgKindError.
+func CheckArgKinds(args []string, kinds ...FileKind) error {
+	for i, want := range kinds {
+		if i >= len(args) || want == FileUnknown {
+			continue
+		}
+		kind, err := SniffFile(args[i])
+		if err != nil || kind == FileUnknown || kind == want {
+			continue
+		}
+		return &ArgKindError{Arg: i + 1, Path: args[i], Got: kind, Want: want}
+	}
+	return nil
+}
+
+func withArticle(noun string) string {
+	if strings.ContainsRune("aeiou", rune(noun[0])) {
+		return "an " + noun
+	}
+	return "a " + noun
+}
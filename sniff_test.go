@@ -0,0 +1,117 @@
+package art
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestCheckArgKinds passes each kind of file the tools read as an argument
+// that expects another kind, as if the user swapped two arguments.
+func TestCheckArgKinds(t *testing.T) {
+	g := newTestGroup(t, "check arg kinds", 3, nil)
+	update, _ := g.makeUpdate(t, 2)
+	binary, err := g.setupMsg.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	file := func(name string) string { return filepath.Join(dir, name) }
+	for name, data := range map[string][]byte{
+		"setup.json":     g.msg,
+		"setup.json.sig": g.sig,
+		"setup.bin":      binary,
+		"update.msg":     update,
+		"notes.txt":      []byte("not a file the tools read"),
+	} {
+		if err := os.WriteFile(file(name), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, data := range map[string][]byte{"setup.json.gz": g.msg, "update.msg.gz": update} {
+		if err := WriteMessageFile(file(name), data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = WritePublicIKToFile(g.iks[0].Public().(ed25519.PublicKey), file("ik.pem"),
+		EncodingPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveTreeState(file("state.json"), g.states[1]); err != nil {
+		t.Fatal(err)
+	}
+
+	setupArgs := []FileKind{FileUnknown, FilePEMKey, FilePEMKey, FileSetupMessage}
+	updateArgs := []FileKind{FileUnknown, FilePEMKey, FileTreeState, FileUpdateMessage}
+	tests := []struct {
+		name  string
+		args  []string
+		kinds []FileKind
+		err   *ArgKindError // nil if the arguments pass
+	}{
+		{"setup arguments", []string{"2", "ik.pem", "ik.pem", "setup.json"}, setupArgs, nil},
+		{"binary setup message", []string{"2", "ik.pem", "ik.pem", "setup.bin"}, setupArgs,
+			nil},
+		{"gzipped setup message", []string{"2", "ik.pem", "ik.pem", "setup.json.gz"},
+			setupArgs, nil},
+		{"update arguments", []string{"2", "ik.pem", "state.json", "update.msg"},
+			updateArgs, nil},
+		{"unknown kind", []string{"2", "notes.txt", "ik.pem", "setup.json"}, setupArgs, nil},
+		{"missing file", []string{"2", "missing.pem", "ik.pem", "setup.json"}, setupArgs,
+			nil},
+		{"too few arguments", []string{"2", "ik.pem"}, setupArgs, nil},
+
+		{"JSON setup message for a key", []string{"2", "setup.json", "ik.pem", "setup.json"},
+			setupArgs, &ArgKindError{2, "setup.json", FileSetupMessage, FilePEMKey}},
+		{"binary setup message for a key", []string{"2", "ik.pem", "setup.bin", "setup.json"},
+			setupArgs, &ArgKindError{3, "setup.bin", FileSetupMessage, FilePEMKey}},
+		{"key for a setup message", []string{"2", "ik.pem", "ik.pem", "ik.pem"}, setupArgs,
+			&ArgKindError{4, "ik.pem", FilePEMKey, FileSetupMessage}},
+		{"signature for a setup message",
+			[]string{"2", "ik.pem", "ik.pem", "setup.json.sig"}, setupArgs,
+			&ArgKindError{4, "setup.json.sig", FileSignature, FileSetupMessage}},
+		{"signature for a key", []string{"2", "setup.json.sig", "ik.pem", "setup.json"},
+			setupArgs, &ArgKindError{2, "setup.json.sig", FileSignature, FilePEMKey}},
+		{"gzipped setup message for an update message",
+			[]string{"2", "ik.pem", "state.json", "setup.json.gz"}, updateArgs,
+			&ArgKindError{4, "setup.json.gz", FileSetupMessage, FileUpdateMessage}},
+		{"gzipped update message for a tree state",
+			[]string{"2", "ik.pem", "update.msg.gz", "update.msg"}, updateArgs,
+			&ArgKindError{3, "update.msg.gz", FileUpdateMessage, FileTreeState}},
+		{"state and update message swapped",
+			[]string{"2", "ik.pem", "update.msg", "state.json"}, updateArgs,
+			&ArgKindError{3, "update.msg", FileUpdateMessage, FileTreeState}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := make([]string, len(tt.args))
+			for i, arg := range tt.args {
+				args[i] = arg
+				if i > 0 {
+					args[i] = file(arg)
+				}
+			}
+
+			err := CheckArgKinds(args, tt.kinds...)
+			if tt.err == nil {
+				if err != nil {
+					t.Errorf("got error %v, want success", err)
+				}
+				return
+			}
+			var kindErr *ArgKindError
+			if !errors.As(err, &kindErr) {
+				t.Fatalf("got error %v, want an *ArgKindError", err)
+			}
+			want := *tt.err
+			want.Path = file(want.Path)
+			if *kindErr != want {
+				t.Errorf("got error %+v, want %+v", *kindErr, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package art
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// ErrStateMAC is returned when loading a tree state whose MAC does not
+// verify.
+var ErrStateMAC = errors.New("the state's MAC does not verify; the state file was " +
+	"corrupted or tampered with")
+
+// minStateMACKeySize is the size of the shortest state MAC key.
+const minStateMACKeySize = 16
+
+// CheckStateMACKey checks that key is long enough to be the key of a state's
+// MAC (see TreeState.MACKey).
+func CheckStateMACKey(key []byte) error {
+	if len(key) < minStateMACKeySize {
+		return fmt.Errorf("the state MAC key is %d bytes; it must be at least %d",
+			len(key), minStateMACKeySize)
+	}
+	return nil
+}
+
+// ReadStateMACKeyFile returns the state MAC key in keyFile: the file's
+// contents, which must be at least 16 bytes.
+func ReadStateMACKeyFile(keyFile string) ([]byte, error) {
+	key, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	if err := CheckStateMACKey(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// mac returns the MAC of the serialized state, which covers every field but
+// the MAC itself.
+func (tree *treeJson) mac(key []byte) ([]byte, error) {
+	unsigned := *tree
+	unsigned.MAC = nil
+
+	data, err := json.Marshal(&unsigned)
+	if err != nil {
+		return nil, err
+	}
+
+	mac := NewHMAC(key)
+	mac.Write(data)
+	return mac.Sum(nil), nil
+}
+
+// checkMAC verifies the state's MAC with key, unless key is nil.
+func (tree *treeJson) checkMAC(key []byte) error {
+	if key == nil {
+		return nil
+	}
+	if len(tree.MAC) == 0 {
+		return errors.New("the state has no MAC")
+	}
+
+	want, err := tree.mac(key)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(tree.MAC, want) {
+		return ErrStateMAC
+	}
+	return nil
+}
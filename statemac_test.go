@@ -0,0 +1,100 @@
+package art
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+var testStateMACKey = []byte("0123456789abcdef0123456789abcdef")
+
+// macedState returns the encoding of a member's state, MAC'd with
+// testStateMACKey.
+func macedState(t *testing.T) []byte {
+	t.Helper()
+	g := newTestGroup(t, "state mac", 3, nil)
+	state := *g.states[1]
+	state.MACKey = testStateMACKey
+
+	var buf bytes.Buffer
+	if err := WriteTreeState(&buf, &state); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestStateMAC(t *testing.T) {
+	data := macedState(t)
+
+	state, err := ReadTreeStateWithMAC(bytes.NewReader(data), testStateMACKey)
+	if err != nil {
+		t.Fatalf("ReadTreeStateWithMAC: %v", err)
+	}
+	if !bytes.Equal(state.MACKey, testStateMACKey) {
+		t.Error("the loaded state does not keep its MAC key")
+	}
+	if _, err := ReadTreeState(bytes.NewReader(data)); err != nil {
+		t.Errorf("ReadTreeState without a MAC key: %v", err)
+	}
+
+	otherKey := bytes.Repeat([]byte{1}, minStateMACKeySize)
+	if _, err := ReadTreeStateWithMAC(bytes.NewReader(data), otherKey); !errors.Is(err,
+		ErrStateMAC) {
+		t.Errorf("ReadTreeStateWithMAC with the wrong key: got %v, want ErrStateMAC", err)
+	}
+}
+
+func TestStateMACTampered(t *testing.T) {
+	data := macedState(t)
+
+	// each case flips the lowest bit of the byte that follows prefix, which
+	// keeps the state well-formed
+	tests := []struct {
+		name   string
+		prefix string
+	}{
+		{"version", `"version": `},
+		{"tree key", `"publicTree": [` + "\n" + `        "L`},
+		{"IK", `"iKeys": [` + "\n" + `        "L`},
+		{"leaf key", `"lk": "L`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			i := bytes.Index(data, []byte(tt.prefix))
+			if i < 0 {
+				t.Fatalf("the state has no %q", tt.prefix)
+			}
+			tampered := bytes.Clone(data)
+			tampered[i+len(tt.prefix)] ^= 1
+
+			_, err := ReadTreeStateWithMAC(bytes.NewReader(tampered), testStateMACKey)
+			if !errors.Is(err, ErrStateMAC) {
+				t.Errorf("got error %v, want ErrStateMAC", err)
+			}
+		})
+	}
+}
+
+func TestStateMACMissing(t *testing.T) {
+	g := newTestGroup(t, "state mac", 3, nil)
+	var buf bytes.Buffer
+	if err := WriteTreeState(&buf, g.states[1]); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ReadTreeStateWithMAC(&buf, testStateMACKey); err == nil {
+		t.Error("ReadTreeStateWithMAC accepted a state without a MAC")
+	}
+}
+
+func TestStateMACKeyTooShort(t *testing.T) {
+	g := newTestGroup(t, "state mac", 3, nil)
+	state := *g.states[1]
+	state.MACKey = testStateMACKey[:minStateMACKeySize-1]
+
+	var buf bytes.Buffer
+	if err := WriteTreeState(&buf, &state); err == nil {
+		t.Error("WriteTreeState accepted a MAC key that is too short")
+	}
+}
@@ -0,0 +1,147 @@
+package art
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+)
+
+// A Suite names the algorithms a group uses, so that a member whose build
+// lacks one of them can fail with a clear error rather than deriving the
+// wrong keys.
+type Suite struct {
+	// Curve is the curve of the EKs, the SUK and the tree's keys.
+	Curve string `json:"curve"`
+	// Signature is the scheme the initiator signed the setup message with.
+	Signature string `json:"signature"`
+	// KDF is the key derivation function for the stage key.
+	KDF string `json:"kdf"`
+	// Combine is how a node's key is derived from its children's keys (see
+	// CombineKeys).  It is empty in messages from before it was recorded,
+	// which combine keys with CombineDH.
+	Combine string `json:"combine,omitempty"`
+	// Order is the order of the tree's keys in the setup message (see
+	// PublicNode.MarshalKeysOrder).  It is empty in messages from before it
+	// was recorded, which list the keys in OrderLevel.
+	Order string `json:"order,omitempty"`
+}
+
+const (
+	CurveX25519 = "X25519"
+
+	SignatureEd25519   = "Ed25519"
+	SignatureECDSAP256 = "ECDSA-P256-SHA256"
+
+	KDFHKDFSHA256 = "HKDF-SHA256"
+	// KDFHKDFSHA256Epoch is HKDF-SHA256 with an epoch secret: along with
+	// each stage key, a second HKDF output (see DeriveEpochSecret) takes the
+	// place of the stage key as the input to the next one, so that the stage
+	// key, which the application uses, never feeds the key schedule.
+	KDFHKDFSHA256Epoch = "HKDF-SHA256-epoch"
+
+	// CombineDH takes the X25519 shared secret of a node's children, as is,
+	// as the node's private key.
+	CombineDH = "DH"
+
+	// OrderLevel lists the tree's keys level by level, starting at the root,
+	// and each level from left to right.  A key's position in this order is
+	// its node's index (see PathIndices).
+	OrderLevel = "level"
+	// OrderIn lists the tree's keys in order: each node's left subtree, then
+	// the node, then its right subtree.  The leaves are at the even
+	// positions.
+	OrderIn = "in"
+)
+
+// DefaultSuite returns the suite of a group set up with an Ed25519 IK.  A
+// setup message without a suite (from before suites were recorded) uses the
+// default suite.
+func DefaultSuite() *Suite {
+	return &Suite{
+		Curve:     CurveX25519,
+		Signature: SignatureEd25519,
+		KDF:       KDFHKDFSHA256,
+		Combine:   CombineDH,
+	}
+}
+
+// SignatureScheme returns the name of the signature scheme for pk (see Sign
+// and Verify).
+func SignatureScheme(pk crypto.PublicKey) (string, error) {
+	switch pk.(type) {
+	case ed25519.PublicKey:
+		return SignatureEd25519, nil
+	case *ecdsa.PublicKey:
+		return SignatureECDSAP256, nil
+	default:
+		return "", fmt.Errorf("unsupported signing key type %T", pk)
+	}
+}
+
+// Check returns an error for each algorithm in the suite that this build
+// does not support.  A nil suite is the default suite.
+func (suite *Suite) Check() error {
+	var errs []error
+
+	if suite == nil {
+		return nil
+	}
+
+	if suite.Curve != CurveX25519 {
+		errs = append(errs, fmt.Errorf("this build doesn't support curve %q", suite.Curve))
+	}
+	if suite.Signature != SignatureEd25519 && suite.Signature != SignatureECDSAP256 {
+		errs = append(errs, fmt.Errorf("this build doesn't support signature scheme %q",
+			suite.Signature))
+	}
+	if suite.KDF != KDFHKDFSHA256 && suite.KDF != KDFHKDFSHA256Epoch {
+		errs = append(errs, fmt.Errorf("this build doesn't support KDF %q", suite.KDF))
+	}
+	if suite.Combine != "" && suite.Combine != CombineDH {
+		errs = append(errs, fmt.Errorf("this build doesn't support node key combination %q",
+			suite.Combine))
+	}
+
+	if suite.Order != "" && suite.Order != OrderLevel && suite.Order != OrderIn {
+		errs = append(errs, fmt.Errorf("this build doesn't support tree key order %q",
+			suite.Order))
+	}
+
+	return errors.Join(errs...)
+}
+
+// GetSuite returns the setup message's suite, or the default suite if the
+// message does not carry one.
+func (sm *SetupMessage) GetSuite() *Suite {
+	if sm.Suite == nil {
+		return DefaultSuite()
+	}
+	return sm.Suite
+}
+
+// SignatureSchemeOfKeyFile returns the name of the signature scheme of the
+// PEM-encoded private key in privIKFile.
+func SignatureSchemeOfKeyFile(privIKFile string) (string, error) {
+	sk, err := ReadSigningKeyFromFile(privIKFile, EncodingPEM)
+	if err != nil {
+		return "", fmt.Errorf("can't read private key file: %v", err)
+	}
+	return SignatureScheme(sk.Public())
+}
+
+// SetSignatureScheme records in the setup message's suite the signature
+// scheme of the key in privIKFile, which is to sign the message.
+func (sm *SetupMessage) SetSignatureScheme(privIKFile string) error {
+	scheme, err := SignatureSchemeOfKeyFile(privIKFile)
+	if err != nil {
+		return err
+	}
+
+	if sm.Suite == nil {
+		sm.Suite = DefaultSuite()
+	}
+	sm.Suite.Signature = scheme
+	return nil
+}
@@ -0,0 +1,67 @@
+package art
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSuiteCheck(t *testing.T) {
+	tests := []struct {
+		name  string
+		suite func(s *Suite) *Suite
+		want  []string // substrings of the error, or none for success
+	}{
+		{"legacy (no suite)", func(*Suite) *Suite { return nil }, nil},
+		{"default", func(s *Suite) *Suite { return s }, nil},
+		{"ECDSA, epoch secret, OrderIn", func(s *Suite) *Suite {
+			s.Signature, s.KDF, s.Order = SignatureECDSAP256, KDFHKDFSHA256Epoch, OrderIn
+			return s
+		}, nil},
+		{"no combine or order", func(s *Suite) *Suite {
+			s.Combine, s.Order = "", ""
+			return s
+		}, nil},
+		{"curve", func(s *Suite) *Suite {
+			s.Curve = "X448"
+			return s
+		}, []string{`curve "X448"`}},
+		{"signature", func(s *Suite) *Suite {
+			s.Signature = "Ed448"
+			return s
+		}, []string{`signature scheme "Ed448"`}},
+		{"KDF", func(s *Suite) *Suite {
+			s.KDF = "HKDF-SHA512"
+			return s
+		}, []string{`KDF "HKDF-SHA512"`}},
+		{"combine", func(s *Suite) *Suite {
+			s.Combine = "hash"
+			return s
+		}, []string{`node key combination "hash"`}},
+		{"order", func(s *Suite) *Suite {
+			s.Order = "post"
+			return s
+		}, []string{`tree key order "post"`}},
+		{"every field", func(s *Suite) *Suite {
+			return &Suite{Curve: "P-256", Signature: "RSA", KDF: "PBKDF2"}
+		}, []string{`curve "P-256"`, `signature scheme "RSA"`, `KDF "PBKDF2"`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.suite(DefaultSuite()).Check()
+			if len(tt.want) == 0 {
+				if err != nil {
+					t.Errorf("got error %v, want success", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("got success, want an error naming %q", tt.want)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("got error %q, want it to name %s", err, want)
+				}
+			}
+		})
+	}
+}
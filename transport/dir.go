@@ -0,0 +1,145 @@
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/syslab-wm/art/internal/fileutl"
+)
+
+// A Dir exchanges messages through a shared directory, in the files the
+// tools read and write: the nth message is NNNNNN-KIND.msg (n zero-padded
+// to six digits), and its signature or MAC is in the same file with a .sig
+// or .mac suffix.  For instance, a group's setup message is usually
+// 000001-setup.msg, with its signature in 000001-setup.msg.sig, and the
+// files can be passed directly to process_setup_message.
+//
+// Each member reads the directory with its own Dir, which tracks the next
+// message the member receives; the sequence number is the member's to keep
+// between runs (see Next).
+type Dir struct {
+	path string
+	next int
+}
+
+// NewDir returns the transport for the directory path, which receives
+// messages starting at sequence number next (1 for a member that has not
+// received any).
+func NewDir(path string, next int) *Dir {
+	return &Dir{path: path, next: next}
+}
+
+// Next returns the sequence number of the next message Recv returns.
+func (d *Dir) Next() int {
+	return d.next
+}
+
+// Path returns the name of the file that holds the message of the kind kind
+// with sequence number seq.  The authenticator is in the same file, with
+// the suffix AuthSuffix(kind).
+func (d *Dir) Path(seq int, kind Kind) string {
+	return filepath.Join(d.path, fmt.Sprintf("%06d-%s.msg", seq, kind))
+}
+
+// AuthSuffix returns the suffix of the file that holds the authenticator of
+// a message of the kind kind.
+func AuthSuffix(kind Kind) string {
+	if kind == KindSetup {
+		return ".sig"
+	}
+	return ".mac"
+}
+
+// Send writes msg to the directory with the next free sequence number.  The
+// authenticator is written first, and claims the sequence number, so that a
+// message file never appears without its authenticator; if another member
+// claims the number concurrently, Send takes the next one.
+func (d *Dir) Send(msg *Message) error {
+	if err := msg.Kind.check(); err != nil {
+		return err
+	}
+
+	seq, err := d.lastSeq()
+	if err != nil {
+		return err
+	}
+
+	for {
+		seq++
+		name := d.Path(seq, msg.Kind)
+		err := fileutl.WriteNew(name+AuthSuffix(msg.Kind), 0644, writeBytes(msg.Auth))
+		if errors.Is(err, fs.ErrExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		return fileutl.WriteNew(name, 0644, writeBytes(msg.Data))
+	}
+}
+
+// Recv reads the message with the next sequence number.
+func (d *Dir) Recv() (*Message, error) {
+	names, err := filepath.Glob(filepath.Join(d.path, fmt.Sprintf("%06d-*.msg", d.next)))
+	if err != nil {
+		return nil, err
+	}
+	if len(names) == 0 {
+		return nil, ErrNoMessage
+	}
+	if len(names) > 1 {
+		return nil, fmt.Errorf("there are %d messages with sequence number %d",
+			len(names), d.next)
+	}
+
+	name := names[0]
+	_, kind, _ := strings.Cut(strings.TrimSuffix(filepath.Base(name), ".msg"), "-")
+	msg := &Message{Kind: Kind(kind)}
+	if err := msg.Kind.check(); err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+
+	if msg.Data, err = os.ReadFile(name); err != nil {
+		return nil, err
+	}
+	if msg.Auth, err = os.ReadFile(name + AuthSuffix(msg.Kind)); err != nil {
+		return nil, err
+	}
+
+	d.next++
+	return msg, nil
+}
+
+// lastSeq returns the highest sequence number in the directory, or 0 if it
+// holds no messages.
+func (d *Dir) lastSeq() (int, error) {
+	entries, err := os.ReadDir(d.path)
+	if err != nil {
+		return 0, err
+	}
+
+	last := 0
+	for _, entry := range entries {
+		prefix, _, ok := strings.Cut(entry.Name(), "-")
+		if !ok {
+			continue
+		}
+		if seq, err := strconv.Atoi(prefix); err == nil {
+			last = max(last, seq)
+		}
+	}
+	return last, nil
+}
+
+func writeBytes(data []byte) func(w io.Writer) error {
+	return func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	}
+}
@@ -0,0 +1,66 @@
+// Package transport exchanges a group's setup and update messages between
+// its members.  A Transport is a broadcast channel: a message sent by one
+// member is received, in order, by every member.  Dir is the file-based
+// exchange the command-line tools use, and Bus is an in-memory
+// implementation, for running a whole group in one process.
+package transport
+
+import (
+	"errors"
+	"os"
+)
+
+// A Kind is the kind of a message.
+type Kind string
+
+const (
+	// KindSetup is a setup message, authenticated by the initiator's
+	// signature.
+	KindSetup Kind = "setup"
+
+	// KindUpdate is an update message, authenticated by its MAC.
+	KindUpdate Kind = "update"
+)
+
+// A Message is an encoded message along with its authenticator: the
+// signature of a setup message or the MAC of an update message.
+type Message struct {
+	Kind Kind
+	Data []byte
+	Auth []byte
+}
+
+// ErrNoMessage is returned by Recv if no message is pending.
+var ErrNoMessage = errors.New("no message is pending")
+
+// A Transport sends messages to, and receives messages from, the group.
+type Transport interface {
+	// Send broadcasts msg to the group.
+	Send(msg *Message) error
+
+	// Recv returns the next message, in the order the messages were sent,
+	// or ErrNoMessage if there is none yet.  A member receives its own
+	// messages too.
+	Recv() (*Message, error)
+}
+
+func (kind Kind) check() error {
+	if kind != KindSetup && kind != KindUpdate {
+		return errors.New("unknown message kind " + string(kind))
+	}
+	return nil
+}
+
+// SendFiles sends the message of the kind kind in msgFile, authenticated by
+// the signature or MAC in authFile, on t.
+func SendFiles(t Transport, kind Kind, msgFile, authFile string) error {
+	data, err := os.ReadFile(msgFile)
+	if err != nil {
+		return err
+	}
+	auth, err := os.ReadFile(authFile)
+	if err != nil {
+		return err
+	}
+	return t.Send(&Message{Kind: kind, Data: data, Auth: auth})
+}
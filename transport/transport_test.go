@@ -0,0 +1,165 @@
+package transport
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+)
+
+// transports returns, for each implementation, a function that makes n
+// endpoints of a new channel.
+func transports(t *testing.T) map[string]func(n int) []Transport {
+	return map[string]func(n int) []Transport{
+		"dir": func(n int) []Transport {
+			dir := t.TempDir()
+			var ts []Transport
+			for i := 0; i < n; i++ {
+				ts = append(ts, NewDir(dir, 1))
+			}
+			return ts
+		},
+		"bus": func(n int) []Transport {
+			bus := NewBus()
+			var ts []Transport
+			for i := 0; i < n; i++ {
+				ts = append(ts, bus.Endpoint())
+			}
+			return ts
+		},
+	}
+}
+
+// testMessages returns n messages: a setup message, then updates.
+func testMessages(n int) []*Message {
+	var msgs []*Message
+	for i := 0; i < n; i++ {
+		kind := KindUpdate
+		if i == 0 {
+			kind = KindSetup
+		}
+		msgs = append(msgs, &Message{
+			Kind: kind,
+			Data: []byte(fmt.Sprintf("message %d", i+1)),
+			Auth: []byte(fmt.Sprintf("auth %d", i+1)),
+		})
+	}
+	return msgs
+}
+
+// checkRecv fails unless t receives want next.
+func checkRecv(t *testing.T, tr Transport, want *Message) {
+	t.Helper()
+	got, err := tr.Recv()
+	if err != nil {
+		t.Fatalf("Recv: got error %v, want %s", err, want.Data)
+	}
+	if got.Kind != want.Kind || !bytes.Equal(got.Data, want.Data) ||
+		!bytes.Equal(got.Auth, want.Auth) {
+		t.Fatalf("Recv: got %s message %q (auth %q), want %s message %q (auth %q)",
+			got.Kind, got.Data, got.Auth, want.Kind, want.Data, want.Auth)
+	}
+}
+
+// checkEmpty fails unless t has no message pending.
+func checkEmpty(t *testing.T, tr Transport) {
+	t.Helper()
+	if msg, err := tr.Recv(); !errors.Is(err, ErrNoMessage) {
+		t.Fatalf("Recv: got message %v, error %v; want ErrNoMessage", msg, err)
+	}
+}
+
+func TestSendRecv(t *testing.T) {
+	for name, endpoints := range transports(t) {
+		t.Run(name, func(t *testing.T) {
+			ts := endpoints(3)
+			checkEmpty(t, ts[0])
+
+			// messages from several members are received in the order they
+			// were sent, by every member, including the sender
+			msgs := testMessages(5)
+			for i, msg := range msgs {
+				if err := ts[i%2].Send(msg); err != nil {
+					t.Fatalf("Send %d: %v", i+1, err)
+				}
+			}
+			for _, tr := range ts {
+				for _, msg := range msgs {
+					checkRecv(t, tr, msg)
+				}
+				checkEmpty(t, tr)
+			}
+
+			// a message sent after a member caught up is received next
+			more := &Message{Kind: KindUpdate, Data: []byte("late"), Auth: []byte("late auth")}
+			if err := ts[2].Send(more); err != nil {
+				t.Fatal(err)
+			}
+			checkRecv(t, ts[0], more)
+			checkEmpty(t, ts[0])
+		})
+	}
+}
+
+func TestSendUnknownKind(t *testing.T) {
+	for name, endpoints := range transports(t) {
+		t.Run(name, func(t *testing.T) {
+			tr := endpoints(1)[0]
+			if err := tr.Send(&Message{Kind: "welcome", Data: []byte("x")}); err == nil {
+				t.Error("Send accepted a message of an unknown kind")
+			}
+			checkEmpty(t, tr)
+		})
+	}
+}
+
+// TestBusCopies checks that a Bus keeps its own copy of a message, so that the
+// sender may reuse its buffers.
+func TestBusCopies(t *testing.T) {
+	tr := NewBus().Endpoint()
+	msg := &Message{Kind: KindUpdate, Data: []byte("data"), Auth: []byte("auth")}
+	if err := tr.Send(msg); err != nil {
+		t.Fatal(err)
+	}
+	want := &Message{Kind: msg.Kind, Data: []byte("data"), Auth: []byte("auth")}
+	msg.Data[0], msg.Auth[0] = 'X', 'X'
+	checkRecv(t, tr, want)
+}
+
+// TestDirFiles checks that a Dir writes each message, and its authenticator,
+// to the files the tools read, and that a Dir resumes at its sequence number.
+func TestDirFiles(t *testing.T) {
+	dir := t.TempDir()
+	sender := NewDir(dir, 1)
+	msgs := testMessages(3)
+	for _, msg := range msgs {
+		if err := sender.Send(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i, msg := range msgs {
+		name := sender.Path(i+1, msg.Kind)
+		for file, want := range map[string][]byte{
+			name:                        msg.Data,
+			name + AuthSuffix(msg.Kind): msg.Auth,
+		} {
+			got, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("%s holds %q, want %q", file, got, want)
+			}
+		}
+	}
+
+	resumed := NewDir(dir, 2)
+	checkRecv(t, resumed, msgs[1])
+	checkRecv(t, resumed, msgs[2])
+	checkEmpty(t, resumed)
+	if resumed.Next() != 4 {
+		t.Errorf("got next sequence number %d, want 4", resumed.Next())
+	}
+}
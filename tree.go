@@ -1,14 +1,18 @@
 package art
 
 import (
+	"bytes"
 	"crypto/ecdh"
 	"crypto/ed25519"
+	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"math"
+	"io"
+	"math/bits"
 	"os"
 
-	"github.com/syslab-wm/art/internal/jsonutl"
+	"github.com/syslab-wm/art/internal/fileutl"
 	"github.com/syslab-wm/mu"
 )
 
@@ -28,11 +32,41 @@ type PublicNode struct {
 	Height int // a height of zero indicates a leaf node
 }
 
+// The versions of the serialized tree state.  A state without a version is
+// from before states were versioned; it is the original format (publicTree,
+// sk, lk and iKeys), possibly with some of the fields added before version 2.
+const (
+	// treeStateVersion2 introduces the version field, with transcriptHash
+	// and setupMessageHash.
+	treeStateVersion2 = 2
+	// treeStateVersion3 introduces epochSecret.  Only states with an epoch
+	// secret are written as version 3, so that older builds, which would
+	// chain the next stage key from the stage key, reject them, but can still
+	// read the others.
+	treeStateVersion3 = 3
+
+	treeStateVersion = treeStateVersion3
+)
+
 type treeJson struct {
+	Version int `json:"version"`
+
 	PublicTree [][]byte `json:"publicTree"`
 	Sk         []byte   `json:"sk"`
 	Lk         []byte   `json:"lk"`
 	IKeys      [][]byte `json:"iKeys"`
+
+	TranscriptHash   []byte `json:"transcriptHash,omitempty"`
+	SetupMessageHash []byte `json:"setupMessageHash,omitempty"`
+	Epoch            int    `json:"epoch,omitempty"`
+
+	LeafMetadata []string `json:"leafMetadata,omitempty"`
+
+	EpochSecret []byte `json:"epochSecret,omitempty"`
+
+	// MAC is the state's MAC, if the state had a MACKey when it was
+	// written.
+	MAC []byte `json:"mac,omitempty"`
 }
 
 type TreeState struct {
@@ -42,11 +76,46 @@ type TreeState struct {
 	Sk         ed25519.PrivateKey
 	Lk         *ecdh.PrivateKey
 	IKeys      [][]byte
+
+	// TranscriptHash commits to every message applied to the state: the
+	// setup message, then each update message, in order.  Members that have
+	// applied the same messages have equal transcript hashes.
+	TranscriptHash []byte
+
+	// SetupMessageHash is the SHA-256 digest of the setup message (as the
+	// bytes that were signed) from which the state was derived, so that a
+	// member can later show which signed message its keys came from.  It is
+	// zero in states saved before the digest was recorded.
+	SetupMessageHash [sha256.Size]byte
+
+	// Epoch counts the updates applied to the state since setup, that is,
+	// the stage keys derived after the first: it is 0 after setup, and each
+	// update made or processed increments it.  States saved before the epoch
+	// was recorded restart it at 0.
+	Epoch int
+
+	// LeafMetadata is the setup message's LeafMetadata, if any.
+	LeafMetadata []string
+
+	// EpochSecret is the secret from which, instead of from the stage key,
+	// the next stage key is derived, if the group's suite derives epoch
+	// secrets (see KDFHKDFSHA256Epoch); it is nil otherwise.
+	EpochSecret []byte
+
+	// MACKey, if non-nil, is the key of the HMAC-SHA256 that WriteTreeState
+	// (and SaveTreeState) records in the state, over the state's contents,
+	// so that the state is tamper-evident, including its public parts such
+	// as the tree and the epoch; it is not encrypted.  The key itself is not
+	// saved.  A state loaded with a MAC key (see LoadTreeStateWithMAC) keeps
+	// the key, so that saving it again renews the MAC.
+	MACKey []byte
 }
 
 func (treeState *TreeState) Save(fileName string) {
-	treeJson := MarshallTreeState(treeState)
-	jsonutl.Encode(fileName, treeJson)
+	err := SaveTreeState(fileName, treeState)
+	if err != nil {
+		mu.Fatalf("error saving tree state to %s: %v", fileName, err)
+	}
 }
 
 func (treeState *TreeState) SaveStageKey(fileName string) {
@@ -62,10 +131,91 @@ func (treeState *TreeState) StageKey() ed25519.PrivateKey {
 	return treeState.Sk
 }
 
+// extendTranscript hashes the previous transcript hash together with the
+// bytes of a newly applied message.
+func (treeState *TreeState) extendTranscript(msg []byte) {
+	h := sha256.New()
+	h.Write(treeState.TranscriptHash)
+	h.Write(msg)
+	treeState.TranscriptHash = h.Sum(nil)
+}
+
+// LeafIndex returns the index of the member that owns the state, by locating
+// the member's leaf key in the public tree.  It returns 0 if the leaf key is
+// not in the tree.
+func (treeState *TreeState) LeafIndex() int {
+	lk := PublicOf(treeState.Lk)
+	for i, leaf := range treeState.PublicTree.Leaves() {
+		if leaf.GetPk().Equal(lk) {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// CheckConsistency checks the state of the member at position index for
+// corruption or tampering: the tree must be sound (see CheckShape), and
+// the member's path must match the tree (see VerifyPath).
+//
+// The stage key itself cannot be recomputed from the state, since every
+// stage key is derived from the previous one; only the tree and the leaf
+// key are checked.
+func (treeState *TreeState) CheckConsistency(index int) error {
+	if treeState.Lk == nil {
+		return errors.New("the state has no leaf key")
+	}
+	if len(treeState.Sk) == 0 {
+		return errors.New("the state has no stage key")
+	}
+	if err := treeState.PublicTree.CheckShape(); err != nil {
+		return err
+	}
+
+	return treeState.VerifyPath(index)
+}
+
+// VerifyPath checks that the leaf key is the key of the leaf of the member at
+// position index, and that the private keys derived from it along the
+// member's path match the public keys stored on that path, up to the root.
+// After processing a message, a mismatch means that the message's tree (or
+// an update's path keys) is corrupt, or that the derivation is buggy.
+func (treeState *TreeState) VerifyPath(index int) error {
+	if treeState.Lk == nil {
+		return errors.New("the state has no leaf key")
+	}
+
+	copathKeys, err := CoPath(treeState.PublicTree, index, nil)
+	if err != nil {
+		return err
+	}
+	pathKeys, err := PathNodeKeys(treeState.Lk, copathKeys)
+	if err != nil {
+		return err
+	}
+
+	// pathKeys run from the leaf up to the root; the direct path runs down
+	path := directPath(treeState.PublicTree, index)
+	for i, key := range pathKeys {
+		node := path[len(path)-1-i]
+		if !node.GetPk().Equal(PublicOf(key)) {
+			if i == 0 {
+				return fmt.Errorf("the leaf key does not match leaf %d", index)
+			}
+			nodeIndices, _ := PathIndices(treeState.PublicTree, index)
+			return fmt.Errorf("the key derived for node %d on the path of leaf %d "+
+				"does not match the tree", nodeIndices[i], index)
+		}
+	}
+
+	return nil
+}
+
 func (treeState *TreeState) DeriveTreeKey(index int) *ecdh.PrivateKey {
 	// find the nodes on the copath
-	copathNodes := make([]*ecdh.PublicKey, 0)
-	copathNodes = CoPath(treeState.PublicTree, index, copathNodes)
+	copathNodes, err := CoPath(treeState.PublicTree, index, nil)
+	if err != nil {
+		mu.Fatalf("error finding the copath: %v", err)
+	}
 
 	// with the leaf key, derive the private keys on the path up to the root
 	pathKeys, err := PathNodeKeys(treeState.Lk, copathNodes)
@@ -78,24 +228,29 @@ func (treeState *TreeState) DeriveTreeKey(index int) *ecdh.PrivateKey {
 }
 
 func (treeState *TreeState) Read(treeStateFile string) {
-	var tree treeJson
-
-	treeFile, err := os.Open(treeStateFile)
-	if err != nil {
-		mu.Fatalf("error opening file %s", treeStateFile)
-	}
-
-	decoder := json.NewDecoder(treeFile)
-	err = decoder.Decode(&tree)
+	state, err := LoadTreeState(treeStateFile)
 	if err != nil {
-		mu.Fatalf("error reading tree state from %s", treeStateFile)
+		mu.Fatalf("error reading tree state from %s: %v", treeStateFile, err)
 	}
 
-	defer treeFile.Close()
+	*treeState = *state
+}
 
-	treeState.UnMarshallTreeState(&tree)
+// chainKey returns the secret the next stage key is derived from: the epoch
+// secret, if the state has one, or else the stage key.
+func (state *TreeState) chainKey() []byte {
+	if state.EpochSecret != nil {
+		return state.EpochSecret
+	}
+	return state.Sk
 }
 
+// DeriveStageKey derives the state's next stage key from the tree secret
+// treeSecret and the state's tree.  The next stage key is chained from the
+// epoch secret, which is also derived anew, only if the state has one, that
+// is, if the group was set up with epoch secrets (setup_group's
+// -epoch-secret; see KDFHKDFSHA256Epoch).  Otherwise, it is chained from the
+// stage key itself.
 func (state *TreeState) DeriveStageKey(treeSecret *ecdh.PrivateKey) {
 	treeKeys, err := state.PublicTree.MarshalKeys()
 	if err != nil {
@@ -103,7 +258,7 @@ func (state *TreeState) DeriveStageKey(treeSecret *ecdh.PrivateKey) {
 	}
 
 	stageInfo := StageKeyInfo{
-		PrevStageKey:  state.Sk,
+		PrevStageKey:  state.chainKey(),
 		TreeSecretKey: treeSecret.Bytes(),
 		IKeys:         state.IKeys,
 		TreeKeys:      treeKeys,
@@ -114,15 +269,198 @@ func (state *TreeState) DeriveStageKey(treeSecret *ecdh.PrivateKey) {
 		mu.Fatalf("DeriveStageKey failed: %v", err)
 	}
 
-	state.Sk = stageKey
+	// expand the key, as loading a saved state does, so that the stage key
+	// (which MACs updates and, without an epoch secret, seeds the next
+	// stage key) is the same whether or not the state was saved and
+	// reloaded in between
+	state.Sk = ed25519.NewKeyFromSeed(stageKey)
+
+	if state.EpochSecret != nil {
+		state.EpochSecret, err = DeriveEpochSecret(&stageInfo)
+		if err != nil {
+			mu.Fatalf("DeriveEpochSecret failed: %v", err)
+		}
+	}
+}
+
+// UpdateKey replaces the leaf key of the member at position index with a
+// fresh key, updates the path to the root, and derives the new stage key.
+// It returns the update message for the other members, along with the
+// previous stage key, which is needed to MAC the message.
+func (state *TreeState) UpdateKey(index int) (*UpdateMessage, ed25519.PrivateKey) {
+	return state.UpdateKeyFrom(index, nil)
+}
+
+// UpdateKeyFrom is like UpdateKey, but generates the new leaf key from the
+// next 32 bytes of r (see DHKeyGenFrom), e.g., a hardware RNG.  If r is nil,
+// crypto/rand is used.
+func (state *TreeState) UpdateKeyFrom(index int, r io.Reader) (*UpdateMessage,
+	ed25519.PrivateKey) {
+
+	var err error
+
+	// create a new leaf key
+	if r == nil {
+		state.Lk, err = DHKeyGen()
+	} else {
+		state.Lk, err = DHKeyGenFrom(r)
+	}
+	if err != nil {
+		mu.Fatalf("error creating the new leaf key: %v", err)
+	}
+
+	pathKeys := UpdateCoPathNodes(index, state)
+	treeSecret := pathKeys[len(pathKeys)-1]
+
+	publicPathKeys := GetPublicKeys(pathKeys)
+
+	updateMsg := CreateUpdateMessage(index, pathKeys)
+	state.extendTranscript(updateMsg.macBytes())
+
+	// replace the updated nodes in the full tree representation
+	state.PublicTree, err = UpdatePublicTree(publicPathKeys, state.PublicTree,
+		index)
+	if err != nil {
+		mu.Fatalf("error updating the public tree: %v", err)
+	}
+
+	prevStageKey := state.Sk
+	state.DeriveStageKey(treeSecret)
+	state.Epoch++
+	updateMsg.Epoch = state.Epoch
+
+	return &updateMsg, prevStageKey
+}
+
+// ProcessUpdateMessage applies another member's (already verified) update
+// message to the state of the member at position index.
+func (state *TreeState) ProcessUpdateMessage(index int, updateMsg *UpdateMessage) {
+	count(updatesProcessed)
+
+	updatedPathKeys := UnmarshallPublicKeys(updateMsg.PathPublicKeys)
+	state.extendTranscript(updateMsg.macBytes())
+
+	// replace the updated nodes in the full tree representation
+	var err error
+	state.PublicTree, err = UpdatePublicTree(updatedPathKeys, state.PublicTree,
+		updateMsg.Idx)
+	if err != nil {
+		mu.Fatalf("error applying the update message: %v", err)
+	}
+
+	pathKeys := UpdateCoPathNodes(index, state)
+	treeSecret := pathKeys[len(pathKeys)-1]
+
+	state.DeriveStageKey(treeSecret)
+	state.Epoch++
+}
+
+// SubtreeStageKeys re-derives, for each member whose leaf is in the subtree
+// rooted at the node at the given node index, the stage key that the
+// member's state yields: the derivation of ProcessUpdateMessage, from the
+// tree secret of the member's leaf key and copath, and the member's current
+// stage key (or epoch secret), IKs and tree.  states[i-1] is the state of
+// the member at position i; members without a state (nil) are skipped.  The
+// keys are keyed by member index.
+//
+// The keys are not the group's stage key, but members whose states agree
+// derive equal keys, so that a member whose key differs from the others' has
+// a tampered or out-of-sync leaf key, tree or stage key.  This is a debugging
+// aid, to narrow a divergence down to a subtree.
+func SubtreeStageKeys(states []*TreeState, subtreeRoot int) (map[int]ed25519.PrivateKey,
+	error) {
+
+	if len(states) == 0 {
+		return nil, ErrEmptyTree
+	}
+	lo, hi, err := LeafSpan(newPublicTreeShape(len(states)), subtreeRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[int]ed25519.PrivateKey)
+	for index := lo; index <= hi; index++ {
+		state := states[index-1]
+		if state == nil {
+			continue
+		}
+		if state.PublicTree.NumLeaves() != len(states) {
+			return nil, fmt.Errorf("member %d's tree has %d leaves, not %d", index,
+				state.PublicTree.NumLeaves(), len(states))
+		}
+
+		copathNodes, err := CoPath(state.PublicTree, index, nil)
+		if err != nil {
+			return nil, err
+		}
+		pathKeys, err := PathNodeKeys(state.Lk, copathNodes)
+		if err != nil {
+			return nil, fmt.Errorf("member %d: %v", index, err)
+		}
+		treeKeys, err := state.PublicTree.MarshalKeys()
+		if err != nil {
+			return nil, fmt.Errorf("member %d: %v", index, err)
+		}
+
+		seed, err := DeriveStageKey(&StageKeyInfo{
+			PrevStageKey:  state.chainKey(),
+			TreeSecretKey: pathKeys[len(pathKeys)-1].Bytes(),
+			IKeys:         state.IKeys,
+			TreeKeys:      treeKeys,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("member %d: %v", index, err)
+		}
+		keys[index] = ed25519.NewKeyFromSeed(seed)
+	}
+
+	return keys, nil
 }
 
 // leftSubtreeSize computes the number of leaves in the leftsubtree of a
-// tree with x leaves
+// tree with x leaves.  A tree with at most one leaf has no left subtree.
 func leftSubtreeSize(x int) int {
-	// 2^{ ceil(log2(x))  -   1}
-	exp := math.Ceil(math.Log2(float64(x))) - 1
-	return int(math.Pow(2, exp))
+	if x <= 1 {
+		return 0
+	}
+	// 2^{ ceil(log2(x))  -   1}, computed with integer arithmetic so that it
+	// is exact for every x
+	return 1 << (bits.Len(uint(x-1)) - 1)
+}
+
+// maxTreeHeight is the height of the tallest tree whose leaf count fits in
+// an int.
+const maxTreeHeight = bits.UintSize - 1
+
+// leftSubtreeLeaves returns the number of leaves in the left subtree of a
+// node of the given height.  In a left-balanced tree the left subtree is
+// full, so this is 2^(height-1).
+func leftSubtreeLeaves(height int) int {
+	if height < 1 || height > maxTreeHeight {
+		mu.BUG("invalid tree height %d", height)
+	}
+	return 1 << (height - 1)
+}
+
+// NumLeaves returns the number of leaves in the tree.  Since every left
+// subtree is full, this only walks the tree's right spine.
+func (publicNode *PublicNode) NumLeaves() int {
+	numLeaves := 1
+	for node := publicNode; node.Height != 0; node = node.Right {
+		numLeaves += leftSubtreeLeaves(node.Height)
+	}
+	return numLeaves
+}
+
+// checkLeafIndex checks that idx is the position of a leaf in the tree; it
+// guards the index arithmetic against out-of-range (e.g., attacker-supplied)
+// indices, which would otherwise silently select the wrong leaf.
+func checkLeafIndex(root *PublicNode, idx int) error {
+	numLeaves := root.NumLeaves()
+	if idx < 1 || idx > numLeaves {
+		return fmt.Errorf("leaf index %d out of range [1, %d]", idx, numLeaves)
+	}
+	return nil
 }
 
 func createTree(leafKeys []*ecdh.PrivateKey, x int, y int) (*Node, error) {
@@ -144,14 +482,9 @@ func createTree(leafKeys []*ecdh.PrivateKey, x int, y int) (*Node, error) {
 
 	// compute current node's private key from its children's keys
 
-	pkRight := right.sk.PublicKey()
-	raw, err := left.sk.ECDH(pkRight)
-	if err != nil {
-		return nil, fmt.Errorf("ECDH for node failed: %v", err)
-	}
-	sk, err := UnmarshalPrivateX25519FromRaw(raw)
+	sk, err := CombineKeys(left.sk, PublicOf(right.sk))
 	if err != nil {
-		return nil, fmt.Errorf("can't unmarshal private x25519 key for node: %v", err)
+		return nil, err
 	}
 
 	return &Node{sk: sk, left: left, right: right, x: x, y: y, numLeaves: n}, nil
@@ -159,6 +492,9 @@ func createTree(leafKeys []*ecdh.PrivateKey, x int, y int) (*Node, error) {
 }
 
 func CreateTree(leafKeys []*ecdh.PrivateKey) (*Node, error) {
+	if len(leafKeys) == 0 {
+		return nil, ErrEmptyTree
+	}
 	return createTree(leafKeys, 0, 0)
 }
 
@@ -169,9 +505,17 @@ func (node *Node) PublicKeys() *PublicNode {
 
 	left := node.left.PublicKeys()
 	right := node.right.PublicKeys()
-	pk := node.sk.PublicKey()
+	pk := PublicOf(node.sk)
+
+	height := 0
+	if left != nil {
+		height = left.Height + 1
+	}
+	if right != nil && right.Height >= height {
+		height = right.Height + 1
+	}
 
-	return &PublicNode{pk: pk, Left: left, Right: right}
+	return &PublicNode{pk: pk, Left: left, Right: right, Height: height}
 }
 
 /*
@@ -290,6 +634,80 @@ func (publicNode *PublicNode) MarshalKeys() ([][]byte, error) {
 	return marshalledList, nil
 }
 
+// Hash returns the SHA-256 digest of the tree's raw public keys, in level
+// order.  The digest identifies the tree whatever the encoding (or the key
+// order) of the message that carried it.
+func (publicNode *PublicNode) Hash() []byte {
+	h := sha256.New()
+	for _, node := range publicNode.levelOrder() {
+		h.Write(node.GetPk().Bytes())
+	}
+	return h.Sum(nil)
+}
+
+// MarshalKeysOrder is like MarshalKeys, but lists the keys in the given
+// order, OrderLevel (the order of MarshalKeys) or OrderIn; an empty order is
+// OrderLevel.  For instance, the tree of three members
+//
+//	    r
+//	   / \
+//	  a   l3
+//	 / \
+//	l1  l2
+//
+// is [r, a, l3, l1, l2] in OrderLevel, and [l1, a, l2, r, l3] in OrderIn.
+func (publicNode *PublicNode) MarshalKeysOrder(order string) ([][]byte, error) {
+	nodes, err := publicNode.nodesInOrder(order)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([][]byte, 0, len(nodes))
+	for _, node := range nodes {
+		pem, err := MarshalPublicEKToPEM(node.pk)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal public EK: %v", err)
+		}
+		keys = append(keys, pem)
+	}
+	return keys, nil
+}
+
+// nodesInOrder returns the tree's nodes in the given order (see
+// MarshalKeysOrder).
+func (publicNode *PublicNode) nodesInOrder(order string) ([]*PublicNode, error) {
+	switch order {
+	case "", OrderLevel:
+		return publicNode.levelOrder(), nil
+	case OrderIn:
+		return publicNode.inOrder(nil), nil
+	default:
+		return nil, fmt.Errorf("unknown tree key order %q", order)
+	}
+}
+
+// inOrder appends the tree's nodes, in order, to nodes.
+func (publicNode *PublicNode) inOrder(nodes []*PublicNode) []*PublicNode {
+	if publicNode == nil {
+		return nodes
+	}
+	nodes = publicNode.Left.inOrder(nodes)
+	nodes = append(nodes, publicNode)
+	return publicNode.Right.inOrder(nodes)
+}
+
+// Leaves returns the tree's leaf nodes, ordered left to right.  The leaf at
+// position i in the slice is the leaf of the member at index i+1.
+func (publicNode *PublicNode) Leaves() []*PublicNode {
+	if publicNode == nil {
+		return nil
+	}
+	if publicNode.Height == 0 {
+		return []*PublicNode{publicNode}
+	}
+	return append(publicNode.Left.Leaves(), publicNode.Right.Leaves()...)
+}
+
 func (publicNode *PublicNode) GetPk() *ecdh.PublicKey {
 	return publicNode.pk
 }
@@ -298,83 +716,461 @@ func (publicNode *PublicNode) UpdatePk(newPK *ecdh.PublicKey) {
 	publicNode.pk = newPK
 }
 
+// ErrEmptyTree is returned when constructing a public tree from an empty list
+// of keys; every group has at least one member, and so at least one node.
+var ErrEmptyTree = errors.New("the tree has no nodes")
+
 // constructing a public tree from a level-order list of marshalled keys
 func UnmarshalKeysToPublicTree(marshalledKeys [][]byte) (*PublicNode, error) {
-	root := &PublicNode{pk: nil, Left: nil, Right: nil}
-	nodeQueue := make([]*PublicNode, 0)
+	return UnmarshalKeysToPublicTreeOrder(marshalledKeys, OrderLevel)
+}
 
-	for i := 0; i < len(marshalledKeys); i++ {
-		// unmarshal the value
-		pk, err := UnmarshalPublicEKFromPEM(marshalledKeys[i])
+// UnmarshalKeysToPublicTreeOrder is like UnmarshalKeysToPublicTree, but takes
+// the keys in the given order (see MarshalKeysOrder).
+func UnmarshalKeysToPublicTreeOrder(marshalledKeys [][]byte, order string) (*PublicNode, error) {
+	keys := make([]*ecdh.PublicKey, 0, len(marshalledKeys))
+	for _, pem := range marshalledKeys {
+		pk, err := UnmarshalPublicEKFromPEM(pem)
 		if err != nil {
 			return nil, fmt.Errorf("failed to unmarshal public EK: %v", err)
 		}
+		keys = append(keys, pk)
+	}
 
-		// insert it into the tree
-		root, nodeQueue = insertPublicNode(root, pk, nodeQueue)
+	return publicTreeFromKeys(keys, order)
+}
+
+// publicTreeFromKeys constructs a public tree from a list of keys in the
+// given order.  The list alone does not determine the tree's shape, but the
+// shape of a left-balanced tree is fixed by its number of leaves, and a tree
+// with n leaves has 2n-1 nodes.  So, first build the shape, and then fill in
+// the keys in order.
+func publicTreeFromKeys(keys []*ecdh.PublicKey, order string) (*PublicNode, error) {
+	if len(keys) == 0 {
+		return nil, ErrEmptyTree
+	}
+	if len(keys)%2 == 0 {
+		return nil, fmt.Errorf("invalid number of tree keys (%d); a tree has an odd number of nodes",
+			len(keys))
+	}
+
+	root := newPublicTreeShape((len(keys) + 1) / 2)
+	nodes, err := root.nodesInOrder(order)
+	if err != nil {
+		return nil, err
+	}
+	for i, node := range nodes {
+		node.pk = keys[i]
 	}
 
-	updatePublicHeights(root)
 	return root, nil
 }
 
-func insertPublicNode(root *PublicNode, pk *ecdh.PublicKey, nodeQueue []*PublicNode) (*PublicNode, []*PublicNode) {
-	node := &PublicNode{pk: pk, Left: nil, Right: nil, Height: 0}
+// newPublicTreeShape creates a left-balanced tree with numLeaves leaves and
+// no keys.
+func newPublicTreeShape(numLeaves int) *PublicNode {
+	if numLeaves < 1 {
+		mu.BUG("invalid number of leaves %d", numLeaves)
+	}
+	if numLeaves == 1 {
+		return &PublicNode{Height: 0}
+	}
 
-	if root.pk == nil {
-		root = node
-	} else if nodeQueue[0].Left == nil {
-		nodeQueue[0].Left = node
-		nodeQueue[0].Height = node.Height + 1
-	} else { //nodeQueue[0].right == nil
-		nodeQueue[0].Right = node
-		if nodeQueue[0].Left.Height < node.Height {
-			nodeQueue[0].Height = node.Height + 1
-		}
-		nodeQueue = nodeQueue[1:]
+	h := leftSubtreeSize(numLeaves)
+	left := newPublicTreeShape(h)
+	right := newPublicTreeShape(numLeaves - h)
+
+	height := left.Height + 1
+	if right.Height >= left.Height {
+		height = right.Height + 1
 	}
 
-	nodeQueue = append(nodeQueue, node)
-	return root, nodeQueue
+	return &PublicNode{Left: left, Right: right, Height: height}
 }
 
-func updatePublicHeights(node *PublicNode) *PublicNode {
+// CheckShape checks that the tree is structurally sound: every node has a
+// key, every internal node has two children, and the tree has exactly the
+// left-balanced shape for its number of leaves, with heights to match.  A
+// tree decoded from a level-order list of keys always passes, since the list
+// only determines the number of leaves; the check guards against trees that
+// were built or modified through PublicNode's exported fields, in which a
+// leaf can sit where an internal node belongs, or vice versa.
+func (publicNode *PublicNode) CheckShape() error {
+	numLeaves, err := countLeaves(publicNode)
+	if err != nil {
+		return err
+	}
+	return checkShape(publicNode, newPublicTreeShape(numLeaves), 0)
+}
+
+// countLeaves counts the leaves of the tree without assuming its shape.
+func countLeaves(node *PublicNode) (int, error) {
+	if node == nil {
+		return 0, errors.New("the tree has a missing node")
+	}
 	if node.Left == nil && node.Right == nil {
-		node.Height = 0
-		return node
+		return 1, nil
+	}
+	if node.Left == nil || node.Right == nil {
+		return 0, errors.New("the tree has an internal node with only one child")
+	}
+	left, err := countLeaves(node.Left)
+	if err != nil {
+		return 0, err
 	}
+	right, err := countLeaves(node.Right)
+	if err != nil {
+		return 0, err
+	}
+	return left + right, nil
+}
 
-	left := updatePublicHeights(node.Left)
-	right := updatePublicHeights(node.Right)
+// checkShape checks node, at the given depth, against the corresponding node
+// of the expected shape.
+func checkShape(node, want *PublicNode, depth int) error {
+	if node.GetPk() == nil {
+		return fmt.Errorf("a node at depth %d has no key", depth)
+	}
 
-	if left.Height > right.Height {
-		node.Height = left.Height + 1
-	} else {
-		node.Height = right.Height + 1
+	isLeaf := node.Left == nil
+	switch {
+	case isLeaf && want.Height != 0:
+		return fmt.Errorf("a node at depth %d is a leaf, but should be an internal node", depth)
+	case !isLeaf && want.Height == 0:
+		return fmt.Errorf("a node at depth %d is an internal node, but should be a leaf", depth)
+	case node.Height != want.Height:
+		return fmt.Errorf("a node at depth %d has height %d; expected %d", depth,
+			node.Height, want.Height)
+	case isLeaf:
+		return nil
 	}
-	return node
+
+	if err := checkShape(node.Left, want.Left, depth+1); err != nil {
+		return err
+	}
+	return checkShape(node.Right, want.Right, depth+1)
 }
 
-func CoPath(root *PublicNode, idx int, copathNodes []*ecdh.PublicKey) []*ecdh.PublicKey {
-	// if len(copathNodes) == 0 {
-	// 	copathNodes = append(copathNodes, root.GetPk())
-	// }
+// LeafDepths returns the depth (the number of edges from the root) of each
+// leaf of a left-balanced tree with numLeaves leaves, in member order.  A
+// member's depth is the number of DHs needed to derive the tree key from its
+// leaf key.
+func LeafDepths(numLeaves int) []int {
+	if numLeaves < 1 {
+		return nil
+	}
+	if numLeaves == 1 {
+		return []int{0}
+	}
 
-	// height of 0 means we're at the leaf
-	if root.Height == 0 {
-		// copathNodes = append(copathNodes, root)
-		return copathNodes
+	h := leftSubtreeSize(numLeaves)
+	depths := append(LeafDepths(h), LeafDepths(numLeaves-h)...)
+	for i := range depths {
+		depths[i]++
 	}
+	return depths
+}
 
-	// leaf is in the left subtree
-	if idx <= int(math.Pow(2, float64(root.Height)))/2 {
-		copathNodes = append(copathNodes, root.Right.GetPk())
-		return CoPath(root.Left, idx, copathNodes)
-	} else { // leaf is in the right subtree
-		idx = idx - int(math.Pow(2, float64(root.Height)))/2
-		copathNodes = append(copathNodes, root.Left.GetPk())
-		return CoPath(root.Right, idx, copathNodes)
+// levelOrder returns the tree's nodes level-by-level, starting at the root;
+// this is the order of MarshalKeys.  A node's position in this list is its
+// node index, so the root is node 0.
+func (publicNode *PublicNode) levelOrder() []*PublicNode {
+	if publicNode == nil {
+		return nil
 	}
+
+	nodes := []*PublicNode{publicNode}
+	for i := 0; i < len(nodes); i++ {
+		if nodes[i].Left != nil {
+			nodes = append(nodes, nodes[i].Left)
+		}
+		if nodes[i].Right != nil {
+			nodes = append(nodes, nodes[i].Right)
+		}
+	}
+	return nodes
+}
+
+// directPath returns the nodes from the root down to the leaf of the member
+// at position idx.
+func directPath(root *PublicNode, idx int) []*PublicNode {
+	nodes := make([]*PublicNode, 0, root.Height+1)
+
+	node := root
+	for node.Height != 0 {
+		nodes = append(nodes, node)
+		half := leftSubtreeLeaves(node.Height)
+		if idx <= half { // leaf is in the left subtree
+			node = node.Left
+		} else { // leaf is in the right subtree
+			idx = idx - half
+			node = node.Right
+		}
+	}
+
+	return append(nodes, node)
+}
+
+// PathIndices returns the node indices of the path from the leaf of the
+// member at position leafIndex (the first member is at index 1) up to and
+// including the root.  Node indices are positions in the level-order listing
+// of the tree (the order of MarshalKeys and of a setup message's TreeKeys),
+// so the last entry is always 0.
+func PathIndices(root *PublicNode, leafIndex int) ([]int, error) {
+	if err := checkLeafIndex(root, leafIndex); err != nil {
+		return nil, err
+	}
+
+	nodeIndex := make(map[*PublicNode]int)
+	for i, node := range root.levelOrder() {
+		nodeIndex[node] = i
+	}
+
+	path := directPath(root, leafIndex)
+	indices := make([]int, 0, len(path))
+	for i := len(path) - 1; i >= 0; i-- {
+		indices = append(indices, nodeIndex[path[i]])
+	}
+
+	return indices, nil
+}
+
+// AddFrontier returns the node indices (see PathIndices) of the nodes whose
+// public keys an adder must know to insert the next leaf, i.e., the leaf of
+// member root.NumLeaves()+1.  These are the roots of the full subtrees
+// along the tree's right spine, from the root's left child down: in the
+// tree grown by one leaf, they are the new leaf's copath, and they keep
+// their keys.  So a server can serve joins from these nodes alone.  If the
+// tree is full, the frontier is just the root ([0]), which becomes the new
+// root's left child.
+func AddFrontier(root *PublicNode) ([]int, error) {
+	if root == nil {
+		return nil, errors.New("empty tree")
+	}
+	if err := root.CheckShape(); err != nil {
+		return nil, err
+	}
+
+	nodeIndex := make(map[*PublicNode]int)
+	for i, node := range root.levelOrder() {
+		nodeIndex[node] = i
+	}
+
+	var frontier []int
+	node, numLeaves := root, root.NumLeaves()
+	for numLeaves&(numLeaves-1) != 0 { // the subtree at node is not full
+		frontier = append(frontier, nodeIndex[node.Left])
+		numLeaves -= leftSubtreeLeaves(node.Height)
+		node = node.Right
+	}
+
+	return append(frontier, nodeIndex[node]), nil
+}
+
+// PCSFrontier returns the positions of the members that must each send an
+// update before the stage key is secure again (post-compromise security)
+// after the state of the member at position compromisedIndex leaks.  The
+// state holds the member's leaf key, from which the adversary derives every
+// key on the member's path; since an update message carries the new public
+// keys on the updater's path, the adversary can also process every other
+// member's update, as the member itself would.  So only the member's own
+// update, which replaces its leaf key and its whole path, heals the group:
+// the result is just compromisedIndex.  Keys off the member's path were
+// never exposed.
+func PCSFrontier(root *PublicNode, compromisedIndex int) ([]int, error) {
+	if err := checkLeafIndex(root, compromisedIndex); err != nil {
+		return nil, err
+	}
+	return []int{compromisedIndex}, nil
+}
+
+// treeLinks describes the shape of a tree in terms of node indices (see
+// PathIndices): the parent and children of each node, and the span lo
+// through hi of the leaf positions under it.  An absent parent or child is
+// -1.  A span counts blank leaves (see placeMembers) as well as members'
+// leaves, so not every position in it is a member's.
+type treeLinks struct {
+	parent, left, right []int
+	lo, hi              []int
+}
+
+func newTreeLinks(root *PublicNode) *treeLinks {
+	nodes := root.levelOrder()
+	n := len(nodes)
+	links := &treeLinks{
+		parent: make([]int, n),
+		left:   make([]int, n),
+		right:  make([]int, n),
+		lo:     make([]int, n),
+		hi:     make([]int, n),
+	}
+
+	nodeIndex := make(map[*PublicNode]int, n)
+	for i, node := range nodes {
+		nodeIndex[node] = i
+	}
+
+	links.parent[0] = -1
+	links.lo[0], links.hi[0] = 1, root.NumLeaves()
+	for i, node := range nodes { // parents come before their children
+		links.left[i], links.right[i] = -1, -1
+		if node.Height == 0 {
+			continue
+		}
+		l, r := nodeIndex[node.Left], nodeIndex[node.Right]
+		links.left[i], links.right[i] = l, r
+		links.parent[l], links.parent[r] = i, i
+
+		mid := links.lo[i] + leftSubtreeLeaves(node.Height)
+		links.lo[l], links.hi[l] = links.lo[i], mid-1
+		links.lo[r], links.hi[r] = mid, links.hi[i]
+	}
+
+	return links
+}
+
+func (links *treeLinks) checkNodeIndex(index int) error {
+	if index < 0 || index >= len(links.parent) {
+		return fmt.Errorf("node index %d out of range [0, %d]", index, len(links.parent)-1)
+	}
+	return nil
+}
+
+// sibling returns the node index of the sibling of the (non-root) node at
+// index.
+func (links *treeLinks) sibling(index int) int {
+	p := links.parent[index]
+	if links.left[p] == index {
+		return links.right[p]
+	}
+	return links.left[p]
+}
+
+// Parent returns the node index of the parent of the node at the given node
+// index.
+func Parent(root *PublicNode, index int) (int, error) {
+	links := newTreeLinks(root)
+	if err := links.checkNodeIndex(index); err != nil {
+		return 0, err
+	}
+	if index == 0 {
+		return 0, errors.New("the root has no parent")
+	}
+	return links.parent[index], nil
+}
+
+// Sibling returns the node index of the sibling of the node at the given node
+// index: the other child of its parent.  The copath of a leaf is the list of
+// siblings of the nodes on its direct path.
+func Sibling(root *PublicNode, index int) (int, error) {
+	links := newTreeLinks(root)
+	if err := links.checkNodeIndex(index); err != nil {
+		return 0, err
+	}
+	if index == 0 {
+		return 0, errors.New("the root has no sibling")
+	}
+	return links.sibling(index), nil
+}
+
+// LeafSpan returns the positions of the first and the last leaf (inclusive)
+// in the subtree rooted at the node at the given node index.  Some of the
+// leaves in the span may be blank.
+func LeafSpan(root *PublicNode, index int) (lo, hi int, err error) {
+	links := newTreeLinks(root)
+	if err := links.checkNodeIndex(index); err != nil {
+		return 0, 0, err
+	}
+	return links.lo[index], links.hi[index], nil
+}
+
+// CommonAncestorDepth returns the depth (the number of edges from the root)
+// of the lowest common ancestor of the leaves of the members at positions a
+// and b.  The root is at depth 0; if a == b, the result is the depth of a's
+// leaf.
+func CommonAncestorDepth(root *PublicNode, a, b int) (int, error) {
+	if err := checkLeafIndex(root, a); err != nil {
+		return 0, err
+	}
+	if err := checkLeafIndex(root, b); err != nil {
+		return 0, err
+	}
+
+	pathA, pathB := directPath(root, a), directPath(root, b)
+	depth := 0
+	for depth+1 < len(pathA) && depth+1 < len(pathB) && pathA[depth+1] == pathB[depth+1] {
+		depth++
+	}
+	return depth, nil
+}
+
+// AreSiblings reports whether the leaves of the members at positions a and b
+// are siblings, i.e., children of the same node, so that each is the other's
+// first copath node.
+func AreSiblings(root *PublicNode, a, b int) (bool, error) {
+	depth, err := CommonAncestorDepth(root, a, b)
+	if err != nil {
+		return false, err
+	}
+
+	depths := LeafDepths(root.NumLeaves())
+	return a != b && depths[a-1] == depth+1 && depths[b-1] == depth+1, nil
+}
+
+// DirectPath returns the nodes on the direct path of the member at position
+// leafIndex: its leaf and the leaf's ancestors, from the leaf up to and
+// including the root, in the order of PathIndices.  The siblings of the
+// direct path's nodes, but the root, are the copath (see CoPath); together,
+// the two cover each level of the tree from the leaf's to the root's.
+func DirectPath(root *PublicNode, leafIndex int) ([]*PublicNode, error) {
+	if err := checkLeafIndex(root, leafIndex); err != nil {
+		return nil, err
+	}
+
+	path := directPath(root, leafIndex)
+	nodes := make([]*PublicNode, 0, len(path))
+	for i := len(path) - 1; i >= 0; i-- {
+		nodes = append(nodes, path[i])
+	}
+
+	return nodes, nil
+}
+
+// CoPath appends to copathNodes the public keys of the copath of the member
+// at position idx, from the root's child down to the leaf's sibling.
+func CoPath(root *PublicNode, idx int, copathNodes []*ecdh.PublicKey) ([]*ecdh.PublicKey, error) {
+	if err := checkLeafIndex(root, idx); err != nil {
+		return nil, err
+	}
+
+	path := directPath(root, idx)
+	for i := 0; i < len(path)-1; i++ {
+		if path[i+1] == path[i].Left { // leaf is in the left subtree
+			copathNodes = append(copathNodes, path[i].Right.GetPk())
+		} else { // leaf is in the right subtree
+			copathNodes = append(copathNodes, path[i].Left.GetPk())
+		}
+	}
+
+	return copathNodes, nil
+}
+
+// CoPathIndices returns the node indices (see PathIndices) of the copath of
+// the member at position idx, in the order of CoPath: from the root's child
+// down to the leaf's sibling.
+func CoPathIndices(root *PublicNode, idx int) ([]int, error) {
+	path, err := PathIndices(root, idx)
+	if err != nil {
+		return nil, err
+	}
+
+	links := newTreeLinks(root)
+	indices := make([]int, 0, len(path)-1)
+	for i := len(path) - 2; i >= 0; i-- {
+		indices = append(indices, links.sibling(path[i]))
+	}
+
+	return indices, nil
 }
 
 func DeriveLeafKey(ekPath string, suk *ecdh.PublicKey) (*ecdh.PrivateKey, error) {
@@ -383,6 +1179,12 @@ func DeriveLeafKey(ekPath string, suk *ecdh.PublicKey) (*ecdh.PrivateKey, error)
 		return nil, fmt.Errorf("can't read private key file: %v", err)
 	}
 
+	return DeriveLeafKeyFromEK(ek, suk)
+}
+
+// DeriveLeafKeyFromEK is like DeriveLeafKey, but takes the private EK itself
+// rather than its file.
+func DeriveLeafKeyFromEK(ek *ecdh.PrivateKey, suk *ecdh.PublicKey) (*ecdh.PrivateKey, error) {
 	raw, err := KeyExchange(ek, suk)
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate the member's leaf key: %v", err)
@@ -404,115 +1206,367 @@ func DeriveLeafKeyOrFail(privKeyFile string, setupKey *ecdh.PublicKey) *ecdh.Pri
 	return leafKey
 }
 
-func MarshallTreeState(state *TreeState) *treeJson {
+func marshalTreeState(state *TreeState) (*treeJson, error) {
 	publicTree, err := state.PublicTree.MarshalKeys()
 	if err != nil {
-		mu.Fatalf("failed to marshal the public keys: %v", err)
+		return nil, fmt.Errorf("failed to marshal the public keys: %v", err)
 	}
 
 	sk, err := MarshalPrivateIKToPEM(state.Sk)
 	if err != nil {
-		mu.Fatalf("error marshaling private stage key: %v", err)
+		return nil, fmt.Errorf("error marshaling private stage key: %v", err)
 	}
 
 	lk, err := MarshalPrivateEKToPEM(state.Lk)
 	if err != nil {
-		mu.Fatalf("error marshalling private leaf key: %v", err)
+		return nil, fmt.Errorf("error marshalling private leaf key: %v", err)
 	}
-	return &treeJson{publicTree, sk, lk, state.IKeys}
+	var setupMsgHash []byte
+	if state.SetupMessageHash != [sha256.Size]byte{} {
+		setupMsgHash = state.SetupMessageHash[:]
+	}
+	version := treeStateVersion2
+	if state.EpochSecret != nil {
+		version = treeStateVersion3
+	}
+	return &treeJson{
+		Version:          version,
+		PublicTree:       publicTree,
+		Sk:               sk,
+		Lk:               lk,
+		IKeys:            state.IKeys,
+		TranscriptHash:   state.TranscriptHash,
+		SetupMessageHash: setupMsgHash,
+		Epoch:            state.Epoch,
+		LeafMetadata:     state.LeafMetadata,
+		EpochSecret:      state.EpochSecret,
+	}, nil
 }
 
-func UnMarshallTreeState(tree *treeJson) *TreeState {
+// migrateTreeState upgrades a serialized state of an older version to the
+// current version, or fails if the state is of a version this build does not
+// know.  The hashes of an unversioned state may be missing; they cannot be
+// recomputed without the messages they digest, so they are left empty (a
+// missing SetupMessageHash is zero, and a missing TranscriptHash restarts the
+// transcript at the next message).
+func migrateTreeState(tree *treeJson) error {
+	switch {
+	case tree.Version == 0:
+		tree.Version = treeStateVersion2
+	case tree.Version < 0 || tree.Version > treeStateVersion:
+		return fmt.Errorf("the state is of version %d, but this build only supports "+
+			"versions up to %d; upgrade the tools", tree.Version, treeStateVersion)
+	}
+	return nil
+}
+
+// unmarshalTreeState decodes tree.  If partial is set, the stage key and the
+// leaf key may be missing, in which case they are left nil.
+func unmarshalTreeState(tree *treeJson, partial bool) (*TreeState, error) {
 	var err error
 	var treeState TreeState
 
+	if err := migrateTreeState(tree); err != nil {
+		return nil, err
+	}
+
 	treeState.IKeys = tree.IKeys
+	treeState.TranscriptHash = tree.TranscriptHash
+	treeState.Epoch = tree.Epoch
+	treeState.LeafMetadata = tree.LeafMetadata
+
+	if tree.EpochSecret != nil {
+		if len(tree.EpochSecret) != StageKeySize {
+			return nil, fmt.Errorf("epoch secret has %d bytes; expected %d",
+				len(tree.EpochSecret), StageKeySize)
+		}
+		treeState.EpochSecret = tree.EpochSecret
+	}
+
+	if len(tree.SetupMessageHash) != 0 {
+		if len(tree.SetupMessageHash) != sha256.Size {
+			return nil, fmt.Errorf("setup message hash has %d bytes; expected %d",
+				len(tree.SetupMessageHash), sha256.Size)
+		}
+		copy(treeState.SetupMessageHash[:], tree.SetupMessageHash)
+	}
 
 	treeState.PublicTree, err = UnmarshalKeysToPublicTree(tree.PublicTree)
 	if err != nil {
-		mu.Fatalf("error unmarshalling private tree from TREE_FILE", err)
+		return nil, fmt.Errorf("error unmarshalling public tree: %v", err)
 	}
 
-	treeState.Sk, err = UnmarshalPrivateIKFromPEM(tree.Sk)
-	if err != nil {
-		mu.Fatalf("error unmarshalling private stage key from TREE_FILE: %v", err)
+	if !partial || len(tree.Sk) != 0 {
+		treeState.Sk, err = UnmarshalPrivateIKFromPEM(tree.Sk)
+		if err != nil {
+			return nil, fmt.Errorf("error unmarshalling private stage key: %v", err)
+		}
+	}
+
+	if !partial || len(tree.Lk) != 0 {
+		treeState.Lk, err = UnmarshalPrivateEKFromPEM(tree.Lk)
+		if err != nil {
+			return nil, fmt.Errorf("error unmarshalling private leaf key: %v", err)
+		}
 	}
 
-	treeState.Lk, err = UnmarshalPrivateEKFromPEM(tree.Lk)
+	return &treeState, nil
+}
+
+func MarshallTreeState(state *TreeState) *treeJson {
+	tree, err := marshalTreeState(state)
 	if err != nil {
-		mu.Fatalf("error unmarshalling private leaf key from TREE_FILE: %v", err)
+		mu.Fatalf("%v", err)
 	}
+	return tree
+}
 
-	return &treeState
+func UnMarshallTreeState(tree *treeJson) *TreeState {
+	treeState, err := unmarshalTreeState(tree, false)
+	if err != nil {
+		mu.Fatalf("%v from TREE_FILE", err)
+	}
+	return treeState
 }
 
 func (treeState *TreeState) UnMarshallTreeState(tree *treeJson) {
-	var err error
-
-	treeState.IKeys = tree.IKeys
+	*treeState = *UnMarshallTreeState(tree)
+}
 
-	treeState.PublicTree, err = UnmarshalKeysToPublicTree(tree.PublicTree)
+// WriteTreeState writes the JSON encoding of state to w.
+func WriteTreeState(w io.Writer, state *TreeState) error {
+	tree, err := marshalTreeState(state)
 	if err != nil {
-		mu.Fatalf("error unmarshalling private tree from TREE_FILE", err)
+		return err
+	}
+	if state.MACKey != nil {
+		if err := CheckStateMACKey(state.MACKey); err != nil {
+			return err
+		}
+		if tree.MAC, err = tree.mac(state.MACKey); err != nil {
+			return err
+		}
 	}
 
-	treeState.Sk, err = UnmarshalPrivateIKFromPEM(tree.Sk)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "    ")
+	return enc.Encode(tree)
+}
+
+// ReadTreeState reads a JSON-encoded tree state from r.  The state's MAC,
+// if any, is not checked.
+func ReadTreeState(r io.Reader) (*TreeState, error) {
+	return readTreeState(r, false, nil)
+}
+
+// ReadTreeStateWithMAC is like ReadTreeState, but fails with ErrStateMAC
+// unless the state's MAC verifies with macKey (see TreeState.MACKey), and
+// sets the state's MACKey to macKey.  A nil macKey checks nothing.
+func ReadTreeStateWithMAC(r io.Reader, macKey []byte) (*TreeState, error) {
+	return readTreeState(r, false, macKey)
+}
+
+// readTreeState reads a JSON-encoded tree state from r, and checks its MAC
+// with macKey; partial is as for unmarshalTreeState.
+func readTreeState(r io.Reader, partial bool, macKey []byte) (*TreeState, error) {
+	var tree treeJson
+
+	decoder := json.NewDecoder(r)
+	err := decoder.Decode(&tree)
 	if err != nil {
-		mu.Fatalf("error unmarshalling private stage key from TREE_FILE: %v", err)
+		return nil, fmt.Errorf("can't decode tree state: %v", err)
 	}
 
-	treeState.Lk, err = UnmarshalPrivateEKFromPEM(tree.Lk)
+	if err := tree.checkMAC(macKey); err != nil {
+		return nil, err
+	}
+	state, err := unmarshalTreeState(&tree, partial)
 	if err != nil {
-		mu.Fatalf("error unmarshalling private leaf key from TREE_FILE: %v", err)
+		return nil, err
 	}
+	state.MACKey = macKey
+	return state, nil
 }
 
-func ReadTreeState(treeStateFile string) *TreeState {
-	var tree treeJson
+// SaveTreeState writes state to the file treeStateFile.  The file is
+// replaced atomically, so a failed write leaves any previous state intact.
+func SaveTreeState(treeStateFile string, state *TreeState) error {
+	// the state holds private keys, so it is only readable by its owner
+	return fileutl.Write(treeStateFile, 0600, func(w io.Writer) error {
+		return WriteTreeState(w, state)
+	})
+}
 
-	treeFile, err := os.Open(treeStateFile)
+// SaveNewTreeState is like SaveTreeState, but fails closed if treeStateFile
+// already exists, rather than replacing a state (and its leaf key) that may
+// still be needed; the error then wraps fs.ErrExist.
+func SaveNewTreeState(treeStateFile string, state *TreeState) error {
+	return fileutl.WriteNew(treeStateFile, 0600, func(w io.Writer) error {
+		return WriteTreeState(w, state)
+	})
+}
+
+// LoadTreeState reads the tree state stored in the file treeStateFile.  The
+// state's MAC, if any, is not checked.
+func LoadTreeState(treeStateFile string) (*TreeState, error) {
+	return loadTreeState(treeStateFile, false, nil)
+}
+
+// LoadTreeStateWithMAC is like LoadTreeState, but checks the state's MAC
+// with macKey, as ReadTreeStateWithMAC does.
+func LoadTreeStateWithMAC(treeStateFile string, macKey []byte) (*TreeState, error) {
+	return loadTreeState(treeStateFile, false, macKey)
+}
+
+// LoadPartialTreeState is like LoadTreeState, but accepts a state that is
+// missing its stage key or its leaf key (e.g., one written by an older
+// tool); the missing keys are nil.  See RepairLeafKey.
+func LoadPartialTreeState(treeStateFile string) (*TreeState, error) {
+	return loadTreeState(treeStateFile, true, nil)
+}
+
+// LoadPartialTreeStateWithMAC is like LoadPartialTreeState, but checks the
+// state's MAC with macKey, as ReadTreeStateWithMAC does.
+func LoadPartialTreeStateWithMAC(treeStateFile string, macKey []byte) (*TreeState, error) {
+	return loadTreeState(treeStateFile, true, macKey)
+}
+
+// VerifyTreeStateFile checks the state of the member at position index in
+// treeStateFile for corruption or tampering: its MAC must verify with macKey
+// (see ReadTreeStateWithMAC; a nil macKey skips the check), and the state
+// must pass CheckConsistency.
+func VerifyTreeStateFile(index int, treeStateFile string, macKey []byte) error {
+	state, err := LoadTreeStateWithMAC(treeStateFile, macKey)
 	if err != nil {
-		mu.Fatalf("error opening file %s", treeStateFile)
+		return fmt.Errorf("can't read tree state from %s: %v", treeStateFile, err)
 	}
+	if err := state.CheckConsistency(index); err != nil {
+		return fmt.Errorf("%s is corrupt: %v", treeStateFile, err)
+	}
+	return nil
+}
 
-	decoder := json.NewDecoder(treeFile)
-	err = decoder.Decode(&tree)
+func loadTreeState(treeStateFile string, partial bool, macKey []byte) (*TreeState, error) {
+	treeFile, err := os.Open(treeStateFile)
 	if err != nil {
-		mu.Fatalf("error reading tree state from %s", treeStateFile)
+		return nil, err
 	}
-
 	defer treeFile.Close()
 
-	return UnMarshallTreeState(&tree)
+	return readTreeState(treeFile, partial, macKey)
 }
 
-// update the full tree with the new leaf and path keys
+// RepairLeafKey fills in the leaf key of the member at position index, which
+// the member re-derived from its private EK and the group's SUK, into a state
+// that lacks it.  The leaf key must still be the one in the tree, i.e., the
+// member must not have updated its leaf key since setup.
+//
+// If the state also lacks the stage key, the stage key (and the epoch
+// secret, if the group's suite derives one) is re-derived as of setup from
+// setupMsg, the setup message the state was derived from, just as
+// processing the message derives it: from the message's tree keys, in the
+// order of its suite.  This is only correct if no update has been applied
+// to the state, so the state must still be at epoch 0, with the message's
+// tree.  setupMsg may be nil if the state has its stage key.  RepairLeafKey
+// reports whether it re-derived the stage key.
+func (treeState *TreeState) RepairLeafKey(index int, leafKey *ecdh.PrivateKey,
+	setupMsg *SetupMessage) (bool, error) {
+
+	if err := checkLeafIndex(treeState.PublicTree, index); err != nil {
+		return false, err
+	}
+
+	leaf := treeState.PublicTree.Leaves()[index-1]
+	if !leaf.GetPk().Equal(PublicOf(leafKey)) {
+		return false, fmt.Errorf("the derived leaf key does not match leaf %d: either "+
+			"the private EK or the SUK is wrong, or the member has updated its "+
+			"leaf key since setup", index)
+	}
+
+	if treeState.Sk != nil {
+		treeState.Lk = leafKey
+		return false, nil
+	}
+
+	if setupMsg == nil {
+		return false, errors.New("the state has no stage key; the setup message is " +
+			"needed to re-derive it")
+	}
+	if err := treeState.checkSetupMessage(setupMsg); err != nil {
+		return false, err
+	}
+
+	treeState.Lk = leafKey
+	treeSecret := treeState.DeriveTreeKey(index)
+	treeState.Sk = setupMsg.DeriveStageKey(treeSecret)
+	treeState.EpochSecret = setupMsg.DeriveEpochSecret(treeSecret)
+	return true, nil
+}
+
+// checkSetupMessage checks that the state is as setupMsg left it: that it
+// was derived from setupMsg (if the state records the message's hash), and
+// that no update has been applied since.
+func (treeState *TreeState) checkSetupMessage(setupMsg *SetupMessage) error {
+	if treeState.SetupMessageHash != [sha256.Size]byte{} &&
+		treeState.SetupMessageHash != setupMsg.Hash() {
+		return errors.New("the state was not derived from the setup message")
+	}
+	if treeState.Epoch != 0 {
+		return fmt.Errorf("the state is at epoch %d; the stage key can only be "+
+			"re-derived as of setup", treeState.Epoch)
+	}
+
+	setupTree, err := UnmarshalKeysToPublicTreeOrder(setupMsg.TreeKeys,
+		setupMsg.GetSuite().Order)
+	if err != nil {
+		return fmt.Errorf("error unmarshalling the setup message's tree: %v", err)
+	}
+	setupKeys, err := setupTree.MarshalKeys()
+	if err != nil {
+		return err
+	}
+	stateKeys, err := treeState.PublicTree.MarshalKeys()
+	if err != nil {
+		return err
+	}
+	if len(setupKeys) != len(stateKeys) {
+		return errors.New("the state's tree is not the setup message's")
+	}
+	for i := range setupKeys {
+		if !bytes.Equal(setupKeys[i], stateKeys[i]) {
+			return errors.New("the state's tree is not the setup message's: an " +
+				"update has been applied to the state")
+		}
+	}
+	return nil
+}
+
+// UpdatePublicTree replaces the public keys on the path of the member at
+// position idx with pathKeys, which are ordered from the leaf up to the root.
 func UpdatePublicTree(pathKeys []*ecdh.PublicKey, root *PublicNode,
-	idx int) *PublicNode {
-	// height of 0 means we're at the leaf
-	if root.Height == 0 {
-		root.UpdatePk(pathKeys[0])
-		// copathNodes = append(copathNodes, root)
-		return root
+	idx int) (*PublicNode, error) {
+	if err := checkLeafIndex(root, idx); err != nil {
+		return nil, err
 	}
 
-	// leaf is in the left subtree
-	if idx <= int(math.Pow(2, float64(root.Height)))/2 {
-		root.UpdatePk(pathKeys[len(pathKeys)-1])
-		root.Left = UpdatePublicTree(pathKeys[:len(pathKeys)-1], root.Left, idx)
+	path := directPath(root, idx)
+	if len(pathKeys) != len(path) {
+		return nil, fmt.Errorf("got %d path keys for leaf %d; expected %d",
+			len(pathKeys), idx, len(path))
+	}
 
-	} else { // leaf is in the right subtree
-		idx = idx - int(math.Pow(2, float64(root.Height)))/2
-		root.UpdatePk(pathKeys[len(pathKeys)-1])
-		root.Right = UpdatePublicTree(pathKeys[:len(pathKeys)-1], root.Right, idx)
+	for i, node := range path {
+		node.UpdatePk(pathKeys[len(pathKeys)-1-i])
 	}
-	return root
+	return root, nil
 }
 
 func UpdateCoPathNodes(index int, state *TreeState) []*ecdh.PrivateKey {
 	// get the copath nodes
-	copathNodes := make([]*ecdh.PublicKey, 0)
-	copathNodes = CoPath(state.PublicTree, index, copathNodes)
+	copathNodes, err := CoPath(state.PublicTree, index, nil)
+	if err != nil {
+		mu.Fatalf("error finding the copath: %v", err)
+	}
 
 	// with the leaf key, derive the private keys on the path up to the root
 	pathKeys, err := PathNodeKeys(state.Lk, copathNodes)
@@ -523,14 +1577,14 @@ func UpdateCoPathNodes(index int, state *TreeState) []*ecdh.PrivateKey {
 	return pathKeys
 }
 
-func generateTree(leafKeys []*ecdh.PrivateKey) (*ecdh.PrivateKey, *PublicNode) {
+func generateTree(leafKeys []*ecdh.PrivateKey) (*ecdh.PrivateKey, *PublicNode, error) {
 	treeRoot, err := CreateTree(leafKeys)
 	if err != nil {
-		mu.Fatalf("failed to create ART tree: %v", err)
+		return nil, nil, fmt.Errorf("failed to create ART tree: %v", err)
 	}
 
 	treePublic := treeRoot.PublicKeys()
 	treeSecret := treeRoot.GetSk() // TODO: rename to just treeRoot.Key(); // this is tk
 
-	return treeSecret, treePublic
+	return treeSecret, treePublic, nil
 }
@@ -0,0 +1,1065 @@
+package art
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestLeftSubtreeSize(t *testing.T) {
+	// sizes 0 to 17; trees of 0 or 1 leaves have no left subtree
+	want := []int{0, 0, 1, 2, 2, 4, 4, 4, 4, 8, 8, 8, 8, 8, 8, 8, 8, 16}
+	for x, w := range want {
+		if got := leftSubtreeSize(x); got != w {
+			t.Errorf("leftSubtreeSize(%d) = %d, want %d", x, got, w)
+		}
+	}
+
+	// exact at the top of the int range, where float arithmetic was not
+	if got, w := leftSubtreeSize(math.MaxInt), 1<<(bits.UintSize-2); got != w {
+		t.Errorf("leftSubtreeSize(MaxInt) = %d, want %d", got, w)
+	}
+	if got := leftSubtreeSize(-1); got != 0 {
+		t.Errorf("leftSubtreeSize(-1) = %d, want 0", got)
+	}
+}
+
+func TestTreeShapes(t *testing.T) {
+	for n := 1; n <= 17; n++ {
+		root := newPublicTreeShape(n)
+		if got := root.NumLeaves(); got != n {
+			t.Errorf("%d leaves: NumLeaves = %d", n, got)
+		}
+		if got := len(root.levelOrder()); got != 2*n-1 {
+			t.Errorf("%d leaves: %d nodes, want %d", n, got, 2*n-1)
+		}
+		if got := len(root.Leaves()); got != n {
+			t.Errorf("%d leaves: Leaves returns %d", n, got)
+		}
+
+		// the left subtree is full, the right one at most as tall
+		if n > 1 {
+			left := root.Left.NumLeaves()
+			if left != leftSubtreeSize(n) || left&(left-1) != 0 {
+				t.Errorf("%d leaves: left subtree has %d leaves", n, left)
+			}
+			if root.Right.Height > root.Left.Height {
+				t.Errorf("%d leaves: right subtree taller than the left", n)
+			}
+		}
+
+		depths := LeafDepths(n)
+		for i, depth := range depths {
+			if got := len(directPath(root, i+1)) - 1; got != depth {
+				t.Errorf("%d leaves: leaf %d at depth %d, LeafDepths says %d", n, i+1,
+					got, depth)
+			}
+		}
+	}
+}
+
+func TestLeafIndexRange(t *testing.T) {
+	root := newPublicTreeShape(5)
+	for _, idx := range []int{0, -1, 6, math.MaxInt, math.MinInt} {
+		if _, err := CoPath(root, idx, nil); err == nil {
+			t.Errorf("CoPath accepted leaf index %d", idx)
+		}
+		if _, err := PathIndices(root, idx); err == nil {
+			t.Errorf("PathIndices accepted leaf index %d", idx)
+		}
+		if _, err := DirectPath(root, idx); err == nil {
+			t.Errorf("DirectPath accepted leaf index %d", idx)
+		}
+		if _, err := UpdatePublicTree(nil, root, idx); err == nil {
+			t.Errorf("UpdatePublicTree accepted leaf index %d", idx)
+		}
+	}
+}
+
+func TestSubtreeStageKeys(t *testing.T) {
+	for _, epochSecret := range []bool{false, true} {
+		g := newTestGroup(t, "subtree stage keys", 5, &SetupOptions{EpochSecret: epochSecret})
+		g.update(t, 3)
+
+		keys, err := SubtreeStageKeys(g.states, 0)
+		if err != nil {
+			t.Fatalf("epoch secret %v: SubtreeStageKeys: %v", epochSecret, err)
+		}
+		if len(keys) != len(g.states) {
+			t.Fatalf("epoch secret %v: got keys for %d members, want %d", epochSecret,
+				len(keys), len(g.states))
+		}
+		for i, state := range g.states {
+			next := *state
+			next.DeriveStageKey(next.DeriveTreeKey(i + 1))
+			if !StageKeyEqual(keys[i+1], next.Sk) {
+				t.Errorf("epoch secret %v: member %d's key is not the stage key "+
+					"DeriveStageKey derives", epochSecret, i+1)
+			}
+		}
+
+		// node 1 is the root's left child, the subtree of members 1 to 4
+		keys, err = SubtreeStageKeys(g.states, 1)
+		if err != nil {
+			t.Fatalf("epoch secret %v: SubtreeStageKeys: %v", epochSecret, err)
+		}
+		if len(keys) != 4 || keys[5] != nil {
+			t.Errorf("epoch secret %v: got keys for members %v, want 1 to 4", epochSecret,
+				keys)
+		}
+	}
+
+	if _, err := SubtreeStageKeys(nil, 0); err == nil {
+		t.Error("SubtreeStageKeys succeeded without states")
+	}
+}
+
+func TestCheckConsistencySwappedChildren(t *testing.T) {
+	tests := []struct {
+		name string
+		// parent returns the node whose children are swapped
+		parent func(root *PublicNode) *PublicNode
+	}{
+		{"root, subtrees of different shapes", func(root *PublicNode) *PublicNode { return root }},
+		{"root's left child, equal subtrees", func(root *PublicNode) *PublicNode { return root.Left }},
+		{"leaves of members 1 and 2", func(root *PublicNode) *PublicNode { return root.Left.Left }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := newTestGroup(t, "swapped children", 5, nil)
+			state := g.states[1]
+			if err := state.CheckConsistency(2); err != nil {
+				t.Fatalf("CheckConsistency of the untouched state: %v", err)
+			}
+
+			parent := tt.parent(state.PublicTree)
+			parent.Left, parent.Right = parent.Right, parent.Left
+			if err := state.CheckConsistency(2); err == nil {
+				t.Error("CheckConsistency accepted a tree with swapped children")
+			}
+		})
+	}
+}
+
+// TestVerifyPathTampered checks that VerifyPath names the node of a tampered
+// key on the member's path, and ignores a tampered key off the path, which
+// the member's keys don't depend on.
+func TestVerifyPathTampered(t *testing.T) {
+	const index = 2
+	g := newTestGroup(t, "verify path tampered", 5, nil)
+	if err := g.states[index-1].VerifyPath(index); err != nil {
+		t.Fatalf("VerifyPath of the untouched state: %v", err)
+	}
+	other, err := DHKeyGenFrom(testReader("verify path other key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// member 2's path is nodes 6, 3, 1 and 0 (see TestNodeRelations), and
+	// node 7 is member 3's leaf
+	tests := []struct {
+		node int
+		want string // the error, or "" if VerifyPath succeeds
+	}{
+		{6, "the leaf key does not match leaf 2"},
+		{3, "node 3 on the path of leaf 2"},
+		{1, "node 1 on the path of leaf 2"},
+		{0, "node 0 on the path of leaf 2"},
+		{7, ""},
+	}
+	for _, tt := range tests {
+		state := cloneState(t, g.states[index-1])
+		state.PublicTree.levelOrder()[tt.node].UpdatePk(other.PublicKey())
+		err := state.VerifyPath(index)
+		if tt.want == "" {
+			if err != nil {
+				t.Errorf("node %d tampered: got error %v, want success", tt.node, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("node %d tampered: got error %v, want %q", tt.node, err, tt.want)
+		}
+	}
+}
+
+// partialState returns a copy of the state of the member at position index,
+// without its leaf key or stage key, as an older tool wrote it.
+func (g *testGroup) partialState(index int) *TreeState {
+	state := *g.states[index-1]
+	state.Lk, state.Sk, state.EpochSecret = nil, nil, nil
+	return &state
+}
+
+func TestRepairLeafKey(t *testing.T) {
+	tests := []struct {
+		order       string
+		epochSecret bool
+	}{
+		{OrderLevel, false},
+		{OrderIn, false},
+		{OrderIn, true},
+	}
+
+	for _, tt := range tests {
+		name := fmt.Sprintf("order %s, epoch secret %v", tt.order, tt.epochSecret)
+		t.Run(name, func(t *testing.T) {
+			g := newTestGroup(t, "repair "+name, 5,
+				&SetupOptions{TreeOrder: tt.order, EpochSecret: tt.epochSecret})
+			want := g.states[1]
+			leafKey, err := DeriveLeafKeyFromEK(g.eks[1], g.setupMsg.GetSetupKey())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			state := g.partialState(2)
+			rederived, err := state.RepairLeafKey(2, leafKey, g.setupMsg)
+			if err != nil {
+				t.Fatalf("RepairLeafKey: %v", err)
+			}
+			if !rederived {
+				t.Error("RepairLeafKey did not report re-deriving the stage key")
+			}
+			if !StageKeyEqual(state.Sk, want.Sk) {
+				t.Error("the re-derived stage key is not the one processing the setup " +
+					"message derives")
+			}
+			if !bytes.Equal(state.EpochSecret, want.EpochSecret) {
+				t.Error("the re-derived epoch secret is not the one processing the " +
+					"setup message derives")
+			}
+
+			state = g.partialState(2)
+			if _, err := state.RepairLeafKey(2, leafKey, nil); err == nil {
+				t.Error("RepairLeafKey re-derived the stage key without the setup message")
+			}
+			other := newTestGroup(t, "repair other "+name, 5, &SetupOptions{TreeOrder: tt.order})
+			if _, err := state.RepairLeafKey(2, leafKey, other.setupMsg); err == nil {
+				t.Error("RepairLeafKey accepted another group's setup message")
+			}
+
+			g.update(t, 3)
+			state = g.partialState(2)
+			if _, err := state.RepairLeafKey(2, leafKey, g.setupMsg); err == nil {
+				t.Error("RepairLeafKey re-derived the setup stage key after an update")
+			}
+		})
+	}
+}
+
+func TestVerifyTreeStateFile(t *testing.T) {
+	otherKey := bytes.Repeat([]byte{1}, minStateMACKeySize)
+
+	tests := []struct {
+		name   string
+		tamper func(state *TreeState, g *testGroup)
+		macKey []byte
+		ok     bool
+	}{
+		{"consistent", func(*TreeState, *testGroup) {}, testStateMACKey, true},
+		{"no MAC check", func(*TreeState, *testGroup) {}, nil, true},
+		{"wrong MAC key", func(*TreeState, *testGroup) {}, otherKey, false},
+		{"swapped children", func(state *TreeState, _ *testGroup) {
+			root := state.PublicTree
+			root.Left, root.Right = root.Right, root.Left
+		}, testStateMACKey, false},
+		{"another member's leaf key", func(state *TreeState, g *testGroup) {
+			state.Lk = g.states[2].Lk
+		}, testStateMACKey, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := newTestGroup(t, "verify tree state file", 5, nil)
+			state := *g.states[1]
+			state.MACKey = testStateMACKey
+			tt.tamper(&state, g)
+
+			file := filepath.Join(t.TempDir(), "state.json")
+			if err := SaveTreeState(file, &state); err != nil {
+				t.Fatal(err)
+			}
+			err := VerifyTreeStateFile(2, file, tt.macKey)
+			if (err == nil) != tt.ok {
+				t.Errorf("got error %v, want success %v", err, tt.ok)
+			}
+		})
+	}
+
+	if err := VerifyTreeStateFile(2, filepath.Join(t.TempDir(), "missing.json"),
+		nil); err == nil {
+		t.Error("VerifyTreeStateFile accepted a missing file")
+	}
+}
+
+func TestMarshalKeysOrderRoundTrip(t *testing.T) {
+	r := testReader("marshal keys order")
+	for n := 1; n <= 9; n++ {
+		leafKeys := make([]*ecdh.PrivateKey, n)
+		for i := range leafKeys {
+			var err error
+			if leafKeys[i], err = DHKeyGenFrom(r); err != nil {
+				t.Fatal(err)
+			}
+		}
+		root, err := CreateTree(leafKeys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tree := root.PublicKeys()
+
+		for _, order := range []string{OrderLevel, OrderIn} {
+			keys, err := tree.MarshalKeysOrder(order)
+			if err != nil {
+				t.Fatalf("%d leaves, order %s: MarshalKeysOrder: %v", n, order, err)
+			}
+			decoded, err := UnmarshalKeysToPublicTreeOrder(keys, order)
+			if err != nil {
+				t.Fatalf("%d leaves, order %s: UnmarshalKeysToPublicTreeOrder: %v", n,
+					order, err)
+			}
+			if !bytes.Equal(decoded.Hash(), tree.Hash()) {
+				t.Errorf("%d leaves, order %s: the decoded tree differs", n, order)
+			}
+			again, err := decoded.MarshalKeysOrder(order)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.EqualFunc(keys, again, bytes.Equal) {
+				t.Errorf("%d leaves, order %s: the keys differ when re-encoded", n, order)
+			}
+		}
+	}
+}
+
+// TestMarshalKeysOrderLayout checks the layouts of the tree of three members
+// that MarshalKeysOrder documents: [r, a, l3, l1, l2] in OrderLevel, and
+// [l1, a, l2, r, l3] in OrderIn.
+func TestMarshalKeysOrderLayout(t *testing.T) {
+	r := testReader("marshal keys layout")
+	leafKeys := make([]*ecdh.PrivateKey, 3)
+	for i := range leafKeys {
+		var err error
+		if leafKeys[i], err = DHKeyGenFrom(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root, err := CreateTree(leafKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a is the parent of l1 and l2, and r the parent of a and l3
+	a, err := CombineKeys(leafKeys[0], PublicOf(leafKeys[1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rk, err := CombineKeys(a, PublicOf(leafKeys[2]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rk.Equal(root.GetSk()) {
+		t.Fatal("the tree secret is not DH(DH(l1, l2), l3)")
+	}
+
+	pem := func(key *ecdh.PrivateKey) []byte {
+		data, err := MarshalPublicEKToPEM(PublicOf(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	l1, l2, l3 := pem(leafKeys[0]), pem(leafKeys[1]), pem(leafKeys[2])
+	layouts := map[string][][]byte{
+		OrderLevel: {pem(rk), pem(a), l3, l1, l2},
+		OrderIn:    {l1, pem(a), l2, pem(rk), l3},
+	}
+
+	tree := root.PublicKeys()
+	for order, want := range layouts {
+		got, err := tree.MarshalKeysOrder(order)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.EqualFunc(got, want, bytes.Equal) {
+			t.Errorf("order %s: the keys are not in the documented layout", order)
+		}
+
+		decoded, err := UnmarshalKeysToPublicTreeOrder(want, order)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decoded.Hash(), tree.Hash()) {
+			t.Errorf("order %s: the documented layout decodes to another tree", order)
+		}
+	}
+
+	// the orders differ, so decoding in the wrong one gives another tree
+	misread, err := UnmarshalKeysToPublicTreeOrder(layouts[OrderIn], OrderLevel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(misread.Hash(), tree.Hash()) {
+		t.Error("the OrderIn layout decodes to the same tree in OrderLevel")
+	}
+}
+
+func TestEpochSecretChain(t *testing.T) {
+	const n = 4
+	g := newTestGroup(t, "epoch secret chain", n, &SetupOptions{EpochSecret: true})
+	seen := make(map[string]bool)
+
+	for epoch, index := range []int{0, 2, 4, 1, 3} {
+		prev := g.states[0]
+		prevEpochSecret, prevSk := prev.EpochSecret, prev.Sk
+		if epoch > 0 {
+			g.update(t, index)
+		}
+		g.checkAgree(t)
+
+		state := g.states[0]
+		if len(state.EpochSecret) != StageKeySize {
+			t.Fatalf("epoch %d: the epoch secret is %d bytes", epoch,
+				len(state.EpochSecret))
+		}
+		for i, other := range g.states {
+			if !bytes.Equal(other.EpochSecret, state.EpochSecret) {
+				t.Fatalf("epoch %d: member %d's epoch secret differs from member 1's",
+					epoch, i+1)
+			}
+		}
+		if bytes.Equal(state.Sk.Seed(), state.EpochSecret) {
+			t.Errorf("epoch %d: the stage key is the epoch secret", epoch)
+		}
+		for _, secret := range [][]byte{state.Sk.Seed(), state.EpochSecret} {
+			if seen[string(secret)] {
+				t.Errorf("epoch %d: a stage key or epoch secret repeats", epoch)
+			}
+			seen[string(secret)] = true
+		}
+		if epoch == 0 {
+			continue
+		}
+
+		// the stage key is chained from the previous epoch secret, and not
+		// from the previous stage key
+		leafKeys := make([]*ecdh.PrivateKey, n)
+		for i, other := range g.states {
+			leafKeys[i] = other.Lk
+		}
+		want, err := OracleStageKey(g.setupMsg, leafKeys, prevEpochSecret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !StageKeyEqual(state.Sk, want) {
+			t.Errorf("epoch %d: the stage key is not chained from the epoch secret",
+				epoch)
+		}
+		fromSk, err := OracleStageKey(g.setupMsg, leafKeys, prevSk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if StageKeyEqual(state.Sk, fromSk) {
+			t.Errorf("epoch %d: the stage key is chained from the previous stage key",
+				epoch)
+		}
+	}
+
+	plain := newTestGroup(t, "epoch secret chain plain", n, nil)
+	if plain.states[0].EpochSecret != nil {
+		t.Error("a group set up without epoch secrets has one")
+	}
+}
+
+// stateV1File is a state of the member at position 2 of a two-member group, as
+// written before states were versioned: it has no version, transcript hash,
+// setup message hash, or epoch.  stateV1StageKey is its stage key's safety
+// number.
+const (
+	stateV1File     = "testdata/state-v1.json"
+	stateV1StageKey = "81322 27325 99090 93330 99725 45612 20357 02447 62699 02184 11361 41063"
+)
+
+func TestLoadTreeStateV1(t *testing.T) {
+	state, err := LoadTreeState(stateV1File)
+	if err != nil {
+		t.Fatalf("LoadTreeState: %v", err)
+	}
+	if got := StageKeyFingerprint(state.Sk); got != stateV1StageKey {
+		t.Errorf("got stage key %s, want %s", got, stateV1StageKey)
+	}
+	if state.Epoch != 0 || state.TranscriptHash != nil || state.EpochSecret != nil {
+		t.Error("the fields that a v1 state lacks are not left empty")
+	}
+	if err := state.CheckConsistency(2); err != nil {
+		t.Errorf("CheckConsistency: %v", err)
+	}
+
+	// the state is saved as the current version, with the same stage key
+	file := filepath.Join(t.TempDir(), "state.json")
+	if err := SaveTreeState(file, state); err != nil {
+		t.Fatal(err)
+	}
+	tree := readTreeJson(t, file)
+	if tree.Version != treeStateVersion2 {
+		t.Errorf("the migrated state is saved as version %d, want %d", tree.Version,
+			treeStateVersion2)
+	}
+	migrated, err := LoadTreeState(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !StageKeyEqual(migrated.Sk, state.Sk) {
+		t.Error("the migrated state has another stage key")
+	}
+}
+
+// readTreeJson reads the serialized state in file.
+func readTreeJson(t *testing.T, file string) *treeJson {
+	t.Helper()
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tree treeJson
+	if err := json.Unmarshal(data, &tree); err != nil {
+		t.Fatal(err)
+	}
+	return &tree
+}
+
+func TestTreeStateVersionRoundTrip(t *testing.T) {
+	tests := []struct {
+		version     int
+		epochSecret bool
+	}{
+		{treeStateVersion2, false},
+		{treeStateVersion3, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("version %d", tt.version), func(t *testing.T) {
+			g := newTestGroup(t, "state round trip", 3,
+				&SetupOptions{EpochSecret: tt.epochSecret,
+					LeafMetadata: map[string]string{"member2": "bob"}})
+			g.update(t, 3)
+			state := g.states[1]
+
+			file := filepath.Join(t.TempDir(), "state.json")
+			if err := SaveTreeState(file, state); err != nil {
+				t.Fatal(err)
+			}
+			if got := readTreeJson(t, file).Version; got != tt.version {
+				t.Errorf("the state is saved as version %d, want %d", got, tt.version)
+			}
+
+			loaded, err := LoadTreeState(file)
+			if err != nil {
+				t.Fatalf("LoadTreeState: %v", err)
+			}
+			if !StageKeyEqual(loaded.Sk, state.Sk) || !loaded.Lk.Equal(state.Lk) ||
+				!bytes.Equal(loaded.PublicTree.Hash(), state.PublicTree.Hash()) ||
+				!reflect.DeepEqual(loaded.IKeys, state.IKeys) ||
+				!bytes.Equal(loaded.TranscriptHash, state.TranscriptHash) ||
+				loaded.SetupMessageHash != state.SetupMessageHash ||
+				loaded.Epoch != state.Epoch ||
+				!reflect.DeepEqual(loaded.LeafMetadata, state.LeafMetadata) ||
+				!bytes.Equal(loaded.EpochSecret, state.EpochSecret) {
+				t.Error("the loaded state differs from the saved one")
+			}
+		})
+	}
+}
+
+func TestTreeStateFutureVersion(t *testing.T) {
+	g := newTestGroup(t, "state future version", 2, nil)
+	tree, err := marshalTreeState(g.states[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree.Version = treeStateVersion + 1
+	data, err := json.Marshal(tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadTreeState(bytes.NewReader(data)); err == nil {
+		t.Error("ReadTreeState accepted a state of a future version")
+	}
+}
+
+// TestSaveTreeStateStable checks that saving a loaded state writes the same
+// bytes it was loaded from, and that the setup message hash, which is that of
+// the signed message bytes, survives the round trip.
+func TestSaveTreeStateStable(t *testing.T) {
+	for _, epochSecret := range []bool{false, true} {
+		g := newTestGroup(t, "save tree state stable", 3,
+			&SetupOptions{EpochSecret: epochSecret})
+		for i, state := range g.states {
+			if state.SetupMessageHash != sha256.Sum256(g.msg) {
+				t.Fatalf("epoch secret %v: member %d's setup message hash is not the "+
+					"message's", epochSecret, i+1)
+			}
+		}
+		g.update(t, 1)
+
+		dir := t.TempDir()
+		first, second := filepath.Join(dir, "first.json"), filepath.Join(dir, "second.json")
+		if err := SaveTreeState(first, g.states[1]); err != nil {
+			t.Fatal(err)
+		}
+		loaded, err := LoadTreeState(first)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if loaded.SetupMessageHash != g.states[1].SetupMessageHash {
+			t.Errorf("epoch secret %v: the loaded setup message hash differs", epochSecret)
+		}
+		if err := SaveTreeState(second, loaded); err != nil {
+			t.Fatal(err)
+		}
+
+		a, err := os.ReadFile(first)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := os.ReadFile(second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(a, b) {
+			t.Errorf("epoch secret %v: saving the loaded state writes other bytes",
+				epochSecret)
+		}
+	}
+}
+
+// TestStageKeyReload pins a derived stage key across a save and reload: the
+// reloaded state has the very same key, so that it MACs an update, and
+// chains the next stage key, as the state it was saved from does.
+func TestStageKeyReload(t *testing.T) {
+	for _, epochSecret := range []bool{false, true} {
+		g := newTestGroup(t, "stage key reload", 3, &SetupOptions{EpochSecret: epochSecret})
+		g.update(t, 3)
+
+		file := filepath.Join(t.TempDir(), "state.json")
+		if err := SaveTreeState(file, g.states[1]); err != nil {
+			t.Fatal(err)
+		}
+		loaded, err := LoadTreeState(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(loaded.Sk, g.states[1].Sk) {
+			t.Fatalf("epoch secret %v: got stage key %x after the reload, want %x",
+				epochSecret, loaded.Sk, g.states[1].Sk)
+		}
+
+		var macs [][]byte
+		for _, state := range []*TreeState{g.states[1], loaded} {
+			updateMsg, prevStageKey := state.UpdateKeyFrom(2, testReader("stage key reload update"))
+			macs = append(macs, updateMsg.MAC(prevStageKey))
+		}
+		if !bytes.Equal(macs[0], macs[1]) {
+			t.Errorf("epoch secret %v: the reloaded state MACs an update otherwise",
+				epochSecret)
+		}
+		if !bytes.Equal(loaded.Sk, g.states[1].Sk) {
+			t.Errorf("epoch secret %v: the reloaded state derives another next stage key",
+				epochSecret)
+		}
+	}
+}
+
+// TestSaveNewTreeState checks that SaveTreeState replaces an existing state
+// file, while SaveNewTreeState (process_setup_message's -no-overwrite) writes
+// a new one but fails closed on an existing one, leaving it intact.
+func TestSaveNewTreeState(t *testing.T) {
+	g := newTestGroup(t, "save new tree state", 2, nil)
+	path := filepath.Join(t.TempDir(), "state.json")
+	load := func() *TreeState {
+		t.Helper()
+		state, err := LoadTreeState(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return state
+	}
+
+	if err := SaveNewTreeState(path, g.states[0]); err != nil {
+		t.Fatalf("SaveNewTreeState to a new file: %v", err)
+	}
+	if !load().Lk.Equal(g.states[0].Lk) {
+		t.Fatal("SaveNewTreeState saved another state")
+	}
+
+	err := SaveNewTreeState(path, g.states[1])
+	if !errors.Is(err, fs.ErrExist) {
+		t.Errorf("SaveNewTreeState over an existing file: got error %v, want fs.ErrExist",
+			err)
+	}
+	if !load().Lk.Equal(g.states[0].Lk) {
+		t.Error("SaveNewTreeState replaced the existing state")
+	}
+
+	if err := SaveTreeState(path, g.states[1]); err != nil {
+		t.Fatalf("SaveTreeState over an existing file: %v", err)
+	}
+	if !load().Lk.Equal(g.states[1].Lk) {
+		t.Error("SaveTreeState did not replace the existing state")
+	}
+}
+
+// TestEmptyTree checks that an empty list of tree keys, or a group of no
+// members, is reported as an error rather than yielding a nil tree.
+func TestEmptyTree(t *testing.T) {
+	for _, order := range []string{OrderLevel, OrderIn} {
+		for _, keys := range [][][]byte{nil, {}} {
+			root, err := UnmarshalKeysToPublicTreeOrder(keys, order)
+			if !errors.Is(err, ErrEmptyTree) || root != nil {
+				t.Errorf("%s order: got tree %v and error %v, want ErrEmptyTree", order,
+					root, err)
+			}
+		}
+	}
+	if _, err := CreateTree(nil); !errors.Is(err, ErrEmptyTree) {
+		t.Errorf("CreateTree: got error %v, want ErrEmptyTree", err)
+	}
+	if _, err := SubtreeStageKeys(nil, 0); !errors.Is(err, ErrEmptyTree) {
+		t.Errorf("SubtreeStageKeys: got error %v, want ErrEmptyTree", err)
+	}
+
+	g := newTestGroup(t, "empty tree", 3, nil)
+	noTree := *g.setupMsg
+	noTree.TreeKeys = nil
+	noMembers := SetupMessage{Suite: g.setupMsg.Suite, Suk: g.setupMsg.Suk}
+	for _, sm := range []*SetupMessage{&noTree, &noMembers} {
+		for _, mode := range []ValidationMode{ValidateFast, ValidateDeep} {
+			err := sm.ValidateMode(mode)
+			if err == nil || !strings.Contains(err.Error(), "setup message contains no tree") {
+				t.Errorf("%d IKeys: got error %v, want no tree", len(sm.IKeys), err)
+			}
+		}
+	}
+
+	msg, err := json.Marshal(&noTree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := Sign(g.iks[0], msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ProcessSetupMessageBytes(2, g.eks[1], msg, sig, g.iks[0].Public()); err == nil {
+		t.Error("ProcessSetupMessageBytes accepted a setup message with no tree")
+	}
+}
+
+// TestPCSFrontier checks PCSFrontier's result on trees of several shapes, and
+// that it agrees with the group: an adversary holding a member's leaked
+// state keeps up with every other member's update, and loses the stage key
+// only when the member itself updates.
+func TestPCSFrontier(t *testing.T) {
+	for _, n := range []int{1, 2, 3, 5, 8, 13} {
+		root := newPublicTreeShape(n)
+		for _, idx := range []int{0, -1, n + 1} {
+			if _, err := PCSFrontier(root, idx); err == nil {
+				t.Errorf("%d leaves: PCSFrontier accepted leaf index %d", n, idx)
+			}
+		}
+		for idx := 1; idx <= n; idx++ {
+			frontier, err := PCSFrontier(root, idx)
+			if err != nil {
+				t.Fatalf("%d leaves: leaf %d: %v", n, idx, err)
+			}
+			if !slices.Equal(frontier, []int{idx}) {
+				t.Errorf("%d leaves: leaf %d: got frontier %v, want [%d]", n, idx,
+					frontier, idx)
+			}
+		}
+	}
+
+	const compromised = 2
+	g := newTestGroup(t, "pcs frontier", 5, nil)
+	adversary := cloneState(t, g.states[compromised-1])
+	for _, updater := range []int{1, 3, 5} {
+		msg, mac := g.update(t, updater)
+		if err := ProcessUpdateMessageBytes(adversary, compromised, msg, mac); err != nil {
+			t.Fatalf("adversary processing the update of member %d: %v", updater, err)
+		}
+		if !StageKeyEqual(adversary.Sk, g.states[0].Sk) {
+			t.Fatalf("the update of member %d, off the frontier, healed the group",
+				updater)
+		}
+	}
+
+	msg, mac := g.update(t, compromised)
+	if err := ProcessUpdateMessageBytes(adversary, compromised, msg, mac); err != nil {
+		t.Fatal(err)
+	}
+	if StageKeyEqual(adversary.Sk, g.states[0].Sk) {
+		t.Error("the adversary derived the stage key after the compromised member's update")
+	}
+}
+
+// TestNodeRelations checks Parent, Sibling and LeafSpan against a known tree
+// of 5 members, whose level-order node indices are:
+//
+//	            0
+//	       1          2 (5)
+//	   3       4
+//	 5   6   7   8
+//	(1) (2) (3) (4)
+func TestNodeRelations(t *testing.T) {
+	root := newPublicTreeShape(5)
+	tests := []struct {
+		index, parent, sibling int
+		lo, hi                 int
+	}{
+		{0, -1, -1, 1, 5},
+		{1, 0, 2, 1, 4},
+		{2, 0, 1, 5, 5},
+		{3, 1, 4, 1, 2},
+		{4, 1, 3, 3, 4},
+		{5, 3, 6, 1, 1},
+		{6, 3, 5, 2, 2},
+		{7, 4, 8, 3, 3},
+		{8, 4, 7, 4, 4},
+	}
+	for _, tt := range tests {
+		parent, err := Parent(root, tt.index)
+		if tt.parent < 0 {
+			if err == nil {
+				t.Errorf("Parent(%d) = %d, want an error", tt.index, parent)
+			}
+		} else if err != nil || parent != tt.parent {
+			t.Errorf("Parent(%d) = %d, %v, want %d", tt.index, parent, err, tt.parent)
+		}
+
+		sibling, err := Sibling(root, tt.index)
+		if tt.sibling < 0 {
+			if err == nil {
+				t.Errorf("Sibling(%d) = %d, want an error", tt.index, sibling)
+			}
+		} else if err != nil || sibling != tt.sibling {
+			t.Errorf("Sibling(%d) = %d, %v, want %d", tt.index, sibling, err, tt.sibling)
+		}
+
+		lo, hi, err := LeafSpan(root, tt.index)
+		if err != nil || lo != tt.lo || hi != tt.hi {
+			t.Errorf("LeafSpan(%d) = %d, %d, %v, want %d, %d", tt.index, lo, hi, err,
+				tt.lo, tt.hi)
+		}
+	}
+
+	// the leaves are where PathIndices puts them
+	for i, want := range []int{5, 6, 7, 8, 2} {
+		path, err := PathIndices(root, i+1)
+		if err != nil || path[0] != want {
+			t.Errorf("member %d's leaf: got path %v, %v, want it to start at %d", i+1,
+				path, err, want)
+		}
+	}
+
+	for _, index := range []int{-1, 9} {
+		if _, err := Parent(root, index); err == nil {
+			t.Errorf("Parent accepted node index %d", index)
+		}
+		if _, err := Sibling(root, index); err == nil {
+			t.Errorf("Sibling accepted node index %d", index)
+		}
+		if _, _, err := LeafSpan(root, index); err == nil {
+			t.Errorf("LeafSpan accepted node index %d", index)
+		}
+	}
+}
+
+// TestCommonAncestorDepth checks CommonAncestorDepth and AreSiblings against
+// known trees (see TestNodeRelations for the tree of 5 members) for adjacent,
+// distant and identical members.
+func TestCommonAncestorDepth(t *testing.T) {
+	tests := []struct {
+		n, a, b  int
+		depth    int
+		siblings bool
+	}{
+		{5, 1, 2, 2, true},
+		{5, 2, 1, 2, true},
+		{5, 3, 4, 2, true},
+		{5, 2, 3, 1, false},
+		{5, 1, 4, 1, false},
+		{5, 4, 5, 0, false},
+		{5, 1, 5, 0, false},
+		{5, 3, 3, 3, false},
+		{5, 5, 5, 1, false},
+		{3, 1, 2, 1, true},
+		{3, 2, 3, 0, false},
+		{2, 1, 2, 0, true},
+		{1, 1, 1, 0, false},
+	}
+	for _, tt := range tests {
+		root := newPublicTreeShape(tt.n)
+		depth, err := CommonAncestorDepth(root, tt.a, tt.b)
+		if err != nil || depth != tt.depth {
+			t.Errorf("%d leaves: CommonAncestorDepth(%d, %d) = %d, %v, want %d", tt.n,
+				tt.a, tt.b, depth, err, tt.depth)
+		}
+		siblings, err := AreSiblings(root, tt.a, tt.b)
+		if err != nil || siblings != tt.siblings {
+			t.Errorf("%d leaves: AreSiblings(%d, %d) = %v, %v, want %v", tt.n, tt.a,
+				tt.b, siblings, err, tt.siblings)
+		}
+	}
+
+	root := newPublicTreeShape(5)
+	for _, pair := range [][2]int{{0, 1}, {1, 6}, {-1, -1}} {
+		if _, err := CommonAncestorDepth(root, pair[0], pair[1]); err == nil {
+			t.Errorf("CommonAncestorDepth accepted members %d and %d", pair[0], pair[1])
+		}
+		if _, err := AreSiblings(root, pair[0], pair[1]); err == nil {
+			t.Errorf("AreSiblings accepted members %d and %d", pair[0], pair[1])
+		}
+	}
+}
+
+// TestAddFrontier checks AddFrontier against known trees, and, for trees of
+// several sizes, that the frontier is the copath of the next member's leaf in
+// the tree grown by one leaf: the frontier's subtrees hold the same members,
+// in the same order.
+func TestAddFrontier(t *testing.T) {
+	known := map[int][]int{1: {0}, 2: {0}, 3: {1, 2}, 4: {0}, 5: {1, 2}, 7: {1, 5, 6}, 8: {0}}
+	for n, want := range known {
+		got, err := AddFrontier(syntheticSetupMessage(t, n).GetPublicTree())
+		if err != nil || !slices.Equal(got, want) {
+			t.Errorf("%d leaves: got frontier %v, %v, want %v", n, got, err, want)
+		}
+	}
+
+	for n := 1; n <= 33; n++ {
+		root, grown := syntheticSetupMessage(t, n).GetPublicTree(), newPublicTreeShape(n+1)
+		frontier, err := AddFrontier(root)
+		if err != nil {
+			t.Fatalf("%d leaves: %v", n, err)
+		}
+
+		// the copath of the new leaf, from the root's child down
+		path, err := PathIndices(grown, n+1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var copath []int
+		for i := len(path) - 2; i >= 0; i-- {
+			sibling, err := Sibling(grown, path[i])
+			if err != nil {
+				t.Fatal(err)
+			}
+			copath = append(copath, sibling)
+		}
+
+		if len(frontier) != len(copath) {
+			t.Fatalf("%d leaves: got frontier %v, want %d nodes, as the copath %v",
+				n, frontier, len(copath), copath)
+		}
+		next := 1
+		for i := range frontier {
+			lo, hi, err := LeafSpan(root, frontier[i])
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantLo, wantHi, err := LeafSpan(grown, copath[i])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if lo != wantLo || hi != wantHi || lo != next {
+				t.Errorf("%d leaves: frontier node %d spans members %d to %d, want %d "+
+					"to %d", n, frontier[i], lo, hi, wantLo, wantHi)
+			}
+			next = hi + 1
+		}
+		if next != n+1 {
+			t.Errorf("%d leaves: the frontier spans members 1 to %d", n, next-1)
+		}
+	}
+
+	if _, err := AddFrontier(nil); err == nil {
+		t.Error("AddFrontier accepted an empty tree")
+	}
+	if _, err := AddFrontier(newPublicTreeShape(3)); err == nil {
+		t.Error("AddFrontier accepted a tree without keys")
+	}
+}
+
+// TestDirectPath checks, for trees of several sizes, that DirectPath runs
+// from the member's leaf up to the root, as PathIndices does, and that the
+// direct path and the copath together cover exactly the nodes on the levels
+// from the leaf to the root: the root, and at each level below it, one node
+// of the direct path and its sibling on the copath.
+func TestDirectPath(t *testing.T) {
+	for n := 1; n <= 17; n++ {
+		root := newPublicTreeShape(n)
+		nodeIndex := make(map[*PublicNode]int)
+		for i, node := range root.levelOrder() {
+			nodeIndex[node] = i
+		}
+
+		for leaf := 1; leaf <= n; leaf++ {
+			path, err := DirectPath(root, leaf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			indices, err := PathIndices(root, leaf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			copath, err := CopathIndices(root, leaf)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(path) != len(indices) || path[0] != root.Leaves()[leaf-1] ||
+				path[len(path)-1] != root {
+				t.Fatalf("%d leaves: member %d's direct path doesn't run from its leaf to "+
+					"the root", n, leaf)
+			}
+			covered := make(map[int]bool)
+			for i, node := range path {
+				if nodeIndex[node] != indices[i] {
+					t.Errorf("%d leaves: member %d's direct path has node %d where "+
+						"PathIndices has %d", n, leaf, nodeIndex[node], indices[i])
+				}
+				covered[indices[i]] = true
+			}
+
+			// the copath runs down from the root's child, the path up to it
+			if len(copath) != len(path)-1 {
+				t.Fatalf("%d leaves: member %d has %d copath nodes, want %d", n, leaf,
+					len(copath), len(path)-1)
+			}
+			for i, index := range copath {
+				sibling, err := Sibling(root, indices[len(indices)-2-i])
+				if err != nil || sibling != index {
+					t.Errorf("%d leaves: member %d's copath node %d is not the sibling of "+
+						"its path node", n, leaf, index)
+				}
+				if covered[index] {
+					t.Errorf("%d leaves: member %d's node %d is on both its path and "+
+						"copath", n, leaf, index)
+				}
+				covered[index] = true
+			}
+			if len(covered) != 2*len(path)-1 {
+				t.Errorf("%d leaves: member %d's path and copath cover %d nodes, want %d",
+					n, leaf, len(covered), 2*len(path)-1)
+			}
+		}
+	}
+}
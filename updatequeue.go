@@ -0,0 +1,217 @@
+package art
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// ErrQueueClosed is returned when enqueueing an update on a closed
+// UpdateQueue.
+var ErrQueueClosed = errors.New("the update queue is closed")
+
+// An UpdateResult is the outcome of applying a queued update: the updater's
+// index and the update's epoch, and either the resulting stage key or the
+// error that kept the update from being applied.
+type UpdateResult struct {
+	Idx      int
+	Epoch    int
+	StageKey ed25519.PrivateKey
+	Err      error
+}
+
+// queuedUpdate is an update waiting in an UpdateQueue; seq is its position
+// in the order of arrival.
+type queuedUpdate struct {
+	msg, mac []byte
+	idx      int
+	epoch    int
+	seq      int
+}
+
+// An UpdateQueue applies the updates that members send concurrently (e.g.,
+// to a server) to the state of the member at position index, one at a time,
+// in an order that does not depend on the order in which they arrive: by
+// epoch, then by updater's index (and, for updates without an epoch, by
+// arrival).  Updates are queued with Enqueue, and applied when Flush is
+// called, e.g., once per round.
+//
+// Of the updates made concurrently from the same epoch, only the first one
+// applied can be: each one is MAC'd with the stage key it replaces.  The
+// update from the member with the lowest index therefore wins, and the
+// others fail; their updaters must redo them from the new epoch.
+//
+// The queue holds at most capacity updates: Enqueue blocks while it is full,
+// until Flush makes room.  The results of the applied updates are sent, in
+// order, on the channel that Results returns, which is buffered to the same
+// capacity; Flush blocks while it is full.  Flush sends the results after
+// applying the updates, without holding the state, so that a consumer may
+// call State while it drains the results.  An UpdateQueue is safe for
+// concurrent use.
+type UpdateQueue struct {
+	index int
+
+	// flushMu serializes Flush and Close, so that the results of one are all
+	// sent before those of the next; it is acquired before mu.
+	flushMu sync.Mutex
+
+	mu      sync.Mutex // guards state, pending, seq and closed
+	state   *TreeState
+	pending []queuedUpdate
+	seq     int
+	closed  bool
+
+	slots   chan struct{}
+	results chan UpdateResult
+}
+
+// NewUpdateQueue returns a queue of at most capacity updates for the state of
+// the member at position index.  The queue owns the state from then on.
+func NewUpdateQueue(state *TreeState, index, capacity int) *UpdateQueue {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &UpdateQueue{
+		index:   index,
+		state:   state,
+		slots:   make(chan struct{}, capacity),
+		results: make(chan UpdateResult, capacity),
+	}
+}
+
+// Enqueue queues the encoded update message msg, with its MAC mac, blocking
+// while the queue is full.  It fails if the message can't be decoded, or is
+// the queue's own member's update, which that member has already applied.
+func (q *UpdateQueue) Enqueue(msg, mac []byte) error {
+	updateMsg, err := DecodeUpdateMessage(msg)
+	if err != nil {
+		return fmt.Errorf("can't decode update message: %v", err)
+	}
+	if updateMsg.Idx == q.index {
+		return fmt.Errorf("the update is by member %d, the queue's own member", q.index)
+	}
+
+	q.slots <- struct{}{}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		<-q.slots
+		return ErrQueueClosed
+	}
+	q.pending = append(q.pending, queuedUpdate{
+		msg:   msg,
+		mac:   mac,
+		idx:   updateMsg.Idx,
+		epoch: updateMsg.Epoch,
+		seq:   q.seq,
+	})
+	q.seq++
+	return nil
+}
+
+// Flush applies the queued updates, in order, and sends their results on the
+// Results channel.  An update fails, and leaves the state unchanged, if it is
+// for an epoch the state has passed (typically, because another update from
+// the same epoch was applied first) or if its MAC does not verify.  Updates
+// for later epochs than the next one stay queued until the updates before
+// them arrive, unless the queue is full: they then fail, so that they can't
+// keep the updates they wait for out of the queue.
+//
+// The order of the updates is deterministic among the updates queued when
+// Flush is called: an update that arrives after a Flush that applied another
+// update from the same epoch fails, whatever its updater's index.
+func (q *UpdateQueue) Flush() {
+	q.flushMu.Lock()
+	defer q.flushMu.Unlock()
+
+	q.mu.Lock()
+	results := q.flush(false)
+	q.mu.Unlock()
+
+	for _, result := range results {
+		q.results <- result
+	}
+}
+
+// flush applies the queued updates, with q.mu held, and returns their
+// results, which the caller must send once it has released q.mu.  If final,
+// the updates for later epochs fail rather than staying queued.
+func (q *UpdateQueue) flush(final bool) []UpdateResult {
+	var results []UpdateResult
+	pending := q.pending
+	q.pending = nil
+	keep := !final && len(pending) < cap(q.slots)
+
+	sort.Slice(pending, func(i, j int) bool {
+		a, b := pending[i], pending[j]
+		if a.epoch != b.epoch {
+			return a.epoch < b.epoch
+		}
+		if a.idx != b.idx {
+			return a.idx < b.idx
+		}
+		return a.seq < b.seq
+	})
+
+	for _, update := range pending {
+		if update.epoch > q.state.Epoch+1 && keep {
+			q.pending = append(q.pending, update)
+			continue
+		}
+
+		result := UpdateResult{Idx: update.idx, Epoch: update.epoch}
+		if update.epoch != 0 && update.epoch != q.state.Epoch+1 {
+			result.Err = fmt.Errorf("the update is for epoch %d, but the state is at "+
+				"epoch %d", update.epoch, q.state.Epoch)
+		} else {
+			result.Err = ProcessUpdateMessageBytes(q.state, q.index, update.msg, update.mac)
+		}
+		if result.Err == nil {
+			result.StageKey = q.state.Sk
+		}
+
+		<-q.slots
+		results = append(results, result)
+	}
+	return results
+}
+
+// Results returns the channel on which Flush sends the results of the applied
+// updates.  It is closed by Close.
+func (q *UpdateQueue) Results() <-chan UpdateResult {
+	return q.results
+}
+
+// State calls f with the queue's state, which f must not retain.  No update
+// is applied while f runs.
+func (q *UpdateQueue) State(f func(state *TreeState)) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	f(q.state)
+}
+
+// Close applies the updates still queued, as Flush does, and then closes the
+// Results channel; the updates for later epochs than the next one fail, as
+// the updates before them are missing.  Enqueue fails once the queue is
+// closed.
+func (q *UpdateQueue) Close() {
+	q.flushMu.Lock()
+	defer q.flushMu.Unlock()
+
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return
+	}
+	results := q.flush(true)
+	q.closed = true
+	q.mu.Unlock()
+
+	for _, result := range results {
+		q.results <- result
+	}
+	close(q.results)
+}
@@ -0,0 +1,138 @@
+package art
+
+import (
+	"testing"
+	"time"
+)
+
+// receive returns the next n results of q, failing if they don't arrive.
+func receive(t *testing.T, q *UpdateQueue, n int) []UpdateResult {
+	t.Helper()
+	results := make([]UpdateResult, n)
+	for i := range results {
+		select {
+		case results[i] = <-q.Results():
+		case <-time.After(5 * time.Second):
+			t.Fatalf("got %d results, want %d", i, n)
+		}
+	}
+	return results
+}
+
+func TestUpdateQueueOrder(t *testing.T) {
+	g := newTestGroup(t, "update queue order", 5, nil)
+	q := NewUpdateQueue(cloneState(t, g.states[0]), 1, 8)
+
+	// concurrent updates from epoch 0, arriving out of index order
+	for _, index := range []int{4, 2, 3} {
+		msg, mac := g.makeUpdate(t, index)
+		if err := q.Enqueue(msg, mac); err != nil {
+			t.Fatalf("Enqueue: %v", err)
+		}
+	}
+	q.Flush()
+
+	results := receive(t, q, 3)
+	for i, want := range []struct {
+		idx int
+		ok  bool
+	}{{2, true}, {3, false}, {4, false}} {
+		got := results[i]
+		if got.Idx != want.idx || (got.Err == nil) != want.ok {
+			t.Errorf("result %d: got member %d, error %v; want member %d, success %v",
+				i, got.Idx, got.Err, want.idx, want.ok)
+		}
+	}
+	if !StageKeyEqual(results[0].StageKey, g.states[1].Sk) {
+		t.Error("the winning update does not give its updater's stage key")
+	}
+}
+
+func TestUpdateQueueLaterEpoch(t *testing.T) {
+	g := newTestGroup(t, "update queue later epoch", 3, nil)
+	q := NewUpdateQueue(cloneState(t, g.states[0]), 1, 8)
+
+	msg1, mac1 := g.makeUpdate(t, 2)
+	msg2, mac2 := g.makeUpdate(t, 2)
+
+	// the update for epoch 2 waits for the one for epoch 1
+	if err := q.Enqueue(msg2, mac2); err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+	q.Flush()
+	select {
+	case result := <-q.Results():
+		t.Fatalf("got a result for epoch %d before the update for epoch 1", result.Epoch)
+	default:
+	}
+
+	if err := q.Enqueue(msg1, mac1); err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+	q.Flush()
+	for i, result := range receive(t, q, 2) {
+		if result.Err != nil || result.Epoch != i+1 {
+			t.Errorf("result %d: got epoch %d, error %v; want epoch %d", i, result.Epoch,
+				result.Err, i+1)
+		}
+	}
+	q.State(func(state *TreeState) {
+		if !StageKeyEqual(state.Sk, g.states[1].Sk) {
+			t.Error("the queue's state does not have the updater's stage key")
+		}
+	})
+
+	q.Close()
+	if err := q.Enqueue(msg1, mac1); err != ErrQueueClosed {
+		t.Errorf("Enqueue on a closed queue: got %v, want ErrQueueClosed", err)
+	}
+}
+
+// TestUpdateQueueStateWhileDraining checks that a consumer which calls State
+// for each result does not deadlock with a Flush that waits for it to drain
+// the results.
+func TestUpdateQueueStateWhileDraining(t *testing.T) {
+	const rounds = 3
+	g := newTestGroup(t, "update queue draining", 3, nil)
+	q := NewUpdateQueue(cloneState(t, g.states[0]), 1, 1)
+
+	done := make(chan int)
+	go func() {
+		n := 0
+		for result := range q.Results() {
+			// let the next Flush fill the results before asking for the state
+			time.Sleep(20 * time.Millisecond)
+			q.State(func(state *TreeState) {
+				if result.Err == nil && state.Epoch < result.Epoch {
+					t.Errorf("the state is at epoch %d after the update for epoch %d",
+						state.Epoch, result.Epoch)
+				}
+			})
+			n++
+		}
+		done <- n
+	}()
+
+	updates := make([][2][]byte, rounds)
+	for i := range updates {
+		updates[i][0], updates[i][1] = g.makeUpdate(t, 2)
+	}
+	go func() {
+		for _, update := range updates {
+			if err := q.Enqueue(update[0], update[1]); err != nil {
+				t.Errorf("Enqueue: %v", err)
+			}
+			q.Flush()
+		}
+		q.Close()
+	}()
+
+	select {
+	case n := <-done:
+		if n != rounds {
+			t.Errorf("got %d results, want %d", n, rounds)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the consumer deadlocked with Flush")
+	}
+}